@@ -15,6 +15,8 @@ require (
 	github.com/zmap/zcrypto v0.0.0-20250129210703-03c45d0bae98
 	github.com/zmap/zflags v1.4.0-beta.1.0.20200204220219-9d95409821b6
 	github.com/zmap/zgrab2 v0.1.8
+	golang.org/x/net v0.34.0
+	golang.org/x/sync v0.11.0
 	gotest.tools/v3 v3.5.2
 )
 
@@ -41,8 +43,6 @@ require (
 	github.com/zmap/rc2 v0.0.0-20190804163417-abaa70531248 // indirect
 	golang.org/x/crypto v0.33.0 // indirect
 	golang.org/x/mod v0.23.0 // indirect
-	golang.org/x/net v0.34.0 // indirect
-	golang.org/x/sync v0.11.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/term v0.29.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
@@ -24,12 +24,25 @@ import (
 	// the order of these imports is important, as the modules are registered in the init() functions.
 	// Import modules after the basic cmd pkg
 	_ "github.com/zmap/zdns/src/modules/alookup"
+	_ "github.com/zmap/zdns/src/modules/anylookup"
 	_ "github.com/zmap/zdns/src/modules/axfr"
+	_ "github.com/zmap/zdns/src/modules/bimi"
 	_ "github.com/zmap/zdns/src/modules/bindversion"
+	_ "github.com/zmap/zdns/src/modules/caalookup"
+	_ "github.com/zmap/zdns/src/modules/cdcompare"
 	_ "github.com/zmap/zdns/src/modules/dmarc"
+	_ "github.com/zmap/zdns/src/modules/emailaudit"
+	_ "github.com/zmap/zdns/src/modules/fingerprint"
+	_ "github.com/zmap/zdns/src/modules/mtasts"
+	_ "github.com/zmap/zdns/src/modules/multitype"
 	_ "github.com/zmap/zdns/src/modules/mxlookup"
+	_ "github.com/zmap/zdns/src/modules/naptr"
 	_ "github.com/zmap/zdns/src/modules/nslookup"
+	_ "github.com/zmap/zdns/src/modules/ptrlookup"
 	_ "github.com/zmap/zdns/src/modules/spf"
+	_ "github.com/zmap/zdns/src/modules/sshfp"
+	_ "github.com/zmap/zdns/src/modules/svcblookup"
+	_ "github.com/zmap/zdns/src/modules/wildcard"
 )
 
 func main() {
@@ -0,0 +1,141 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	answerSelectionAll    = "all"
+	answerSelectionFirst  = "first"
+	answerSelectionRandom = "random"
+	answerSelectionLowest = "lowest"
+)
+
+// answerSelector trims the A and AAAA records of a result down to one of each, the way a client picks a single address
+// out of a round-robin set. Other records, ex. CNAMEs, are kept.
+type answerSelector struct {
+	mode string
+	seed int64 // with answerSelectionRandom, the pick for a name depends only on the seed so output is reproducible
+}
+
+// newAnswerSelector returns the selector for --answer-selection, or nil if every answer is to be output. A seed of 0
+// picks a seed at random.
+func newAnswerSelector(mode string, seed int64) (*answerSelector, error) {
+	switch mode {
+	case answerSelectionAll:
+		return nil, nil
+	case answerSelectionFirst, answerSelectionLowest:
+	case answerSelectionRandom:
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+	default:
+		return nil, fmt.Errorf("invalid --answer-selection %q. Options: all, first, random, lowest", mode)
+	}
+	return &answerSelector{mode: mode, seed: seed}, nil
+}
+
+// apply returns the module result data with a single address of each family, in a copy of data that leaves the
+// addresses of the original untouched
+func (s *answerSelector) apply(name string, data interface{}) interface{} {
+	if s == nil {
+		return data
+	}
+	switch res := data.(type) {
+	case *zdns.SingleQueryResult:
+		if res == nil {
+			return data
+		}
+		selected := *res
+		selected.Answers = s.selectRecords(name, res.Answers)
+		return &selected
+	case *zdns.IPResult:
+		if res == nil {
+			return data
+		}
+		return &zdns.IPResult{
+			IPv4Addresses: s.selectAddresses(name+"/A", res.IPv4Addresses),
+			IPv6Addresses: s.selectAddresses(name+"/AAAA", res.IPv6Addresses),
+		}
+	}
+	return data
+}
+
+func (s *answerSelector) selectRecords(name string, answers []interface{}) []interface{} {
+	var v4, v6 []string
+	for _, a := range answers {
+		if ans, ok := a.(zdns.Answer); ok && ans.RrType == dns.TypeA {
+			v4 = append(v4, ans.Answer)
+		} else if ok && ans.RrType == dns.TypeAAAA {
+			v6 = append(v6, ans.Answer)
+		}
+	}
+	keep := make(map[string]struct{}, 2)
+	for _, addr := range s.selectAddresses(name+"/A", v4) {
+		keep["A/"+addr] = struct{}{}
+	}
+	for _, addr := range s.selectAddresses(name+"/AAAA", v6) {
+		keep["AAAA/"+addr] = struct{}{}
+	}
+	selected := make([]interface{}, 0, len(answers))
+	for _, a := range answers {
+		ans, ok := a.(zdns.Answer)
+		if !ok || (ans.RrType != dns.TypeA && ans.RrType != dns.TypeAAAA) {
+			selected = append(selected, a)
+			continue
+		}
+		key := ans.Type + "/" + ans.Answer
+		if _, ok := keep[key]; ok {
+			selected = append(selected, a)
+			// the same address can appear twice in a response, only output it once
+			delete(keep, key)
+		}
+	}
+	return selected
+}
+
+// selectAddresses returns a slice holding the one address picked out of addrs, key identifies the set for random picks
+func (s *answerSelector) selectAddresses(key string, addrs []string) []string {
+	if len(addrs) <= 1 {
+		return addrs
+	}
+	pick := addrs[0]
+	switch s.mode {
+	case answerSelectionRandom:
+		h := fnv.New64a()
+		_ = binary.Write(h, binary.BigEndian, s.seed)
+		h.Write([]byte(key))
+		pick = addrs[h.Sum64()%uint64(len(addrs))]
+	case answerSelectionLowest:
+		lowest := net.ParseIP(pick).To16()
+		for _, addr := range addrs[1:] {
+			if ip := net.ParseIP(addr).To16(); ip != nil && (lowest == nil || bytes.Compare(ip, lowest) < 0) {
+				pick, lowest = addr, ip
+			}
+		}
+	}
+	return []string{pick}
+}
@@ -0,0 +1,66 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// answerTypeFilter is the set of record types kept in the answers output with --answer-types. Lookups still see every
+// record, so CNAMEs are followed and DNSSEC is validated as usual.
+type answerTypeFilter map[uint16]struct{}
+
+// newAnswerTypeFilter parses the comma-separated record types of --answer-types, or returns nil if every answer is to
+// be output
+func newAnswerTypeFilter(types string) (answerTypeFilter, error) {
+	if types == "" {
+		return nil, nil
+	}
+	f := make(answerTypeFilter)
+	for _, t := range strings.Split(types, ",") {
+		t = strings.ToUpper(strings.TrimSpace(t))
+		rrType, ok := dns.StringToType[t]
+		if !ok || rrType == dns.TypeNone {
+			return nil, fmt.Errorf("invalid record type %q in --answer-types", t)
+		}
+		f[rrType] = struct{}{}
+	}
+	return f, nil
+}
+
+// apply returns the module result data with only the answers of the filter's types, collected in a new slice rather
+// than filtered in place
+func (f answerTypeFilter) apply(data interface{}) interface{} {
+	res, ok := data.(*zdns.SingleQueryResult)
+	if f == nil || !ok || res == nil {
+		return data
+	}
+	filtered := *res
+	filtered.Answers = make([]interface{}, 0, len(res.Answers))
+	for _, a := range res.Answers {
+		if ans, ok := a.(zdns.WithBaseAnswer); ok {
+			if _, keep := f[ans.BaseAns().RrType]; !keep {
+				continue
+			}
+		}
+		filtered.Answers = append(filtered.Answers, a)
+	}
+	return &filtered
+}
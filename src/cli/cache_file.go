@@ -0,0 +1,78 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zmap/zdns/src/internal/util"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// loadCacheFile fills cache with the entries saved to path by a previous run. A missing or unreadable file isn't fatal,
+// the run starts with whatever could be loaded
+func loadCacheFile(path string, cache *zdns.Cache) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Infof("cache file %s does not exist yet, starting with an empty cache", path)
+		return
+	} else if err != nil {
+		log.Warnf("unable to open cache file (%s), starting with an empty cache: %v", path, err)
+		return
+	}
+	defer func(f *os.File) {
+		if closeErr := f.Close(); closeErr != nil {
+			log.Errorf("unable to close cache file: %v", closeErr)
+		}
+	}(f)
+	loaded, err := cache.Load(bufio.NewReader(f))
+	if err != nil {
+		log.Warnf("unable to load cache file (%s), loaded %d entries: %v", path, loaded, err)
+		return
+	}
+	log.Infof("loaded %d unexpired entries from cache file %s", loaded, path)
+}
+
+// saveCacheFile writes the unexpired entries of cache to path. The file is replaced only once it's fully written, so an
+// interrupted save doesn't lose the previous one
+func saveCacheFile(path string, cache *zdns.Cache) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.DefaultFilePermissions)
+	if err != nil {
+		return fmt.Errorf("unable to open cache file (%s): %w", tmpPath, err)
+	}
+	w := bufio.NewWriter(f)
+	saved, err := cache.Save(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("unable to write cache file (%s): %w", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to replace cache file (%s): %w", path, err)
+	}
+	log.Infof("saved %d entries to cache file %s", saved, path)
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -37,6 +38,13 @@ type InputHandler interface {
 type OutputHandler interface {
 	WriteResults(results <-chan string, wg *sync.WaitGroup) error
 }
+
+// bufferedOutputHandler is implemented by output handlers that buffer results, so --flush-interval and --no-buffer can
+// control how often they're written out
+type bufferedOutputHandler interface {
+	SetFlushInterval(interval time.Duration)
+}
+
 type StatusHandler interface {
 	LogPeriodicUpdates(statusChan <-chan zdns.Status, wg *sync.WaitGroup) error
 }
@@ -45,30 +53,65 @@ type StatusHandler interface {
 // Order here is the order they'll be printed to the user, so preserve alphabetical order
 type GeneralOptions struct {
 	LookupAllNameServers bool   `long:"all-nameservers" description:"Behavior is dependent on --iterative. In --iterative, --all-name-servers will query all root servers, then all gtld servers, etc. recording the responses at each layer. In non-iterative mode, the query will be sent to all external resolvers specified in --name-servers."`
+	AllNSConcurrency     int    `long:"all-nameservers-concurrency" default:"4" description:"how many nameservers are queried at once for each name with --all-nameservers, so a slow nameserver doesn't hold up the others. Results are still reported in nameserver order. 1 queries them one at a time"`
+	CacheFilePath        string `long:"cache-file" description:"file the cache is loaded from at startup and saved to at exit, so later runs can reuse its unexpired entries. Entries keep their original expiration times, those that expired in between are skipped. Mostly useful with --iterative, to not re-query the root and TLD servers"`
 	CacheSize            int    `long:"cache-size" default:"10000" description:"how many items can be stored in internal recursive cache"`
+	BreakerCooldown      int    `long:"circuit-breaker-cooldown" default:"30" description:"how long a name server tripped by --circuit-breaker-threshold is left out of name server selection before it's tried again, in seconds"`
+	BreakerThreshold     int    `long:"circuit-breaker-threshold" default:"0" description:"stop selecting a name server from --name-servers for --circuit-breaker-cooldown after this many consecutive queries to it fail to get a response. Tripped name servers are listed in the metadata. 0 disables the circuit breaker. Not applicable with --iterative or per-name name servers"`
+	DumpSchema           string `long:"dump-schema" description:"print the JSON Schema of the output records of a module, derived from its result types, and exit. Fields are annotated with the output groups (--result-verbosity, --include-fields) they belong to under x-groups"`
 	GoMaxProcs           int    `long:"go-processes" default:"0" description:"number of OS processes to use, GOMAXPROCS if 0"`
 	IterationTimeout     int    `long:"iteration-timeout" default:"8" description:"timeout for a single iterative step in an iterative query, in seconds. Only applicable with --iterative"`
 	IterativeResolution  bool   `long:"iterative" description:"Perform own iteration instead of relying on recursive resolver"`
+	MaxCNAMEDepth        int    `long:"max-cname-depth" default:"12" description:"most CNAMEs/DNAMEs followed from a name, longer chains end in SERVFAIL. Chains that lead back to a name already in them end in CNAME_LOOP. The chain followed is output under cname_chain"`
 	MaxDepth             int    `long:"max-depth" default:"10" description:"how deep should we recurse when performing iterative lookups"`
 	NameServerMode       bool   `long:"name-server-mode" description:"Treats input as nameservers to query with a static query rather than queries to send to a static name server"`
-	NameServersString    string `long:"name-servers" description:"List of DNS servers to use. Can be passed as comma-delimited string or via @/path/to/file. If no port is specified, defaults to 53. If not provided, defaults to either the default root servers in --iterative or the recursive resolvers specified in /etc/resolv.conf or OS equivalent."`
+	NameServersString    string `long:"name-servers" description:"List of DNS servers to use. Can be passed as comma-delimited string or via @/path/to/file. Entries can have a port (1.1.1.1:5353, [2001:db8::1]:53) and a tls:// or https:// scheme (tls://8.8.8.8, https://dns.google), mixed in one list. If no port is specified, defaults to 53. Link-local IPv6 addresses must include a zone, ex. fe80::1%eth0. If not provided, defaults to either the default root servers in --iterative or the recursive resolvers specified in /etc/resolv.conf or OS equivalent."`
+	NameServerStrategy   string `long:"nameserver-strategy" default:"random" description:"how lookups without a name server of their own pick one of --name-servers. Options: random (each thread sticks to one picked at random), round-robin (lookups cycle through them across all threads), latency-weighted (picked at random, favoring those with a lower observed round trip time, timeouts count against a name server). Not applicable with --iterative"`
 	UseNanoseconds       bool   `long:"nanoseconds" description:"Use nanosecond resolution timestamps in output"`
 	NetworkTimeout       int    `long:"network-timeout" default:"2" description:"timeout for round trip network operations, in seconds"`
 	DisableFollowCNAMEs  bool   `long:"no-follow-cnames" description:"do not follow CNAMEs/DNAMEs in the lookup process"`
+	NoRetryServFail      bool   `long:"no-retry-servfail" description:"report SERVFAIL answers as-is instead of retrying them. Timeouts and other temporary failures are still retried"`
+	ProbeRoots           bool   `long:"probe-roots" description:"before the scan, query each root server for the root NS records and log whether it's reachable and how quickly it answered. The outcome is listed under root_probes in the metadata. Only applicable with --iterative"`
+	PruneRoots           bool   `long:"prune-unreachable-roots" description:"with --probe-roots, leave the root servers that didn't answer out of the scan, so lookups don't waste their first query on them"`
+	QNAMEMinimization    bool   `long:"qname-minimization" description:"only send each name server in an iterative lookup the labels of the name it needs to refer us onwards, asking for the NS records of progressively longer names, RFC 7816. Falls back to the full name when a server answers unexpectedly. Only applicable with --iterative"`
+	QueryTimeout         int    `long:"query-timeout" default:"0" description:"deadline for a single query to one name server, in seconds, across its UDP retransmits and TCP fallback, each of which still gets --network-timeout. A query that hits it is retried like a timeout, as long as --timeout for the name hasn't passed. 0 for each query to only get --network-timeout"`
+	RootHintsFilePath    string `long:"root-hints-file" description:"root hints file in the standard named.root format, listing the root servers to start iterative resolution from. Only applicable with --iterative. Defaults to the built-in list of root servers. Root server addresses can also be given directly with --name-servers"`
 	Retries              int    `long:"retries" default:"3" description:"how many times should zdns retry query against a new nameserver if timeout or temporary failure"`
+	RetryBackoff         int    `long:"retry-backoff" default:"0" description:"milliseconds to wait before retrying a query that timed out or got SERVFAIL, doubled for each further retry of the name (up to 10s) with random jitter. A retry that would wait past --timeout isn't made. 0 retries immediately"`
+	ServFailOtherServer  bool   `long:"retry-servfail-other-server" description:"retry a SERVFAIL answer against another of --name-servers instead of the same one, as another resolver may not share its upstream failure. Each attempt is in the trace with its name server and status. Not applicable with --iterative or per-name name servers"`
+	Seed                 int64  `long:"seed" description:"seed for the random choices of lookups, ex. which name server is queried or which authority is tried first, so runs can be reproduced for debugging. Reproducible with --threads=1, as names are otherwise spread over the threads as they become free. Picked at random if unset. Source ports of --randomize-source-port stay random"`
+	ShutdownGracePeriod  int    `long:"shutdown-grace-period" default:"30" description:"on SIGINT or SIGTERM, no more names are read and the lookups in flight get this many seconds to finish before they're abandoned. The results that finished, the metadata and the closing of --output-format=json-array are still written, then zdns exits with status 130. A second signal abandons the lookups at once"`
+	StripOutOfBailiwick  bool   `long:"strip-out-of-bailiwick" description:"with --iterative, leave the records of responses whose owner is outside the zone of the queried name server, ex. injected to poison caches, out of results and the cache, so they aren't trusted. They're counted under out_of_bailiwick either way"`
 	Threads              int    `short:"t" long:"threads" default:"100" description:"number of lightweight go threads"`
 	Timeout              int    `long:"timeout" default:"20" description:"timeout for resolving a individual name, in seconds"`
+	TimeoutIsError       bool   `long:"timeout-is-error" description:"report lookups that time out once --retries are exhausted with the generic ERROR status instead of TIMEOUT/ITERATIVE_TIMEOUT. Names are still written to --retry-file as timeouts"`
 	Version              bool   `long:"version" short:"v" description:"Print the version of zdns and exit"`
 }
 
 // QueryOptions affect the fields of the actual DNS queries. Applicable to all modules.
 type QueryOptions struct {
-	CheckingDisabled   bool   `long:"checking-disabled" description:"Sends DNS packets with the CD bit set"`
-	ClassString        string `long:"class" default:"INET" description:"DNS class to query. Options: INET, CSNET, CHAOS, HESIOD, NONE, ANY."`
-	ClientSubnetString string `long:"client-subnet" description:"Client subnet in CIDR format for EDNS0."`
-	Dnssec             bool   `long:"dnssec" description:"Requests DNSSEC records by setting the DNSSEC OK (DO) bit"`
-	ValidateDNSSEC     bool   `long:"validate-dnssec" description:"Validate DNSSEC records, only applicable with --iterative"`
-	UseNSID            bool   `long:"nsid" description:"Request NSID."`
+	CheckingDisabled   bool     `long:"checking-disabled" description:"Sends DNS packets with the CD bit set"`
+	ClassString        string   `long:"class" default:"INET" description:"DNS class to query. Options: INET, CSNET, CHAOS, HESIOD, NONE, ANY."`
+	ClientSubnetString string   `long:"client-subnet" description:"Client subnet in CIDR format for EDNS0."`
+	Cookies            bool     `long:"cookies" description:"Send a DNS cookie (RFC 7873) with each query, and reuse the server cookie each name server returns. The cookies in responses are reported under the cookie field, see --include-fields"`
+	Dnssec             bool     `long:"dnssec" description:"Requests DNSSEC records by setting the DNSSEC OK (DO) bit"`
+	DisableCompression bool     `long:"no-query-compression" description:"Send queries without DNS name compression. Query sizes with and without compression are reported under the query_size field"`
+	NoRecursion        bool     `long:"no-recursion" description:"Send queries with the recursion desired (RD) bit cleared, ex. to probe authoritative servers directly without --iterative. Whether the answer was authoritative is reported under the flags field, see --include-fields. Queries in --iterative mode never set the RD bit"`
+	ValidateDNSSEC     bool     `long:"validate-dnssec" description:"Validate DNSSEC records, only applicable with --iterative"`
+	RequireSecure      bool     `long:"require-dnssec-secure" description:"report successful lookups whose answer DNSSEC validation didn't find Secure with the error status DNSSEC_NOT_SECURE, and the validation status (Insecure, Bogus, Indeterminate) as the error, so they go to --error-file if set. Results of modules that don't return DNS answers are never validated and always reported. Requires --validate-dnssec"`
+	OnlyTrusted        bool     `long:"only-trusted" description:"as --require-dnssec-secure, also for NXDOMAIN and CNAME_TARGET_NXDOMAIN answers, and leave the answer, authority and additional records of lookups DNSSEC validation didn't find Secure out of the output, as a strict validating resolver would, so only validated records are output. The validation result is kept under dnssec. Requires --validate-dnssec"`
+	DNSSECFetchLimit   int      `long:"dnssec-fetch-concurrency" default:"0" description:"maximum DNSKEY/DS lookups in flight across all threads during DNSSEC validation, 0 for no limit. Concurrent validations needing the same keys always share one lookup"`
+	DNSSECClockSkew    int      `long:"dnssec-clock-skew" default:"0" description:"seconds of clock drift to tolerate when checking RRSIG inception and expiration times during DNSSEC validation"`
+	DNSSECSections     string   `long:"dnssec-validate-sections" default:"answer,authority,additional" description:"Comma-separated list of message sections to run DNSSEC validation over. Skipping additional avoids extra DNSKEY/DS fetches. Options: answer, authority, additional"`
+	DNSSECAlgorithms   string   `long:"dnssec-allowed-algorithms" description:"Comma-separated list of DNSSEC algorithms, by mnemonic or number, ex. ECDSAP256SHA256,15. RRSIGs made with any other algorithm fail to verify, so records only signed with them are Bogus. Useful to measure zones still relying on deprecated algorithms like RSASHA1 (5). Requires --validate-dnssec"`
+	TrustAnchorFile    string   `long:"trust-anchor-file" description:"zone file of DS or DNSKEY records to trust as the base of the DNSSEC chain of trust for their zones, ex. for a private root or an internal zone. Root anchors are added to the built-in ones, see --replace-root-anchors. Requires --validate-dnssec"`
+	ReplaceRootAnchors bool     `long:"replace-root-anchors" description:"trust only the root anchors in --trust-anchor-file, instead of adding them to the built-in root anchors"`
+	EDNSOptions        []string `long:"edns-option" description:"attach an EDNS0 option to every query, as CODE:HEXDATA, ex. 65001:cafe, for experimental or vendor options. Repeat the flag or give a comma-separated list to attach several, ex. 65001:cafe,65002:. Options in responses that zdns doesn't parse are reported under local in the OPT record, with their data hex encoded"`
+	PadQueries         int      `long:"edns-padding" description:"pad queries over DoT/DoH with the EDNS0 padding option (RFC 7830) to a multiple of this many bytes, ex. 128, so their size reveals less about the name queried. 0 for no padding"`
+	PadPlaintext       bool     `long:"edns-padding-plaintext" description:"with --edns-padding, also pad queries sent over plain UDP/TCP"`
+	UDPBufferSize      int      `long:"udp-buffer-size" default:"1232" description:"EDNS0 UDP payload size advertised in queries, the largest UDP response a name server may send before truncating it. Smaller sizes force more truncation and TCP fallback, larger ones risk IP fragmentation. At least 512. The size of each response received is reported under response_size, see --include-fields=query_size"`
+	UseExpire          bool     `long:"expire" description:"Request the EDNS0 EXPIRE option (RFC 7314), which authoritative servers answer with the time left before they stop serving the zone. Reported under the expire field of the OPT record, with low set when under a day"`
+	UseNSID            bool     `long:"nsid" description:"Request NSID."`
 }
 
 // NetworkOptions options for controlling the network behavior. Applicable to all modules.
@@ -78,33 +121,69 @@ type NetworkOptions struct {
 	DNSOverHTTPS          bool   `long:"https" description:"Use DNS over HTTPS for lookups, mutually exclusive with --udp-only, --iterative, and --tls"`
 	LocalAddrString       string `long:"local-addr" description:"comma-delimited list of local addresses to use, serve as the source IP for outbound queries"`
 	LocalIfaceString      string `long:"local-interface" description:"local interface to use"`
+	MaxQPS                int    `long:"max-qps" default:"0" description:"maximum queries per second sent in total, across all threads and name servers, retries included. Queries over the limit wait for their turn rather than being dropped. 0 for no limit"`
+	MaxQPSPerNameServer   int    `long:"max-qps-per-nameserver" default:"0" description:"maximum queries per second sent to any one name server IP, across all threads. Queries over the limit wait for their turn rather than being dropped. 0 for no limit"`
 	DisableRecycleSockets bool   `long:"no-recycle-sockets" description:"do not create long-lived unbound UDP socket for each thread at launch and reuse for all (UDP) queries"`
 	PreferIPv4Iteration   bool   `long:"prefer-ipv4-iteration" description:"Prefer IPv4/A record lookups during iterative resolution. Ignored unless used with both IPv4 and IPv6 query transport"`
 	PreferIPv6Iteration   bool   `long:"prefer-ipv6-iteration" description:"Prefer IPv6/AAAA record lookups during iterative resolution. Ignored unless used with both IPv4 and IPv6 query transport"`
+	RandomizeSourcePort   bool   `long:"randomize-source-port" description:"send each UDP query from a fresh socket bound to a port picked uniformly at random from 1024-65535, rather than reusing a socket per thread or taking an OS-picked ephemeral port. For studies of spoofing resistance. The source port of each query is reported under source_port, see --include-fields"`
 	RootCAsFile           string `long:"root-cas-file" description:"Path to a file containing PEM-encoded root CAs to use for verifying server certificates, required for --verify-server-cert"`
 	TCPOnly               bool   `long:"tcp-only" description:"Only perform lookups over TCP"`
 	DNSOverTLS            bool   `long:"tls" description:"Use DNS over TLS for lookups, mutually exclusive with --udp-only, --iterative, and --https"`
+	TLSServerName         string `long:"tls-server-name" description:"server name sent in the TLS handshake and checked against the certificate with --tls, instead of the name server's domain name. Useful for name servers given by IP address"`
+	TXTTCPFallback        bool   `long:"txt-tcp-fallback" description:"with --udp-only, still retry TXT lookups over TCP when the UDP response is truncated, so long records such as DKIM keys aren't lost. Lookups of other types stay on UDP"`
 	UDPOnly               bool   `long:"udp-only" description:"Only perform lookups over UDP"`
+	UDPRetransmits        int    `long:"udp-retransmits" default:"0" description:"number of quick retransmits of a UDP query on the same socket before it counts as a timeout and consumes a --retries. Useful on lossy links. Retransmits are held to the query rate limits like any other query"`
+	UDPRetransmitInterval int    `long:"udp-retransmit-interval" default:"500" description:"time to wait for a response before retransmitting a UDP query, in milliseconds. Only applicable with --udp-retransmits"`
 	VerifyServerCert      bool   `long:"verify-server-cert" description:"Verify the server's certificate when using DNS over TLS or DNS over HTTPS"`
 }
 
 // InputOutputOptions options for controlling the input and output behavior of zdns. Applicable to all modules.
 type InputOutputOptions struct {
 	AlexaFormat                  bool   `long:"alexa" description:"is input file from Alexa Top Million download"`
+	AnswerSelection              string `long:"answer-selection" default:"all" description:"which A/AAAA records of a round-robin set to output, other records are kept. Options: all, first (in response order), random, lowest (numerically). Applies to raw A/AAAA lookups and ALOOKUP"`
+	AnswerSelectionSeed          int64  `long:"answer-selection-seed" description:"seed for --answer-selection=random, the same seed picks the same address for a name across runs. Picked at random if unset"`
+	AnswerTypes                  string `long:"answer-types" description:"comma-separated record types to output in the answers of a lookup, ex. A,AAAA, others are left out. Lookups still use every record, so CNAMEs are followed and DNSSEC validated as usual. Applies to lookups whose results list answers, ex. A or TXT, not ALOOKUP or MXLOOKUP"`
 	BlacklistFilePath            string `long:"blacklist-file" description:"blacklist file for servers to exclude from lookups"`
 	DNSConfigFilePath            string `long:"conf-file" default:"/etc/resolv.conf" description:"config file for DNS servers"`
+	CSVColumns                   string `long:"csv-columns" default:"name,status,resolver,answers,ttl" description:"with --output-format=csv, comma separated list of columns to output, in order. Options: name, module, status, resolver, answers, ttl, error. answers are the addresses of A/AAAA lookups and the server names of NS lookups, ttl is the lowest TTL among them"`
+	CSVMultiValue                string `long:"csv-multi-value" default:"join" description:"with --output-format=csv, how names with several answers are output. Options: join (one row, with the answers separated by ';'), rows (one row per answer, other columns repeated)"`
+	DedupeInput                  bool   `long:"dedupe-input" description:"share one lookup between input lines with the same name that are looked up at the same time, so duplicate names don't each send their own queries. Every line still gets its own output record, with its own metadata from --metadata-passthrough. Lines asking for a different transport, or a different name server, aren't shared. Duplicates that arrive after a lookup finished are looked up again, and are answered from the cache"`
 	MultipleModuleConfigFilePath string `short:"c" long:"multi-config-file" description:"config file path for multiple module"`
-	IncludeInOutput              string `long:"include-fields" description:"Comma separated list of fields to additionally output beyond result verbosity. Options: class, protocol, ttl, resolver, flags, dnssec"`
-	InputFilePath                string `short:"f" long:"input-file" default:"-" description:"names to read, defaults to stdin"`
+	ErrorFilePath                string `long:"error-file" description:"where should JSON output for lookups that ended in an error status (ex. TIMEOUT, SERVFAIL) be saved. If provided, these results are not written to --output-file. Use '-' for stderr"`
+	OutputFilter                 string `long:"filter" description:"only output records matching this expression, other records are dropped but still counted in the metadata. Predicates compare the status, ex. status==NOERROR, or the number of answers, optionally of one type, ex. answers>0 or answers.A>=1, with ==, !=, <, <=, >, >=. Join them with && and ||, && binds tighter. With several modules, a record is output if any module's result matches"`
+	FlushInterval                int    `long:"flush-interval" default:"1000" description:"how often results buffered for the output, error, retry and trace files are written out, in milliseconds. Lower it for streaming pipelines that should see results promptly"`
+	IncludeInOutput              string `long:"include-fields" description:"Comma separated list of fields to additionally output beyond result verbosity. Options: class, protocol, ttl, resolver, flags, dnssec, query_size, iteration_servers, query_count, nameservers_consulted, cookie, raw, timing, source_port. raw is each response in wire format, base64 encoded, under raw_response. timing adds the wall time of each lookup in milliseconds under duration_ms, and of each trace step with --result-verbosity=trace. source_port is the local port each UDP query was sent from"`
+	InputFilePath                string `short:"f" long:"input-file" default:"-" description:"names to read, defaults to stdin. Multiple files can be given as a comma-separated list and are read in order. Gzip-compressed files are detected automatically"`
+	MaxAnswers                   int    `long:"max-answers" description:"output at most this many answers per lookup, the first ones taken, and set answers_truncated on lookups that had more. Bounds the output of names with huge answer sets. Applies to lookups whose results list answers, ex. A or TXT, not ALOOKUP or MXLOOKUP. 0 for no limit"`
+	MaxTraceEntries              int    `long:"max-trace-entries" description:"with --result-verbosity=trace, output at most this many trace steps per lookup, the first ones taken. The number of steps left out is reported under trace_truncated. Resolution itself is unaffected. 0 for no limit"`
 	LogFilePath                  string `long:"log-file" default:"-" description:"where should JSON logs be saved, defaults to stderr"`
 	MetadataFilePath             string `long:"metadata-file" description:"where should JSON metadata be saved, defaults to no metadata output. Use '-' for stderr."`
-	MetadataFormat               bool   `long:"metadata-passthrough" description:"if input records have the form 'name,METADATA', METADATA will be propagated to the output"`
+	MetadataFormat               bool   `long:"metadata-passthrough" description:"if input records have the form 'name,METADATA', METADATA will be propagated to the output. A 'transport=udp|tcp|tls' token in METADATA, with tokens separated by ';', sends that line's queries over the given transport. A line with an invalid transport, or one that can't be used with the other options, is output with status ILLEGAL_INPUT"`
+	MetricsAddr                  string `long:"metrics-addr" description:"address, ex: :9090, to serve Prometheus metrics on at /metrics while the scan runs: queries sent by status, retries, cache hits and misses, and lookups and their latency by module and status"`
+	OrderedOutput                bool   `long:"ordered-output" description:"write results to --output-file in the order their names were read, rather than as their lookups finish, for reproducible diffs between runs. Results sent to --error-file are not reordered"`
+	OrderedOutputBuffer          int    `long:"ordered-output-buffer" default:"10000" description:"with --ordered-output, how many names can be read ahead of the oldest unfinished lookup. Results that finished early are held in memory until it does, so this bounds memory use"`
 	OutputFilePath               string `short:"o" long:"output-file" default:"-" description:"where should JSON output be saved, defaults to stdout"`
+	OutputFormat                 string `long:"output-format" default:"json" description:"format of each output record, applies to --output-file and --error-file. Options: json, json-array, msgpack, csv. json-array writes a single JSON array, streamed one result per line and closed once all lookups finish. csv writes a header row then a row per lookup, see --csv-columns. msgpack records have the same fields as JSON ones and are written back to back, each prefixed with its length as a 4-byte big-endian integer"`
 	QuietStatusUpdates           bool   `short:"q" long:"quiet" description:"do not print status updates"`
+	NoBuffer                     bool   `long:"no-buffer" description:"write each result out as soon as it's ready rather than every --flush-interval, at the cost of a write per result"`
 	NameOverride                 string `long:"override-name" description:"name overrides all passed in names. Commonly used with --name-server-mode."`
+	PcapFilePath                 string `long:"pcap-file" description:"write the UDP query/response packets of every lookup, with synthetic IP/UDP headers, to this pcap file for debugging. Has overhead, so --threads is capped when used. TCP, DoT and DoH traffic is not captured"`
 	NamePrefix                   string `long:"prefix" description:"name to be prepended to what's passed in (e.g., www.)"`
+	ReportInputFile              bool   `long:"report-input-file" description:"include the input file each name was read from in the output, useful with multiple --input-file's"`
+	RetryFilePath                string `long:"retry-file" description:"where should names whose lookups ended in a transient error (TIMEOUT, ITERATIVE_TIMEOUT, SERVFAIL) be saved. Written as 'name,reason' so the file can be re-run with --metadata-passthrough"`
+	CNAMETargetNXDomain          bool   `long:"cname-target-nxdomain" description:"when a CNAME/DNAME chain leads to a name that doesn't exist, report the status CNAME_TARGET_NXDOMAIN with the chain under answers and the missing name under nxdomain_target, rather than NXDOMAIN or NOERROR"`
+	DetectCNAMEViolations        bool   `long:"detect-cname-violations" description:"flag responses where a CNAME coexists with other data for the same name or sits at a zone apex alongside its SOA. Violations are reported under cname_violations"`
+	SeparateUnrelatedAnswers     bool   `long:"separate-unrelated-answers" description:"report answer records that are unrelated to the query (not the queried name, its CNAME/DNAME chain, or the queried type) under extra_answers instead of answers"`
 	ResultVerbosity              string `long:"result-verbosity" default:"normal" description:"Sets verbosity of each output record. Options: short, normal, long, trace"`
+	TraceFilePath                string `long:"trace-file" description:"with --trace-format=dot, file the trace of each lookup is written to"`
+	TraceFormat                  string `long:"trace-format" default:"json" description:"how lookup traces are output. Options: json (under trace in each result, with --result-verbosity=trace), dot (a Graphviz digraph per lookup written to --trace-file, of the zones and name servers queried and the referrals between them)"`
+	ConcatenateTXT               bool   `long:"txt-concat" description:"output the character-strings of each TXT record concatenated into a single answer, as SPF and DKIM read them, rather than joined by newlines. The strings as sent are listed under segments"`
 	StatusUpdatesFilePath        string `short:"u" long:"status-updates-file" default:"-" description:"file to write scan progress to, defaults to stderr"`
+	SummaryBuffer                int    `long:"summary-buffer" default:"10000" description:"how many results can be waiting to be written to --summary-file. Once it's full, results for it are dropped rather than slow down the lookups, and counted under summary_dropped in the metadata"`
+	SummaryFilePath              string `long:"summary-file" description:"also write every result to this file, '-' for stdout, in --summary-format and filtered by --summary-filter, ex. a CSV summary alongside a full JSON archive in --output-file. Results aren't reordered by --ordered-output"`
+	SummaryFilter                string `long:"summary-filter" description:"only write results matching this expression to --summary-file, see --filter for the syntax"`
+	SummaryFormat                string `long:"summary-format" default:"json" description:"format of the results written to --summary-file. Options: json, json-array, msgpack, csv. csv uses --csv-columns and --csv-multi-value"`
 	Verbosity                    int    `long:"verbosity" default:"3" description:"log verbosity: 1 (lowest)--5 (highest)"`
 }
 
@@ -117,16 +196,32 @@ type CLIConf struct {
 	TimeFormat         string
 	NameServers        []string // recursive resolvers if not in iterative mode, root servers/servers to start iteration if in iterative mode
 	Domains            []string // if user provides domain names as arguments, dig-style
+	InputFilePaths     []string // input files parsed from --input-file, read in order
 	LocalAddrSpecified bool
 	LocalAddrs         []net.IP
 	ClientSubnet       *dns.EDNS0_SUBNET
 	InputHandler       InputHandler
 	OutputHandler      OutputHandler
+	ErrorOutputHandler OutputHandler // if set, results with an error status are written here instead of OutputHandler
+	RetryOutputHandler OutputHandler // if set, names with a transient error status are written here so they can be re-run
+	TraceOutputHandler OutputHandler // if set, the DOT graph of each lookup's trace is written here
 	StatusHandler      StatusHandler
 	CLIModule          string                  // the module name as passed in by the user
 	ActiveModuleNames  []string                // names of modules that are active in this invocation of zdns. Mostly used with MULTIPLE
 	ActiveModules      map[string]LookupModule // map of module names to modules
 	Class              uint16
+	answerSelector     *answerSelector // nil if every A/AAAA record is output
+	outputFilter       *outputFilter   // nil if every record is output
+	csvEncoder         *csvEncoder     // set with --output-format=csv
+	lookupMetrics      *lookupMetrics  // set with --metrics-addr
+	// name servers in --name-servers whose tls:// or https:// scheme differs from the lookup transport, by transport
+	schemeNameServers map[string][]zdns.NameServer
+	// set with --dedupe-input
+	lookupCoalescer *lookupCoalescer
+	// record types kept in the answers with --answer-types, nil if answers of every type are output
+	answerTypes answerTypeFilter
+	// results are also written to this sink with --summary-file
+	summarySink *outputSink
 }
 
 var GC CLIConf
@@ -149,7 +244,9 @@ func Execute() {
 		GC.ActiveModules[GC.CLIModule] = lookupModule
 		GC.ActiveModuleNames = []string{GC.CLIModule}
 	}
-	Run(GC)
+	if err := Run(GC); errors.Is(err, ErrInterrupted) {
+		os.Exit(InterruptedExitCode)
+	}
 }
 
 func handleMultipleModule(GC *CLIConf) error {
@@ -207,6 +304,14 @@ func parseArgs() {
 		fmt.Println()
 		os.Exit(0)
 	}
+	if GC.DumpSchema != "" {
+		schema, err := dumpSchema(GC.DumpSchema)
+		if err != nil {
+			log.Fatalf("could not dump schema: %v", err)
+		}
+		fmt.Println(string(schema))
+		os.Exit(0)
+	}
 	parser.SubcommandsOptional = false
 	parser.Options = flags.Default
 	args, moduleType, _, err := parser.ParseCommandLine(os.Args[1:])
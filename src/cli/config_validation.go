@@ -51,10 +51,42 @@ func populateNetworkingConfig(gc *CLIConf) error {
 		return errors.New("--https and --tls cannot both be specified")
 	}
 
+	if gc.TLSServerName != "" && !gc.DNSOverTLS {
+		return errors.New("--tls-server-name is only applicable with --tls")
+	}
+
+	if gc.MaxQPS < 0 {
+		return errors.New("--max-qps cannot be negative")
+	}
+
+	if gc.MaxQPSPerNameServer < 0 {
+		return errors.New("--max-qps-per-nameserver cannot be negative")
+	}
+
+	if gc.AllNSConcurrency < 0 {
+		return errors.New("--all-nameservers-concurrency cannot be negative")
+	}
+
+	if gc.QNAMEMinimization && !gc.IterativeResolution {
+		return errors.New("--qname-minimization is only applicable with --iterative")
+	}
+
+	if gc.RootHintsFilePath != "" && !gc.IterativeResolution {
+		return errors.New("--root-hints-file is only applicable with --iterative")
+	}
+
+	if gc.RootHintsFilePath != "" && gc.NameServersString != "" {
+		return errors.New("--root-hints-file and --name-servers cannot both be specified")
+	}
+
 	if err := parseNameServers(gc); err != nil {
 		return errors.Wrap(err, "name servers could not be parsed")
 	}
 
+	if err := parseInputFilePaths(gc); err != nil {
+		return errors.Wrap(err, "input files could not be parsed")
+	}
+
 	if err := validateClientSubnetString(gc); err != nil {
 		return errors.Wrap(err, "client subnet did not pass validation")
 	}
@@ -151,7 +183,33 @@ func parseNameServers(gc *CLIConf) error {
 			}
 			nses = trimmedNSes
 		}
-		gc.NameServers = nses
+		entries := make([]nameServerEntry, 0, len(nses))
+		for _, ns := range nses {
+			entry, err := parseNameServerEntry(ns)
+			if err != nil {
+				return fmt.Errorf("invalid name server %q in --name-servers: %w", ns, err)
+			}
+			entries = append(entries, entry)
+		}
+		return splitNameServersBySchemes(gc, entries)
+	}
+	return nil
+}
+
+// parseInputFilePaths splits the comma-separated --input-file into individual paths
+func parseInputFilePaths(gc *CLIConf) error {
+	gc.InputFilePaths = nil
+	usesStdin := false
+	for _, path := range strings.Split(gc.InputFilePath, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" || path == "-" {
+			if usesStdin {
+				return errors.New("stdin ('-') can only be specified once in --input-file")
+			}
+			usesStdin = true
+			path = "-"
+		}
+		gc.InputFilePaths = append(gc.InputFilePaths, path)
 	}
 	return nil
 }
@@ -54,4 +54,88 @@ func TestValidateNetworkingConfig(t *testing.T) {
 		require.Nil(t, err, "Expected no error but got %v", err)
 		require.Equal(t, "127.0.0.1:53", gc.NameServers[0], "Expected user supplied port to not be changed")
 	})
+	t.Run("Multiple input files", func(t *testing.T) {
+		gc := &CLIConf{
+			InputOutputOptions: InputOutputOptions{
+				InputFilePath: "a.txt, b.txt.gz,-",
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.Nil(t, err, "Expected no error but got %v", err)
+		require.Equal(t, []string{"a.txt", "b.txt.gz", "-"}, gc.InputFilePaths)
+	})
+	t.Run("Stdin specified twice as input file", func(t *testing.T) {
+		gc := &CLIConf{
+			InputOutputOptions: InputOutputOptions{
+				InputFilePath: "-,a.txt,-",
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("Root hints without iterative", func(t *testing.T) {
+		gc := &CLIConf{
+			GeneralOptions: GeneralOptions{
+				RootHintsFilePath: "named.root",
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("Root hints with name servers", func(t *testing.T) {
+		gc := &CLIConf{
+			GeneralOptions: GeneralOptions{
+				IterativeResolution: true,
+				NameServersString:   "198.41.0.4",
+				RootHintsFilePath:   "named.root",
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("Negative all nameservers concurrency", func(t *testing.T) {
+		gc := &CLIConf{
+			GeneralOptions: GeneralOptions{
+				AllNSConcurrency: -1,
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("QNAME minimization without iterative", func(t *testing.T) {
+		gc := &CLIConf{
+			GeneralOptions: GeneralOptions{
+				QNAMEMinimization: true,
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("TLS server name without TLS", func(t *testing.T) {
+		gc := &CLIConf{
+			NetworkOptions: NetworkOptions{
+				TLSServerName: "dns.google",
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("Negative max QPS", func(t *testing.T) {
+		gc := &CLIConf{
+			NetworkOptions: NetworkOptions{
+				MaxQPS: -1,
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
+	t.Run("Negative max QPS per nameserver", func(t *testing.T) {
+		gc := &CLIConf{
+			NetworkOptions: NetworkOptions{
+				MaxQPSPerNameServer: -1,
+			},
+		}
+		err := populateNetworkingConfig(gc)
+		require.NotNil(t, err, "Expected an error but got nil")
+	})
 }
@@ -0,0 +1,201 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	csvMultiValueJoin = "join" // multi-valued answers are joined into a single cell
+	csvMultiValueRows = "rows" // each value of a multi-valued answer gets its own row
+	csvValueSeparator = ";"    // separates the values of a multi-valued answer in a joined cell
+)
+
+// csvColumns are the columns that can be chosen with --csv-columns
+var csvColumns = []string{"name", "module", "status", "resolver", "answers", "ttl", "error"}
+
+// csvEncoder writes results as CSV rows, one per module lookup of a name, or one per answer with csvMultiValueRows
+type csvEncoder struct {
+	columns   []string
+	splitRows bool
+}
+
+func newCSVEncoder(columns, multiValue string) (*csvEncoder, error) {
+	e := &csvEncoder{}
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !slices.Contains(csvColumns, column) {
+			return nil, fmt.Errorf("invalid CSV column %q. Options: %s", column, strings.Join(csvColumns, ", "))
+		}
+		e.columns = append(e.columns, column)
+	}
+	switch multiValue {
+	case csvMultiValueJoin:
+	case csvMultiValueRows:
+		e.splitRows = true
+	default:
+		return nil, fmt.Errorf("invalid CSV multi-value mode %q. Options: %s, %s", multiValue, csvMultiValueJoin, csvMultiValueRows)
+	}
+	return e, nil
+}
+
+// header returns the header row, without a trailing newline
+func (e *csvEncoder) header() string {
+	return e.writeRows([][]string{e.columns})
+}
+
+// encode returns the rows for res, without a trailing newline
+func (e *csvEncoder) encode(res *zdns.Result) string {
+	modules := make([]string, 0, len(res.Results))
+	for module := range res.Results {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	var rows [][]string
+	for _, module := range modules {
+		modRes := res.Results[module]
+		values := make([][]string, len(e.columns))
+		rowCount := 1
+		for i, column := range e.columns {
+			values[i] = csvColumnValues(column, res, module, &modRes)
+			if e.splitRows {
+				rowCount = max(rowCount, len(values[i]))
+			}
+		}
+		for row := 0; row < rowCount; row++ {
+			cells := make([]string, len(e.columns))
+			for i, v := range values {
+				switch {
+				case !e.splitRows:
+					cells[i] = strings.Join(v, csvValueSeparator)
+				case len(v) == 1:
+					// single-valued columns are repeated on every row
+					cells[i] = v[0]
+				case row < len(v):
+					cells[i] = v[row]
+				}
+			}
+			rows = append(rows, cells)
+		}
+	}
+	return e.writeRows(rows)
+}
+
+// csvColumnValues returns the value(s) of a column for one of a name's module results. Only the answers column can have
+// more than one value.
+func csvColumnValues(column string, res *zdns.Result, module string, modRes *zdns.SingleModuleResult) []string {
+	switch column {
+	case "name":
+		return []string{res.Name}
+	case "module":
+		return []string{module}
+	case "status":
+		return []string{modRes.Status}
+	case "resolver":
+		return []string{csvResolver(modRes.Data)}
+	case "answers":
+		return csvAnswers(modRes.Data)
+	case "ttl":
+		return []string{csvTTL(modRes.Data)}
+	case "error":
+		return []string{modRes.Error}
+	}
+	return nil
+}
+
+func (e *csvEncoder) writeRows(rows [][]string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	// writing to a strings.Builder can't fail
+	_ = w.WriteAll(rows)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// csvResolver returns the resolver that answered a lookup, if the module's result records it
+func csvResolver(data interface{}) string {
+	if sqr, ok := data.(*zdns.SingleQueryResult); ok && sqr != nil {
+		return sqr.Resolver
+	}
+	return ""
+}
+
+// csvAnswers returns the answer values of the A/AAAA and NS modules' results, and of raw lookups
+func csvAnswers(data interface{}) []string {
+	var values []string
+	switch d := data.(type) {
+	case *zdns.SingleQueryResult:
+		if d == nil {
+			return nil
+		}
+		for _, ans := range d.Answers {
+			if a, ok := ans.(zdns.WithBaseAnswer); ok {
+				values = append(values, a.BaseAns().Answer)
+			}
+		}
+	case *zdns.IPResult:
+		if d == nil {
+			return nil
+		}
+		values = append(values, d.IPv4Addresses...)
+		values = append(values, d.IPv6Addresses...)
+	case *zdns.NSResult:
+		if d == nil {
+			return nil
+		}
+		for _, server := range d.Servers {
+			values = append(values, server.Name)
+		}
+	}
+	return values
+}
+
+// csvTTL returns the lowest TTL among a result's answers, or an empty string if the result has no TTLs
+func csvTTL(data interface{}) string {
+	var ttls []uint32
+	switch d := data.(type) {
+	case *zdns.SingleQueryResult:
+		if d == nil {
+			return ""
+		}
+		for _, ans := range d.Answers {
+			if a, ok := ans.(zdns.WithBaseAnswer); ok {
+				ttls = append(ttls, a.BaseAns().TTL)
+			}
+		}
+	case *zdns.NSResult:
+		if d == nil {
+			return ""
+		}
+		for _, server := range d.Servers {
+			ttls = append(ttls, server.TTL)
+		}
+	}
+	if len(ttls) == 0 {
+		return ""
+	}
+	lowest := ttls[0]
+	for _, ttl := range ttls[1:] {
+		lowest = min(lowest, ttl)
+	}
+	return strconv.FormatUint(uint64(lowest), 10)
+}
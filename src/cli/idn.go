@@ -0,0 +1,48 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// idnProfile converts names per IDNA2008 the way a resolver would for a lookup, labels such as _dmarc or * that are
+// not valid host names are still allowed
+var idnProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// normalizeIDN returns the ASCII (punycode) form of an internationalized domain name, ex. münchen.de becomes
+// xn--mnchen-3ya.de. Names that are already ASCII are returned unchanged and isIDN is false.
+func normalizeIDN(name string) (asciiName string, isIDN bool, err error) {
+	if isASCII(name) {
+		return name, false, nil
+	}
+	asciiName, err = idnProfile.ToASCII(name)
+	if err != nil {
+		return "", true, fmt.Errorf("unable to convert internationalized name %q to ASCII: %w", name, err)
+	}
+	return asciiName, true, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
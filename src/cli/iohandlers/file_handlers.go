@@ -16,8 +16,13 @@ package iohandlers
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -26,13 +31,31 @@ import (
 	"github.com/zmap/zdns/src/internal/util"
 )
 
+// InputFileSeparator separates the source input file from the input line when FileInputHandler is asked to report
+// which file each line was read from. Tabs cannot appear in a domain name, so this is unambiguous.
+const InputFileSeparator = "\t"
+
+// gzipMagic is the two-byte header that begins every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// FileInputHandler feeds lines from one or more input files into the input channel. Files are opened lazily, one
+// after the other, so only a single file is open at a time. Gzip-compressed files are detected and decompressed
+// transparently.
 type FileInputHandler struct {
-	filepath string
+	filepaths       []string
+	reportInputFile bool
 }
 
-func NewFileInputHandler(filepath string) *FileInputHandler {
+// NewFileInputHandler creates a FileInputHandler that reads from filepaths in order. A path of "" or "-" reads stdin.
+// If reportInputFile is set, each line is prefixed with the path it was read from and InputFileSeparator, use
+// SplitInputFileFromLine to recover both.
+func NewFileInputHandler(filepaths []string, reportInputFile bool) *FileInputHandler {
+	if len(filepaths) == 0 {
+		filepaths = []string{"-"}
+	}
 	return &FileInputHandler{
-		filepath: filepath,
+		filepaths:       filepaths,
+		reportInputFile: reportInputFile,
 	}
 }
 
@@ -40,36 +63,131 @@ func (h *FileInputHandler) FeedChannel(in chan<- string, wg *sync.WaitGroup) err
 	defer close(in)
 	defer (*wg).Done()
 
+	for _, filepath := range h.filepaths {
+		if err := h.feedFile(filepath, in); err != nil {
+			log.Fatalf("unable to read input file (%s): %v", filepath, err)
+		}
+	}
+	return nil
+}
+
+// feedFile feeds every line of a single input file into the input channel
+func (h *FileInputHandler) feedFile(filepath string, in chan<- string) error {
 	var f *os.File
-	if h.filepath == "" || h.filepath == "-" {
+	if filepath == "" || filepath == "-" {
 		f = os.Stdin
 	} else {
 		var err error
-		f, err = os.Open(h.filepath)
+		f, err = os.Open(filepath)
 		if err != nil {
-			log.Fatalf("unable to open input file: %v", err)
+			return errors.Wrap(err, "unable to open input file")
 		}
+		defer func(f *os.File) {
+			if err := f.Close(); err != nil {
+				log.Errorf("unable to close input file (%s): %v", filepath, err)
+			}
+		}(f)
+	}
+	r, err := newMaybeGzipReader(f)
+	if err != nil {
+		return err
 	}
-	s := bufio.NewScanner(f)
+	s := bufio.NewScanner(r)
 	for s.Scan() {
-		in <- s.Text()
+		if h.reportInputFile {
+			in <- filepath + InputFileSeparator + s.Text()
+		} else {
+			in <- s.Text()
+		}
 	}
-	if err := s.Err(); err != nil {
-		log.Fatalf("input unable to read file: %v", err)
+	if err = s.Err(); err != nil {
+		return errors.Wrap(err, "input unable to read file")
 	}
 	return nil
 }
 
+// newMaybeGzipReader returns a reader that transparently decompresses r if it begins with a gzip header, otherwise
+// the contents of r are returned unchanged
+func newMaybeGzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(gzipMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.Wrap(err, "unable to read input file header")
+	}
+	if !bytes.Equal(header, gzipMagic) {
+		return br, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open gzip input file")
+	}
+	return gz, nil
+}
+
+// SplitInputFileFromLine splits a line fed by a FileInputHandler with reportInputFile set into the source file and
+// the original line. If the line does not contain a source file, the file is empty and the line is returned as-is.
+func SplitInputFileFromLine(line string) (inputFile, rest string) {
+	inputFile, rest, found := strings.Cut(line, InputFileSeparator)
+	if !found {
+		return "", line
+	}
+	return inputFile, rest
+}
+
 type FileOutputHandler struct {
-	filepath string
+	filepath      string
+	header        string        // if set, written as the first line of the file
+	delimiter     string        // written after each result
+	separator     string        // if set, written between results, and the last result ends with a newline
+	footer        string        // if set, written as the last line of the file
+	flushInterval time.Duration // how often buffered results are written out, 0 to write each result as it comes
 }
 
 func NewFileOutputHandler(filepath string) *FileOutputHandler {
 	return &FileOutputHandler{
-		filepath: filepath,
+		filepath:      filepath,
+		delimiter:     "\n",
+		flushInterval: DefaultFlushInterval,
+	}
+}
+
+// NewRawFileOutputHandler creates a FileOutputHandler that writes results as-is, without a trailing newline, for
+// binary output formats whose records delimit themselves
+func NewRawFileOutputHandler(filepath string) *FileOutputHandler {
+	return &FileOutputHandler{
+		filepath:      filepath,
+		flushInterval: DefaultFlushInterval,
+	}
+}
+
+// NewFileOutputHandlerWithHeader creates a FileOutputHandler that writes header as the first line, for output formats
+// such as CSV whose records are described by a header row
+func NewFileOutputHandlerWithHeader(filepath, header string) *FileOutputHandler {
+	return &FileOutputHandler{
+		filepath:      filepath,
+		header:        header,
+		delimiter:     "\n",
+		flushInterval: DefaultFlushInterval,
 	}
 }
 
+// NewJSONArrayFileOutputHandler creates a FileOutputHandler that writes results as the elements of a single JSON
+// array, one per line. Results are streamed as they arrive, and the array is closed once the results channel is
+func NewJSONArrayFileOutputHandler(filepath string) *FileOutputHandler {
+	return &FileOutputHandler{
+		filepath:      filepath,
+		header:        jsonArrayHeader,
+		separator:     jsonArraySeparator,
+		footer:        jsonArrayFooter,
+		flushInterval: DefaultFlushInterval,
+	}
+}
+
+// SetFlushInterval sets how often buffered results are written out, 0 writes each result as soon as it comes
+func (h *FileOutputHandler) SetFlushInterval(interval time.Duration) {
+	h.flushInterval = interval
+}
+
 func (h *FileOutputHandler) WriteResults(results <-chan string, wg *sync.WaitGroup) error {
 	defer (*wg).Done()
 
@@ -89,11 +207,5 @@ func (h *FileOutputHandler) WriteResults(results <-chan string, wg *sync.WaitGro
 			}
 		}(f)
 	}
-	for n := range results {
-		_, err := f.WriteString(n + "\n")
-		if err != nil {
-			return errors.Wrap(err, "unable to write to output file")
-		}
-	}
-	return nil
+	return writeResults(f, results, h.header, h.delimiter, h.separator, h.footer, h.flushInterval, "output file")
 }
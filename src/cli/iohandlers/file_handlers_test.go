@@ -0,0 +1,178 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package iohandlers
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestInputFile(t *testing.T, name, contents string, compress bool) string {
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	if compress {
+		gz := gzip.NewWriter(f)
+		_, err = gz.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+	} else {
+		_, err = f.WriteString(contents)
+		require.NoError(t, err)
+	}
+	return path
+}
+
+func readAllFromInputHandler(t *testing.T, h *FileInputHandler) []string {
+	in := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		require.NoError(t, h.FeedChannel(in, &wg))
+	}()
+	lines := make([]string, 0)
+	for line := range in {
+		lines = append(lines, line)
+	}
+	wg.Wait()
+	return lines
+}
+
+func TestFileInputHandlerMultipleFiles(t *testing.T) {
+	plain := writeTestInputFile(t, "plain.txt", "google.com\nyahoo.com,metadata\n", false)
+	compressed := writeTestInputFile(t, "compressed.txt.gz", "example.com\n", true)
+
+	lines := readAllFromInputHandler(t, NewFileInputHandler([]string{plain, compressed}, false))
+	require.Equal(t, []string{"google.com", "yahoo.com,metadata", "example.com"}, lines)
+}
+
+func TestFileInputHandlerReportInputFile(t *testing.T) {
+	first := writeTestInputFile(t, "first.txt", "google.com\n", false)
+	second := writeTestInputFile(t, "second.txt.gz", "yahoo.com,metadata\n", true)
+
+	lines := readAllFromInputHandler(t, NewFileInputHandler([]string{first, second}, true))
+	require.Len(t, lines, 2)
+	inputFile, line := SplitInputFileFromLine(lines[0])
+	require.Equal(t, first, inputFile)
+	require.Equal(t, "google.com", line)
+	inputFile, line = SplitInputFileFromLine(lines[1])
+	require.Equal(t, second, inputFile)
+	require.Equal(t, "yahoo.com,metadata", line, "metadata passthrough should be preserved")
+}
+
+func TestFileInputHandlerConcatenatedGzip(t *testing.T) {
+	// gzip files joined with cat are read as one stream, as gunzip does
+	path := filepath.Join(t.TempDir(), "joined.txt.gz")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	for _, contents := range []string{"google.com\n", "yahoo.com,metadata\n"} {
+		gz := gzip.NewWriter(f)
+		_, err = gz.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+	}
+	require.NoError(t, f.Close())
+
+	lines := readAllFromInputHandler(t, NewFileInputHandler([]string{path}, false))
+	require.Equal(t, []string{"google.com", "yahoo.com,metadata"}, lines)
+}
+
+func TestSplitInputFileFromLineWithoutFile(t *testing.T) {
+	inputFile, line := SplitInputFileFromLine("google.com")
+	require.Empty(t, inputFile)
+	require.Equal(t, "google.com", line)
+}
+
+func writeAllToOutputHandler(t *testing.T, h *FileOutputHandler, results []string) string {
+	path := filepath.Join(t.TempDir(), "output.json")
+	h.filepath = path
+	out := make(chan string, len(results))
+	for _, result := range results {
+		out <- result
+	}
+	close(out)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	require.NoError(t, h.WriteResults(out, &wg))
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(contents)
+}
+
+func TestJSONArrayFileOutputHandler(t *testing.T) {
+	results := []string{`{"name":"google.com"}`, `{"name":"yahoo.com"}`}
+	contents := writeAllToOutputHandler(t, NewJSONArrayFileOutputHandler(""), results)
+	require.Equal(t, "[\n{\"name\":\"google.com\"},\n{\"name\":\"yahoo.com\"}\n]\n", contents)
+	var decoded []map[string]string
+	require.NoError(t, json.Unmarshal([]byte(contents), &decoded))
+	require.Len(t, decoded, 2)
+
+	contents = writeAllToOutputHandler(t, NewJSONArrayFileOutputHandler(""), nil)
+	require.Equal(t, "[\n]\n", contents)
+	require.NoError(t, json.Unmarshal([]byte(contents), &decoded))
+	require.Empty(t, decoded)
+}
+
+// chanWriter sends each write it gets on a channel
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestStreamOutputHandlerFlushInterval(t *testing.T) {
+	// without buffering, each result is written out as it comes
+	writes := make(chanWriter, 10)
+	h := NewStreamOutputHandler(writes)
+	h.SetFlushInterval(0)
+	results := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		require.NoError(t, h.WriteResults(results, &wg))
+	}()
+	results <- "a"
+	require.Equal(t, "a\n", <-writes)
+	results <- "b"
+	require.Equal(t, "b\n", <-writes)
+	close(results)
+	wg.Wait()
+
+	// buffered results are written out together once the results are done, if the interval hasn't passed
+	writes = make(chanWriter, 10)
+	h = NewStreamOutputHandler(writes)
+	h.SetFlushInterval(time.Hour)
+	results = make(chan string)
+	wg.Add(1)
+	go func() {
+		require.NoError(t, h.WriteResults(results, &wg))
+	}()
+	results <- "a"
+	results <- "b"
+	require.Empty(t, writes)
+	close(results)
+	wg.Wait()
+	require.Equal(t, "a\nb\n", <-writes)
+	require.Empty(t, writes)
+}
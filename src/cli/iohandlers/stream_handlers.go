@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -48,23 +49,133 @@ func (h *StreamInputHandler) FeedChannel(in chan<- string, wg *sync.WaitGroup) e
 	return nil
 }
 
+// DefaultFlushInterval is how long results may sit in an output handler's buffer before they're written out
+const DefaultFlushInterval = time.Second
+
 type StreamOutputHandler struct {
-	writer io.Writer
+	writer        io.Writer
+	header        string        // if set, written before the first result
+	delimiter     string        // written after each result
+	separator     string        // if set, written between results, and the last result ends with a newline
+	footer        string        // if set, written after the last result
+	flushInterval time.Duration // how often buffered results are written out, 0 to write each result as it comes
 }
 
 func NewStreamOutputHandler(w io.Writer) *StreamOutputHandler {
 	return &StreamOutputHandler{
-		writer: w,
+		writer:        w,
+		delimiter:     "\n",
+		flushInterval: DefaultFlushInterval,
+	}
+}
+
+// NewRawStreamOutputHandler creates a StreamOutputHandler that writes results as-is, without a trailing newline, for
+// binary output formats whose records delimit themselves
+func NewRawStreamOutputHandler(w io.Writer) *StreamOutputHandler {
+	return &StreamOutputHandler{
+		writer:        w,
+		flushInterval: DefaultFlushInterval,
+	}
+}
+
+// NewStreamOutputHandlerWithHeader creates a StreamOutputHandler that writes header as the first line, for output
+// formats such as CSV whose records are described by a header row
+func NewStreamOutputHandlerWithHeader(w io.Writer, header string) *StreamOutputHandler {
+	return &StreamOutputHandler{
+		writer:        w,
+		header:        header,
+		delimiter:     "\n",
+		flushInterval: DefaultFlushInterval,
 	}
 }
 
+// NewJSONArrayStreamOutputHandler creates a StreamOutputHandler that writes results as the elements of a single JSON
+// array, one per line. Results are streamed as they arrive, and the array is closed once the results channel is
+func NewJSONArrayStreamOutputHandler(w io.Writer) *StreamOutputHandler {
+	return &StreamOutputHandler{
+		writer:        w,
+		header:        jsonArrayHeader,
+		separator:     jsonArraySeparator,
+		footer:        jsonArrayFooter,
+		flushInterval: DefaultFlushInterval,
+	}
+}
+
+// SetFlushInterval sets how often buffered results are written out, 0 writes each result as soon as it comes
+func (h *StreamOutputHandler) SetFlushInterval(interval time.Duration) {
+	h.flushInterval = interval
+}
+
 func (h *StreamOutputHandler) WriteResults(results <-chan string, wg *sync.WaitGroup) error {
 	defer (*wg).Done()
-	for n := range results {
-		_, err := io.WriteString(h.writer, n+"\n")
-		if err != nil {
-			return errors.Wrap(err, "unable to write to output stream")
+	return writeResults(h.writer, results, h.header, h.delimiter, h.separator, h.footer, h.flushInterval, "output stream")
+}
+
+// writeResults writes each result to w followed by delimiter, or after separator if it isn't the first, between the
+// header and footer lines if set. Writes are buffered and flushed every flushInterval, or after every result if it's
+// 0, and once the results channel is closed. dest names the output in errors.
+func writeResults(w io.Writer, results <-chan string, header, delimiter, separator, footer string, flushInterval time.Duration, dest string) error {
+	bw := bufio.NewWriter(w)
+	if header != "" {
+		if _, err := bw.WriteString(header + "\n"); err != nil {
+			return errors.Wrapf(err, "unable to write header to %s", dest)
+		}
+	}
+	var flushTick <-chan time.Time
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+	written := false
+	for done := false; !done; {
+		select {
+		case n, ok := <-results:
+			if !ok {
+				done = true
+				break
+			}
+			if written {
+				n = separator + n
+			}
+			if _, err := bw.WriteString(n + delimiter); err != nil {
+				return errors.Wrapf(err, "unable to write to %s", dest)
+			}
+			written = true
+			if flushInterval == 0 {
+				if err := bw.Flush(); err != nil {
+					return errors.Wrapf(err, "unable to write to %s", dest)
+				}
+			}
+		case <-flushTick:
+			if err := bw.Flush(); err != nil {
+				return errors.Wrapf(err, "unable to write to %s", dest)
+			}
+		}
+	}
+	if footer != "" {
+		if _, err := bw.WriteString(footerLine(separator, footer, written)); err != nil {
+			return errors.Wrapf(err, "unable to write footer to %s", dest)
 		}
 	}
+	if err := bw.Flush(); err != nil {
+		return errors.Wrapf(err, "unable to write to %s", dest)
+	}
 	return nil
 }
+
+// JSON array output wraps the results in brackets, with each result on its own line
+const (
+	jsonArrayHeader    = "["
+	jsonArraySeparator = ",\n"
+	jsonArrayFooter    = "]"
+)
+
+// footerLine returns the footer as its own line. When results are separated rather than delimited, the last result
+// isn't terminated yet, so it's ended first.
+func footerLine(separator, footer string, written bool) string {
+	if written && separator != "" {
+		return "\n" + footer + "\n"
+	}
+	return footer + "\n"
+}
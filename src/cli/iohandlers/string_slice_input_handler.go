@@ -20,7 +20,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// StringSliceInputHandler Feeds a channel with the strings in the slice.
+// StringSliceInputHandler Feeds a channel with the strings in the slice. Names are cleared from the slice as they're fed,
+// so the handler doesn't keep the whole input alive for the length of a scan.
 type StringSliceInputHandler struct {
 	Names []string
 }
@@ -35,8 +36,10 @@ func NewStringSliceInputHandler(domains []string) *StringSliceInputHandler {
 func (h *StringSliceInputHandler) FeedChannel(in chan<- string, wg *sync.WaitGroup) error {
 	defer close(in)
 	defer wg.Done()
-	for _, name := range h.Names {
+	for i, name := range h.Names {
+		h.Names[i] = ""
 		in <- name
 	}
+	h.Names = nil
 	return nil
 }
@@ -0,0 +1,41 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package iohandlers
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringSliceInputHandlerReleasesNames(t *testing.T) {
+	names := []string{"google.com", "yahoo.com"}
+	h := NewStringSliceInputHandler(names)
+	in := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		require.NoError(t, h.FeedChannel(in, &wg))
+	}()
+	fed := make([]string, 0)
+	for name := range in {
+		fed = append(fed, name)
+	}
+	wg.Wait()
+	require.Equal(t, []string{"google.com", "yahoo.com"}, fed)
+	require.Nil(t, h.Names)
+	require.Equal(t, []string{"", ""}, names, "the handler shouldn't keep fed names alive")
+}
@@ -0,0 +1,93 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package cli
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	minLatencyBucket    = 100 * time.Microsecond // upper bound of the first bucket
+	latencyBucketGrowth = 1.05                   // each bucket's upper bound is this much larger than the last's
+	numLatencyBuckets   = 400                    // with the above, the last bucket starts at ~8 hours
+)
+
+// latencyHistogram approximates the distribution of lookup latencies in constant memory, so it can be kept for scans of
+// any size. Buckets grow geometrically, so reported percentiles are within ~5% of the true value.
+type latencyHistogram struct {
+	counts [numLatencyBuckets]uint64
+	total  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// LatencySummary describes a latency distribution, in seconds
+type LatencySummary struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	i := 0
+	if d > minLatencyBucket {
+		i = int(math.Ceil(math.Log(float64(d)/float64(minLatencyBucket)) / math.Log(latencyBucketGrowth)))
+		i = min(i, numLatencyBuckets-1)
+	}
+	h.counts[i]++
+	h.total++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.total += other.total
+	h.sum += other.sum
+	h.max = max(h.max, other.max)
+}
+
+// percentile returns the upper bound of the bucket containing the p-th percentile, p in (0, 1]
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	rank := uint64(math.Ceil(p * float64(h.total)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			upper := time.Duration(float64(minLatencyBucket) * math.Pow(latencyBucketGrowth, float64(i)))
+			// the max is exact, so never report a percentile above it
+			return min(upper, h.max)
+		}
+	}
+	return h.max
+}
+
+// summary returns nil if no latencies were recorded
+func (h *latencyHistogram) summary() *LatencySummary {
+	if h.total == 0 {
+		return nil
+	}
+	return &LatencySummary{
+		Mean: (h.sum / time.Duration(h.total)).Seconds(),
+		P50:  h.percentile(0.5).Seconds(),
+		P90:  h.percentile(0.9).Seconds(),
+		P99:  h.percentile(0.99).Seconds(),
+		Max:  h.max.Seconds(),
+	}
+}
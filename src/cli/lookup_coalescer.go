@@ -0,0 +1,54 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// lookupCoalescer shares a lookup between the workers handling the same name at the same time, for --dedupe-input.
+// Only the first worker's lookup goes out, the others wait for it and output its result in their own records.
+type lookupCoalescer struct {
+	group singleflight.Group
+}
+
+type coalescedLookup struct {
+	res    interface{}
+	trace  zdns.Trace
+	status zdns.Status
+	err    error
+}
+
+// lookupKey identifies lookups that can share a result: the same module looking up the same name, against the same
+// name server and over the same transport
+func lookupKey(moduleName, lookupName string, nameServer *zdns.NameServer, transport string) string {
+	return strings.Join([]string{moduleName, strings.ToLower(lookupName), nameServer.String(), transport}, "\x00")
+}
+
+// lookup calls lookup, unless a lookup with the same key is in flight, in which case its result is returned once it
+// finishes. shared is set if the result was shared with another caller. A nil coalescer always calls lookup.
+func (c *lookupCoalescer) lookup(key string, lookup func() coalescedLookup) (l coalescedLookup, shared bool) {
+	if c == nil {
+		return lookup(), false
+	}
+	v, _, shared := c.group.Do(key, func() (interface{}, error) {
+		return lookup(), nil
+	})
+	return v.(coalescedLookup), shared
+}
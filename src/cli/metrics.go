@@ -0,0 +1,65 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zmap/zdns/src/internal/metrics"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// lookupMetrics counts module lookups by status and observes their latency, a nil *lookupMetrics records nothing
+type lookupMetrics struct {
+	lookups  *metrics.Counter
+	duration *metrics.Histogram
+}
+
+func (m *lookupMetrics) record(module string, status zdns.Status, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lookups.Inc(module, string(status))
+	m.duration.Observe(duration.Seconds(), module)
+}
+
+// startMetricsServer serves the Prometheus metrics of the scan at addr under /metrics, and wires the resolver metrics
+// into config. The server runs until the process exits.
+func startMetricsServer(addr string, config *zdns.ResolverConfig) *lookupMetrics {
+	reg := metrics.NewRegistry()
+	config.Metrics = zdns.NewMetrics(reg, config.Cache)
+	m := &lookupMetrics{
+		lookups:  reg.NewCounter("zdns_lookups_total", "Module lookups completed, by module and status.", "module", "status"),
+		duration: reg.NewHistogram("zdns_lookup_duration_seconds", "Duration of module lookups.", metrics.DefaultBuckets, "module"),
+	}
+	// listen before returning, so a bad address fails the scan up front
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("unable to listen for metrics on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	go func() {
+		if serveErr := http.Serve(listener, mux); serveErr != nil {
+			log.Errorf("metrics server stopped: %v", serveErr)
+		}
+	}()
+	log.Infof("serving metrics on http://%s/metrics", listener.Addr())
+	return m
+}
@@ -33,8 +33,15 @@ type LookupModule interface {
 	NewFlags() interface{}        // needed to satisfy the ZModule interface in ZFlags
 }
 
+// ResultDescriber is implemented by lookup modules so --dump-schema can describe the data of their results
+type ResultDescriber interface {
+	// ResultType returns a zero value of the type Lookup returns as the data of a result
+	ResultType() interface{}
+}
+
 const (
 	BINDVERSION = "BINDVERSION"
+	FINGERPRINT = "FINGERPRINT"
 )
 
 var moduleToLookupModule map[string]LookupModule
@@ -83,7 +90,6 @@ func init() {
 	RegisterLookupModule("MINFO", &BasicLookupModule{DNSType: dns.TypeMINFO, DNSClass: dns.ClassINET})
 	RegisterLookupModule("MR", &BasicLookupModule{DNSType: dns.TypeMR, DNSClass: dns.ClassINET})
 	RegisterLookupModule("MX", &BasicLookupModule{DNSType: dns.TypeMX, DNSClass: dns.ClassINET})
-	RegisterLookupModule("NAPTR", &BasicLookupModule{DNSType: dns.TypeNAPTR, DNSClass: dns.ClassINET})
 	RegisterLookupModule("NID", &BasicLookupModule{DNSType: dns.TypeNID, DNSClass: dns.ClassINET})
 	RegisterLookupModule("NIMLOC", &BasicLookupModule{DNSType: dns.TypeNIMLOC, DNSClass: dns.ClassINET})
 	RegisterLookupModule("NINFO", &BasicLookupModule{DNSType: dns.TypeNINFO, DNSClass: dns.ClassINET})
@@ -109,7 +115,6 @@ func init() {
 	RegisterLookupModule("SOA", &BasicLookupModule{DNSType: dns.TypeSOA, DNSClass: dns.ClassINET})
 	RegisterLookupModule("SPF", &BasicLookupModule{DNSType: dns.TypeSPF, DNSClass: dns.ClassINET})
 	RegisterLookupModule("SRV", &BasicLookupModule{DNSType: dns.TypeSRV, DNSClass: dns.ClassINET})
-	RegisterLookupModule("SSHFP", &BasicLookupModule{DNSType: dns.TypeSSHFP, DNSClass: dns.ClassINET})
 	RegisterLookupModule("SVCB", &BasicLookupModule{DNSType: dns.TypeSVCB, DNSClass: dns.ClassINET})
 	RegisterLookupModule("TALINK", &BasicLookupModule{DNSType: dns.TypeTALINK, DNSClass: dns.ClassINET})
 	RegisterLookupModule("TKEY", &BasicLookupModule{DNSType: dns.TypeTKEY, DNSClass: dns.ClassINET})
@@ -196,6 +201,11 @@ func (lm *BasicLookupModule) Lookup(resolver *zdns.Resolver, lookupName string,
 	return resolver.ExternalLookup(context.Background(), &zdns.Question{Type: lm.DNSType, Class: lm.DNSClass, Name: lookupName}, nameServer)
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (lm *BasicLookupModule) ResultType() interface{} {
+	return &zdns.SingleQueryResult{}
+}
+
 func GetLookupModule(name string) (LookupModule, error) {
 	module, ok := moduleToLookupModule[name]
 	if !ok {
@@ -0,0 +1,187 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package cli
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	httpsTransport = "https"
+
+	schemeSeparator = "://"
+	dohPath         = "/dns-query" // the only path DoH name servers are queried at
+)
+
+// nameServerEntry is a single entry of --name-servers, split into the transport given by its scheme and its address
+type nameServerEntry struct {
+	transport string // tlsTransport or httpsTransport for tls:// and https:// entries, "" if the entry has no scheme
+	address   string // the entry without its scheme, ex. 1.1.1.1:5353, [2001:db8::1]:53 or dns.google
+}
+
+// parseNameServerEntry splits entry into its scheme and address, and checks the address is an IP, an IP and port, or
+// a domain name with an optional port. IPv6 addresses with a port must be bracketed, ex. [2001:db8::1]:53.
+func parseNameServerEntry(entry string) (nameServerEntry, error) {
+	var parsed nameServerEntry
+	parsed.address = strings.TrimSpace(entry)
+	if scheme, address, found := strings.Cut(parsed.address, schemeSeparator); found {
+		switch strings.ToLower(scheme) {
+		case tlsTransport:
+			parsed.transport = tlsTransport
+		case httpsTransport:
+			parsed.transport = httpsTransport
+		case "http":
+			return parsed, errors.New("DNS over HTTPS name servers must use https://")
+		default:
+			return parsed, fmt.Errorf("unknown scheme %q, options: tls://, https://", scheme)
+		}
+		parsed.address = address
+	}
+	if parsed.transport == httpsTransport {
+		// DoH name servers are always queried at /dns-query, so that's the only path allowed
+		parsed.address = strings.TrimSuffix(parsed.address, dohPath)
+		if strings.Contains(parsed.address, "/") {
+			return parsed, fmt.Errorf("DNS over HTTPS name servers are queried at %s, other paths aren't supported", dohPath)
+		}
+	}
+	if err := validateNameServerAddress(parsed.address); err != nil {
+		return parsed, err
+	}
+	if parsed.transport == httpsTransport && net.ParseIP(strings.Trim(nameServerHost(parsed.address), "[]")) != nil {
+		return parsed, errors.New("DNS over HTTPS name servers must be given by domain name, ex. https://dns.google")
+	}
+	return parsed, nil
+}
+
+// validateNameServerAddress checks address is an IP, an IP and port, or a domain name with an optional port
+func validateNameServerAddress(address string) error {
+	if address == "" {
+		return errors.New("empty name server")
+	}
+	if strings.Contains(address, "%") {
+		_, err := convertScopedNameServerString(address)
+		return err
+	}
+	if net.ParseIP(address) != nil {
+		return nil
+	}
+	if strings.HasPrefix(address, "[") {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("bracketed IPv6 addresses need a port, ex. [2001:db8::1]:53: %s", address)
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address: %s", host)
+		}
+		_, err = parseNameServerPort(port)
+		return err
+	}
+	if strings.Count(address, ":") > 1 {
+		return fmt.Errorf("IPv6 addresses with a port must be bracketed, ex. [2001:db8::1]:53: %s", address)
+	}
+	host, port, hasPort := strings.Cut(address, ":")
+	if hasPort {
+		if _, err := parseNameServerPort(port); err != nil {
+			return err
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(host); !ok || strings.Trim(host, "0123456789.") == "" {
+		return fmt.Errorf("not an IP address or domain name: %s", host)
+	}
+	return nil
+}
+
+// nameServerHost returns the host of a name server address, without its port
+func nameServerHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// parseNameServerPort parses the port of a name server, which must be between 1 and 65535
+func parseNameServerPort(port string) (uint16, error) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("invalid port %q, must be between 1 and 65535", port)
+	}
+	return uint16(p), nil
+}
+
+// splitNameServersBySchemes sorts the --name-servers entries into the ones looked up over the transport given by
+// --tls or --https (or plain DNS), which are left in gc.NameServers, and the ones whose scheme asks for another
+// transport, which are resolved into gc.schemeNameServers. If no flag is given and no entry lacks a scheme, the
+// first entry's scheme is used as if its flag had been given.
+func splitNameServersBySchemes(gc *CLIConf, entries []nameServerEntry) error {
+	lookupTransport := ""
+	if gc.DNSOverTLS {
+		lookupTransport = tlsTransport
+	} else if gc.DNSOverHTTPS {
+		lookupTransport = httpsTransport
+	}
+	hasSchemes, hasPlainEntries := false, false
+	for _, entry := range entries {
+		if entry.transport != "" {
+			hasSchemes = true
+		} else {
+			hasPlainEntries = true
+		}
+	}
+	if hasSchemes && gc.IterativeResolution {
+		return errors.New("tls:// and https:// name servers cannot be used with --iterative")
+	}
+	if hasSchemes && gc.UDPOnly {
+		return errors.New("tls:// and https:// name servers cannot be used with --udp-only")
+	}
+	if hasSchemes && lookupTransport == "" && !hasPlainEntries {
+		lookupTransport = entries[0].transport
+		gc.DNSOverTLS = lookupTransport == tlsTransport
+		gc.DNSOverHTTPS = lookupTransport == httpsTransport
+	}
+	gc.NameServers = nil
+	schemeAddresses := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.transport == "" || entry.transport == lookupTransport {
+			gc.NameServers = append(gc.NameServers, entry.address)
+		} else {
+			schemeAddresses[entry.transport] = append(schemeAddresses[entry.transport], entry.address)
+		}
+	}
+	if len(gc.NameServers) == 0 {
+		return fmt.Errorf("no name server in --name-servers uses --%s", lookupTransport)
+	}
+	gc.schemeNameServers = nil
+	for transport, addresses := range schemeAddresses {
+		nameServers, err := convertNameServerStringSliceToNameServers(addresses, zdns.IPv4OrIPv6, transport == tlsTransport, transport == httpsTransport)
+		if err != nil {
+			return err
+		}
+		if gc.schemeNameServers == nil {
+			gc.schemeNameServers = make(map[string][]zdns.NameServer)
+		}
+		gc.schemeNameServers[transport] = nameServers
+	}
+	return nil
+}
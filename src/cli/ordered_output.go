@@ -0,0 +1,90 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"sync"
+)
+
+// sequencedLine is an input line numbered with its position in the input, for --ordered-output
+type sequencedLine struct {
+	index uint64
+	line  string
+}
+
+// sequencedResult is the output record of a finished lookup, held until every earlier line's lookup has finished
+type sequencedResult struct {
+	record    string
+	hasRecord bool // lookups with no output, or whose result went to --error-file, still advance the sequence
+}
+
+// outputSequencer numbers input lines and re-orders the records of their lookups, which finish out of order, so they're
+// written in input order. At most window lines are handed out ahead of the oldest unfinished one. Once that many
+// results are held back, reading input blocks until it finishes, so a stuck lookup can't grow the buffer without bound.
+type outputSequencer struct {
+	lines chan sequencedLine
+	out   chan<- string
+
+	mu      sync.Mutex
+	space   *sync.Cond // signalled when next advances
+	next    uint64     // index of the next record to write
+	pending map[uint64]sequencedResult
+	window  uint64
+}
+
+func newOutputSequencer(out chan<- string, window int) *outputSequencer {
+	s := &outputSequencer{
+		lines:   make(chan sequencedLine),
+		out:     out,
+		pending: make(map[uint64]sequencedResult),
+		window:  uint64(window),
+	}
+	s.space = sync.NewCond(&s.mu)
+	return s
+}
+
+// feed numbers the lines read from in and passes them to the workers, closing lines once in is closed
+func (s *outputSequencer) feed(in <-chan string) {
+	var index uint64
+	for line := range in {
+		s.mu.Lock()
+		for index >= s.next+s.window {
+			s.space.Wait()
+		}
+		s.mu.Unlock()
+		s.lines <- sequencedLine{index: index, line: line}
+		index++
+	}
+	close(s.lines)
+}
+
+// done records the result of the line at index and writes out every record that's now next in order
+func (s *outputSequencer) done(index uint64, result sequencedResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[index] = result
+	for {
+		res, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.next)
+		if res.hasRecord {
+			s.out <- res.record
+		}
+		s.next++
+	}
+	s.space.Broadcast()
+}
@@ -0,0 +1,168 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// filterPredicateRegex matches a single --filter predicate, ex. "status==NOERROR" or "answers.A>=1"
+var filterPredicateRegex = regexp.MustCompile(`^(status|answers(?:\.([A-Za-z0-9]+))?)\s*(==|!=|>=|<=|>|<)\s*([A-Za-z0-9_]+)$`)
+
+// outputFilter drops output records that don't match a --filter expression. An expression is a disjunction, '||', of
+// conjunctions, '&&', of predicates on the status of a lookup and the number of answers it got, optionally of a single
+// type, ex. "status==NOERROR && answers.A>=1 || status==SERVFAIL".
+type outputFilter struct {
+	clauses [][]filterPredicate // the record matches if all predicates of any clause match
+}
+
+type filterPredicate struct {
+	field  string // "status" or "answers"
+	rrType uint16 // for "answers", only answers of this type are counted. 0 counts every answer
+	op     string
+	status string // the status compared against, upper case
+	count  int    // the number of answers compared against
+}
+
+// newOutputFilter parses a --filter expression, returning nil if expr is empty and every record is output
+func newOutputFilter(expr string) (*outputFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	f := &outputFilter{}
+	for _, clause := range strings.Split(expr, "||") {
+		var predicates []filterPredicate
+		for _, predicate := range strings.Split(clause, "&&") {
+			p, err := parseFilterPredicate(strings.TrimSpace(predicate))
+			if err != nil {
+				return nil, err
+			}
+			predicates = append(predicates, p)
+		}
+		f.clauses = append(f.clauses, predicates)
+	}
+	return f, nil
+}
+
+func parseFilterPredicate(predicate string) (filterPredicate, error) {
+	m := filterPredicateRegex.FindStringSubmatch(predicate)
+	if m == nil {
+		return filterPredicate{}, fmt.Errorf("invalid --filter predicate %q, expected ex. status==NOERROR or answers.A>=1", predicate)
+	}
+	p := filterPredicate{field: m[1], op: m[3]}
+	if p.field == "status" {
+		if p.op != "==" && p.op != "!=" {
+			return filterPredicate{}, fmt.Errorf("invalid --filter predicate %q, statuses can only be compared with == and !=", predicate)
+		}
+		p.status = strings.ToUpper(m[4])
+		return p, nil
+	}
+	p.field = "answers"
+	if m[2] != "" {
+		rrType, ok := dns.StringToType[strings.ToUpper(m[2])]
+		if !ok {
+			return filterPredicate{}, fmt.Errorf("invalid record type %q in --filter predicate %q", m[2], predicate)
+		}
+		p.rrType = rrType
+	}
+	count, err := strconv.Atoi(m[4])
+	if err != nil || count < 0 {
+		return filterPredicate{}, fmt.Errorf("invalid answer count %q in --filter predicate %q", m[4], predicate)
+	}
+	p.count = count
+	return p, nil
+}
+
+// matches returns whether the result of any of the modules of res matches the filter
+func (f *outputFilter) matches(res *zdns.Result) bool {
+	if f == nil {
+		return true
+	}
+	for _, moduleRes := range res.Results {
+		for _, clause := range f.clauses {
+			if clauseMatches(clause, &moduleRes) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func clauseMatches(clause []filterPredicate, res *zdns.SingleModuleResult) bool {
+	for _, p := range clause {
+		if !p.matches(res) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *filterPredicate) matches(res *zdns.SingleModuleResult) bool {
+	if p.field == "status" {
+		return (res.Status == p.status) == (p.op == "==")
+	}
+	n := countAnswers(res.Data, p.rrType)
+	switch p.op {
+	case "==":
+		return n == p.count
+	case "!=":
+		return n != p.count
+	case ">":
+		return n > p.count
+	case ">=":
+		return n >= p.count
+	case "<":
+		return n < p.count
+	default:
+		return n <= p.count
+	}
+}
+
+// countAnswers returns the number of answers of rrType, or of every type if 0, in a module's result data. Only raw
+// lookups and the addresses of ALOOKUP are counted, other modules' data has no answers.
+func countAnswers(data interface{}, rrType uint16) int {
+	switch res := data.(type) {
+	case *zdns.SingleQueryResult:
+		if res == nil {
+			return 0
+		}
+		n := 0
+		for _, a := range res.Answers {
+			if ans, ok := a.(zdns.WithBaseAnswer); ok && (rrType == 0 || ans.BaseAns().RrType == rrType) {
+				n++
+			}
+		}
+		return n
+	case *zdns.IPResult:
+		if res == nil {
+			return 0
+		}
+		switch rrType {
+		case 0:
+			return len(res.IPv4Addresses) + len(res.IPv6Addresses)
+		case dns.TypeA:
+			return len(res.IPv4Addresses)
+		case dns.TypeAAAA:
+			return len(res.IPv6Addresses)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zmap/zdns/src/cli/iohandlers"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// outputSink is an additional destination every result is fanned out to, alongside --output-file, with a format and
+// filter of its own (--summary-file). Workers hand it records through a bounded buffer and drop them rather than wait
+// once the buffer is full, so a slow sink never holds up lookups or the main output.
+type outputSink struct {
+	format     string
+	csvEncoder *csvEncoder   // set if format is csv
+	filter     *outputFilter // nil if every record is written
+	handler    OutputHandler
+	records    chan string
+	dropped    atomic.Uint64 // records dropped because the buffer was full
+	mu         sync.RWMutex  // guards closed, so workers abandoned after an interrupt don't send on a closed channel
+	closed     bool
+}
+
+// newOutputSink creates a sink writing records of the given format that match filter to path, '-' for stdout, holding
+// at most buffer records that haven't been written yet
+func newOutputSink(path, format, filter, csvColumns, csvMultiValue string, buffer int) (*outputSink, error) {
+	if buffer < 1 {
+		return nil, errors.New("the buffer must hold at least 1 record")
+	}
+	s := &outputSink{format: format, records: make(chan string, buffer)}
+	var err error
+	if s.filter, err = newOutputFilter(filter); err != nil {
+		return nil, err
+	}
+	switch format {
+	case jsonOutputFormat:
+		s.handler = iohandlers.NewFileOutputHandler(path)
+	case jsonArrayOutputFormat:
+		s.handler = iohandlers.NewJSONArrayFileOutputHandler(path)
+	case msgpackOutputFormat:
+		s.handler = iohandlers.NewRawFileOutputHandler(path)
+	case csvOutputFormat:
+		if s.csvEncoder, err = newCSVEncoder(csvColumns, csvMultiValue); err != nil {
+			return nil, err
+		}
+		s.handler = iohandlers.NewFileOutputHandlerWithHeader(path, s.csvEncoder.header())
+	default:
+		return nil, fmt.Errorf("invalid format %q. Options: json, json-array, msgpack, csv", format)
+	}
+	return s, nil
+}
+
+// send encodes res and queues it for writing if it matches the sink's filter. It never blocks, the record is dropped
+// if the buffer is full or the sink was closed.
+func (s *outputSink) send(res *zdns.Result, groups []string) {
+	if s == nil || !s.filter.matches(res) {
+		return
+	}
+	record, err := encodeResult(res, s.format, s.csvEncoder, groups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.records <- record:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close closes the buffer once the workers are done with the sink, so the handler writes out what's left and returns
+func (s *outputSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// rootProbeCacheSize is the size of the cache of each probe's resolver, its one answer isn't shared with the scan so it
+// can't hide an unreachable root
+const rootProbeCacheSize = 16
+
+// RootProbe is the outcome of the --probe-roots query to one root server
+type RootProbe struct {
+	NameServer string  `json:"name_server"`
+	Reachable  bool    `json:"reachable"`
+	Status     string  `json:"status"`
+	RTT        float64 `json:"rtt,omitempty"` // time for the root server to answer, in seconds
+	Error      string  `json:"error,omitempty"`
+	Pruned     bool    `json:"pruned,omitempty"` // left out of the scan with --prune-unreachable-roots
+}
+
+// probeRootServers queries each root server of rc for the root NS records, concurrently, and returns whether each
+// answered, in the order of rc's IPv4 and then IPv6 root servers
+func probeRootServers(rc *zdns.ResolverConfig) []RootProbe {
+	roots := append(append([]zdns.NameServer{}, rc.RootNameServersV4...), rc.RootNameServersV6...)
+	probes := make([]RootProbe, len(roots))
+	var wg sync.WaitGroup
+	for i := range roots {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			probes[i] = probeRootServer(rc, roots[i])
+		}(i)
+	}
+	wg.Wait()
+	return probes
+}
+
+// probeRootServer sends a root NS query to root with a resolver of its own, so the scan's cache isn't involved
+func probeRootServer(rc *zdns.ResolverConfig, root zdns.NameServer) RootProbe {
+	probe := RootProbe{NameServer: root.String()}
+	probeConfig := *rc
+	probeConfig.Cache = new(zdns.Cache)
+	probeConfig.Cache.Init(rootProbeCacheSize)
+	resolver, err := zdns.InitResolver(&probeConfig)
+	if err != nil {
+		probe.Status = string(zdns.StatusError)
+		probe.Error = err.Error()
+		return probe
+	}
+	defer resolver.Close()
+	start := time.Now()
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &zdns.Question{Name: ".", Type: dns.TypeNS, Class: dns.ClassINET}, &root)
+	probe.Status = string(status)
+	if err != nil {
+		probe.Error = err.Error()
+	}
+	probe.Reachable = status == zdns.StatusNoError && res != nil && len(res.Answers) > 0
+	if probe.Reachable {
+		probe.RTT = time.Since(start).Seconds()
+	}
+	return probe
+}
+
+// reportRootProbes logs the outcome of each probe, and with prune, removes the unreachable root servers from rc. It's
+// fatal if none of the root servers of an IP version in use is reachable.
+func reportRootProbes(rc *zdns.ResolverConfig, probes []RootProbe, prune bool) {
+	unreachable := make(map[string]struct{})
+	for _, probe := range probes {
+		if probe.Reachable {
+			log.Infof("root server %s is reachable, answered in %.1fms", probe.NameServer, probe.RTT*1000)
+			continue
+		}
+		log.Warnf("root server %s is unreachable: %s %s", probe.NameServer, probe.Status, probe.Error)
+		unreachable[probe.NameServer] = struct{}{}
+	}
+	if !prune || len(unreachable) == 0 {
+		return
+	}
+	for i := range probes {
+		_, probes[i].Pruned = unreachable[probes[i].NameServer]
+	}
+	rc.RootNameServersV4 = pruneRootServers(rc.RootNameServersV4, unreachable)
+	rc.RootNameServersV6 = pruneRootServers(rc.RootNameServersV6, unreachable)
+	if rc.IPVersionMode != zdns.IPv6Only && len(rc.RootNameServersV4) == 0 {
+		log.Fatal("none of the IPv4 root servers are reachable, use --6 for IPv6-only resolution")
+	}
+	if rc.IPVersionMode != zdns.IPv4Only && len(rc.RootNameServersV6) == 0 {
+		log.Fatal("none of the IPv6 root servers are reachable, use --4 for IPv4-only resolution")
+	}
+	log.Warnf("left %d unreachable root servers out of the scan", len(unreachable))
+}
+
+// pruneRootServers returns the root servers that aren't in unreachable
+func pruneRootServers(roots []zdns.NameServer, unreachable map[string]struct{}) []zdns.NameServer {
+	kept := make([]zdns.NameServer, 0, len(roots))
+	for _, root := range roots {
+		if _, ok := unreachable[root.String()]; !ok {
+			kept = append(kept, root)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,220 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonSchema is the subset of JSON Schema needed to describe output records. Fields are annotated with the output
+// groups they belong to under x-groups, a field is only output if --result-verbosity or --include-fields selects
+// one of them.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           *schemaProperties      `json:"properties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+	Groups               []string               `json:"x-groups,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// schemaProperties are the properties of an object schema, marshalled in the order of the struct's fields
+type schemaProperties struct {
+	names   []string
+	schemas map[string]*jsonSchema
+}
+
+func (p *schemaProperties) add(name string, s *jsonSchema) {
+	if p.schemas == nil {
+		p.schemas = make(map[string]*jsonSchema)
+	}
+	if _, ok := p.schemas[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.schemas[name] = s
+}
+
+func (p *schemaProperties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range p.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(p.schemas[name])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaBuilder derives JSON schemas from Go types through their json and groups tags. Named struct types are
+// described once under $defs and referred to, so recursive types are supported.
+type schemaBuilder struct {
+	defs map[string]*jsonSchema
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) *jsonSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(textMarshalerType) && !reflect.PointerTo(t).Implements(jsonMarshalerType) {
+		// ex. net.IP, encoded as a string
+		return &jsonSchema{Type: "string"}
+	}
+	if reflect.PointerTo(t).Implements(jsonMarshalerType) {
+		// the type encodes itself, its shape can't be derived
+		return &jsonSchema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// byte slices are base64 encoded
+			return &jsonSchema{Type: "string"}
+		}
+		return &jsonSchema{Type: "array", Items: b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.objectSchema(t)
+		}
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		if _, ok := b.defs[name]; !ok {
+			b.defs[name] = nil // placeholder, so a type referring to itself isn't described again
+			b.defs[name] = b.objectSchema(t)
+		}
+		return &jsonSchema{Ref: "#/$defs/" + name}
+	}
+	// interfaces can hold values of any type
+	return &jsonSchema{}
+}
+
+// objectSchema describes the exported fields of a struct as encoding/json marshals them, with the fields of embedded
+// structs promoted
+func (b *schemaBuilder) objectSchema(t reflect.Type) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: &schemaProperties{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			embedded := b.objectSchema(fieldType)
+			for _, n := range embedded.Properties.names {
+				s.Properties.add(n, embedded.Properties.schemas[n])
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fieldSchema := b.schemaFor(field.Type)
+		if groups := field.Tag.Get("groups"); groups != "" {
+			fieldSchema.Groups = strings.Split(groups, ",")
+		}
+		s.Properties.add(name, fieldSchema)
+	}
+	return s
+}
+
+// moduleSchema returns the JSON schema of the output records of a lookup with module
+func moduleSchema(moduleName string) (*jsonSchema, error) {
+	module, err := GetLookupModule(moduleName)
+	if err != nil {
+		return nil, err
+	}
+	b := &schemaBuilder{defs: make(map[string]*jsonSchema)}
+	var data *jsonSchema
+	if describer, ok := module.(ResultDescriber); ok {
+		data = b.schemaFor(reflect.TypeOf(describer.ResultType()))
+	} else {
+		data = &jsonSchema{Description: "not described by the module"}
+	}
+	moduleResult := b.objectSchema(reflect.TypeOf(zdns.SingleModuleResult{}))
+	dataGroups := moduleResult.Properties.schemas["data"].Groups
+	data.Groups = dataGroups
+	moduleResult.Properties.add("data", data)
+
+	record := b.objectSchema(reflect.TypeOf(zdns.Result{}))
+	results := record.Properties.schemas["results"]
+	results.AdditionalProperties = nil
+	results.Properties = &schemaProperties{}
+	results.Properties.add(moduleName, moduleResult)
+	// results is described per module above rather than through the generic map
+	delete(b.defs, "zdns.SingleModuleResult")
+
+	record.Schema = jsonSchemaDraft
+	record.Title = fmt.Sprintf("zdns %s output record", moduleName)
+	record.Description = "Fields are only output if --result-verbosity or --include-fields selects one of the groups " +
+		"listed under x-groups, and fields marked omitempty in the source are left out when empty."
+	record.Defs = b.defs
+	return record, nil
+}
+
+// dumpSchema returns the JSON schema of the output records of a lookup with module, indented
+func dumpSchema(moduleName string) ([]byte, error) {
+	schema, err := moduleSchema(strings.ToUpper(moduleName))
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
@@ -0,0 +1,140 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InterruptedExitCode is the exit code of a scan stopped by SIGINT or SIGTERM, once the results of the lookups that
+// finished were written out
+const InterruptedExitCode = 130
+
+// scanShutdown stops a scan gracefully when it's interrupted by SIGINT or SIGTERM. Input stops being handed to the
+// workers, the lookups in flight get gracePeriod to finish, and the results of those that did are written out. A
+// second signal, or the grace period running out, abandons the lookups still in flight.
+type scanShutdown struct {
+	signals     chan os.Signal
+	stop        chan struct{} // closed on the first signal
+	abandon     chan struct{} // closed once the lookups in flight are given up on
+	done        chan struct{} // closed once the scan finished, signals aren't watched anymore
+	gracePeriod time.Duration
+	interrupted atomic.Bool
+}
+
+func newScanShutdown(gracePeriod time.Duration) *scanShutdown {
+	s := &scanShutdown{
+		signals:     make(chan os.Signal, 1),
+		stop:        make(chan struct{}),
+		abandon:     make(chan struct{}),
+		done:        make(chan struct{}),
+		gracePeriod: gracePeriod,
+	}
+	signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM)
+	go s.watch()
+	return s
+}
+
+func (s *scanShutdown) watch() {
+	var sig os.Signal
+	select {
+	case sig = <-s.signals:
+	case <-s.done:
+		return
+	}
+	s.interrupted.Store(true)
+	log.Warnf("received %v, no more names will be read. Waiting up to %v for the lookups in flight to finish, send it again to stop now", sig, s.gracePeriod)
+	close(s.stop)
+	timer := time.NewTimer(s.gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-s.signals:
+		log.Warn("received another signal, abandoning the lookups in flight")
+	case <-timer.C:
+		log.Warnf("the lookups in flight didn't finish within %v, abandoning them", s.gracePeriod)
+	case <-s.done:
+		return
+	}
+	close(s.abandon)
+}
+
+// finish stops watching for signals, once the scan is over
+func (s *scanShutdown) finish() {
+	signal.Stop(s.signals)
+	close(s.done)
+}
+
+// feedUntilStopped passes lines from in to out until in is closed or the scan is interrupted, then closes out. Once
+// it returns, whatever is left in in isn't read.
+func feedUntilStopped(in <-chan string, out chan<- string, stop <-chan struct{}) {
+	defer close(out)
+	for {
+		select {
+		case line, ok := <-in:
+			if !ok {
+				return
+			}
+			select {
+			case out <- line:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// abandonable returns the channel workers send to in place of out, or nil if out is nil. What's sent to it is passed
+// on to out, which is closed once the returned channel is, or once abandon is closed as workers stuck in lookups may
+// never let it be closed. Anything sent after that is never read.
+func abandonable[T any](out chan<- T, abandon <-chan struct{}) chan T {
+	if out == nil {
+		return nil
+	}
+	in := make(chan T)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+				out <- v
+			case <-abandon:
+				// pass on what workers that did finish are already sending
+				for {
+					select {
+					case v, ok := <-in:
+						if !ok {
+							return
+						}
+						out <- v
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return in
+}
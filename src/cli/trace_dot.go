@@ -0,0 +1,138 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/internal/util"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	traceFormatJSON = "json"
+	traceFormatDOT  = "dot"
+)
+
+// dotGraph accumulates the nodes and edges of a Graphviz graph, dropping duplicates and keeping the order they were
+// first added in so the output is stable
+type dotGraph struct {
+	lines []string
+	seen  map[string]bool
+}
+
+func (g *dotGraph) add(line string) {
+	if g.seen[line] {
+		return
+	}
+	g.seen[line] = true
+	g.lines = append(g.lines, line)
+}
+
+// traceToDOT renders the trace of a lookup as a Graphviz digraph of its delegation path. Zones are boxes with an edge
+// to each name server queried for them, name servers have an edge to the zones they referred the lookup to and to the
+// questions they answered. Steps answered from the cache are dashed.
+func traceToDOT(name, moduleName string, trace zdns.Trace) string {
+	g := &dotGraph{seen: make(map[string]bool)}
+	// name servers are labeled with their name, if it was learned from glue or an answer along the way
+	nsNames := make(map[string]string)
+	for _, step := range trace {
+		for _, rec := range util.Concat(step.Result.Additionals, step.Result.Answers) {
+			if ans, ok := rec.(zdns.Answer); ok && (ans.RrType == dns.TypeA || ans.RrType == dns.TypeAAAA) {
+				nsNames[ans.Answer] = strings.TrimSuffix(ans.Name, ".")
+			}
+		}
+	}
+	for _, step := range trace {
+		if step.NameServer == "" {
+			continue
+		}
+		style := ""
+		if step.Cached {
+			style = ", style=dashed"
+		}
+		zoneID := "zone " + step.Layer
+		nsID := "ns " + step.NameServer
+		g.add(fmt.Sprintf("  %s [shape=box, label=%s];", dotQuote(zoneID), dotQuote(step.Layer)))
+		nsLabel := step.NameServer
+		if host, _, err := net.SplitHostPort(step.NameServer); err == nil && nsNames[host] != "" {
+			nsLabel = nsNames[host] + "\n" + step.NameServer
+		}
+		g.add(fmt.Sprintf("  %s [label=%s];", dotQuote(nsID), dotQuote(nsLabel)))
+		g.add(fmt.Sprintf("  %s -> %s [label=%s%s];", dotQuote(zoneID), dotQuote(nsID), dotQuote("try "+fmt.Sprint(step.Try)), style))
+
+		if referrals := referredZones(step); len(referrals) > 0 {
+			for _, zone := range referrals {
+				g.add(fmt.Sprintf("  %s [shape=box, label=%s];", dotQuote("zone "+zone), dotQuote(zone)))
+				g.add(fmt.Sprintf("  %s -> %s [label=\"referral\"%s];", dotQuote(nsID), dotQuote("zone "+zone), style))
+			}
+			continue
+		}
+		question := fmt.Sprintf("%s %s", step.Name, dns.TypeToString[step.DNSType])
+		outcome := dns.RcodeToString[step.Result.Flags.ErrorCode]
+		if n := len(step.Result.Answers); n == 1 {
+			outcome += ", 1 answer"
+		} else if n > 1 {
+			outcome = fmt.Sprintf("%s, %d answers", outcome, n)
+		}
+		g.add(fmt.Sprintf("  %s [shape=ellipse, style=filled, label=%s];", dotQuote("question "+question), dotQuote(question)))
+		g.add(fmt.Sprintf("  %s -> %s [label=%s%s];", dotQuote(nsID), dotQuote("question "+question), dotQuote(outcome), style))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(name+" "+moduleName))
+	fmt.Fprintf(&b, "  label=%s;\n", dotQuote(name+" ("+moduleName+")"))
+	for _, line := range g.lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// referredZones returns the zones a response without answers delegated to, from the NS records in its authority
+// section
+func referredZones(step zdns.TraceStep) []string {
+	if len(step.Result.Answers) > 0 {
+		return nil
+	}
+	var zones []string
+	seen := make(map[string]bool)
+	for _, rec := range step.Result.Authorities {
+		ans, ok := rec.(zdns.Answer)
+		if !ok || ans.RrType != dns.TypeNS {
+			continue
+		}
+		zone := strings.TrimSuffix(ans.Name, ".")
+		if zone == "" {
+			zone = "."
+		}
+		if !seen[zone] && zone != step.Layer {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// dotQuote returns s as a quoted DOT ID
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
@@ -15,13 +15,15 @@ package cli
 
 import (
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"os"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -36,29 +38,56 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/zmap/zdns/src/cli/iohandlers"
+	"github.com/zmap/zdns/src/internal/msgpack"
 	blacklist "github.com/zmap/zdns/src/internal/safeblacklist"
 	"github.com/zmap/zdns/src/internal/util"
 	"github.com/zmap/zdns/src/zdns"
 )
 
+const (
+	maxPcapThreads = 10 // --threads is capped to this when writing a pcap, since every packet is written under a lock
+	// past this many names given as arguments, users are pointed to --input-file, which streams names instead
+	argDomainsWarnThreshold = 10000
+
+	jsonOutputFormat      = "json"
+	jsonArrayOutputFormat = "json-array"
+	msgpackOutputFormat   = "msgpack"
+	csvOutputFormat       = "csv"
+)
+
 type routineMetadata struct {
-	Names   int // number of domain names processed
-	Lookups int // number of lookups performed
-	Status  map[zdns.Status]int
+	Names         int // number of domain names processed
+	Lookups       int // number of lookups performed
+	Queries       int // number of queries sent to name servers
+	Status        map[zdns.Status]int
+	NameLatencies latencyHistogram // time taken to process each name, across all modules
+	Coalesced     int              // number of lookups that shared a concurrent lookup's result, with --dedupe-input
 }
 
 type Metadata struct {
 	Names           int                           `json:"names"`
 	Lookups         int                           `json:"lookups"`
+	Queries         int                           `json:"queries"`
 	Status          map[string]int                `json:"statuses"`
 	StartTime       string                        `json:"start_time"`
 	EndTime         string                        `json:"end_time"`
+	Duration        float64                       `json:"duration"`               // wall-clock duration of the run, in seconds
+	NameLatency     *LatencySummary               `json:"name_latency,omitempty"` // per-name processing time, percentiles are approximate
 	NameServers     []string                      `json:"name_servers"`
 	Timeout         int                           `json:"timeout"`
 	Retries         int                           `json:"retries"`
 	Conf            *CLIConf                      `json:"conf"`
 	ZDNSVersion     string                        `json:"zdns_version"`
 	CacheStatistics *zdns.CacheStatisticsMetadata `json:"cache_statistics,omitempty"`
+	NameServerTrips []zdns.NameServerTrips        `json:"name_server_trips,omitempty"` // name servers tripped by --circuit-breaker-threshold
+	// lookups that shared the result of a concurrent lookup of the same name with --dedupe-input, rather than querying
+	CoalescedLookups int `json:"coalesced_lookups,omitempty"`
+	// set if the scan was stopped by SIGINT or SIGTERM, names that weren't read or whose lookups were abandoned are missing
+	Interrupted bool `json:"interrupted,omitempty"`
+	// outcome of querying each root server before the scan, with --probe-roots
+	RootProbes []RootProbe `json:"root_probes,omitempty"`
+	// results not written to --summary-file because it fell too far behind
+	SummaryDropped uint64 `json:"summary_dropped,omitempty"`
 }
 
 func populateCLIConfig(gc *CLIConf) *CLIConf {
@@ -126,10 +155,20 @@ func populateCLIConfig(gc *CLIConf) *CLIConf {
 		runtime.GOMAXPROCS(gc.GoMaxProcs)
 	}
 
+	if gc.PcapFilePath != "" && gc.Threads > maxPcapThreads {
+		log.Warnf("--pcap-file is set, lowering --threads from %d to %d", gc.Threads, maxPcapThreads)
+		gc.Threads = maxPcapThreads
+	}
+
 	// the margin for limit of open files covers different build platforms (linux/darwin), metadata files, or
 	// input and output files etc.
 	// check ulimit if value is high enough and if not, try to fix it
-	ulimitCheck(uint64(gc.Threads + 100))
+	maxSockets := gc.Threads
+	if gc.LookupAllNameServers && gc.AllNSConcurrency > 1 {
+		// each thread's nameservers are queried concurrently, each with its own sockets
+		maxSockets *= gc.AllNSConcurrency
+	}
+	ulimitCheck(uint64(maxSockets + 100))
 
 	if gc.UDPOnly && gc.TCPOnly {
 		log.Fatal("TCP Only and UDP Only are conflicting")
@@ -140,9 +179,12 @@ func populateCLIConfig(gc *CLIConf) *CLIConf {
 	if gc.NameServerMode && gc.MetadataFormat {
 		log.Fatal("Metadata mode is incompatible with name server mode")
 	}
-	if gc.NameServerMode && gc.NameOverride == "" && gc.CLIModule != BINDVERSION {
+	if gc.NameServerMode && gc.NameOverride == "" && gc.CLIModule != BINDVERSION && gc.CLIModule != FINGERPRINT {
 		log.Fatal("Static Name must be defined with --override-name in --name-server-mode unless DNS module does not expect names (e.g., BINDVERSION).")
 	}
+	if gc.NoRecursion && gc.IterativeResolution {
+		log.Warn("--no-recursion has no effect with --iterative, iterative queries never set the RD bit")
+	}
 	// Output Groups are defined by a base + any additional fields that the user wants
 	groups := strings.Split(gc.IncludeInOutput, ",")
 	if gc.ResultVerbosity != "short" && gc.ResultVerbosity != "normal" && gc.ResultVerbosity != "long" && gc.ResultVerbosity != "trace" {
@@ -152,16 +194,179 @@ func populateCLIConfig(gc *CLIConf) *CLIConf {
 	gc.OutputGroups = append(gc.OutputGroups, gc.ResultVerbosity)
 	gc.OutputGroups = append(gc.OutputGroups, groups...)
 
+	switch gc.OutputFormat {
+	case jsonOutputFormat, jsonArrayOutputFormat, msgpackOutputFormat:
+	case csvOutputFormat:
+		if gc.csvEncoder, err = newCSVEncoder(gc.CSVColumns, gc.CSVMultiValue); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal("Invalid output format. Options: json, json-array, msgpack, csv")
+	}
+	// CSV files start with a header row
+	var header string
+	if gc.csvEncoder != nil {
+		header = gc.csvEncoder.header()
+	}
+	// binary formats delimit their own records, so results are written without a trailing newline
+	rawOutput := gc.OutputFormat == msgpackOutputFormat
+	jsonArray := gc.OutputFormat == jsonArrayOutputFormat
+
+	if gc.RequireSecure && !gc.ValidateDNSSEC {
+		log.Fatal("--require-dnssec-secure requires --validate-dnssec")
+	}
+	if gc.OnlyTrusted && !gc.ValidateDNSSEC {
+		log.Fatal("--only-trusted requires --validate-dnssec")
+	}
+	if gc.DNSSECAlgorithms != "" && !gc.ValidateDNSSEC {
+		log.Fatal("--dnssec-allowed-algorithms requires --validate-dnssec")
+	}
+	if gc.TrustAnchorFile != "" && !gc.ValidateDNSSEC {
+		log.Fatal("--trust-anchor-file requires --validate-dnssec")
+	}
+	if gc.ReplaceRootAnchors && gc.TrustAnchorFile == "" {
+		log.Fatal("--replace-root-anchors requires --trust-anchor-file")
+	}
+	if gc.UDPBufferSize < dns.MinMsgSize || gc.UDPBufferSize > dns.MaxMsgSize {
+		log.Fatalf("--udp-buffer-size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	if gc.PadPlaintext && gc.PadQueries == 0 {
+		log.Fatal("--edns-padding-plaintext requires --edns-padding")
+	}
+	if gc.NoRetryServFail && gc.ServFailOtherServer {
+		log.Fatal("--retry-servfail-other-server can't be used with --no-retry-servfail")
+	}
+	if gc.QueryTimeout != 0 && (gc.QueryTimeout < gc.NetworkTimeout || gc.QueryTimeout > gc.Timeout) {
+		log.Fatal("--query-timeout must be between --network-timeout and --timeout")
+	}
+	if gc.ProbeRoots && !gc.IterativeResolution {
+		log.Fatal("--probe-roots is only applicable with --iterative")
+	}
+	if gc.StripOutOfBailiwick && !gc.IterativeResolution {
+		log.Fatal("--strip-out-of-bailiwick is only applicable with --iterative")
+	}
+	if gc.PruneRoots && !gc.ProbeRoots {
+		log.Fatal("--prune-unreachable-roots requires --probe-roots")
+	}
+	if gc.FlushInterval <= 0 {
+		log.Fatal("--flush-interval must be more than 0, use --no-buffer to write each result out as soon as it's ready")
+	}
+	if gc.MaxAnswers < 0 {
+		log.Fatal("--max-answers must be 0 or more")
+	}
+	if gc.MaxTraceEntries < 0 {
+		log.Fatal("--max-trace-entries must be 0 or more")
+	}
+	if gc.BreakerThreshold < 0 {
+		log.Fatal("--circuit-breaker-threshold must be 0 or more")
+	}
+	if gc.BreakerThreshold > 0 && gc.BreakerCooldown < 1 {
+		log.Fatal("--circuit-breaker-cooldown must be at least 1")
+	}
+	if gc.OrderedOutput && gc.OrderedOutputBuffer < 1 {
+		log.Fatal("--ordered-output-buffer must be at least 1")
+	}
+	if gc.ShutdownGracePeriod < 0 {
+		log.Fatal("--shutdown-grace-period must be 0 or more")
+	}
+	if gc.answerTypes, err = newAnswerTypeFilter(gc.AnswerTypes); err != nil {
+		log.Fatal(err)
+	}
+	if gc.answerSelector, err = newAnswerSelector(gc.AnswerSelection, gc.AnswerSelectionSeed); err != nil {
+		log.Fatal(err)
+	}
+	if gc.outputFilter, err = newOutputFilter(gc.OutputFilter); err != nil {
+		log.Fatal(err)
+	}
+	if gc.DedupeInput {
+		gc.lookupCoalescer = new(lookupCoalescer)
+	}
+
 	// setup i/o if not specified
 	if len(GC.Domains) > 0 {
 		// using domains from command line
+		if len(GC.Domains) > argDomainsWarnThreshold {
+			log.Warnf("%d names were passed as arguments and are held in memory until they're looked up, pass large lists with --input-file or on stdin so they're streamed", len(GC.Domains))
+		}
 		gc.InputHandler = iohandlers.NewStringSliceInputHandler(GC.Domains)
 	} else if gc.InputHandler == nil {
-		gc.InputHandler = iohandlers.NewFileInputHandler(gc.InputFilePath)
-	}
-	if gc.OutputHandler == nil {
+		gc.InputHandler = iohandlers.NewFileInputHandler(gc.InputFilePaths, gc.ReportInputFile)
+	}
+	if gc.OutputHandler == nil && rawOutput {
+		gc.OutputHandler = iohandlers.NewRawFileOutputHandler(gc.OutputFilePath)
+	} else if gc.OutputHandler == nil && jsonArray {
+		gc.OutputHandler = iohandlers.NewJSONArrayFileOutputHandler(gc.OutputFilePath)
+	} else if gc.OutputHandler == nil && header != "" {
+		gc.OutputHandler = iohandlers.NewFileOutputHandlerWithHeader(gc.OutputFilePath, header)
+	} else if gc.OutputHandler == nil {
 		gc.OutputHandler = iohandlers.NewFileOutputHandler(gc.OutputFilePath)
 	}
+	if gc.ErrorOutputHandler == nil && gc.ErrorFilePath != "" {
+		if gc.ErrorFilePath == gc.OutputFilePath {
+			log.Fatal("--error-file must be different from --output-file")
+		}
+		switch {
+		case gc.ErrorFilePath == "-" && rawOutput:
+			gc.ErrorOutputHandler = iohandlers.NewRawStreamOutputHandler(os.Stderr)
+		case gc.ErrorFilePath == "-" && jsonArray:
+			gc.ErrorOutputHandler = iohandlers.NewJSONArrayStreamOutputHandler(os.Stderr)
+		case gc.ErrorFilePath == "-" && header != "":
+			gc.ErrorOutputHandler = iohandlers.NewStreamOutputHandlerWithHeader(os.Stderr, header)
+		case gc.ErrorFilePath == "-":
+			gc.ErrorOutputHandler = iohandlers.NewStreamOutputHandler(os.Stderr)
+		case rawOutput:
+			gc.ErrorOutputHandler = iohandlers.NewRawFileOutputHandler(gc.ErrorFilePath)
+		case jsonArray:
+			gc.ErrorOutputHandler = iohandlers.NewJSONArrayFileOutputHandler(gc.ErrorFilePath)
+		case header != "":
+			gc.ErrorOutputHandler = iohandlers.NewFileOutputHandlerWithHeader(gc.ErrorFilePath, header)
+		default:
+			gc.ErrorOutputHandler = iohandlers.NewFileOutputHandler(gc.ErrorFilePath)
+		}
+	}
+	if gc.RetryOutputHandler == nil && gc.RetryFilePath != "" {
+		if gc.NameServerMode {
+			log.Fatal("--retry-file is incompatible with name server mode")
+		}
+		if gc.RetryFilePath == gc.OutputFilePath || gc.RetryFilePath == gc.ErrorFilePath {
+			log.Fatal("--retry-file must be different from --output-file and --error-file")
+		}
+		gc.RetryOutputHandler = iohandlers.NewFileOutputHandler(gc.RetryFilePath)
+	}
+	if gc.TraceFormat != traceFormatJSON && gc.TraceFormat != traceFormatDOT {
+		log.Fatalf("invalid --trace-format %s, options: %s, %s", gc.TraceFormat, traceFormatJSON, traceFormatDOT)
+	}
+	if (gc.TraceFormat == traceFormatDOT) != (gc.TraceFilePath != "") {
+		log.Fatal("--trace-format=dot and --trace-file must be used together")
+	}
+	if gc.TraceOutputHandler == nil && gc.TraceFilePath != "" {
+		if gc.TraceFilePath == gc.OutputFilePath || gc.TraceFilePath == gc.ErrorFilePath || gc.TraceFilePath == gc.RetryFilePath {
+			log.Fatal("--trace-file must be different from --output-file, --error-file and --retry-file")
+		}
+		gc.TraceOutputHandler = iohandlers.NewFileOutputHandler(gc.TraceFilePath)
+	}
+	if gc.SummaryFilePath != "" {
+		if gc.SummaryFilePath == gc.OutputFilePath || gc.SummaryFilePath == gc.ErrorFilePath || gc.SummaryFilePath == gc.RetryFilePath || gc.SummaryFilePath == gc.TraceFilePath {
+			log.Fatal("--summary-file must be different from --output-file, --error-file, --retry-file and --trace-file")
+		}
+		if gc.summarySink, err = newOutputSink(gc.SummaryFilePath, gc.SummaryFormat, gc.SummaryFilter, gc.CSVColumns, gc.CSVMultiValue, gc.SummaryBuffer); err != nil {
+			log.Fatalf("invalid --summary-file options: %v", err)
+		}
+	}
+	// the output handlers buffer results, and write them out every --flush-interval or as they come with --no-buffer
+	flushInterval := time.Duration(gc.FlushInterval) * time.Millisecond
+	if gc.NoBuffer {
+		flushInterval = 0
+	}
+	handlers := []OutputHandler{gc.OutputHandler, gc.ErrorOutputHandler, gc.RetryOutputHandler, gc.TraceOutputHandler}
+	if gc.summarySink != nil {
+		handlers = append(handlers, gc.summarySink.handler)
+	}
+	for _, h := range handlers {
+		if buffered, ok := h.(bufferedOutputHandler); ok {
+			buffered.SetFlushInterval(flushInterval)
+		}
+	}
 	if gc.StatusHandler == nil {
 		gc.StatusHandler = iohandlers.NewStatusHandler(gc.StatusUpdatesFilePath)
 	}
@@ -174,6 +379,7 @@ func populateResolverConfig(gc *CLIConf) *zdns.ResolverConfig {
 	config.TransportMode = zdns.GetTransportMode(gc.UDPOnly, gc.TCPOnly)
 	config.DNSOverHTTPS = gc.DNSOverHTTPS
 	config.DNSOverTLS = gc.DNSOverTLS
+	config.TLSServerName = gc.TLSServerName
 	config.VerifyServerCert = gc.VerifyServerCert
 
 	// Read in the CA file if it exists
@@ -195,25 +401,81 @@ func populateResolverConfig(gc *CLIConf) *zdns.ResolverConfig {
 
 	config.Timeout = time.Second * time.Duration(gc.Timeout)
 	config.NetworkTimeout = time.Second * time.Duration(gc.NetworkTimeout)
+	config.QueryTimeout = time.Second * time.Duration(gc.QueryTimeout)
+	config.UDPRetransmits = gc.UDPRetransmits
+	config.UDPRetransmitInterval = time.Millisecond * time.Duration(gc.UDPRetransmitInterval)
 	config.IterativeTimeout = time.Second * time.Duration(gc.IterationTimeout)
 	config.LookupAllNameServers = gc.LookupAllNameServers
+	config.AllNSConcurrency = gc.AllNSConcurrency
 	config.FollowCNAMEs = !gc.DisableFollowCNAMEs // ZFlags only allows default-false bool flags. We'll invert here.
+	config.QNAMEMinimization = gc.QNAMEMinimization
 
 	if gc.UseNSID {
 		config.EdnsOptions = append(config.EdnsOptions, new(dns.EDNS0_NSID))
 	}
+	if gc.UseExpire {
+		// an empty option asks for the expire time, RFC 7314 section 2
+		config.EdnsOptions = append(config.EdnsOptions, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true})
+	}
 	if gc.ClientSubnet != nil {
 		config.EdnsOptions = append(config.EdnsOptions, gc.ClientSubnet)
 	}
+	for _, options := range gc.EDNSOptions {
+		for _, option := range strings.Split(options, ",") {
+			local, err := parseEDNSOption(option)
+			if err != nil {
+				log.Fatalf("invalid --edns-option: %v", err)
+			}
+			config.EdnsOptions = append(config.EdnsOptions, local)
+		}
+	}
 	config.Cache = new(zdns.Cache)
 	config.Cache.Init(gc.CacheSize)
-	if gc.Verbosity >= 5 {
+	if gc.Verbosity >= 5 || gc.MetadataFilePath != "" {
+		// cache hit rates are part of the metadata summary
 		config.Cache.Stats.CaptureStatistics()
 	}
 	config.Retries = gc.Retries
+	config.RetryBackoff = time.Millisecond * time.Duration(gc.RetryBackoff)
+	config.NoRetryServFail = gc.NoRetryServFail
+	config.ServFailOtherServer = gc.ServFailOtherServer
 	config.MaxDepth = gc.MaxDepth
+	config.MaxCNAMEDepth = gc.MaxCNAMEDepth
 	config.CheckingDisabledBit = gc.CheckingDisabled
+	config.RecursionDisabled = gc.NoRecursion
+	config.Seed = gc.Seed
+	config.StripOutOfBailiwick = gc.StripOutOfBailiwick
+	config.DNSCookies = gc.Cookies
+	config.CompressQueries = !gc.DisableCompression // ZFlags only allows default-false bool flags. We'll invert here.
+	config.EDNSPadding = gc.PadQueries
+	config.UDPBufferSize = uint16(gc.UDPBufferSize)
+	config.EDNSPaddingPlaintext = gc.PadPlaintext
+	config.SeparateUnrelatedAnswers = gc.SeparateUnrelatedAnswers
+	config.DetectCNAMEViolations = gc.DetectCNAMEViolations
+	// responses are only kept in wire format if they're going to be output
+	config.IncludeRawResponse = slices.Contains(gc.OutputGroups, "raw")
+	config.ReportCNAMETargetNXDomain = gc.CNAMETargetNXDomain
 	config.ShouldRecycleSockets = !gc.DisableRecycleSockets
+	config.RandomizeSourcePort = gc.RandomizeSourcePort
+	config.TXTTCPFallback = gc.TXTTCPFallback
+	if gc.MaxQPS > 0 {
+		config.RateLimiter = zdns.NewRateLimiter(gc.MaxQPS)
+	}
+	if gc.MaxQPSPerNameServer > 0 {
+		config.NameServerRateLimiter = zdns.NewNameServerRateLimiter(gc.MaxQPSPerNameServer)
+	}
+	if strategy := zdns.NameServerStrategy(gc.NameServerStrategy); strategy != zdns.NameServerStrategyRandom {
+		selector, err := zdns.NewNameServerSelector(strategy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// shared by every thread's resolver, so lookups are spread across name servers as a whole
+		config.NameServerSelector = selector
+	}
+	if gc.BreakerThreshold > 0 {
+		// shared by every thread's resolver, so one thread's failures keep the others away from the name server too
+		config.NameServerCircuitBreaker = zdns.NewNameServerCircuitBreaker(gc.BreakerThreshold, time.Duration(gc.BreakerCooldown)*time.Second)
+	}
 
 	config.ShouldValidateDNSSEC = gc.ValidateDNSSEC
 	if config.ShouldValidateDNSSEC {
@@ -221,6 +483,31 @@ func populateResolverConfig(gc *CLIConf) *zdns.ResolverConfig {
 		if !gc.IterativeResolution {
 			log.Fatal("DNSSEC validation is only supported with iterative resolution")
 		}
+		for _, section := range strings.Split(gc.DNSSECSections, ",") {
+			config.DNSSECValidateSections = append(config.DNSSECValidateSections, zdns.DNSSECSection(strings.ToLower(strings.TrimSpace(section))))
+		}
+		if gc.DNSSECAlgorithms != "" {
+			algs, err := parseDNSSECAlgorithms(gc.DNSSECAlgorithms)
+			if err != nil {
+				log.Fatalf("Invalid --dnssec-allowed-algorithms: %v", err)
+			}
+			config.DNSSECAllowedAlgorithms = algs
+		}
+		// shared by every thread's resolver so validations of different names wait on the same root/TLD key fetches
+		config.DNSSECFetchGroup = zdns.NewDNSSECFetchGroup(gc.DNSSECFetchLimit)
+		config.DNSSECClockSkew = time.Duration(gc.DNSSECClockSkew) * time.Second
+		if gc.TrustAnchorFile != "" {
+			f, err := os.Open(gc.TrustAnchorFile)
+			if err != nil {
+				log.Fatalf("Could not open trust anchor file: %v", err)
+			}
+			config.TrustAnchors, err = zdns.ParseTrustAnchors(f, gc.TrustAnchorFile)
+			f.Close()
+			if err != nil {
+				log.Fatalf("Could not read trust anchor file %s: %v", gc.TrustAnchorFile, err)
+			}
+			config.ReplaceRootAnchors = gc.ReplaceRootAnchors
+		}
 	} else {
 		config.DNSSecEnabled = gc.Dnssec
 	}
@@ -426,6 +713,24 @@ func populateNameServers(gc *CLIConf, config *zdns.ResolverConfig) (*zdns.Resolv
 
 		return config, nil
 	}
+	if gc.RootHintsFilePath != "" {
+		// User provided root hints, use them to start iteration
+		v4RootServers, v6RootServers, err := zdns.GetRootHints(gc.RootHintsFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not use root hints file: %v", err)
+		}
+		if config.IPVersionMode != zdns.IPv6Only && len(v4RootServers) == 0 {
+			return nil, fmt.Errorf("root hints file (%s) has no IPv4 root servers, use --6 for IPv6-only resolution", gc.RootHintsFilePath)
+		}
+		if config.IPVersionMode != zdns.IPv4Only && len(v6RootServers) == 0 {
+			return nil, fmt.Errorf("root hints file (%s) has no IPv6 root servers, use --4 for IPv4-only resolution", gc.RootHintsFilePath)
+		}
+		config.ExternalNameServersV4 = v4RootServers
+		config.RootNameServersV4 = v4RootServers
+		config.ExternalNameServersV6 = v6RootServers
+		config.RootNameServersV6 = v6RootServers
+		return config, nil
+	}
 	// User did not provide nameservers and we're doing iterative resolution, use ZDNS defaults
 	config.ExternalNameServersV4 = zdns.RootServersV4[:]
 	config.RootNameServersV4 = zdns.RootServersV4[:]
@@ -481,15 +786,45 @@ func populateLocalAddresses(gc *CLIConf, config *zdns.ResolverConfig) (*zdns.Res
 	return config, nil
 }
 
-func Run(gc CLIConf) {
+// ErrInterrupted is returned by Run when the scan was stopped by SIGINT or SIGTERM, after the results of the lookups
+// that finished were written out
+var ErrInterrupted = errors.New("scan interrupted")
+
+func Run(gc CLIConf) error {
 	gc = *populateCLIConfig(&gc)
 	resolverConfig := populateResolverConfig(&gc)
 	// Log any information about the resolver configuration, according to log level
 	resolverConfig.PrintInfo()
+	if gc.PcapFilePath != "" {
+		pcapFile, err := os.OpenFile(gc.PcapFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.DefaultFilePermissions)
+		if err != nil {
+			log.Fatalf("unable to open pcap file (%s): %v", gc.PcapFilePath, err)
+		}
+		defer func(f *os.File) {
+			if closeErr := f.Close(); closeErr != nil {
+				log.Errorf("unable to close pcap file: %v", closeErr)
+			}
+		}(pcapFile)
+		resolverConfig.PcapWriter, err = zdns.NewPcapWriter(pcapFile)
+		if err != nil {
+			log.Fatalf("unable to initialize pcap file: %v", err)
+		}
+	}
+	if gc.CacheFilePath != "" {
+		loadCacheFile(gc.CacheFilePath, resolverConfig.Cache)
+	}
+	if gc.MetricsAddr != "" {
+		gc.lookupMetrics = startMetricsServer(gc.MetricsAddr, resolverConfig)
+	}
 	err := resolverConfig.Validate()
 	if err != nil {
 		log.Fatalf("resolver config did not pass validation: %v", err)
 	}
+	var rootProbes []RootProbe
+	if gc.ProbeRoots {
+		rootProbes = probeRootServers(resolverConfig)
+		reportRootProbes(resolverConfig, rootProbes, gc.PruneRoots)
+	}
 	for _, module := range gc.ActiveModules {
 		// init all modules
 		err = module.CLIInit(&gc, resolverConfig)
@@ -502,11 +837,16 @@ func Run(gc CLIConf) {
 	//	- process until inChan closes, then wg.done()
 	// Once we processing threads have all finished, wait until the
 	// output and metadata threads have completed
+	shutdown := newScanShutdown(time.Duration(gc.ShutdownGracePeriod) * time.Second)
+	defer shutdown.finish()
+	readChan := make(chan string) // lines read by the input handler, passed on to inChan until the scan is interrupted
 	inChan := make(chan string)
 	outChan := make(chan string)
 	metaChan := make(chan routineMetadata, gc.Threads)
 	statusChan := make(chan zdns.Status)
 	var routineWG sync.WaitGroup
+	// the input handler isn't waited for, if the scan is interrupted it's left blocked on the rest of the input
+	var inputWG sync.WaitGroup
 
 	inHandler := gc.InputHandler
 	if inHandler == nil {
@@ -524,18 +864,66 @@ func Run(gc CLIConf) {
 	}
 
 	// Use handlers to populate the input and output/results channel
+	inputWG.Add(1)
 	go func() {
-		if inErr := inHandler.FeedChannel(inChan, &routineWG); inErr != nil {
+		if inErr := inHandler.FeedChannel(readChan, &inputWG); inErr != nil {
 			log.Fatal(fmt.Sprintf("could not feed input channel: %v", inErr))
 		}
 	}()
+	go feedUntilStopped(readChan, inChan, shutdown.stop)
 
 	go func() {
 		if outErr := outHandler.WriteResults(outChan, &routineWG); outErr != nil {
 			log.Fatal(fmt.Sprintf("could not write output results from output channel: %v", outErr))
 		}
 	}()
-	routineWG.Add(2) // input and output handlers
+	routineWG.Add(1) // output handler
+
+	// results with an error status are routed to a separate handler, if one is configured
+	var errorChan chan string
+	if gc.ErrorOutputHandler != nil {
+		errorChan = make(chan string)
+		go func() {
+			if errOutErr := gc.ErrorOutputHandler.WriteResults(errorChan, &routineWG); errOutErr != nil {
+				log.Fatal(fmt.Sprintf("could not write error results from error channel: %v", errOutErr))
+			}
+		}()
+		routineWG.Add(1) // error output handler
+	}
+
+	// names that ended in a transient error are written out so they can be fed back in for a targeted re-run
+	var retryChan chan string
+	if gc.RetryOutputHandler != nil {
+		retryChan = make(chan string)
+		go func() {
+			if retryErr := gc.RetryOutputHandler.WriteResults(retryChan, &routineWG); retryErr != nil {
+				log.Fatal(fmt.Sprintf("could not write retry names from retry channel: %v", retryErr))
+			}
+		}()
+		routineWG.Add(1) // retry output handler
+	}
+
+	// the trace of each lookup is written out as a DOT graph
+	var traceChan chan string
+	if gc.TraceOutputHandler != nil {
+		traceChan = make(chan string)
+		go func() {
+			if traceErr := gc.TraceOutputHandler.WriteResults(traceChan, &routineWG); traceErr != nil {
+				log.Fatal(fmt.Sprintf("could not write traces from trace channel: %v", traceErr))
+			}
+		}()
+		routineWG.Add(1) // trace output handler
+	}
+
+	// results are also fanned out to --summary-file, workers drop them rather than wait if it falls behind
+	if gc.summarySink != nil {
+		go func() {
+			if summaryErr := gc.summarySink.handler.WriteResults(gc.summarySink.records, &routineWG); summaryErr != nil {
+				log.Fatal(fmt.Sprintf("could not write summary results from summary channel: %v", summaryErr))
+			}
+		}()
+		routineWG.Add(1) // summary output handler
+	}
 
 	if !gc.QuietStatusUpdates {
 		go func() {
@@ -546,34 +934,90 @@ func Run(gc CLIConf) {
 		routineWG.Add(1) // status handler
 	}
 
+	// workers send to channels of their own, so the handlers' channels can still be closed if lookups stuck after an
+	// interrupt are abandoned
+	workerOutChan := abandonable(outChan, shutdown.abandon)
+	workerErrorChan := abandonable(errorChan, shutdown.abandon)
+	workerRetryChan := abandonable(retryChan, shutdown.abandon)
+	workerTraceChan := abandonable(traceChan, shutdown.abandon)
+	workerStatusChan := abandonable(statusChan, shutdown.abandon)
+
+	// with --ordered-output, lines are numbered on their way to the workers so results can be put back in input order
+	var sequencer *outputSequencer
+	if gc.OrderedOutput {
+		sequencer = newOutputSequencer(workerOutChan, gc.OrderedOutputBuffer)
+		go sequencer.feed(inChan)
+	}
+
 	// create pool of worker goroutines
 	var lookupWG sync.WaitGroup
 	lookupWG.Add(gc.Threads)
-	startTime := time.Now().Format(gc.TimeFormat)
+	startTime := time.Now()
 	// create shared cache for all threads to share
+	workerSeeds := newWorkerRand(gc.Seed)
 	for i := 0; i < gc.Threads; i++ {
 		i := i
+		seed := workerSeeds.Int63()
 		go func(threadID int) {
-			initWorkerErr := doLookupWorker(&gc, resolverConfig, inChan, outChan, metaChan, statusChan, &lookupWG)
+			initWorkerErr := doLookupWorker(&gc, resolverConfig, seed, inChan, sequencer, workerOutChan, workerErrorChan, workerRetryChan, workerTraceChan, metaChan, workerStatusChan, &lookupWG)
 			if initWorkerErr != nil {
 				log.Fatalf("could not start lookup worker #%d: %v", i, initWorkerErr)
 			}
 		}(i)
 	}
-	lookupWG.Wait()
-	close(outChan)
-	close(metaChan)
-	close(statusChan)
+	workersDone := make(chan struct{})
+	go func() {
+		lookupWG.Wait()
+		close(workersDone)
+	}()
+	abandoned := false
+	select {
+	case <-workersDone:
+	case <-shutdown.abandon:
+		select {
+		case <-workersDone:
+		default:
+			abandoned = true
+		}
+	}
+	if abandoned {
+		// the handlers' channels are closed once abandoned, and workers stuck in lookups never send their metadata, so
+		// only that of the workers which finished is aggregated
+		finished := make(chan routineMetadata, gc.Threads)
+		for len(metaChan) > 0 {
+			finished <- <-metaChan
+		}
+		close(finished)
+		metaChan = finished
+	} else {
+		close(workerOutChan)
+		for _, c := range []chan string{workerErrorChan, workerRetryChan, workerTraceChan} {
+			if c != nil {
+				close(c)
+			}
+		}
+		close(metaChan)
+		close(workerStatusChan)
+	}
+	if gc.summarySink != nil {
+		gc.summarySink.close()
+	}
 	routineWG.Wait()
+	if gc.CacheFilePath != "" {
+		if err = saveCacheFile(gc.CacheFilePath, resolverConfig.Cache); err != nil {
+			log.Errorf("unable to save cache: %v", err)
+		}
+	}
 	if gc.MetadataFilePath != "" {
 		// we're done processing data. aggregate all the data from individual routines
 		metaData := aggregateMetadata(metaChan)
 		if resolverConfig.Cache.Stats.ShouldCaptureStatistics() {
-			// we only capture cache statistics in verbosity=5 to prevent unnecessary overhead
 			metaData.CacheStatistics = resolverConfig.Cache.Stats.GetStatistics()
 		}
-		metaData.StartTime = startTime
+		metaData.NameServerTrips = resolverConfig.NameServerCircuitBreaker.Trips()
+		metaData.StartTime = startTime.Format(gc.TimeFormat)
 		metaData.EndTime = time.Now().Format(gc.TimeFormat)
+		metaData.Duration = time.Since(startTime).Seconds()
 		metaData.NameServers = gc.NameServers
 		metaData.Retries = gc.Retries
 		// Seconds() returns a float. However, timeout is passed in as an integer
@@ -581,55 +1025,90 @@ func Run(gc CLIConf) {
 		// back to an integer here.
 		metaData.Timeout = gc.Timeout
 		metaData.Conf = &gc
-		// add global lookup-related metadata
-		// write out metadata
-		var f *os.File
-		if gc.MetadataFilePath == "-" {
-			f = os.Stderr
-		} else {
-			f, err = os.OpenFile(gc.MetadataFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.DefaultFilePermissions)
-			if err != nil {
-				log.Fatalf("unable to open metadata file: %v", err)
-			}
-			defer func(f *os.File) {
-				err = f.Close()
-				if err != nil {
-					log.Errorf("unable to close metadata file: %v", err)
-				}
-			}(f)
+		metaData.Interrupted = shutdown.interrupted.Load()
+		metaData.RootProbes = rootProbes
+		if gc.summarySink != nil {
+			metaData.SummaryDropped = gc.summarySink.dropped.Load()
 		}
-		j, err := json.Marshal(metaData)
-		if err != nil {
-			log.Fatal("unable to JSON encode metadata:", err.Error())
-		}
-		_, err = f.WriteString(string(j))
+		writeMetadata(gc.MetadataFilePath, &metaData)
+	}
+	if shutdown.interrupted.Load() {
+		return ErrInterrupted
+	}
+	return nil
+}
+
+// writeMetadata writes the JSON encoded metadata to path, or to stderr if path is "-"
+func writeMetadata(path string, metaData *Metadata) {
+	var f *os.File
+	var err error
+	if path == "-" {
+		f = os.Stderr
+	} else {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.DefaultFilePermissions)
 		if err != nil {
-			log.Errorf("unable to write metadata with error: %v", err)
+			log.Fatalf("unable to open metadata file: %v", err)
 		}
+		defer func(f *os.File) {
+			err = f.Close()
+			if err != nil {
+				log.Errorf("unable to close metadata file: %v", err)
+			}
+		}(f)
+	}
+	j, err := json.Marshal(metaData)
+	if err != nil {
+		log.Fatal("unable to JSON encode metadata:", err.Error())
+	}
+	_, err = f.WriteString(string(j))
+	if err != nil {
+		log.Errorf("unable to write metadata with error: %v", err)
 	}
 }
 
 // doLookupWorker is a single worker thread that processes lookups from the input channel. It calls wg.Done when it is finished.
-func doLookupWorker(gc *CLIConf, rc *zdns.ResolverConfig, inputChan <-chan string, outputChan chan<- string, metaChan chan<- routineMetadata, statusChan chan<- zdns.Status, wg *sync.WaitGroup) error {
+// If errorChan is non-nil, results with an error status are sent there instead of outputChan.
+// If retryChan is non-nil, names whose lookups ended in a transient error are sent there as 'name,reason' lines.
+// If traceChan is non-nil, the trace of each lookup is sent there as a DOT graph.
+// If sequencer is non-nil, lines are read from it instead of inputChan and results are handed back to it to be written
+// in input order.
+func doLookupWorker(gc *CLIConf, rc *zdns.ResolverConfig, seed int64, inputChan <-chan string, sequencer *outputSequencer, outputChan, errorChan, retryChan, traceChan chan<- string, metaChan chan<- routineMetadata, statusChan chan<- zdns.Status, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	resolver, err := zdns.InitResolver(rc)
+	resolvers, err := newWorkerResolvers(rc, gc.schemeNameServers, seed)
 	if err != nil {
 		return fmt.Errorf("could not init resolver: %w", err)
 	}
 	var metadata routineMetadata
 	metadata.Status = make(map[zdns.Status]int)
 
-	for line := range inputChan {
-		handleWorkerInput(gc, rc, line, resolver, &metadata, outputChan, statusChan)
+	if sequencer != nil {
+		// each line writes at most one output record, which is handed to the sequencer rather than written directly
+		recordChan := make(chan string, 1)
+		for sl := range sequencer.lines {
+			handleWorkerInput(gc, rc, sl.line, resolvers, &metadata, recordChan, errorChan, retryChan, traceChan, statusChan)
+			var res sequencedResult
+			select {
+			case res.record = <-recordChan:
+				res.hasRecord = true
+			default:
+			}
+			sequencer.done(sl.index, res)
+		}
+	} else {
+		for line := range inputChan {
+			handleWorkerInput(gc, rc, line, resolvers, &metadata, outputChan, errorChan, retryChan, traceChan, statusChan)
+		}
 	}
 	// close the resolver, freeing up resources
-	resolver.Close()
+	metadata.Queries = resolvers.queriesSent()
+	resolvers.close()
 	metaChan <- metadata
 	return nil
 }
 
-func handleWorkerInput(gc *CLIConf, rc *zdns.ResolverConfig, line string, resolver *zdns.Resolver, metadata *routineMetadata, outputChan chan<- string, statusChan chan<- zdns.Status) {
+func handleWorkerInput(gc *CLIConf, rc *zdns.ResolverConfig, line string, resolvers *workerResolvers, metadata *routineMetadata, outputChan, errorChan, retryChan, traceChan chan<- string, statusChan chan<- zdns.Status) {
 	// we'll process each module sequentially, parallelism is per-domain
+	nameStartTime := time.Now()
 	res := zdns.Result{Results: make(map[string]zdns.SingleModuleResult, len(gc.ActiveModules))}
 	// get the fields that won't change for each lookup module
 	rawName := ""
@@ -639,12 +1118,18 @@ func handleWorkerInput(gc *CLIConf, rc *zdns.ResolverConfig, line string, resolv
 	var rank int
 	var entryMetadata string
 	var err error
+	// set if the line can't be looked up as given, every module's lookup then fails with an illegal input status
+	var inputErr error
+	if gc.ReportInputFile {
+		res.InputFile, line = iohandlers.SplitInputFileFromLine(line)
+	}
 	if gc.AlexaFormat {
 		rawName, rank = parseAlexa(line)
 		res.AlexaRank = rank
 	} else if gc.MetadataFormat {
 		rawName, entryMetadata = parseMetadataInputLine(line)
 		res.Metadata = entryMetadata
+		res.Transport, inputErr = parseMetadataTransport(entryMetadata)
 	} else if gc.NameServerMode {
 		nameServers, err = convertNameServerStringToNameServer(line, rc.IPVersionMode, rc.DNSOverTLS, rc.DNSOverHTTPS)
 		if err != nil {
@@ -654,7 +1139,7 @@ func handleWorkerInput(gc *CLIConf, rc *zdns.ResolverConfig, line string, resolv
 			log.Fatal("no name servers found in line: ", line)
 		}
 		// if user provides a domain name for the name server (one.one.one.one) we'll pick one of the IPs at random
-		nameServer = &nameServers[rand.Intn(len(nameServers))]
+		nameServer = &nameServers[resolvers.rand.Intn(len(nameServers))]
 	} else {
 		rawName, nameServerString = parseNormalInputLine(line)
 		if len(nameServerString) != 0 {
@@ -666,10 +1151,36 @@ func handleWorkerInput(gc *CLIConf, rc *zdns.ResolverConfig, line string, resolv
 				log.Fatal("no name servers found in line: ", line)
 			}
 			// if user provides a domain name for the name server (one.one.one.one) we'll pick one of the IPs at random
-			nameServer = &nameServers[rand.Intn(len(nameServers))]
+			nameServer = &nameServers[resolvers.rand.Intn(len(nameServers))]
 		}
 	}
+	// internationalized names are looked up in their punycode form, a name that can't be converted fails every
+	// module's lookup with an illegal input status rather than being sent as-is
+	asciiName, isIDN, idnErr := normalizeIDN(rawName)
+	if isIDN && idnErr == nil {
+		res.UnicodeName = rawName
+		rawName = asciiName
+	} else if idnErr != nil && inputErr == nil {
+		inputErr = idnErr
+	}
 	res.Name = rawName
+	var resolver *zdns.Resolver
+	if res.Transport == "" && nameServer == nil {
+		resolver, err = resolvers.forNameServers()
+	} else {
+		resolver, err = resolvers.forTransport(res.Transport)
+	}
+	if err != nil {
+		// ex. a transport the line asks for that can't be used with the scan's options, only this line fails
+		resolver = resolvers.base
+		if inputErr == nil {
+			inputErr = err
+		}
+	}
+	// whether any module's lookup ended in an error status, used to route the result to the error output
+	hasErrorStatus := false
+	// module:status pairs for lookups that ended in a transient error, written to the retry file
+	var retryReasons []string
 	// handle per-module lookups
 	for moduleName, module := range gc.ActiveModules {
 		var innerRes interface{}
@@ -685,46 +1196,244 @@ func handleWorkerInput(gc *CLIConf, rc *zdns.ResolverConfig, line string, resolv
 		res.Class = dns.Class(gc.Class).String()
 
 		startTime := time.Now()
-		innerRes, trace, status, err = module.Lookup(resolver, lookupName, nameServer)
+		queriesBefore := resolver.QueriesSent()
+		if inputErr != nil {
+			status, err = zdns.StatusIllegalInput, inputErr
+		} else {
+			// with --dedupe-input, a worker looking up a name another worker is already looking up waits for its result
+			key := lookupKey(moduleName, lookupName, nameServer, res.Transport)
+			lookedUp := false
+			l, shared := gc.lookupCoalescer.lookup(key, func() coalescedLookup {
+				var l coalescedLookup
+				l.res, l.trace, l.status, l.err = module.Lookup(resolver, lookupName, nameServer)
+				lookedUp = true
+				return l
+			})
+			innerRes, trace, status, err = l.res, l.trace, l.status, l.err
+			if shared && !lookedUp {
+				metadata.Coalesced++
+			}
+		}
+		// the retry file records the original reason a lookup failed, even if the reported status is remapped
+		retryStatus := status
+		if gc.TimeoutIsError {
+			status, err = timeoutAsError(status, err)
+		}
+		if gc.RequireSecure || gc.OnlyTrusted {
+			status, err = requireDNSSECSecure(status, innerRes, err, gc.OnlyTrusted)
+		}
+		// innerRes may be held by the cache too, so each rewrite of the result below returns a copy rather than modify it
+		if gc.OnlyTrusted && status == zdns.StatusDNSSECNotSecure {
+			innerRes = dropUntrustedRecords(innerRes)
+		}
 
+		elapsed := time.Since(startTime)
 		lookupRes := zdns.SingleModuleResult{
-			Timestamp: time.Now().Format(gc.TimeFormat),
-			Duration:  time.Since(startTime).Seconds(),
+			Timestamp:            time.Now().Format(gc.TimeFormat),
+			Duration:             elapsed.Seconds(),
+			DurationMS:           zdns.DurationMS(elapsed),
+			QueryCount:           resolver.QueriesSent() - queriesBefore,
+			NameServersConsulted: trace.NameServersConsulted(),
+			LameNameServers:      trace.LameNameServers(),
 		}
 		if status != zdns.StatusNoOutput {
 			lookupRes.Status = string(status)
-			lookupRes.Data = innerRes
-			lookupRes.Trace = trace
+			lookupRes.Data = gc.answerSelector.apply(lookupName, innerRes)
+			if gc.ConcatenateTXT {
+				if sqr, ok := lookupRes.Data.(*zdns.SingleQueryResult); ok {
+					lookupRes.Data = zdns.ConcatenateTXTAnswers(sqr)
+				}
+			}
+			lookupRes.Data = gc.answerTypes.apply(lookupRes.Data)
+			lookupRes.Data = truncateAnswers(lookupRes.Data, gc.MaxAnswers)
+			lookupRes.Trace, lookupRes.TraceTruncated = truncateTrace(trace, gc.MaxTraceEntries)
 			if err != nil {
 				lookupRes.Error = err.Error()
 			}
 			res.Results[moduleName] = lookupRes
+			if zdns.IsStatusError(status) {
+				hasErrorStatus = true
+			}
+			if zdns.IsStatusTransientError(retryStatus) {
+				retryReasons = append(retryReasons, moduleName+":"+string(retryStatus))
+			}
 			if !gc.QuietStatusUpdates {
 				statusChan <- status
 			}
 		}
+		if traceChan != nil && len(trace) > 0 {
+			traceChan <- traceToDOT(lookupName, moduleName, trace)
+		}
 		metadata.Status[status]++
 		metadata.Lookups++
+		gc.lookupMetrics.record(moduleName, status, time.Since(startTime))
 	}
-	if len(res.Results) > 0 {
-		v, _ := version.NewVersion("0.0.0")
-		o := &sheriff.Options{
-			Groups:          gc.OutputGroups,
-			ApiVersion:      v,
-			IncludeEmptyTag: true,
-		}
-		data, err := sheriff.Marshal(o, res)
+	// records not matching --filter are dropped, their lookups are still counted in the metadata
+	outputRecord := len(res.Results) > 0 && gc.outputFilter.matches(&res)
+	if outputRecord {
+		record, err := encodeResult(&res, gc.OutputFormat, gc.csvEncoder, gc.OutputGroups)
 		if err != nil {
-			log.Fatalf("unable to marshal result to JSON: %v", err)
+			log.Fatal(err)
 		}
-		cleansedData := replaceIntSliceInterface(data)
-		jsonRes, err := json.Marshal(cleansedData)
-		if err != nil {
-			log.Fatalf("unable to marshal JSON result: %v", err)
+		if errorChan != nil && hasErrorStatus {
+			errorChan <- record
+		} else {
+			outputChan <- record
 		}
-		outputChan <- string(jsonRes)
+	}
+	if len(res.Results) > 0 {
+		gc.summarySink.send(&res, gc.OutputGroups)
+	}
+	if retryChan != nil && len(retryReasons) > 0 {
+		retryChan <- makeRetryLine(rawName, retryReasons)
 	}
 	metadata.Names++
+	metadata.NameLatencies.add(time.Since(nameStartTime))
+}
+
+// truncateAnswers returns the module result data with at most maxAnswers answers, maxAnswers of 0 keeps every answer.
+// The copy's answers are capped to their length, so appending to them can't overwrite those of data.
+func truncateAnswers(data interface{}, maxAnswers int) interface{} {
+	res, ok := data.(*zdns.SingleQueryResult)
+	if !ok || res == nil || maxAnswers <= 0 || len(res.Answers) <= maxAnswers {
+		return data
+	}
+	truncated := *res
+	truncated.Answers = res.Answers[:maxAnswers:maxAnswers]
+	truncated.AnswersTruncated = true
+	return &truncated
+}
+
+// truncateTrace returns the first maxEntries steps of trace and how many steps were left out, maxEntries of 0 keeps
+// every step
+func truncateTrace(trace zdns.Trace, maxEntries int) (zdns.Trace, int) {
+	if maxEntries <= 0 || len(trace) <= maxEntries {
+		return trace, 0
+	}
+	return trace[:maxEntries], len(trace) - maxEntries
+}
+
+// timeoutAsError maps the timeout statuses to the generic error status for --timeout-is-error, noting the timeout in
+// the error. Other statuses are returned unchanged.
+func timeoutAsError(status zdns.Status, err error) (zdns.Status, error) {
+	if status != zdns.StatusTimeout && status != zdns.StatusIterTimeout {
+		return status, err
+	}
+	if err == nil {
+		return zdns.StatusError, fmt.Errorf("lookup timed out (%s)", status)
+	}
+	return zdns.StatusError, fmt.Errorf("lookup timed out (%s): %w", status, err)
+}
+
+// parseEDNSOption parses an --edns-option, CODE:HEXDATA, into an option attached to queries as-is. The data may be empty
+func parseEDNSOption(option string) (*dns.EDNS0_LOCAL, error) {
+	codeString, hexData, _ := strings.Cut(option, ":")
+	code, err := strconv.ParseUint(strings.TrimSpace(codeString), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("option code of %q must be a number between 0 and 65535", option)
+	}
+	data, err := hex.DecodeString(strings.TrimSpace(hexData))
+	if err != nil {
+		return nil, fmt.Errorf("option data of %q must be hex encoded: %w", option, err)
+	}
+	return &dns.EDNS0_LOCAL{Code: uint16(code), Data: data}, nil
+}
+
+// parseDNSSECAlgorithms parses a comma-separated list of DNSSEC algorithm mnemonics (ex. RSASHA256) or numbers
+func parseDNSSECAlgorithms(list string) ([]uint8, error) {
+	var algs []uint8
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if alg, ok := dns.StringToAlgorithm[strings.ToUpper(field)]; ok {
+			algs = append(algs, alg)
+			continue
+		}
+		alg, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unknown DNSSEC algorithm %q", field)
+		}
+		algs = append(algs, uint8(alg))
+	}
+	return algs, nil
+}
+
+// requireDNSSECSecure remaps a successful lookup whose answer DNSSEC validation didn't find Secure to
+// StatusDNSSECNotSecure, with the validation status as the error, for --require-dnssec-secure. With negative, the
+// answers saying the name doesn't exist (NXDOMAIN, CNAME_TARGET_NXDOMAIN) must be Secure too, for --only-trusted.
+func requireDNSSECSecure(status zdns.Status, res interface{}, err error, negative bool) (zdns.Status, error) {
+	prefix := ""
+	switch {
+	case status == zdns.StatusNoError:
+	case negative && (status == zdns.StatusNXDomain || status == zdns.StatusCNAMETargetNXDomain):
+		// the original status is kept in the error, since it's replaced
+		prefix = string(status) + ": "
+	default:
+		return status, err
+	}
+	sqr, ok := res.(*zdns.SingleQueryResult)
+	if !ok || sqr.DNSSECResult == nil {
+		return zdns.StatusDNSSECNotSecure, errors.New(prefix + "answer was not DNSSEC validated")
+	}
+	if sqr.DNSSECResult.Status != zdns.DNSSECSecure {
+		return zdns.StatusDNSSECNotSecure, fmt.Errorf("%sDNSSEC status is %s", prefix, sqr.DNSSECResult.Status)
+	}
+	return status, err
+}
+
+// dropUntrustedRecords returns the result of a lookup whose answer DNSSEC validation didn't find Secure without its
+// records, for --only-trusted. The results of modules that don't return DNS answers aren't validated, so they're
+// dropped entirely. The records are cleared on a copy of the result.
+func dropUntrustedRecords(res interface{}) interface{} {
+	sqr, ok := res.(*zdns.SingleQueryResult)
+	if !ok || sqr == nil {
+		return nil
+	}
+	trusted := *sqr
+	trusted.Answers = nil
+	trusted.Additionals = nil
+	trusted.Authorities = nil
+	trusted.ExtraAnswers = nil
+	return &trusted
+}
+
+// encodeResult encodes res as a record of the given --output-format, csvEnc is used for csv and groups select the
+// fields of the other formats
+func encodeResult(res *zdns.Result, format string, csvEnc *csvEncoder, groups []string) (string, error) {
+	if format == csvOutputFormat {
+		return csvEnc.encode(res), nil
+	}
+	v, _ := version.NewVersion("0.0.0")
+	o := &sheriff.Options{
+		Groups:          groups,
+		ApiVersion:      v,
+		IncludeEmptyTag: true,
+	}
+	data, err := sheriff.Marshal(o, res)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal result to JSON: %w", err)
+	}
+	cleansedData := replaceIntSliceInterface(data)
+	jsonRes, err := json.Marshal(cleansedData)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal JSON result: %w", err)
+	}
+	record, err := encodeOutputRecord(format, jsonRes)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode result as %s: %w", format, err)
+	}
+	return record, nil
+}
+
+// encodeOutputRecord converts a JSON result into a record of the given --output-format
+func encodeOutputRecord(format string, jsonRes []byte) (string, error) {
+	if format != msgpackOutputFormat {
+		return string(jsonRes), nil
+	}
+	record, err := msgpack.FramedFromJSON(jsonRes)
+	if err != nil {
+		return "", err
+	}
+	return string(record), nil
 }
 
 func parseAlexa(line string) (string, int) {
@@ -769,17 +1478,30 @@ func makeName(name, prefix, nameOverride string) (string, bool) {
 	}
 }
 
+// makeRetryLine formats a name and the reasons its lookups failed so the line can be used as input with
+// --metadata-passthrough, ex. "google.com,A:TIMEOUT;AAAA:SERVFAIL"
+func makeRetryLine(name string, reasons []string) string {
+	// modules are looked up in map order, sort so the reason is deterministic
+	sort.Strings(reasons)
+	return name + "," + strings.Join(reasons, ";")
+}
+
 func aggregateMetadata(c <-chan routineMetadata) Metadata {
 	var meta Metadata
+	var nameLatencies latencyHistogram
 	meta.ZDNSVersion = zdns.ZDNSVersion
 	meta.Status = make(map[string]int)
 	for m := range c {
 		meta.Names += m.Names
 		meta.Lookups += m.Lookups
+		meta.Queries += m.Queries
 		for k, v := range m.Status {
 			meta.Status[string(k)] += v
 		}
+		nameLatencies.merge(&m.NameLatencies)
+		meta.CoalescedLookups += m.Coalesced
 	}
+	meta.NameLatency = nameLatencies.summary()
 	return meta
 }
 
@@ -796,8 +1518,20 @@ func convertNameServerStringSliceToNameServers(nameServerStrings []string, mode
 }
 
 func convertNameServerStringToNameServer(inaddr string, mode zdns.IPVersionMode, usingDoT, usingDoH bool) ([]zdns.NameServer, error) {
+	if strings.Contains(inaddr, "%") {
+		// link-local IPv6 address with a zone, ex. fe80::1%eth0 or [fe80::1%eth0]:53
+		ns, err := convertScopedNameServerString(inaddr)
+		if err != nil {
+			return nil, err
+		}
+		ns.PopulateDefaultPort(usingDoT, usingDoH)
+		return []zdns.NameServer{*ns}, nil
+	}
 	host, port, err := util.SplitHostPort(inaddr)
 	if err == nil && host != nil {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d, must be between 1 and 65535: %s", port, inaddr)
+		}
 		return []zdns.NameServer{{IP: host, Port: uint16(port)}}, nil
 	}
 
@@ -811,16 +1545,22 @@ func convertNameServerStringToNameServer(inaddr string, mode zdns.IPVersionMode,
 
 	// may be the domain name of a name server (one.one.one.one)
 	// we'll add these prefixes back on later, stripping so we can detect ports
+	if strings.HasPrefix(inaddr, "http://") {
+		return nil, fmt.Errorf("DNS over HTTPS name servers must use https://: %s", inaddr)
+	}
 	inaddr = strings.TrimPrefix(inaddr, "https://")
-	inaddr = strings.TrimPrefix(inaddr, "http://")
 	domainAndPort := strings.Split(inaddr, ":")
 	port = 0
+	if len(domainAndPort) > 2 {
+		return nil, fmt.Errorf("IPv6 addresses with a port must be bracketed, ex. [2001:db8::1]:53: %s", inaddr)
+	}
 	if len(domainAndPort) == 2 {
 		// domain name with port (one.one.one.one:53)
-		port, err = strconv.Atoi(domainAndPort[1])
+		p, err := parseNameServerPort(domainAndPort[1])
 		if err != nil {
-			return nil, fmt.Errorf("invalid port: %s", inaddr)
+			return nil, fmt.Errorf("%v: %s", err, inaddr)
 		}
+		port = int(p)
 	}
 	ips, err := net.LookupIP(domainAndPort[0])
 	if err != nil {
@@ -839,6 +1579,27 @@ func convertNameServerStringToNameServer(inaddr string, mode zdns.IPVersionMode,
 	return nses, nil
 }
 
+// convertScopedNameServerString parses an IPv6 address carrying a %zone suffix, with or without a port. The port is
+// left unset if not given.
+func convertScopedNameServerString(inaddr string) (*zdns.NameServer, error) {
+	addr, port := inaddr, uint64(0)
+	if host, portString, err := net.SplitHostPort(inaddr); err == nil {
+		addr = host
+		if port, err = strconv.ParseUint(portString, 10, 16); err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port: %s", inaddr)
+		}
+	}
+	ipString, zone, _ := strings.Cut(addr, "%")
+	ip := net.ParseIP(ipString)
+	if ip == nil || !util.IsIPv6(&ip) {
+		return nil, fmt.Errorf("a zone can only be given with an IPv6 address: %s", inaddr)
+	}
+	if zone == "" {
+		return nil, fmt.Errorf("empty zone: %s", inaddr)
+	}
+	return &zdns.NameServer{IP: ip, Port: uint16(port), Zone: zone}, nil
+}
+
 func removeDomainsFromNameServersString(nameServersString string) []string {
 	// User can provide name servers as either IPs, IP+Port, or domain name
 	// For the purposes of determining what IP mode the user's host supports, we'll only consider IPs or IP+Port
@@ -847,8 +1608,14 @@ func removeDomainsFromNameServersString(nameServersString string) []string {
 	nses := strings.Split(nameServersString, ",")
 	ipOnlyNSes := make([]string, 0, len(nses))
 	for _, ns := range nses {
+		// a tls:// or https:// scheme doesn't change the address family of the name server
+		if _, address, found := strings.Cut(ns, schemeSeparator); found {
+			ns = address
+		}
 		if net.ParseIP(ns) != nil {
 			ipOnlyNSes = append(ipOnlyNSes, ns)
+		} else if _, err := convertScopedNameServerString(ns); err == nil {
+			ipOnlyNSes = append(ipOnlyNSes, ns)
 		} else if ip, _, err := net.SplitHostPort(ns); err == nil && net.ParseIP(ip) != nil {
 			ipOnlyNSes = append(ipOnlyNSes, ns)
 		}
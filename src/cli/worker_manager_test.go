@@ -15,9 +15,19 @@
 package cli
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 
 	"github.com/zmap/zdns/src/zdns"
@@ -85,6 +95,28 @@ func TestConvertNameServerStringToNameServer(t *testing.T) {
 	})
 }
 
+func TestConvertScopedNameServerString(t *testing.T) {
+	tests := []struct {
+		nameServerString   string
+		expectedNameServer string
+	}{
+		{"fe80::1%eth0", "[fe80::1%eth0]:53"},
+		{"[fe80::1%eth0]:35", "[fe80::1%eth0]:35"},
+		{"[fe80::1%en0]:853", "[fe80::1%en0]:853"},
+	}
+	for _, test := range tests {
+		nses, err := convertNameServerStringToNameServer(test.nameServerString, zdns.IPv4OrIPv6, false, false)
+		require.Nil(t, err)
+		require.Len(t, nses, 1)
+		require.Equal(t, test.expectedNameServer, nses[0].String())
+		require.Equal(t, "fe80::1", nses[0].IP.String())
+	}
+	for _, bad := range []string{"192.168.0.1%eth0", "fe80::1%", "[fe80::1%eth0]:port", "[fe80::1%eth0]:70000"} {
+		_, err := convertNameServerStringToNameServer(bad, zdns.IPv4OrIPv6, false, false)
+		require.Error(t, err, bad)
+	}
+}
+
 func containsExpectedNameServerStrings(t *testing.T, actualNSes []zdns.NameServer, expectedNameServers []string) {
 	require.Len(t, actualNSes, len(expectedNameServers))
 	currentNS := ""
@@ -154,6 +186,11 @@ func TestRemoveDomainsFromNameServersString(t *testing.T) {
 			input:    "[2001:4860:4860::8888]:53,example.com",
 			expected: []string{"[2001:4860:4860::8888]:53"},
 		},
+		// Test with link-local IPv6 with a zone, with and without a port, and domain
+		{
+			input:    "fe80::1%eth0,example.com,[fe80::2%eth1]:53",
+			expected: []string{"fe80::1%eth0", "[fe80::2%eth1]:53"},
+		},
 	}
 
 	for _, test := range tests {
@@ -163,3 +200,845 @@ func TestRemoveDomainsFromNameServersString(t *testing.T) {
 		})
 	}
 }
+
+// statusModule is a lookup module whose lookups end with the status set for their name, NOERROR by default
+type statusModule struct {
+	statuses map[string]zdns.Status
+}
+
+func (m statusModule) CLIInit(gc *CLIConf, rc *zdns.ResolverConfig) error { return nil }
+func (m statusModule) Help() string                                       { return "" }
+func (m statusModule) GetDescription() string                             { return "" }
+func (m statusModule) Validate(args []string) error                       { return nil }
+func (m statusModule) NewFlags() interface{}                              { return m }
+
+func (m statusModule) Lookup(resolver *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	if status, ok := m.statuses[lookupName]; ok {
+		return nil, nil, status, errors.New("lookup failed")
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusNoError, nil
+}
+
+func TestErrorOutputRouting(t *testing.T) {
+	rc := zdns.NewResolverConfig()
+	rc.RootNameServersV4 = []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}}
+	rc.ExternalNameServersV4 = []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+	rc.LocalAddrsV4 = []net.IP{net.ParseIP("127.0.0.1")}
+	rc.IPVersionMode = zdns.IPv4Only
+	resolvers, err := newWorkerResolvers(rc, nil, 1)
+	require.NoError(t, err)
+	gc := &CLIConf{
+		ActiveModules: map[string]LookupModule{"A": statusModule{statuses: map[string]zdns.Status{"failed.example": zdns.StatusServFail}}},
+		OutputGroups:  []string{"short"},
+	}
+	gc.QuietStatusUpdates = true
+	metadata := routineMetadata{Status: make(map[zdns.Status]int)}
+	outputChan := make(chan string, 2)
+	errorChan := make(chan string, 2)
+
+	handleWorkerInput(gc, rc, "ok.example", resolvers, &metadata, outputChan, errorChan, nil, nil, nil)
+	handleWorkerInput(gc, rc, "failed.example", resolvers, &metadata, outputChan, errorChan, nil, nil, nil)
+	require.Len(t, outputChan, 1)
+	require.Contains(t, <-outputChan, `"ok.example"`)
+	require.Len(t, errorChan, 1)
+	require.Contains(t, <-errorChan, `"failed.example"`)
+
+	// without an error output, failed lookups are written with the others
+	handleWorkerInput(gc, rc, "failed.example", resolvers, &metadata, outputChan, nil, nil, nil, nil)
+	require.Len(t, outputChan, 1)
+	require.Contains(t, <-outputChan, `"failed.example"`)
+}
+
+func TestMakeRetryLine(t *testing.T) {
+	line := makeRetryLine("google.com", []string{"AAAA:SERVFAIL", "A:TIMEOUT"})
+	require.Equal(t, "google.com,A:TIMEOUT;AAAA:SERVFAIL", line)
+	name, metadata := parseMetadataInputLine(line)
+	require.Equal(t, "google.com", name)
+	require.Equal(t, "A:TIMEOUT;AAAA:SERVFAIL", metadata)
+}
+
+func TestAggregateMetadata(t *testing.T) {
+	c := make(chan routineMetadata, 2)
+	var first, second routineMetadata
+	first.Names, first.Lookups, first.Queries = 2, 2, 5
+	first.Status = map[zdns.Status]int{zdns.StatusNoError: 1, zdns.StatusTimeout: 1}
+	first.NameLatencies.add(10 * time.Millisecond)
+	first.NameLatencies.add(20 * time.Millisecond)
+	second.Names, second.Lookups, second.Queries = 1, 1, 3
+	second.Status = map[zdns.Status]int{zdns.StatusNoError: 1}
+	second.NameLatencies.add(3 * time.Second)
+	c <- first
+	c <- second
+	close(c)
+
+	meta := aggregateMetadata(c)
+	require.Equal(t, 3, meta.Names)
+	require.Equal(t, 3, meta.Lookups)
+	require.Equal(t, 8, meta.Queries)
+	require.Equal(t, map[string]int{"NOERROR": 2, "TIMEOUT": 1}, meta.Status)
+	require.NotNil(t, meta.NameLatency)
+	require.InDelta(t, 1.01, meta.NameLatency.Mean, 0.001)
+	require.Equal(t, 3.0, meta.NameLatency.Max)
+	require.Equal(t, 3.0, meta.NameLatency.P99)
+	// percentiles are accurate to within a bucket's width
+	require.InDelta(t, 0.02, meta.NameLatency.P50, 0.02*(latencyBucketGrowth-1))
+
+	empty := make(chan routineMetadata)
+	close(empty)
+	require.Nil(t, aggregateMetadata(empty).NameLatency)
+}
+
+func TestTimeoutAsError(t *testing.T) {
+	status, err := timeoutAsError(zdns.StatusTimeout, nil)
+	require.Equal(t, zdns.StatusError, status)
+	require.EqualError(t, err, "lookup timed out (TIMEOUT)")
+
+	lookupErr := errors.New("cycling lookup failed")
+	status, err = timeoutAsError(zdns.StatusIterTimeout, lookupErr)
+	require.Equal(t, zdns.StatusError, status)
+	require.ErrorIs(t, err, lookupErr)
+	require.Contains(t, err.Error(), "ITERATIVE_TIMEOUT")
+
+	// other statuses are left alone
+	status, err = timeoutAsError(zdns.StatusServFail, lookupErr)
+	require.Equal(t, zdns.StatusServFail, status)
+	require.Equal(t, lookupErr, err)
+	status, err = timeoutAsError(zdns.StatusNoError, nil)
+	require.Equal(t, zdns.StatusNoError, status)
+	require.NoError(t, err)
+}
+
+func TestRequireDNSSECSecure(t *testing.T) {
+	secure := &zdns.SingleQueryResult{DNSSECResult: &zdns.DNSSECResult{Status: zdns.DNSSECSecure}}
+	status, err := requireDNSSECSecure(zdns.StatusNoError, secure, nil, false)
+	require.Equal(t, zdns.StatusNoError, status)
+	require.NoError(t, err)
+
+	bogus := &zdns.SingleQueryResult{DNSSECResult: &zdns.DNSSECResult{Status: zdns.DNSSECBogus}}
+	status, err = requireDNSSECSecure(zdns.StatusNoError, bogus, nil, false)
+	require.Equal(t, zdns.StatusDNSSECNotSecure, status)
+	require.EqualError(t, err, "DNSSEC status is Bogus")
+
+	// no validation result to go on
+	status, err = requireDNSSECSecure(zdns.StatusNoError, &zdns.SingleQueryResult{}, nil, false)
+	require.Equal(t, zdns.StatusDNSSECNotSecure, status)
+	require.Error(t, err)
+	status, _ = requireDNSSECSecure(zdns.StatusNoError, &zdns.IPResult{}, nil, false)
+	require.Equal(t, zdns.StatusDNSSECNotSecure, status)
+
+	// failed lookups keep their status
+	status, err = requireDNSSECSecure(zdns.StatusNXDomain, bogus, nil, false)
+	require.Equal(t, zdns.StatusNXDomain, status)
+	require.NoError(t, err)
+
+	// with --only-trusted, so must denials of existence
+	for _, denial := range []zdns.Status{zdns.StatusNXDomain, zdns.StatusCNAMETargetNXDomain} {
+		status, err = requireDNSSECSecure(denial, bogus, nil, true)
+		require.Equal(t, zdns.StatusDNSSECNotSecure, status)
+		require.EqualError(t, err, string(denial)+": DNSSEC status is Bogus")
+		status, err = requireDNSSECSecure(denial, secure, nil, true)
+		require.Equal(t, denial, status)
+		require.NoError(t, err)
+	}
+	status, _ = requireDNSSECSecure(zdns.StatusServFail, bogus, nil, true)
+	require.Equal(t, zdns.StatusServFail, status)
+}
+
+func TestDropUntrustedRecords(t *testing.T) {
+	a := zdns.Answer{Name: "example.com", RrType: dns.TypeA, Type: "A", Answer: "192.0.2.1"}
+	bogus := &zdns.SingleQueryResult{
+		Answers:      []interface{}{a},
+		Authorities:  []interface{}{a},
+		Additionals:  []interface{}{a},
+		Protocol:     "udp",
+		DNSSECResult: &zdns.DNSSECResult{Status: zdns.DNSSECBogus},
+	}
+	trusted := dropUntrustedRecords(bogus).(*zdns.SingleQueryResult)
+	require.Empty(t, trusted.Answers)
+	require.Empty(t, trusted.Authorities)
+	require.Empty(t, trusted.Additionals)
+	require.Equal(t, "udp", trusted.Protocol)
+	require.Equal(t, zdns.DNSSECBogus, trusted.DNSSECResult.Status, "the validation result is kept")
+	require.Len(t, bogus.Answers, 1, "the result itself isn't modified")
+
+	require.Nil(t, dropUntrustedRecords(&zdns.IPResult{IPv4Addresses: []string{"192.0.2.1"}}))
+}
+
+func TestParseMetadataTransport(t *testing.T) {
+	tests := []struct {
+		metadata  string
+		transport string
+		wantErr   bool
+	}{
+		{metadata: "", transport: ""},
+		{metadata: "A:TIMEOUT;AAAA:SERVFAIL", transport: ""},
+		{metadata: "transport=tcp", transport: tcpTransport},
+		{metadata: "A:TIMEOUT;transport=TLS", transport: tlsTransport},
+		{metadata: "transport=udp;A:TIMEOUT", transport: udpTransport},
+		{metadata: "transport=https", wantErr: true},
+	}
+	for _, test := range tests {
+		transport, err := parseMetadataTransport(test.metadata)
+		if test.wantErr {
+			require.Error(t, err, test.metadata)
+			continue
+		}
+		require.NoError(t, err, test.metadata)
+		require.Equal(t, test.transport, transport, test.metadata)
+	}
+}
+
+func TestTransportResolverConfig(t *testing.T) {
+	rc := zdns.NewResolverConfig()
+	rc.DNSOverHTTPS = true
+	rc.ExternalNameServersV4 = []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 53}, {IP: net.ParseIP("8.8.8.8"), Port: 5353}}
+
+	tcp := transportResolverConfig(rc, tcpTransport)
+	require.Equal(t, zdns.TCPOnly, tcp.TransportMode)
+	require.False(t, tcp.DNSOverHTTPS)
+	require.False(t, tcp.DNSOverTLS)
+	require.Equal(t, rc.ExternalNameServersV4, tcp.ExternalNameServersV4)
+
+	tls := transportResolverConfig(rc, tlsTransport)
+	require.True(t, tls.DNSOverTLS)
+	require.Equal(t, uint16(853), tls.ExternalNameServersV4[0].Port, "name servers on the DNS port move to the DoT port")
+	require.Equal(t, uint16(5353), tls.ExternalNameServersV4[1].Port, "explicit ports are kept")
+	require.Equal(t, uint16(53), rc.ExternalNameServersV4[0].Port, "the original config is unchanged")
+	require.True(t, rc.DNSOverHTTPS)
+
+	// with --tls, a line asking for plain DNS goes back to the DNS port
+	rc = zdns.NewResolverConfig()
+	rc.DNSOverTLS = true
+	rc.ExternalNameServersV4 = []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 853}, {IP: net.ParseIP("8.8.8.8"), Port: 5353}}
+	for _, transport := range []string{udpTransport, tcpTransport} {
+		plain := transportResolverConfig(rc, transport)
+		require.False(t, plain.DNSOverTLS)
+		require.Equal(t, uint16(53), plain.ExternalNameServersV4[0].Port, "name servers on the DoT port move to the DNS port")
+		require.Equal(t, uint16(5353), plain.ExternalNameServersV4[1].Port, "explicit ports are kept")
+	}
+	require.Equal(t, uint16(853), rc.ExternalNameServersV4[0].Port, "the original config is unchanged")
+}
+
+func TestParseNameServerEntry(t *testing.T) {
+	tests := []struct {
+		entry     string
+		transport string
+		address   string
+	}{
+		{"1.1.1.1:5353", "", "1.1.1.1:5353"},
+		{"[2001:db8::1]:53", "", "[2001:db8::1]:53"},
+		{"2001:db8::1", "", "2001:db8::1"},
+		{" dns.google:53 ", "", "dns.google:53"},
+		{"tls://1.1.1.1", tlsTransport, "1.1.1.1"},
+		{"TLS://[2001:db8::1]:8853", tlsTransport, "[2001:db8::1]:8853"},
+		{"https://dns.google", httpsTransport, "dns.google"},
+		{"https://cloudflare-dns.com/dns-query", httpsTransport, "cloudflare-dns.com"},
+	}
+	for _, test := range tests {
+		entry, err := parseNameServerEntry(test.entry)
+		require.NoError(t, err, test.entry)
+		require.Equal(t, test.transport, entry.transport, test.entry)
+		require.Equal(t, test.address, entry.address, test.entry)
+	}
+	for _, bad := range []string{"", "udp://1.1.1.1", "http://dns.google", "https://1.1.1.1", "https://dns.google/resolve",
+		"1.1.1.1:0", "1.1.1.1:65536", "1.1.1.1:dns", "2001:db8::1:53:", "[2001:db8::1]", "[1.1.1.1]:53", "1.1.1.556", "tls://"} {
+		_, err := parseNameServerEntry(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSplitNameServersBySchemes(t *testing.T) {
+	parse := func(entries ...string) []nameServerEntry {
+		parsed := make([]nameServerEntry, 0, len(entries))
+		for _, entry := range entries {
+			e, err := parseNameServerEntry(entry)
+			require.NoError(t, err)
+			parsed = append(parsed, e)
+		}
+		return parsed
+	}
+	t.Run("Mixed schemes", func(t *testing.T) {
+		gc := &CLIConf{}
+		require.NoError(t, splitNameServersBySchemes(gc, parse("1.1.1.1:5353", "tls://8.8.8.8", "[2001:db8::1]:53", "tls://[2001:db8::2]:8853")))
+		require.Equal(t, []string{"1.1.1.1:5353", "[2001:db8::1]:53"}, gc.NameServers)
+		require.False(t, gc.DNSOverTLS)
+		tlsNameServers := gc.schemeNameServers[tlsTransport]
+		require.Len(t, tlsNameServers, 2)
+		require.Equal(t, "8.8.8.8:853", tlsNameServers[0].String())
+		require.Equal(t, "[2001:db8::2]:8853", tlsNameServers[1].String())
+	})
+	t.Run("Single scheme sets the transport", func(t *testing.T) {
+		gc := &CLIConf{}
+		require.NoError(t, splitNameServersBySchemes(gc, parse("tls://1.1.1.1", "tls://8.8.8.8:8853")))
+		require.True(t, gc.DNSOverTLS)
+		require.Equal(t, []string{"1.1.1.1", "8.8.8.8:8853"}, gc.NameServers)
+		require.Empty(t, gc.schemeNameServers)
+	})
+	t.Run("Entries matching the transport flag", func(t *testing.T) {
+		gc := &CLIConf{NetworkOptions: NetworkOptions{DNSOverTLS: true}}
+		require.NoError(t, splitNameServersBySchemes(gc, parse("1.1.1.1", "tls://8.8.8.8")))
+		require.Equal(t, []string{"1.1.1.1", "8.8.8.8"}, gc.NameServers)
+		require.Empty(t, gc.schemeNameServers)
+	})
+	t.Run("No entry for the transport flag", func(t *testing.T) {
+		gc := &CLIConf{NetworkOptions: NetworkOptions{DNSOverHTTPS: true}}
+		require.Error(t, splitNameServersBySchemes(gc, parse("tls://8.8.8.8")))
+	})
+	t.Run("Schemes with iterative", func(t *testing.T) {
+		gc := &CLIConf{}
+		gc.IterativeResolution = true
+		require.Error(t, splitNameServersBySchemes(gc, parse("tls://8.8.8.8")))
+	})
+}
+
+func TestSchemeResolverConfig(t *testing.T) {
+	rc := zdns.NewResolverConfig()
+	rc.IPVersionMode = zdns.IPv4Only
+	rc.ExternalNameServersV4 = []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 53}}
+	nameServers := []zdns.NameServer{{IP: net.ParseIP("8.8.8.8"), Port: 853}, {IP: net.ParseIP("2001:db8::1"), Port: 853}}
+
+	tls := schemeResolverConfig(rc, tlsTransport, nameServers)
+	require.True(t, tls.DNSOverTLS)
+	require.Equal(t, nameServers[:1], tls.ExternalNameServersV4)
+	require.Equal(t, nameServers[:1], tls.RootNameServersV4)
+	require.Empty(t, tls.ExternalNameServersV6, "IPv6 name servers are dropped in IPv4 only mode")
+	require.Equal(t, uint16(53), rc.ExternalNameServersV4[0].Port, "the original config is unchanged")
+}
+
+func TestAnswerSelector(t *testing.T) {
+	a := func(rrType uint16, addr string) zdns.Answer {
+		return zdns.Answer{Name: "example.com", RrType: rrType, Type: dns.TypeToString[rrType], Answer: addr}
+	}
+	cname := zdns.Answer{Name: "www.example.com", RrType: dns.TypeCNAME, Type: "CNAME", Answer: "example.com."}
+	res := &zdns.SingleQueryResult{Answers: []interface{}{
+		cname, a(dns.TypeA, "192.0.2.9"), a(dns.TypeA, "192.0.2.10"), a(dns.TypeA, "192.0.2.3"),
+	}}
+
+	s, err := newAnswerSelector(answerSelectionAll, 0)
+	require.NoError(t, err)
+	require.Same(t, res, s.apply("www.example.com", res))
+
+	s, err = newAnswerSelector(answerSelectionFirst, 0)
+	require.NoError(t, err)
+	selected := s.apply("www.example.com", res).(*zdns.SingleQueryResult)
+	require.Equal(t, []interface{}{cname, a(dns.TypeA, "192.0.2.9")}, selected.Answers)
+	require.Len(t, res.Answers, 4, "the original result may be cached and must not change")
+
+	s, err = newAnswerSelector(answerSelectionLowest, 0)
+	require.NoError(t, err)
+	selected = s.apply("www.example.com", res).(*zdns.SingleQueryResult)
+	require.Equal(t, []interface{}{cname, a(dns.TypeA, "192.0.2.3")}, selected.Answers)
+
+	// the same seed picks the same address every time
+	s, err = newAnswerSelector(answerSelectionRandom, 42)
+	require.NoError(t, err)
+	ips := &zdns.IPResult{IPv4Addresses: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, IPv6Addresses: []string{"2001:db8::1"}}
+	first := s.apply("example.com", ips).(*zdns.IPResult)
+	require.Len(t, first.IPv4Addresses, 1)
+	require.Equal(t, []string{"2001:db8::1"}, first.IPv6Addresses)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, first, s.apply("example.com", ips))
+	}
+
+	_, err = newAnswerSelector("middle", 0)
+	require.Error(t, err)
+}
+
+func TestTruncateTrace(t *testing.T) {
+	trace := zdns.Trace{{Layer: "."}, {Layer: "com"}, {Layer: "example.com"}}
+	truncated, dropped := truncateTrace(trace, 0)
+	require.Equal(t, trace, truncated)
+	require.Zero(t, dropped)
+	truncated, dropped = truncateTrace(trace, 3)
+	require.Equal(t, trace, truncated)
+	require.Zero(t, dropped)
+	truncated, dropped = truncateTrace(trace, 2)
+	require.Equal(t, trace[:2], truncated)
+	require.Equal(t, 1, dropped)
+}
+
+func TestTruncateAnswers(t *testing.T) {
+	res := &zdns.SingleQueryResult{Answers: []interface{}{
+		zdns.Answer{Type: "TXT", Answer: "a"}, zdns.Answer{Type: "TXT", Answer: "b"}, zdns.Answer{Type: "TXT", Answer: "c"},
+	}}
+	require.Same(t, res, truncateAnswers(res, 0))
+	require.Same(t, res, truncateAnswers(res, 3))
+
+	truncated := truncateAnswers(res, 2).(*zdns.SingleQueryResult)
+	require.Equal(t, res.Answers[:2], truncated.Answers)
+	require.True(t, truncated.AnswersTruncated)
+	require.Len(t, res.Answers, 3, "the original result may be cached and isn't modified")
+	require.False(t, res.AnswersTruncated)
+
+	ipRes := &zdns.IPResult{IPv4Addresses: []string{"192.0.2.1", "192.0.2.2"}}
+	require.Same(t, ipRes, truncateAnswers(ipRes, 1))
+}
+
+func TestAnswerTypeFilter(t *testing.T) {
+	f, err := newAnswerTypeFilter("")
+	require.NoError(t, err)
+	require.Nil(t, f)
+	_, err = newAnswerTypeFilter("A,NOTATYPE")
+	require.Error(t, err)
+
+	cname := zdns.Answer{Name: "www.example.com", RrType: dns.TypeCNAME, Type: "CNAME", Answer: "example.com."}
+	a := zdns.Answer{Name: "example.com", RrType: dns.TypeA, Type: "A", Answer: "192.0.2.1"}
+	aaaa := zdns.Answer{Name: "example.com", RrType: dns.TypeAAAA, Type: "AAAA", Answer: "2001:db8::1"}
+	rrsig := zdns.RRSIGAnswer{Answer: zdns.Answer{Name: "example.com", RrType: dns.TypeRRSIG, Type: "RRSIG"}, TypeCovered: dns.TypeA}
+	res := &zdns.SingleQueryResult{Answers: []interface{}{cname, a, rrsig, aaaa}}
+	require.Same(t, res, answerTypeFilter(nil).apply(res))
+
+	f, err = newAnswerTypeFilter("a, aaaa")
+	require.NoError(t, err)
+	filtered := f.apply(res).(*zdns.SingleQueryResult)
+	require.Equal(t, []interface{}{a, aaaa}, filtered.Answers)
+	require.Len(t, res.Answers, 4, "the original result may be cached and isn't modified")
+
+	ipRes := &zdns.IPResult{IPv4Addresses: []string{"192.0.2.1"}}
+	require.Same(t, ipRes, f.apply(ipRes))
+}
+
+func TestCSVEncoder(t *testing.T) {
+	res := &zdns.Result{
+		Name: "example.com",
+		Results: map[string]zdns.SingleModuleResult{
+			"A": {
+				Status: string(zdns.StatusNoError),
+				Data: &zdns.SingleQueryResult{
+					Resolver: "192.0.2.53:53",
+					Answers: []interface{}{
+						zdns.Answer{Name: "example.com", RrType: dns.TypeA, TTL: 300, Answer: "192.0.2.1"},
+						zdns.Answer{Name: "example.com", RrType: dns.TypeA, TTL: 60, Answer: "192.0.2.2"},
+					},
+				},
+			},
+		},
+	}
+	joined, err := newCSVEncoder("name,status,resolver,answers,ttl", csvMultiValueJoin)
+	require.NoError(t, err)
+	require.Equal(t, "name,status,resolver,answers,ttl", joined.header())
+	require.Equal(t, "example.com,NOERROR,192.0.2.53:53,192.0.2.1;192.0.2.2,60", joined.encode(res))
+
+	rows, err := newCSVEncoder("name, answers", csvMultiValueRows)
+	require.NoError(t, err)
+	require.Equal(t, "example.com,192.0.2.1\nexample.com,192.0.2.2", rows.encode(res))
+
+	_, err = newCSVEncoder("name,bogus", csvMultiValueJoin)
+	require.Error(t, err)
+	_, err = newCSVEncoder("name", "bogus")
+	require.Error(t, err)
+}
+
+func TestCSVEncoderEscapesCells(t *testing.T) {
+	res := &zdns.Result{
+		Name: `odd,"name"`,
+		Results: map[string]zdns.SingleModuleResult{
+			"NSLOOKUP": {
+				Status: string(zdns.StatusNoError),
+				Data: &zdns.NSResult{Servers: []zdns.NSRecord{
+					{Name: "ns1.example.com", TTL: 3600},
+					{Name: "ns2.example.com", TTL: 7200},
+				}},
+			},
+		},
+	}
+	e, err := newCSVEncoder("name,module,answers,ttl", csvMultiValueJoin)
+	require.NoError(t, err)
+	require.Equal(t, `"odd,""name""",NSLOOKUP,ns1.example.com;ns2.example.com,3600`, e.encode(res))
+}
+
+func TestCacheFileSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zdns.cache")
+	q := zdns.Question{Type: dns.TypeA, Class: dns.ClassINET, Name: "example.com"}
+	res := zdns.SingleQueryResult{
+		Answers: []interface{}{zdns.Answer{TTL: 3600, Type: "A", RrType: dns.TypeA, RrClass: dns.ClassINET, Name: "example.com", Answer: "192.0.2.1"}},
+		Flags:   zdns.DNSFlags{Authoritative: true},
+	}
+
+	// a missing file starts an empty cache
+	cache := new(zdns.Cache)
+	cache.Init(100)
+	loadCacheFile(path, cache)
+	cache.SafeAddCachedAnswer(q, &res, nil, "example.com", 0, false)
+	require.NoError(t, saveCacheFile(path, cache))
+	_, err := os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err), "temporary file should be renamed over the cache file")
+
+	restarted := new(zdns.Cache)
+	restarted.Init(100)
+	loadCacheFile(path, restarted)
+	cached, found := restarted.GetCachedResults(q, nil, 0)
+	require.True(t, found)
+	require.Equal(t, []interface{}{res.Answers[0]}, cached.Answers)
+}
+
+func TestTraceToDOT(t *testing.T) {
+	trace := zdns.Trace{
+		{
+			Name: "example.com", DNSType: dns.TypeA, Layer: ".", NameServer: "198.41.0.4:53", Try: 1,
+			Result: zdns.SingleQueryResult{
+				Authorities: []interface{}{zdns.Answer{RrType: dns.TypeNS, Name: "com.", Answer: "a.gtld-servers.net."}},
+				Additionals: []interface{}{zdns.Answer{RrType: dns.TypeA, Name: "a.gtld-servers.net.", Answer: "192.5.6.30"}},
+			},
+		},
+		{
+			Name: "example.com", DNSType: dns.TypeA, Layer: "com", NameServer: "192.5.6.30:53", Try: 1, Cached: true,
+			Result: zdns.SingleQueryResult{
+				Answers: []interface{}{zdns.Answer{RrType: dns.TypeA, Name: "example.com.", Answer: "192.0.2.1"}},
+			},
+		},
+	}
+	require.Equal(t, `digraph "example.com A" {
+  label="example.com (A)";
+  "zone ." [shape=box, label="."];
+  "ns 198.41.0.4:53" [label="198.41.0.4:53"];
+  "zone ." -> "ns 198.41.0.4:53" [label="try 1"];
+  "zone com" [shape=box, label="com"];
+  "ns 198.41.0.4:53" -> "zone com" [label="referral"];
+  "ns 192.5.6.30:53" [label="a.gtld-servers.net\n192.5.6.30:53"];
+  "zone com" -> "ns 192.5.6.30:53" [label="try 1", style=dashed];
+  "question example.com A" [shape=ellipse, style=filled, label="example.com A"];
+  "ns 192.5.6.30:53" -> "question example.com A" [label="NOERROR, 1 answer", style=dashed];
+}`, traceToDOT("example.com", "A", trace))
+}
+
+func TestDOTQuote(t *testing.T) {
+	require.Equal(t, `"a \"quoted\" \\ name\nnext"`, dotQuote("a \"quoted\" \\ name\nnext"))
+}
+
+func TestOutputSequencerRestoresInputOrder(t *testing.T) {
+	out := make(chan string, 10)
+	seq := newOutputSequencer(out, 10)
+	in := make(chan string, 4)
+	for _, line := range []string{"a", "b", "c", "d"} {
+		in <- line
+	}
+	close(in)
+	go seq.feed(in)
+	var lines []sequencedLine
+	for sl := range seq.lines {
+		lines = append(lines, sl)
+	}
+	require.Len(t, lines, 4)
+
+	// finish out of order, the lookup of "c" producing no output
+	seq.done(lines[3].index, sequencedResult{record: "d", hasRecord: true})
+	seq.done(lines[1].index, sequencedResult{record: "b", hasRecord: true})
+	require.Empty(t, out, "nothing can be written before the first line finishes")
+	seq.done(lines[0].index, sequencedResult{record: "a", hasRecord: true})
+	require.Equal(t, "a", <-out)
+	require.Equal(t, "b", <-out)
+	require.Empty(t, out)
+	seq.done(lines[2].index, sequencedResult{})
+	require.Equal(t, "d", <-out)
+	require.Empty(t, out)
+}
+
+func TestOutputSequencerBoundsLinesInFlight(t *testing.T) {
+	out := make(chan string, 10)
+	seq := newOutputSequencer(out, 2)
+	in := make(chan string, 3)
+	in <- "a"
+	in <- "b"
+	in <- "c"
+	close(in)
+	go seq.feed(in)
+	first, second := <-seq.lines, <-seq.lines
+	select {
+	case sl := <-seq.lines:
+		t.Fatalf("line %q handed out while the buffer was full", sl.line)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the later line finishing doesn't make room, the oldest one does
+	seq.done(second.index, sequencedResult{record: "b", hasRecord: true})
+	select {
+	case sl := <-seq.lines:
+		t.Fatalf("line %q handed out while the buffer was full", sl.line)
+	case <-time.After(50 * time.Millisecond):
+	}
+	seq.done(first.index, sequencedResult{record: "a", hasRecord: true})
+	third := <-seq.lines
+	require.Equal(t, "c", third.line)
+	seq.done(third.index, sequencedResult{record: "c", hasRecord: true})
+	require.Equal(t, []string{"a", "b", "c"}, []string{<-out, <-out, <-out})
+}
+
+func TestOutputFilter(t *testing.T) {
+	f, err := newOutputFilter("")
+	require.NoError(t, err)
+	require.Nil(t, f, "an empty filter outputs every record")
+	require.True(t, f.matches(&zdns.Result{}))
+
+	a := zdns.Answer{Name: "example.com", RrType: dns.TypeA, Type: "A", Answer: "192.0.2.1"}
+	cname := zdns.Answer{Name: "www.example.com", RrType: dns.TypeCNAME, Type: "CNAME", Answer: "example.com."}
+	result := func(status zdns.Status, answers ...interface{}) *zdns.Result {
+		return &zdns.Result{Results: map[string]zdns.SingleModuleResult{
+			"A": {Status: string(status), Data: &zdns.SingleQueryResult{Answers: answers}},
+		}}
+	}
+	f, err = newOutputFilter("status==NOERROR && answers.a>=1 || status == SERVFAIL")
+	require.NoError(t, err)
+	require.True(t, f.matches(result(zdns.StatusNoError, cname, a)))
+	require.False(t, f.matches(result(zdns.StatusNoError, cname)), "no A records")
+	require.True(t, f.matches(result(zdns.StatusServFail)))
+	require.False(t, f.matches(result(zdns.StatusNXDomain)))
+
+	f, err = newOutputFilter("status!=noerror")
+	require.NoError(t, err)
+	require.False(t, f.matches(result(zdns.StatusNoError, a)))
+	require.True(t, f.matches(result(zdns.StatusTimeout)))
+
+	f, err = newOutputFilter("answers.AAAA>0")
+	require.NoError(t, err)
+	require.True(t, f.matches(&zdns.Result{Results: map[string]zdns.SingleModuleResult{
+		"ALOOKUP": {Status: string(zdns.StatusNoError), Data: &zdns.IPResult{IPv6Addresses: []string{"2001:db8::1"}}},
+	}}))
+
+	for _, expr := range []string{"status>NOERROR", "answers.NOTATYPE>0", "answers>=one", "ttl>60", "status==NOERROR &&"} {
+		_, err = newOutputFilter(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestOutputSink(t *testing.T) {
+	s, err := newOutputSink("-", csvOutputFormat, "status==NOERROR", "name,status", "join", 1)
+	require.NoError(t, err)
+	result := func(name string, status zdns.Status) *zdns.Result {
+		return &zdns.Result{Name: name, Results: map[string]zdns.SingleModuleResult{"A": {Status: string(status)}}}
+	}
+	s.send(result("example.com", zdns.StatusServFail), nil)
+	require.Empty(t, s.records, "records not matching the filter aren't written")
+	s.send(result("example.com", zdns.StatusNoError), nil)
+	s.send(result("example.net", zdns.StatusNoError), nil)
+	require.Equal(t, uint64(1), s.dropped.Load(), "the buffer holds a single record, the second is dropped")
+	require.Equal(t, "example.com,NOERROR", <-s.records)
+
+	s.close()
+	s.send(result("example.org", zdns.StatusNoError), nil)
+	_, ok := <-s.records
+	require.False(t, ok, "records sent once the sink is closed are discarded")
+
+	_, err = newOutputSink("-", "xml", "", "", "", 1)
+	require.Error(t, err)
+	_, err = newOutputSink("-", jsonOutputFormat, "", "", "", 0)
+	require.Error(t, err)
+}
+
+func TestNormalizeIDN(t *testing.T) {
+	name, isIDN, err := normalizeIDN("example.com")
+	require.NoError(t, err)
+	require.False(t, isIDN)
+	require.Equal(t, "example.com", name)
+
+	for input, expected := range map[string]string{
+		"münchen.de":         "xn--mnchen-3ya.de",
+		"MÜNCHEN.de.":        "xn--mnchen-3ya.de.",
+		"_dmarc.bücher.test": "_dmarc.xn--bcher-kva.test",
+	} {
+		name, isIDN, err = normalizeIDN(input)
+		require.NoError(t, err, input)
+		require.True(t, isIDN)
+		require.Equal(t, expected, name)
+	}
+
+	// a label mixing left-to-right and right-to-left characters fails the bidi rule
+	_, isIDN, err = normalizeIDN("aא.example")
+	require.True(t, isIDN)
+	require.Error(t, err)
+}
+
+func TestParseDNSSECAlgorithms(t *testing.T) {
+	algs, err := parseDNSSECAlgorithms("RSASHA256, ecdsap256sha256,15")
+	require.NoError(t, err)
+	require.Equal(t, []uint8{dns.RSASHA256, dns.ECDSAP256SHA256, dns.ED25519}, algs)
+
+	_, err = parseDNSSECAlgorithms("RSASHA256,NOTANALG")
+	require.ErrorContains(t, err, "NOTANALG")
+	_, err = parseDNSSECAlgorithms("256")
+	require.Error(t, err)
+}
+
+func TestParseEDNSOption(t *testing.T) {
+	option, err := parseEDNSOption("65001:CAfe")
+	require.NoError(t, err)
+	require.Equal(t, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{0xca, 0xfe}}, option)
+
+	option, err = parseEDNSOption("65002:")
+	require.NoError(t, err)
+	require.Equal(t, uint16(65002), option.Code)
+	require.Empty(t, option.Data)
+
+	for _, invalid := range []string{"65536:00", "code:00", "65001:abc", "65001:zz"} {
+		_, err = parseEDNSOption(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestLookupCoalescer(t *testing.T) {
+	var c lookupCoalescer
+	var calls atomic.Int32
+	release := make(chan struct{})
+	lookup := func() coalescedLookup {
+		calls.Add(1)
+		<-release
+		return coalescedLookup{res: "result", status: zdns.StatusNoError}
+	}
+	key := lookupKey("A", "Example.com", nil, "")
+	require.Equal(t, key, lookupKey("A", "example.com", nil, ""), "names are compared case-insensitively")
+	require.NotEqual(t, key, lookupKey("AAAA", "example.com", nil, ""))
+	require.NotEqual(t, key, lookupKey("A", "example.com", nil, tcpTransport))
+
+	const callers = 5
+	var started, wg sync.WaitGroup
+	results := make([]coalescedLookup, callers)
+	started.Add(callers)
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			results[i], _ = c.lookup(key, lookup)
+		}(i)
+	}
+	// let every caller join the lookup in flight before it finishes
+	started.Wait()
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), calls.Load())
+	for _, res := range results {
+		require.Equal(t, "result", res.res)
+		require.Equal(t, zdns.StatusNoError, res.status)
+	}
+
+	// a lookup that already finished isn't shared
+	_, shared := c.lookup(key, lookup)
+	require.False(t, shared)
+	require.Equal(t, int32(2), calls.Load())
+
+	var none *lookupCoalescer
+	_, shared = none.lookup(key, lookup)
+	require.False(t, shared)
+}
+
+func TestFeedUntilStopped(t *testing.T) {
+	in, out, stop := make(chan string), make(chan string), make(chan struct{})
+	go feedUntilStopped(in, out, stop)
+	in <- "a.com"
+	require.Equal(t, "a.com", <-out)
+	close(stop)
+	_, ok := <-out
+	require.False(t, ok, "no more lines are handed out once stopped")
+
+	in, out = make(chan string), make(chan string)
+	go feedUntilStopped(in, out, make(chan struct{}))
+	close(in)
+	_, ok = <-out
+	require.False(t, ok)
+}
+
+func TestAbandonable(t *testing.T) {
+	require.Nil(t, abandonable[string](nil, nil))
+
+	out, abandon := make(chan string, 2), make(chan struct{})
+	in := abandonable(out, abandon)
+	in <- "first"
+	close(in)
+	require.Equal(t, "first", <-out)
+	_, ok := <-out
+	require.False(t, ok, "out is closed along with the workers' channel")
+
+	out = make(chan string, 2)
+	_ = abandonable(out, abandon)
+	close(abandon)
+	_, ok = <-out
+	require.False(t, ok, "out is closed once abandoned, even though the workers' channel never is")
+}
+
+func TestScanShutdown(t *testing.T) {
+	s := newScanShutdown(time.Hour)
+	defer s.finish()
+	s.signals <- os.Interrupt
+	<-s.stop
+	require.True(t, s.interrupted.Load())
+	select {
+	case <-s.abandon:
+		require.Fail(t, "lookups in flight get the grace period")
+	default:
+	}
+	s.signals <- syscall.SIGTERM
+	<-s.abandon
+
+	s = newScanShutdown(time.Millisecond)
+	defer s.finish()
+	s.signals <- os.Interrupt
+	<-s.abandon
+}
+
+func TestDumpSchema(t *testing.T) {
+	out, err := dumpSchema("a")
+	require.NoError(t, err)
+	var schema map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &schema))
+	require.Equal(t, jsonSchemaDraft, schema["$schema"])
+
+	properties := schema["properties"].(map[string]interface{})
+	require.Contains(t, properties, "name")
+	results := properties["results"].(map[string]interface{})
+	module := results["properties"].(map[string]interface{})["A"].(map[string]interface{})
+	data := module["properties"].(map[string]interface{})["data"].(map[string]interface{})
+	require.Equal(t, "#/$defs/zdns.SingleQueryResult", data["$ref"])
+
+	defs := schema["$defs"].(map[string]interface{})
+	queryResult := defs["zdns.SingleQueryResult"].(map[string]interface{})
+	answers := queryResult["properties"].(map[string]interface{})["answers"].(map[string]interface{})
+	require.Equal(t, "array", answers["type"])
+	require.ElementsMatch(t, []interface{}{"short", "normal", "long", "trace"}, answers["x-groups"])
+	require.NotContains(t, defs, "zdns.SingleModuleResult")
+
+	_, err = dumpSchema("NOTAMODULE")
+	require.Error(t, err)
+}
+
+func TestProbeRootServers(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Answer = append(resp.Answer, &dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "a.root-servers.net."})
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+	// nothing listens on the port of a closed socket
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+
+	live := zdns.NameServer{IP: net.ParseIP("127.0.0.1"), Port: uint16(pc.LocalAddr().(*net.UDPAddr).Port)}
+	dead := zdns.NameServer{IP: net.ParseIP("127.0.0.1"), Port: uint16(closed.LocalAddr().(*net.UDPAddr).Port)}
+	rc := zdns.NewResolverConfig()
+	rc.IPVersionMode = zdns.IPv4Only
+	rc.LocalAddrsV4 = []net.IP{net.ParseIP("127.0.0.1")}
+	rc.RootNameServersV4 = []zdns.NameServer{dead, live}
+	rc.ExternalNameServersV4 = rc.RootNameServersV4
+	rc.Retries = 0
+	rc.Timeout = time.Second
+	rc.NetworkTimeout = 200 * time.Millisecond
+
+	probes := probeRootServers(rc)
+	require.Len(t, probes, 2)
+	require.Equal(t, dead.String(), probes[0].NameServer)
+	require.False(t, probes[0].Reachable)
+	require.True(t, probes[1].Reachable)
+	require.Positive(t, probes[1].RTT)
+
+	reportRootProbes(rc, probes, false)
+	require.Len(t, rc.RootNameServersV4, 2, "root servers are only pruned when asked to")
+	reportRootProbes(rc, probes, true)
+	require.Equal(t, []zdns.NameServer{live}, rc.RootNameServersV4)
+	require.True(t, probes[0].Pruned)
+	require.False(t, probes[1].Pruned)
+}
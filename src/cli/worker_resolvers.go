@@ -0,0 +1,246 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package cli
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	transportMetadataPrefix = "transport=" // metadata token selecting the transport for a single input line
+
+	udpTransport = "udp"
+	tcpTransport = "tcp"
+	tlsTransport = "tls"
+)
+
+// workerResolvers holds a lookup worker's resolver, along with resolvers for the transports requested by individual
+// input lines through --metadata-passthrough and for the name servers given a tls:// or https:// scheme in
+// --name-servers. Those are created the first time each is needed.
+type workerResolvers struct {
+	config            *zdns.ResolverConfig
+	base              *zdns.Resolver
+	byTransport       map[string]*zdns.Resolver
+	schemeNameServers map[string][]zdns.NameServer // see CLIConf.schemeNameServers
+	byScheme          map[string]*zdns.Resolver
+	rand              *rand.Rand // the worker's random choices, ex. of a name server, also seeding its resolvers
+}
+
+// newWorkerResolvers creates the resolvers of a worker whose random choices are seeded with seed, see newWorkerRand
+func newWorkerResolvers(rc *zdns.ResolverConfig, schemeNameServers map[string][]zdns.NameServer, seed int64) (*workerResolvers, error) {
+	w := &workerResolvers{
+		config:            rc,
+		byTransport:       make(map[string]*zdns.Resolver),
+		schemeNameServers: schemeNameServers,
+		byScheme:          make(map[string]*zdns.Resolver),
+		rand:              newWorkerRand(seed),
+	}
+	var err error
+	if w.base, err = zdns.InitResolver(w.seeded(rc)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// newWorkerRand returns a source of random choices for a worker, seeded with seed, or with a random seed if seed is 0.
+// Each worker has its own, so they aren't shared between goroutines. Workers get their seeds from one created with
+// --seed, so they don't all make the same choices.
+func newWorkerRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// seeded returns a copy of config with a seed of its own for a new resolver, drawn from the worker's random choices
+func (w *workerResolvers) seeded(config *zdns.ResolverConfig) *zdns.ResolverConfig {
+	c := *config
+	c.Seed = w.rand.Int63()
+	return &c
+}
+
+// forTransport returns the resolver for transport, or the worker's resolver if transport is empty
+func (w *workerResolvers) forTransport(transport string) (*zdns.Resolver, error) {
+	if transport == "" {
+		return w.base, nil
+	}
+	if r, ok := w.byTransport[transport]; ok {
+		return r, nil
+	}
+	r, err := zdns.InitResolver(w.seeded(transportResolverConfig(w.config, transport)))
+	if err != nil {
+		return nil, fmt.Errorf("could not init resolver for transport %s: %w", transport, err)
+	}
+	w.byTransport[transport] = r
+	return r, nil
+}
+
+// forNameServers returns the resolver for a lookup to the --name-servers. Lookups are spread over the worker's
+// resolver and the resolvers for name servers given a scheme, in proportion to how many name servers each has.
+func (w *workerResolvers) forNameServers() (*zdns.Resolver, error) {
+	return w.forScheme(w.pickScheme())
+}
+
+// pickScheme returns the transport of a random name server scheme group, weighted by its number of name servers, or
+// "" for the worker's own name servers
+func (w *workerResolvers) pickScheme() string {
+	if len(w.schemeNameServers) == 0 {
+		return ""
+	}
+	n := w.rand.Intn(len(w.config.ExternalNameServersV4) + len(w.config.ExternalNameServersV6) + w.schemeNameServerCount())
+	n -= len(w.config.ExternalNameServersV4) + len(w.config.ExternalNameServersV6)
+	for _, transport := range []string{tlsTransport, httpsTransport} {
+		if n < 0 {
+			break
+		}
+		v4, v6 := splitNameServersByIPVersion(w.schemeNameServers[transport], w.config.IPVersionMode)
+		if n < len(v4)+len(v6) {
+			return transport
+		}
+		n -= len(v4) + len(v6)
+	}
+	return ""
+}
+
+func (w *workerResolvers) schemeNameServerCount() int {
+	count := 0
+	for _, nameServers := range w.schemeNameServers {
+		v4, v6 := splitNameServersByIPVersion(nameServers, w.config.IPVersionMode)
+		count += len(v4) + len(v6)
+	}
+	return count
+}
+
+// forScheme returns the resolver for the name servers given transport's scheme, or the worker's resolver if
+// transport is empty
+func (w *workerResolvers) forScheme(transport string) (*zdns.Resolver, error) {
+	if transport == "" {
+		return w.base, nil
+	}
+	if r, ok := w.byScheme[transport]; ok {
+		return r, nil
+	}
+	r, err := zdns.InitResolver(w.seeded(schemeResolverConfig(w.config, transport, w.schemeNameServers[transport])))
+	if err != nil {
+		return nil, fmt.Errorf("could not init resolver for %s:// name servers: %w", transport, err)
+	}
+	w.byScheme[transport] = r
+	return r, nil
+}
+
+func (w *workerResolvers) queriesSent() int {
+	queries := w.base.QueriesSent()
+	for _, r := range w.byTransport {
+		queries += r.QueriesSent()
+	}
+	for _, r := range w.byScheme {
+		queries += r.QueriesSent()
+	}
+	return queries
+}
+
+func (w *workerResolvers) close() {
+	w.base.Close()
+	for _, r := range w.byTransport {
+		r.Close()
+	}
+	for _, r := range w.byScheme {
+		r.Close()
+	}
+}
+
+// transportResolverConfig returns a copy of rc that sends queries over transport. For DNS over TLS, name servers on
+// the default DNS port are moved to the default DoT port.
+func transportResolverConfig(rc *zdns.ResolverConfig, transport string) *zdns.ResolverConfig {
+	config := *rc
+	config.DNSOverHTTPS = false
+	config.DNSOverTLS = false
+	if (transport == udpTransport || transport == tcpTransport) && rc.DNSOverTLS {
+		// with --tls, name servers without a port were given the DoT port, plain DNS goes to the DNS port
+		config.ExternalNameServersV4 = withPortMoved(rc.ExternalNameServersV4, zdns.DefaultDoTPort, zdns.DefaultDNSPort)
+		config.ExternalNameServersV6 = withPortMoved(rc.ExternalNameServersV6, zdns.DefaultDoTPort, zdns.DefaultDNSPort)
+	}
+	switch transport {
+	case udpTransport:
+		config.TransportMode = zdns.UDPOnly
+	case tcpTransport:
+		config.TransportMode = zdns.TCPOnly
+	case tlsTransport:
+		config.TransportMode = zdns.UDPOrTCP
+		config.DNSOverTLS = true
+		config.ExternalNameServersV4 = withPortMoved(rc.ExternalNameServersV4, zdns.DefaultDNSPort, zdns.DefaultDoTPort)
+		config.ExternalNameServersV6 = withPortMoved(rc.ExternalNameServersV6, zdns.DefaultDNSPort, zdns.DefaultDoTPort)
+	case httpsTransport:
+		config.TransportMode = zdns.UDPOrTCP
+		config.DNSOverHTTPS = true
+	}
+	return &config
+}
+
+// schemeResolverConfig returns a copy of rc that sends queries over transport to nameServers, the name servers given
+// transport's scheme in --name-servers
+func schemeResolverConfig(rc *zdns.ResolverConfig, transport string, nameServers []zdns.NameServer) *zdns.ResolverConfig {
+	config := transportResolverConfig(rc, transport)
+	v4, v6 := splitNameServersByIPVersion(nameServers, rc.IPVersionMode)
+	config.ExternalNameServersV4, config.RootNameServersV4 = v4, v4
+	config.ExternalNameServersV6, config.RootNameServersV6 = v6, v6
+	return config
+}
+
+// splitNameServersByIPVersion splits nameServers into IPv4 and IPv6 name servers, dropping those mode can't use
+func splitNameServersByIPVersion(nameServers []zdns.NameServer, mode zdns.IPVersionMode) (v4, v6 []zdns.NameServer) {
+	for _, ns := range nameServers {
+		if ns.IP.To4() != nil && mode != zdns.IPv6Only {
+			v4 = append(v4, ns)
+		} else if ns.IP.To4() == nil && mode != zdns.IPv4Only {
+			v6 = append(v6, ns)
+		}
+	}
+	return v4, v6
+}
+
+// withPortMoved returns a copy of nameServers where those on port from are on port to instead
+func withPortMoved(nameServers []zdns.NameServer, from, to uint16) []zdns.NameServer {
+	moved := make([]zdns.NameServer, len(nameServers))
+	copy(moved, nameServers)
+	for i := range moved {
+		if moved[i].Port == from {
+			moved[i].Port = to
+		}
+	}
+	return moved
+}
+
+// parseMetadataTransport returns the transport selected by a "transport=" token in an input line's metadata, or ""
+// if there is none. Tokens are separated by ';', ex. "transport=tcp;A:TIMEOUT".
+func parseMetadataTransport(metadata string) (string, error) {
+	for _, token := range strings.Split(metadata, ";") {
+		transport, found := strings.CutPrefix(strings.TrimSpace(token), transportMetadataPrefix)
+		if !found {
+			continue
+		}
+		transport = strings.ToLower(transport)
+		switch transport {
+		case udpTransport, tcpTransport, tlsTransport:
+			return transport, nil
+		default:
+			return "", fmt.Errorf("invalid transport %q, options: %s, %s, %s", transport, udpTransport, tcpTransport, tlsTransport)
+		}
+	}
+	return "", nil
+}
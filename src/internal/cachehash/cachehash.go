@@ -67,6 +67,28 @@ func (c *CacheHash) Eject() {
 	c.len--
 }
 
+// EjectWhile removes key-value pairs from the back of the list, the least-recently used first, for as long as
+// shouldEject returns true for them, up to max pairs. The eject callback isn't called for these.
+// Returns the number of pairs removed.
+func (c *CacheHash) EjectWhile(shouldEject func(k interface{}, v interface{}) bool, max int) int {
+	ejected := 0
+	for ejected < max && c.len > 0 {
+		e := c.l.Back()
+		kv, ok := e.Value.(keyValue)
+		if !ok {
+			log.Panic("CacheHash: EjectWhile: invalid list element value type")
+		}
+		if !shouldEject(kv.Key, kv.Value) {
+			break
+		}
+		delete(c.h, kv.Key)
+		c.l.Remove(e)
+		c.len--
+		ejected++
+	}
+	return ejected
+}
+
 // Upsert upserts a new key-value pair into the cache.
 // If the key already exists, the value is updated and the key is moved to the front of the list.
 // If the key does not exist in the cache, the key-value pair is added to the front of the list.
@@ -94,6 +116,20 @@ func (c *CacheHash) Upsert(k interface{}, v interface{}) (didExist, didEject boo
 	return false, didEject
 }
 
+// Range calls f for each key-value pair, from the least-recently used to the most, until f returns false.
+// The order of the list isn't changed.
+func (c *CacheHash) Range(f func(k interface{}, v interface{}) bool) {
+	for e := c.l.Back(); e != nil; e = e.Prev() {
+		kv, ok := e.Value.(keyValue)
+		if !ok {
+			log.Panic("CacheHash: Range: invalid list element value type")
+		}
+		if !f(kv.Key, kv.Value) {
+			return
+		}
+	}
+}
+
 // First returns the key-value pair at the front of the list.
 // Returns nil, nil if the cache is empty.
 func (c *CacheHash) First() (k interface{}, v interface{}) {
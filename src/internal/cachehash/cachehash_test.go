@@ -116,6 +116,27 @@ func TestEject(t *testing.T) {
 	}
 }
 
+func TestEjectWhile(t *testing.T) {
+	ch := new(CacheHash)
+	ch.Init(5)
+	ch.Upsert("key1", 1)
+	ch.Upsert("key2", 2)
+	ch.Upsert("key3", 3)
+	ch.Upsert("key4", 4)
+	belowThree := func(k interface{}, v interface{}) bool {
+		return v.(int) < 3
+	}
+	assert.Equal(t, 1, ch.EjectWhile(belowThree, 1), "max not respected")
+	assert.Equal(t, 1, ch.EjectWhile(belowThree, 5), "should stop at the first element not to eject")
+	assert.Equal(t, 2, ch.Len())
+	if k, v := ch.Last(); k != "key3" || v != 3 {
+		t.Error("last not updated on eject")
+	}
+	if _, ok := ch.Get("key1"); ok {
+		t.Error("Ejected element not removed from hash")
+	}
+}
+
 func TestUpsertExistingBumpsToFront(t *testing.T) {
 	ch := new(CacheHash)
 	ch.Init(5)
@@ -179,3 +200,26 @@ func TestGetNoMove(t *testing.T) {
 	assert.Equal(t, "key2", k, "First key should still be key2 post GetNoMove")
 	assert.Equal(t, "value2", v, "First value should be value2")
 }
+
+func TestRange(t *testing.T) {
+	ch := new(CacheHash)
+	ch.Init(5)
+	ch.Upsert("key1", "value1")
+	ch.Upsert("key2", "value2")
+	ch.Upsert("key3", "value3")
+	ch.Get("key1")
+
+	var keys []interface{}
+	ch.Range(func(k interface{}, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	assert.Equal(t, []interface{}{"key2", "key3", "key1"}, keys, "Range should go from least to most recently used")
+
+	keys = nil
+	ch.Range(func(k interface{}, v interface{}) bool {
+		keys = append(keys, k)
+		return len(keys) < 2
+	})
+	assert.Equal(t, []interface{}{"key2", "key3"}, keys, "Range should stop when f returns false")
+}
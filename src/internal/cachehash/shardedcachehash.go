@@ -62,6 +62,29 @@ func (c *ShardedCacheHash) Delete(k interface{}) (interface{}, bool) {
 	return c.getShard(k).Delete(k)
 }
 
+// EjectWhile removes least-recently used key-value pairs from the shard holding k, see CacheHash.EjectWhile
+func (c *ShardedCacheHash) EjectWhile(k interface{}, shouldEject func(k interface{}, v interface{}) bool, max int) int {
+	return c.getShard(k).EjectWhile(shouldEject, max)
+}
+
+// Range calls f for each key-value pair of each shard, see CacheHash.Range. Each shard is locked while it's ranged over,
+// so f must not call other methods of c
+func (c *ShardedCacheHash) Range(f func(k interface{}, v interface{}) bool) {
+	for i := 0; i < c.shardsLen; i++ {
+		shard := &c.shards[i]
+		shard.Lock()
+		keepGoing := true
+		shard.Range(func(k interface{}, v interface{}) bool {
+			keepGoing = f(k, v)
+			return keepGoing
+		})
+		shard.Unlock()
+		if !keepGoing {
+			return
+		}
+	}
+}
+
 func (c *ShardedCacheHash) RegisterCB(newCB func(interface{}, interface{})) {
 	for i := 0; i < c.shardsLen; i++ {
 		c.shards[i].RegisterCB(newCB)
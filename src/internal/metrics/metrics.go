@@ -0,0 +1,267 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package metrics exposes counters and histograms in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/). Only what zdns needs is supported: counters,
+// counters read from a function, and histograms, each with optional labels.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram bucket upper bounds, in seconds, suited to DNS lookup latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics and serves them over HTTP. It's safe for concurrent use.
+type Registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(m metric) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+// NewCounter registers and returns a counter with the given label names, its values are given in the same order to Add
+func (reg *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, labelNames: labelNames}, values: make(map[string]*counterValue)}
+	reg.register(c)
+	return c
+}
+
+// NewCounterFunc registers a counter whose value is read from f whenever the metrics are scraped
+func (reg *Registry) NewCounterFunc(name, help string, f func() float64) {
+	reg.register(&counterFunc{desc: desc{name: name, help: help}, f: f})
+}
+
+// NewHistogram registers and returns a histogram with the given bucket upper bounds, in increasing order, and label names
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{desc: desc{name: name, help: help, labelNames: labelNames}, buckets: buckets, values: make(map[string]*histogramValue)}
+	reg.register(h)
+	return h
+}
+
+// Write writes every metric in the text exposition format
+func (reg *Registry) Write(w io.Writer) {
+	reg.Lock()
+	metrics := append([]metric(nil), reg.metrics...)
+	reg.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	reg.Write(w)
+}
+
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "), d.name, metricType)
+}
+
+// labelKey joins label values into a map key, checking there's one value per label name
+func (d *desc) labelKey(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelPairs formats the labels of the series with the given key, plus any extra label pairs, as {a="b",...}
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labelNames) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labelNames[i]+"="+strconv.Quote(v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a series map in a stable order, so scrapes are easy to compare
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a monotonically increasing value per combination of label values
+type Counter struct {
+	desc
+	sync.RWMutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	sync.Mutex
+	v float64
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n, which must not be negative, to the series with the given label values
+func (c *Counter) Add(n float64, labelValues ...string) {
+	key := c.labelKey(labelValues)
+	c.RLock()
+	cv, ok := c.values[key]
+	c.RUnlock()
+	if !ok {
+		c.Lock()
+		if cv, ok = c.values[key]; !ok {
+			cv = &counterValue{}
+			c.values[key] = cv
+		}
+		c.Unlock()
+	}
+	cv.Lock()
+	cv.v += n
+	cv.Unlock()
+}
+
+// Value returns the current value of the series with the given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.RLock()
+	cv, ok := c.values[c.labelKey(labelValues)]
+	c.RUnlock()
+	if !ok {
+		return 0
+	}
+	cv.Lock()
+	defer cv.Unlock()
+	return cv.v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w, "counter")
+	c.RLock()
+	defer c.RUnlock()
+	for _, key := range sortedKeys(c.values) {
+		cv := c.values[key]
+		cv.Lock()
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(cv.v))
+		cv.Unlock()
+	}
+}
+
+type counterFunc struct {
+	desc
+	f func() float64
+}
+
+func (c *counterFunc) write(w io.Writer) {
+	c.writeHeader(w, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.f()))
+}
+
+// Histogram counts observations in buckets per combination of label values
+type Histogram struct {
+	desc
+	sync.RWMutex
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.labelKey(labelValues)
+	h.RLock()
+	hv, ok := h.values[key]
+	h.RUnlock()
+	if !ok {
+		h.Lock()
+		if hv, ok = h.values[key]; !ok {
+			hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+			h.values[key] = hv
+		}
+		h.Unlock()
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	hv.Lock()
+	defer hv.Unlock()
+	if i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w, "histogram")
+	h.RLock()
+	defer h.RUnlock()
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		hv.Lock()
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), hv.count)
+		hv.Unlock()
+	}
+}
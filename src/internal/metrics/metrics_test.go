@@ -0,0 +1,63 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+	queries := reg.NewCounter("zdns_queries_total", "Queries sent.", "status")
+	queries.Inc("NOERROR")
+	queries.Add(2, "TIMEOUT")
+	queries.Inc("NOERROR")
+	reg.NewCounterFunc("zdns_cache_hits_total", "Cache hits.", func() float64 { return 7 })
+	latency := reg.NewHistogram("zdns_lookup_duration_seconds", "Lookup duration.", []float64{0.1, 1}, "module")
+	latency.Observe(0.05, "A")
+	latency.Observe(0.1, "A")
+	latency.Observe(3, "A")
+
+	require.Equal(t, float64(2), queries.Value("NOERROR"))
+	require.Equal(t, float64(0), queries.Value("SERVFAIL"))
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	require.Equal(t, `# HELP zdns_queries_total Queries sent.
+# TYPE zdns_queries_total counter
+zdns_queries_total{status="NOERROR"} 2
+zdns_queries_total{status="TIMEOUT"} 2
+# HELP zdns_cache_hits_total Cache hits.
+# TYPE zdns_cache_hits_total counter
+zdns_cache_hits_total 7
+# HELP zdns_lookup_duration_seconds Lookup duration.
+# TYPE zdns_lookup_duration_seconds histogram
+zdns_lookup_duration_seconds_bucket{module="A",le="0.1"} 2
+zdns_lookup_duration_seconds_bucket{module="A",le="1"} 2
+zdns_lookup_duration_seconds_bucket{module="A",le="+Inf"} 3
+zdns_lookup_duration_seconds_sum{module="A"} 3.15
+zdns_lookup_duration_seconds_count{module="A"} 3
+`, rec.Body.String())
+}
+
+func TestCounterPanicsOnWrongLabelCount(t *testing.T) {
+	c := NewRegistry().NewCounter("c", "help", "a", "b")
+	require.Panics(t, func() { c.Inc("only-one") })
+}
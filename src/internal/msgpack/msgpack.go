@@ -0,0 +1,158 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package msgpack encodes JSON documents as MessagePack (https://msgpack.org), preserving their structure. Only the
+// subset of the format needed to represent JSON values is supported.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// FromJSON re-encodes the JSON document data as MessagePack. Objects become maps with sorted keys, integers are
+// encoded in the smallest representation that holds them and other numbers as 64-bit floats.
+func FromJSON(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("unable to decode JSON: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FramedFromJSON is like FromJSON, but prefixes the MessagePack value with its length as a 4-byte big-endian integer so
+// a stream of values written back to back can be split apart again
+func FramedFromJSON(data []byte) ([]byte, error) {
+	packed, err := FromJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	framed := make([]byte, 4, 4+len(packed))
+	binary.BigEndian.PutUint32(framed, uint32(len(packed)))
+	return append(framed, packed...), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			encodeInt(buf, i)
+		} else if f, err := v.Float64(); err == nil {
+			buf.WriteByte(0xcb)
+			_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		} else {
+			return fmt.Errorf("unable to encode number %s", v)
+		}
+	case string:
+		encodeString(buf, v)
+	case []interface{}:
+		writeHeader(buf, len(v), 0x90, 15, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeHeader(buf, len(v), 0x80, 15, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeString(buf, k)
+			if err := encode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unable to encode value of type %T", v)
+	}
+	return nil
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i)) // positive fixint
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i))) // negative fixint
+	case i >= 0 && i <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(i)})
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		_ = binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		_ = binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		_ = binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(int8(i))})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	if len(s) <= 31 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		buf.Write([]byte{0xd9, byte(len(s))})
+	} else {
+		writeHeader(buf, len(s), 0, -1, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+// writeHeader writes the type and length of an array, map or string. Lengths up to fixMax are packed into fixPrefix,
+// longer ones use the 16 or 32-bit form.
+func writeHeader(buf *bytes.Buffer, n int, fixPrefix byte, fixMax int, prefix16, prefix32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fixPrefix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(prefix16)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(prefix32)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// decode is an example decoder for the subset of MessagePack produced by FromJSON. It returns values in the same
+// shapes as encoding/json with UseNumber, so results can be compared to the JSON they came from.
+func decode(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	readLen := func(size int) (int, error) {
+		buf, err := readN(size)
+		if err != nil {
+			return 0, err
+		}
+		if size == 2 {
+			return int(binary.BigEndian.Uint16(buf)), nil
+		}
+		return int(binary.BigEndian.Uint32(buf)), nil
+	}
+	decodeString := func(n int) (interface{}, error) {
+		buf, err := readN(n)
+		return string(buf), err
+	}
+	decodeArray := func(n int) (interface{}, error) {
+		arr := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := decode(r)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	decodeMap := func(n int) (interface{}, error) {
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := decode(r)
+			if err != nil {
+				return nil, err
+			}
+			if m[k.(string)], err = decode(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	intOf := func(size int, signed bool) (interface{}, error) {
+		buf, err := readN(size)
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, c := range buf {
+			u = u<<8 | uint64(c)
+		}
+		if signed {
+			shift := 64 - 8*size
+			return json.Number(fmt.Sprint(int64(u<<shift) >> shift)), nil
+		}
+		return json.Number(fmt.Sprint(u)), nil
+	}
+	switch {
+	case b <= 0x7f:
+		return json.Number(fmt.Sprint(b)), nil
+	case b >= 0xe0:
+		return json.Number(fmt.Sprint(int8(b))), nil
+	case b&0xe0 == 0xa0:
+		return decodeString(int(b & 0x1f))
+	case b&0xf0 == 0x90:
+		return decodeArray(int(b & 0x0f))
+	case b&0xf0 == 0x80:
+		return decodeMap(int(b & 0x0f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return intOf(1<<(b-0xcc), false)
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return intOf(1<<(b-0xd0), true)
+	case 0xcb:
+		buf, err := readN(8)
+		if err != nil {
+			return nil, err
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(buf))
+		return json.Number(fmt.Sprint(f)), nil
+	case 0xd9:
+		n, err := readN(1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeString(int(n[0]))
+	case 0xda, 0xdb, 0xdc, 0xdd, 0xde, 0xdf:
+		size := 2
+		if b%2 == 1 {
+			size = 4
+		}
+		n, err := readLen(size)
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case 0xda, 0xdb:
+			return decodeString(n)
+		case 0xdc, 0xdd:
+			return decodeArray(n)
+		default:
+			return decodeMap(n)
+		}
+	}
+	return nil, fmt.Errorf("unsupported type byte 0x%x", b)
+}
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	require.NoError(t, d.Decode(&v))
+	return v
+}
+
+func TestFromJSON(t *testing.T) {
+	docs := []string{
+		`{"name":"example.com","results":{"A":{"data":{"answers":[{"ttl":3600,"type":"A","answer":"192.0.2.1"}],"resolver":"1.1.1.1:53"},"duration":0.0123,"status":"NOERROR","timestamp":"2024-09-13T09:51:34-04:00"}}}`,
+		`[null,true,false,0,127,128,255,256,65535,65536,4294967295,4294967296,-1,-32,-33,-128,-129,-32768,-32769,-2147483648,-2147483649,1.5,-2.25e+10]`,
+		`{"short":"` + strings.Repeat("a", 31) + `","medium":"` + strings.Repeat("b", 200) + `","long":"` + strings.Repeat("c", 70000) + `"}`,
+		`{}`,
+		`[]`,
+	}
+	for _, doc := range docs {
+		packed, err := FromJSON([]byte(doc))
+		require.NoError(t, err)
+		decoded, err := decode(bytes.NewReader(packed))
+		require.NoError(t, err)
+		require.Equal(t, decodeJSON(t, doc), decoded)
+	}
+
+	// long arrays and maps use the 16-bit length forms
+	elems := make([]string, 20)
+	for i := range elems {
+		elems[i] = fmt.Sprintf("%q:%d", fmt.Sprint("key", i), i)
+	}
+	doc := "{" + strings.Join(elems, ",") + "}"
+	packed, err := FromJSON([]byte(doc))
+	require.NoError(t, err)
+	require.Equal(t, byte(0xde), packed[0])
+	decoded, err := decode(bytes.NewReader(packed))
+	require.NoError(t, err)
+	require.Equal(t, decodeJSON(t, doc), decoded)
+
+	_, err = FromJSON([]byte(`{"unterminated":`))
+	require.Error(t, err)
+}
+
+func TestFramedFromJSONStream(t *testing.T) {
+	docs := []string{`{"name":"a.com","status":"NOERROR"}`, `{"name":"b.com","status":"NXDOMAIN"}`}
+	var stream bytes.Buffer
+	for _, doc := range docs {
+		framed, err := FramedFromJSON([]byte(doc))
+		require.NoError(t, err)
+		stream.Write(framed)
+	}
+
+	// read the stream back the way a consumer would, one length-prefixed record at a time
+	var decoded []interface{}
+	for stream.Len() > 0 {
+		var length uint32
+		require.NoError(t, binary.Read(&stream, binary.BigEndian, &length))
+		record := make([]byte, length)
+		_, err := io.ReadFull(&stream, record)
+		require.NoError(t, err)
+		v, err := decode(bytes.NewReader(record))
+		require.NoError(t, err)
+		decoded = append(decoded, v)
+	}
+	require.Equal(t, []interface{}{decodeJSON(t, docs[0]), decodeJSON(t, docs[1])}, decoded)
+}
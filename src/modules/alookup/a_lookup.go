@@ -56,6 +56,11 @@ func (aMod *ALookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServe
 	return ipResult, trace, status, err
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (aMod *ALookupModule) ResultType() interface{} {
+	return &zdns.IPResult{}
+}
+
 func (aMod *ALookupModule) Help() string {
 	return ""
 }
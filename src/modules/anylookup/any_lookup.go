@@ -0,0 +1,116 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package anylookup
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// rfc8482HINFOCPU is the CPU of the HINFO record that RFC 8482 section 4.2 has servers synthesize instead of answering
+// an ANY query with all their records
+const rfc8482HINFOCPU = "RFC8482"
+
+type Result struct {
+	// Types lists the record types answered, in the order they first appear
+	Types []string `json:"types,omitempty" groups:"short,normal,long,trace"`
+	// Records groups the answers by record type, ex. "A" or "MX"
+	Records map[string][]interface{} `json:"records,omitempty" groups:"short,normal,long,trace"`
+	// RefusedANY is set when the server answered with the synthesized HINFO record of RFC 8482 rather than its records
+	RefusedANY bool `json:"refused_any" groups:"short,normal,long,trace"`
+	// Minimal is set when the server answered with a single RRset, as RFC 8482 section 4.1 allows. A name that only
+	// has one RRset looks the same
+	Minimal bool `json:"minimal,omitempty" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("ANYLOOKUP", new(AnyLookupModule))
+}
+
+type AnyLookupModule struct {
+	cli.BasicLookupModule
+}
+
+// CLIInit initializes the ANY lookup module
+func (anyMod *AnyLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("ANYLOOKUP module does not support --all-nameservers")
+	}
+	anyMod.BasicLookupModule.DNSType = dns.TypeANY
+	anyMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return anyMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup sends an ANY query for lookupName and groups the answers by record type, noting servers that minimize their
+// responses to ANY queries per RFC 8482
+func (anyMod *AnyLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	innerRes, trace, status, err := anyMod.BasicLookupModule.Lookup(r, lookupName, nameServer)
+	castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+	if !ok {
+		return nil, trace, status, errors.New("lookup didn't return a single query result type")
+	}
+	return groupAnswers(castedInnerRes.Answers), trace, status, err
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (anyMod *AnyLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+func (anyMod *AnyLookupModule) Help() string {
+	return ""
+}
+
+func (anyMod *AnyLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (anyMod *AnyLookupModule) GetDescription() string {
+	return "Sends an ANY query and groups the answers by record type, noting servers that refuse ANY queries per RFC 8482."
+}
+
+func (anyMod *AnyLookupModule) NewFlags() interface{} {
+	return anyMod
+}
+
+// groupAnswers groups answers by record type, and checks whether they're an RFC 8482 minimal response
+func groupAnswers(answers []interface{}) Result {
+	res := Result{Records: make(map[string][]interface{})}
+	rrsets := 0
+	for _, a := range answers {
+		ans, ok := a.(zdns.WithBaseAnswer)
+		if !ok {
+			continue
+		}
+		base := ans.BaseAns()
+		if hinfo, ok := a.(zdns.HINFOAnswer); ok && strings.EqualFold(hinfo.CPU, rfc8482HINFOCPU) {
+			res.RefusedANY = true
+		}
+		if _, ok := res.Records[base.Type]; !ok {
+			res.Types = append(res.Types, base.Type)
+			if base.RrType != dns.TypeRRSIG {
+				rrsets++
+			}
+		}
+		res.Records[base.Type] = append(res.Records[base.Type], a)
+	}
+	res.Minimal = rrsets == 1 && !res.RefusedANY
+	return res
+}
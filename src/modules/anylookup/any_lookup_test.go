@@ -0,0 +1,108 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package anylookup
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question)
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+}
+
+func InitTest(t *testing.T) (*zdns.Resolver, *AnyLookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	anyMod := new(AnyLookupModule)
+	assert.NilError(t, anyMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r, anyMod
+}
+
+func answer(rrType uint16, value string) zdns.Answer {
+	return zdns.Answer{Name: "example.com", Type: dns.TypeToString[rrType], RrType: rrType, Class: "IN", Answer: value}
+}
+
+func TestAnyLookupGroupsAnswers(t *testing.T) {
+	resolver, anyMod := InitTest(t)
+	a1, a2 := answer(dns.TypeA, "192.0.2.1"), answer(dns.TypeA, "192.0.2.2")
+	mx := zdns.PrefAnswer{Answer: answer(dns.TypeMX, "mail.example.com."), Preference: 10}
+	rrsig := zdns.RRSIGAnswer{Answer: answer(dns.TypeRRSIG, ""), TypeCovered: dns.TypeA}
+	mockResults["example.com"] = &zdns.SingleQueryResult{Answers: []interface{}{a1, mx, rrsig, a2}}
+
+	res, _, status, err := anyMod.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Equal(t, queries[0].Type, dns.TypeANY)
+	result := res.(Result)
+	assert.DeepEqual(t, result.Types, []string{"A", "MX", "RRSIG"})
+	assert.DeepEqual(t, result.Records["A"], []interface{}{a1, a2})
+	assert.DeepEqual(t, result.Records["MX"], []interface{}{mx})
+	assert.Assert(t, !result.RefusedANY)
+	assert.Assert(t, !result.Minimal)
+}
+
+func TestAnyLookupRFC8482(t *testing.T) {
+	resolver, anyMod := InitTest(t)
+	hinfo := zdns.HINFOAnswer{Answer: answer(dns.TypeHINFO, ""), CPU: "RFC8482"}
+	mockResults["example.com"] = &zdns.SingleQueryResult{Answers: []interface{}{hinfo}}
+	res, _, status, err := anyMod.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Assert(t, res.(Result).RefusedANY)
+	assert.Assert(t, !res.(Result).Minimal)
+
+	// a single RRset, with its signature
+	mockResults["example.com"] = &zdns.SingleQueryResult{Answers: []interface{}{
+		answer(dns.TypeA, "192.0.2.1"), zdns.RRSIGAnswer{Answer: answer(dns.TypeRRSIG, ""), TypeCovered: dns.TypeA},
+	}}
+	res, _, _, err = anyMod.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Assert(t, !res.(Result).RefusedANY)
+	assert.Assert(t, res.(Result).Minimal)
+}
+
+func TestAnyLookupNXDomain(t *testing.T) {
+	resolver, anyMod := InitTest(t)
+	res, _, status, err := anyMod.Lookup(resolver, "missing.example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNXDomain, status)
+	assert.Equal(t, len(res.(Result).Types), 0)
+}
@@ -34,6 +34,9 @@ type AxfrLookupModule struct {
 	cli.BasicLookupModule
 	NSModule      nslookup.NSLookupModule
 	BlacklistPath string `long:"blacklist-file" description:"path to blacklist file" default:""`
+	AllowTransfer bool   `long:"allow-zone-transfer" description:"confirm that zone transfers should be requested from the name servers of each input name. Required, as operators may treat unsolicited transfers as an attack"`
+	IXFR          bool   `long:"ixfr" description:"request an incremental zone transfer (IXFR) of the changes since --ixfr-serial instead of the whole zone. Servers that can't send the changes send the whole zone"`
+	IXFRSerial    uint32 `long:"ixfr-serial" default:"0" description:"SOA serial of the zone version held, changes since which are requested with --ixfr"`
 	Blacklist     *safeblacklist.SafeBlacklist
 	TransferFact  TransferFactory
 }
@@ -90,7 +93,11 @@ func (axfrMod *AxfrLookupModule) doAXFR(transfer TransferInterface, name string,
 		}
 	}
 	m := new(dns.Msg)
-	m.SetAxfr(dotName(name))
+	if axfrMod.IXFR {
+		m.SetIxfr(dotName(name), axfrMod.IXFRSerial, "", "")
+	} else {
+		m.SetAxfr(dotName(name))
+	}
 	if a, err := transfer.In(m, net.JoinHostPort(server.IP.String(), "53")); err != nil {
 		retv.Status = zdns.StatusError
 		retv.Error = err.Error()
@@ -138,6 +145,11 @@ func (axfrMod *AxfrLookupModule) Lookup(resolver *zdns.Resolver, name string, na
 	return retv, nil, zdns.StatusNoError, nil
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (axfrMod *AxfrLookupModule) ResultType() interface{} {
+	return AXFRResult{}
+}
+
 func (axfrMod *AxfrLookupModule) Help() string {
 	return ""
 }
@@ -168,6 +180,9 @@ func (axfrMod *AxfrLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfi
 	if gc.LookupAllNameServers {
 		return errors.New("AXFR module does not support --all-nameservers")
 	}
+	if !axfrMod.AllowTransfer {
+		return errors.New("AXFR module requests zone transfers, pass --allow-zone-transfer to confirm")
+	}
 	var err error
 	if axfrMod.BlacklistPath != "" {
 		axfrMod.Blacklist = safeblacklist.New()
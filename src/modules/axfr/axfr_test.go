@@ -32,6 +32,9 @@ var axfrRecords = make(map[string][]dns.RR)
 var transferError = ""
 var envelopeError = ""
 
+// the last transfer request the mock received
+var transferRequest *dns.Msg
+
 // trError is used to specify error in the transfer over channel
 type trError struct{}
 
@@ -59,6 +62,7 @@ func (f *MockTransferFactory) NewTransfer() TransferInterface {
 }
 
 func (mock *MockTransfer) In(m *dns.Msg, server string) (chan *dns.Envelope, error) {
+	transferRequest = m
 	var eError error = nil
 	if envelopeError != "" {
 		eError = enError{}
@@ -98,6 +102,7 @@ func InitTest() (*AxfrLookupModule, *zdns.Resolver) {
 	axfrRecords = make(map[string][]dns.RR)
 	transferError = ""
 	envelopeError = ""
+	transferRequest = nil
 
 	nsRecords = make(map[string]*zdns.NSResult)
 	nsStatus = zdns.StatusNoError
@@ -111,6 +116,7 @@ func InitTest() (*AxfrLookupModule, *zdns.Resolver) {
 	rc.IPVersionMode = zdns.IPv4Only
 
 	axfrMod := new(AxfrLookupModule)
+	axfrMod.AllowTransfer = true
 	err := axfrMod.CLIInit(cc, rc)
 	if err != nil {
 		panic("failed to initialize axfr test lookup with error: " + err.Error())
@@ -423,6 +429,29 @@ func TestErrorInNsLookup(t *testing.T) {
 	assert.Equal(t, res, nil)
 }
 
+// Zone transfers must be explicitly allowed
+func TestRequiresAllowZoneTransfer(t *testing.T) {
+	rc := new(zdns.ResolverConfig)
+	axfrMod := new(AxfrLookupModule)
+	err := axfrMod.CLIInit(new(cli.CLIConf), rc)
+	assert.ErrorContains(t, err, "--allow-zone-transfer")
+}
+
+// With --ixfr, an incremental transfer from the given serial is requested
+func TestIXFRRequest(t *testing.T) {
+	axfrMod, resolver := InitTest()
+	ns := &zdns.NameServer{IP: net.ParseIP("192.0.2.3")}
+
+	axfrMod.Lookup(resolver, "example.com", ns)
+	assert.Equal(t, transferRequest.Question[0].Qtype, dns.TypeAXFR)
+
+	axfrMod.IXFR = true
+	axfrMod.IXFRSerial = 2024010101
+	axfrMod.Lookup(resolver, "example.com", ns)
+	assert.Equal(t, transferRequest.Question[0].Qtype, dns.TypeIXFR)
+	assert.Equal(t, transferRequest.Ns[0].(*dns.SOA).Serial, uint32(2024010101))
+}
+
 func verifyResult(t *testing.T, servers []AXFRServerResult, expectedServersMap map[string][]interface{}) {
 	serversLength := len(servers)
 	expectedServersLength := len(expectedServersMap)
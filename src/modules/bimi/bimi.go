@@ -0,0 +1,166 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package bimi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// the TXT record at <selector>._bimi.<domain> with a domain's brand indicator, draft-brand-indicators-for-message-identification
+const bimiRecordRegexp = "^v[\x09\x20]*=[\x09\x20]*BIMI1([\x09\x20]*;|[\x09\x20]*$)"
+
+// StatusInvalidRecord is returned when the domain has a BIMI record, but it couldn't be parsed
+const StatusInvalidRecord zdns.Status = "INVALID_RECORD"
+
+type Result struct {
+	Record string `json:"record,omitempty" groups:"short,normal,long,trace"`
+	// Logo is the URL of the SVG logo, from the l= tag
+	Logo string `json:"logo,omitempty" groups:"short,normal,long,trace"`
+	// Authority is the URL of the Verified Mark Certificate vouching for the logo, from the a= tag
+	Authority string `json:"authority,omitempty" groups:"short,normal,long,trace"`
+	// Declined is set when both tags are empty, the domain explicitly has no brand indicator
+	Declined bool `json:"declined,omitempty" groups:"short,normal,long,trace"`
+	// RecordError is why the record couldn't be parsed
+	RecordError string `json:"record_error,omitempty" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("BIMI", new(BIMILookupModule))
+}
+
+type BIMILookupModule struct {
+	cli.BasicLookupModule
+	Selector string `long:"selector" default:"default" description:"BIMI selector, the record of a domain is looked up at <selector>._bimi.<domain>"`
+	re       *regexp.Regexp
+}
+
+// CLIInit initializes the BIMI lookup module
+func (bimiMod *BIMILookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("BIMI module does not support --all-nameservers")
+	}
+	if bimiMod.Selector == "" {
+		bimiMod.Selector = "default"
+	}
+	if _, ok := dns.IsDomainName(bimiMod.Selector); !ok {
+		return fmt.Errorf("invalid BIMI selector %q", bimiMod.Selector)
+	}
+	bimiMod.re = regexp.MustCompile(bimiRecordRegexp)
+	bimiMod.BasicLookupModule.DNSType = dns.TypeTXT
+	bimiMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return bimiMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup looks up the BIMI record of lookupName and parses its logo and authority tags. A missing record is reported
+// with the status of the TXT lookup, ex. NXDOMAIN or NORECORD, a record that can't be parsed with StatusInvalidRecord
+func (bimiMod *BIMILookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	domain := strings.ToLower(strings.TrimSuffix(lookupName, "."))
+	innerRes, trace, status, err := bimiMod.BasicLookupModule.Lookup(r, bimiMod.Selector+"._bimi."+domain, nameServer)
+	castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+	if !ok {
+		return nil, trace, status, errors.New("lookup didn't return a single query result type")
+	}
+	record, status, err := zdns.CheckTxtRecords(castedInnerRes, status, bimiMod.re, err)
+	res := Result{Record: record}
+	if status != zdns.StatusNoError {
+		return res, trace, status, err
+	}
+	if err = parseRecord(record, &res); err != nil {
+		res.RecordError = err.Error()
+		return res, trace, StatusInvalidRecord, nil
+	}
+	return res, trace, zdns.StatusNoError, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (bimiMod *BIMILookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// parseRecord parses the tag=value pairs of a BIMI record into res. The l= tag is required, both l= and a= must be
+// HTTPS URLs unless empty, and unknown tags are ignored
+func parseRecord(record string, res *Result) error {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(record, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		tag, value, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("invalid tag %q", pair)
+		}
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if _, ok := tags[tag]; ok {
+			return fmt.Errorf("duplicate %s= tag", tag)
+		}
+		tags[tag] = strings.TrimSpace(value)
+	}
+	logo, ok := tags["l"]
+	if !ok {
+		return errors.New("missing l= tag")
+	}
+	if logo != "" {
+		if err := checkHTTPSURL(logo); err != nil {
+			return fmt.Errorf("invalid l= tag: %w", err)
+		}
+	}
+	authority := tags["a"]
+	if authority != "" {
+		if err := checkHTTPSURL(authority); err != nil {
+			return fmt.Errorf("invalid a= tag: %w", err)
+		}
+	}
+	res.Logo = logo
+	res.Authority = authority
+	res.Declined = logo == "" && authority == ""
+	return nil
+}
+
+func checkHTTPSURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an HTTPS URL", rawURL)
+	}
+	return nil
+}
+
+func (bimiMod *BIMILookupModule) Help() string {
+	return ""
+}
+
+func (bimiMod *BIMILookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (bimiMod *BIMILookupModule) GetDescription() string {
+	return "BIMI looks up the BIMI record of a domain at <selector>._bimi.<domain> and parses the logo and Verified Mark Certificate URLs it lists."
+}
+
+func (bimiMod *BIMILookupModule) NewFlags() interface{} {
+	return bimiMod
+}
@@ -0,0 +1,126 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package bimi
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question)
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+}
+
+func InitTest(t *testing.T, selector string) (*zdns.Resolver, *BIMILookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	bimiMod := &BIMILookupModule{Selector: selector}
+	assert.NilError(t, bimiMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r, bimiMod
+}
+
+func txtRecords(name string, records ...string) *zdns.SingleQueryResult {
+	res := &zdns.SingleQueryResult{}
+	for _, record := range records {
+		res.Answers = append(res.Answers, zdns.Answer{Name: name, Type: "TXT", Class: "IN", Answer: record})
+	}
+	return res
+}
+
+func TestLookupRecord(t *testing.T) {
+	r, bimiMod := InitTest(t, "")
+	mockResults["default._bimi.example.com"] = txtRecords("default._bimi.example.com", "some TXT record",
+		"v=BIMI1; l=https://example.com/logo.svg; a=https://example.com/vmc.pem")
+	res, _, status, err := bimiMod.Lookup(r, "Example.com.", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Equal(t, "default._bimi.example.com", queries[0].Name)
+	assert.DeepEqual(t, Result{
+		Record:    "v=BIMI1; l=https://example.com/logo.svg; a=https://example.com/vmc.pem",
+		Logo:      "https://example.com/logo.svg",
+		Authority: "https://example.com/vmc.pem",
+	}, res)
+}
+
+func TestLookupSelector(t *testing.T) {
+	r, bimiMod := InitTest(t, "brand")
+	mockResults["brand._bimi.example.com"] = txtRecords("brand._bimi.example.com", "v=BIMI1; l=https://example.com/brand.svg")
+	res, _, status, err := bimiMod.Lookup(r, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Equal(t, "https://example.com/brand.svg", res.(Result).Logo)
+	assert.Equal(t, "", res.(Result).Authority)
+}
+
+func TestLookupDeclinationRecord(t *testing.T) {
+	r, bimiMod := InitTest(t, "")
+	mockResults["default._bimi.example.com"] = txtRecords("default._bimi.example.com", "v=BIMI1; l=; a=;")
+	res, _, status, err := bimiMod.Lookup(r, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Assert(t, res.(Result).Declined)
+}
+
+func TestLookupMissingRecord(t *testing.T) {
+	r, bimiMod := InitTest(t, "")
+	_, _, status, _ := bimiMod.Lookup(r, "example.com", nil)
+	assert.Equal(t, zdns.StatusNXDomain, status)
+
+	mockResults["default._bimi.example.com"] = txtRecords("default._bimi.example.com", "v=spf1 -all")
+	_, _, status, _ = bimiMod.Lookup(r, "example.com", nil)
+	assert.Equal(t, zdns.StatusNoRecord, status)
+}
+
+func TestLookupMalformedRecord(t *testing.T) {
+	for _, record := range []string{
+		"v=BIMI1; a=https://example.com/vmc.pem",
+		"v=BIMI1; l=http://example.com/logo.svg",
+		"v=BIMI1; l=https://example.com/logo.svg; a=example.com/vmc.pem",
+		"v=BIMI1; l=https://example.com/logo.svg; l=https://example.com/other.svg",
+		"v=BIMI1; l",
+	} {
+		r, bimiMod := InitTest(t, "")
+		mockResults["default._bimi.example.com"] = txtRecords("default._bimi.example.com", record)
+		res, _, status, err := bimiMod.Lookup(r, "example.com", nil)
+		assert.NilError(t, err)
+		assert.Equal(t, StatusInvalidRecord, status, record)
+		assert.Equal(t, record, res.(Result).Record)
+		assert.Assert(t, res.(Result).RecordError != "", record)
+	}
+}
@@ -66,6 +66,11 @@ func (bindVersionMod *BindVersionLookupModule) Lookup(r *zdns.Resolver, lookupNa
 	return res, trace, resStatus, err
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (bindVersionMod *BindVersionLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
 func (bindVersionMod *BindVersionLookupModule) Help() string {
 	return ""
 }
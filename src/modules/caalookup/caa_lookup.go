@@ -0,0 +1,118 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package caalookup
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// criticalFlag is the issuer critical bit of a CAA record's flags, RFC 8659 section 4.1
+const criticalFlag = 128
+
+// Record is a single CAA record, ex. an issue, issuewild or iodef property
+type Record struct {
+	Flag     uint8  `json:"flag" groups:"short,normal,long,trace"`
+	Critical bool   `json:"critical" groups:"short,normal,long,trace"` // the issuer critical flag is set
+	Tag      string `json:"tag" groups:"short,normal,long,trace"`
+	Value    string `json:"value" groups:"short,normal,long,trace"`
+	TTL      uint32 `json:"ttl" groups:"ttl,normal,long,trace"`
+}
+
+// Result is the relevant CAA RRset of a name, found by climbing the domain tree as CAs do, RFC 8659 section 3
+type Result struct {
+	// FoundAt is the name the CAA records were found at, the queried name or one of its ancestors
+	FoundAt string `json:"found_at,omitempty" groups:"short,normal,long,trace"`
+	// ClimbDepth is how many labels were removed from the queried name to find the records, 0 if found at the name
+	ClimbDepth int      `json:"climb_depth" groups:"short,normal,long,trace"`
+	Records    []Record `json:"records" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("CAALOOKUP", new(CAALookupModule))
+}
+
+type CAALookupModule struct {
+	cli.BasicLookupModule
+}
+
+// CLIInit initializes the CAA lookup module
+func (caaMod *CAALookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("CAALOOKUP module does not support --all-nameservers")
+	}
+	caaMod.BasicLookupModule.DNSType = dns.TypeCAA
+	caaMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return caaMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup finds the relevant CAA RRset of lookupName. If the name has no CAA records, its parent is queried, and so on
+// up to the top-level domain. A lookup that fails along the way ends the climb, since the relevant RRset is unknown.
+func (caaMod *CAALookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := Result{Records: []Record{}}
+	var trace zdns.Trace
+	labels := dns.SplitDomainName(lookupName)
+	for depth := range labels {
+		name := strings.Join(labels[depth:], ".")
+		innerRes, innerTrace, status, err := caaMod.BasicLookupModule.Lookup(r, name, nameServer)
+		trace = append(trace, innerTrace...)
+		if status == zdns.StatusNXDomain {
+			// the name doesn't exist, but its ancestors may still have CAA records
+			continue
+		}
+		if status != zdns.StatusNoError || err != nil {
+			return res, trace, status, err
+		}
+		castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+		if !ok {
+			return nil, trace, status, errors.New("lookup didn't return a single query result type")
+		}
+		if records := parseRecords(castedInnerRes); len(records) > 0 {
+			res.FoundAt = name
+			res.ClimbDepth = depth
+			res.Records = records
+			return res, trace, zdns.StatusNoError, nil
+		}
+	}
+	return res, trace, zdns.StatusNoRecord, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (caaMod *CAALookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+func parseRecords(res *zdns.SingleQueryResult) []Record {
+	var records []Record
+	for _, a := range res.Answers {
+		ans, ok := a.(zdns.CAAAnswer)
+		if !ok || ans.RrType != dns.TypeCAA {
+			continue
+		}
+		records = append(records, Record{
+			Flag:     ans.Flag,
+			Critical: ans.Flag&criticalFlag != 0,
+			Tag:      strings.ToLower(ans.Tag),
+			Value:    ans.Value,
+			TTL:      ans.TTL,
+		})
+	}
+	return records
+}
@@ -0,0 +1,124 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package caalookup
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+var mockStatuses = make(map[string]zdns.Status)
+var queries []string
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question.Name)
+	if status, ok := mockStatuses[question.Name]; ok {
+		return &zdns.SingleQueryResult{}, nil, status, nil
+	}
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNoError, nil
+	}
+}
+
+func InitTest(t *testing.T) (*zdns.Resolver, *CAALookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	mockStatuses = make(map[string]zdns.Status)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	caaMod := new(CAALookupModule)
+	assert.NilError(t, caaMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r, caaMod
+}
+
+func caaAnswer(t *testing.T, rr string) zdns.CAAAnswer {
+	parsed, err := dns.NewRR(rr)
+	assert.NilError(t, err)
+	return zdns.ParseAnswer(parsed).(zdns.CAAAnswer)
+}
+
+func TestCAALookup_FoundAtName(t *testing.T) {
+	resolver, caaMod := InitTest(t)
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			caaAnswer(t, `zdns-testing.com. 300 IN CAA 0 issue "letsencrypt.org"`),
+			caaAnswer(t, `zdns-testing.com. 300 IN CAA 128 iodef "mailto:security@zdns-testing.com"`),
+		},
+	}
+	res, _, status, err := caaMod.Lookup(resolver, "zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	result := res.(Result)
+	assert.Equal(t, result.FoundAt, "zdns-testing.com")
+	assert.Equal(t, result.ClimbDepth, 0)
+	assert.DeepEqual(t, result.Records, []Record{
+		{Flag: 0, Tag: "issue", Value: "letsencrypt.org", TTL: 300},
+		{Flag: 128, Critical: true, Tag: "iodef", Value: "mailto:security@zdns-testing.com", TTL: 300},
+	})
+}
+
+func TestCAALookup_ClimbsToParent(t *testing.T) {
+	resolver, caaMod := InitTest(t)
+	mockStatuses["a.b.zdns-testing.com"] = zdns.StatusNXDomain
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{caaAnswer(t, `zdns-testing.com. 300 IN CAA 0 issuewild ";"`)},
+	}
+	res, _, status, err := caaMod.Lookup(resolver, "a.b.zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	result := res.(Result)
+	assert.Equal(t, result.FoundAt, "zdns-testing.com")
+	assert.Equal(t, result.ClimbDepth, 2)
+	assert.DeepEqual(t, queries, []string{"a.b.zdns-testing.com", "b.zdns-testing.com", "zdns-testing.com"})
+}
+
+func TestCAALookup_NoRecordsUpToTLD(t *testing.T) {
+	resolver, caaMod := InitTest(t)
+	res, _, status, err := caaMod.Lookup(resolver, "www.zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoRecord, status)
+	assert.Equal(t, res.(Result).FoundAt, "")
+	assert.DeepEqual(t, queries, []string{"www.zdns-testing.com", "zdns-testing.com", "com"})
+}
+
+func TestCAALookup_FailureStopsClimb(t *testing.T) {
+	resolver, caaMod := InitTest(t)
+	mockStatuses["zdns-testing.com"] = zdns.StatusServFail
+	mockResults["com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{caaAnswer(t, `com. 300 IN CAA 0 issue "ca.example"`)},
+	}
+	_, _, status, _ := caaMod.Lookup(resolver, "www.zdns-testing.com", nil)
+	assert.Equal(t, zdns.StatusServFail, status)
+	assert.DeepEqual(t, queries, []string{"www.zdns-testing.com", "zdns-testing.com"})
+}
@@ -0,0 +1,82 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cdcompare
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+type CDCompareLookupModule struct {
+	QueryType string `long:"query-type" default:"A" description:"record type to query with and without the CD bit"`
+	cli.BasicLookupModule
+}
+
+func init() {
+	cdMod := new(CDCompareLookupModule)
+	cli.RegisterLookupModule("CDCOMPARE", cdMod)
+}
+
+// CLIInit initializes the CDCompare lookup module
+func (cdMod *CDCompareLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.IterativeResolution {
+		return errors.New("CDCOMPARE module requires a validating recursive resolver and does not support --iterative")
+	}
+	if gc.LookupAllNameServers {
+		return errors.New("CDCOMPARE module does not support --all-nameservers")
+	}
+	if gc.CheckingDisabled {
+		return errors.New("CDCOMPARE module sets the CD bit itself and does not support --checking-disabled")
+	}
+	qType, ok := dns.StringToType[strings.ToUpper(cdMod.QueryType)]
+	if !ok {
+		return fmt.Errorf("invalid --query-type: %s", cdMod.QueryType)
+	}
+	cdMod.DNSType = qType
+	cdMod.DNSClass = dns.ClassINET
+	return cdMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+func (cdMod *CDCompareLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	return r.DoCDComparisonLookup(&zdns.Question{Name: lookupName, Type: cdMod.DNSType, Class: cdMod.DNSClass}, nameServer)
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (cdMod *CDCompareLookupModule) ResultType() interface{} {
+	return &zdns.CDComparisonResult{}
+}
+
+func (cdMod *CDCompareLookupModule) Help() string {
+	return ""
+}
+
+func (cdMod *CDCompareLookupModule) GetDescription() string {
+	return "CDCOMPARE queries each name with and without the Checking Disabled bit against a validating resolver. " +
+		"A SERVFAIL without CD that becomes an answer with CD indicates the name is DNSSEC Bogus."
+}
+
+func (cdMod *CDCompareLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (cdMod *CDCompareLookupModule) NewFlags() interface{} {
+	return cdMod
+}
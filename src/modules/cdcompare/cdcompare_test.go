@@ -0,0 +1,105 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package cdcompare
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+type mockResponse struct {
+	res    *zdns.SingleQueryResult
+	status zdns.Status
+}
+
+// responses are returned in order, the first for the query without CD and the second for the query with CD
+var mockResponses []mockResponse
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	resp := mockResponses[len(queries)]
+	queries = append(queries, question)
+	return resp.res, nil, resp.status, nil
+}
+
+func InitTest(t *testing.T, responses ...mockResponse) *zdns.Resolver {
+	mockResponses = responses
+	queries = nil
+	rc := zdns.ResolverConfig{
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 53}},
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("192.168.1.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+	return r
+}
+
+func lookup(t *testing.T, r *zdns.Resolver) *zdns.CDComparisonResult {
+	cdMod := CDCompareLookupModule{}
+	cdMod.DNSType = dns.TypeA
+	cdMod.DNSClass = dns.ClassINET
+	res, _, status, err := cdMod.Lookup(r, "example.com", &zdns.NameServer{IP: net.ParseIP("1.2.3.4"), Port: 53})
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Equal(t, 2, len(queries))
+	for _, q := range queries {
+		assert.Equal(t, "example.com", q.Name)
+		assert.Equal(t, dns.TypeA, q.Type)
+	}
+	return res.(*zdns.CDComparisonResult)
+}
+
+func TestCDCompare_Bogus(t *testing.T) {
+	r := InitTest(t,
+		mockResponse{&zdns.SingleQueryResult{}, zdns.StatusServFail},
+		mockResponse{&zdns.SingleQueryResult{Answers: []interface{}{zdns.Answer{Name: "example.com", Type: "A", Answer: "192.0.2.1"}}}, zdns.StatusNoError},
+	)
+	res := lookup(t, r)
+	assert.Equal(t, zdns.StatusServFail, res.WithoutCD.Status)
+	assert.Equal(t, zdns.StatusNoError, res.WithCD.Status)
+	assert.Equal(t, 1, len(res.WithCD.Answers))
+	assert.Equal(t, zdns.CDStateBogus, res.InferredState)
+}
+
+func TestCDCompare_Secure(t *testing.T) {
+	secure := &zdns.SingleQueryResult{Flags: zdns.DNSFlags{Authenticated: true}}
+	r := InitTest(t, mockResponse{secure, zdns.StatusNoError}, mockResponse{secure, zdns.StatusNoError})
+	assert.Equal(t, zdns.CDStateSecure, lookup(t, r).InferredState)
+}
+
+func TestCDCompare_NotValidated(t *testing.T) {
+	r := InitTest(t, mockResponse{&zdns.SingleQueryResult{}, zdns.StatusNXDomain}, mockResponse{&zdns.SingleQueryResult{}, zdns.StatusNXDomain})
+	assert.Equal(t, zdns.CDStateNotValidated, lookup(t, r).InferredState)
+}
+
+func TestCDCompare_ServFail(t *testing.T) {
+	r := InitTest(t, mockResponse{&zdns.SingleQueryResult{}, zdns.StatusServFail}, mockResponse{&zdns.SingleQueryResult{}, zdns.StatusServFail})
+	assert.Equal(t, zdns.CDStateServFail, lookup(t, r).InferredState)
+}
+
+func TestCDCompare_Indeterminate(t *testing.T) {
+	r := InitTest(t, mockResponse{nil, zdns.StatusTimeout}, mockResponse{&zdns.SingleQueryResult{}, zdns.StatusNoError})
+	assert.Equal(t, zdns.CDStateIndeterminate, lookup(t, r).InferredState)
+}
@@ -62,6 +62,11 @@ func (dmarcMod *DmarcLookupModule) Lookup(r *zdns.Resolver, lookupName string, n
 	return res, trace, resStatus, err
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (dmarcMod *DmarcLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
 func (dmarcMod *DmarcLookupModule) Help() string {
 	return ""
 }
@@ -0,0 +1,303 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package emailaudit
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/modules/dmarc"
+	"github.com/zmap/zdns/src/modules/mxlookup"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	// SPF records are identified by an exact version section, "v=spf10" is not one (RFC 7208, section 4.5)
+	spfRecordRegexp = "(?i)^v=spf1( |$)"
+	spfAllRegexp    = "(?i)(^|\\s)([-~?+]?)all(\\s|$)"
+	// a DKIM key record must carry a p= tag, v=DKIM1 is optional (RFC 6376, section 3.6.1)
+	dkimKeyRegexp     = "(?i)(^|;)[\x09\x20]*p[\x09\x20]*="
+	dkimRevokedRegexp = "(?i)(^|;)[\x09\x20]*p[\x09\x20]*=[\x09\x20]*(;|$)"
+	dmarcPolicyRegexp = "(?i)(^|;)[\x09\x20]*p[\x09\x20]*=[\x09\x20]*([a-z]+)"
+)
+
+// Scoring rubric, the points add up to 100
+const (
+	spfPresentPoints      = 20
+	spfHardFailPoints     = 15 // -all
+	spfSoftFailPoints     = 10 // ~all
+	dmarcPresentPoints    = 20
+	dmarcQuarantinePoints = 20
+	dmarcRejectPoints     = 30
+	dkimPresentPoints     = 15
+
+	strongScore   = 80
+	moderateScore = 50
+)
+
+const (
+	VerdictStrong   = "strong"
+	VerdictModerate = "moderate"
+	VerdictWeak     = "weak"
+)
+
+type SPFResult struct {
+	Record string `json:"record" groups:"short,normal,long,trace"`
+	// All is the qualifier on the all mechanism, one of "-", "~", "?", "+", or empty if the record has no all mechanism
+	All string `json:"all,omitempty" groups:"short,normal,long,trace"`
+	// Valid is false if the domain publishes more than one SPF record, a permanent error (RFC 7208, section 4.5)
+	Valid bool `json:"valid" groups:"short,normal,long,trace"`
+}
+
+type DMARCResult struct {
+	Record   string `json:"record" groups:"short,normal,long,trace"`
+	Policy   string `json:"policy,omitempty" groups:"short,normal,long,trace"`
+	Enforced bool   `json:"enforced" groups:"short,normal,long,trace"` // p=quarantine or p=reject
+}
+
+type DKIMSelector struct {
+	Selector string `json:"selector" groups:"short,normal,long,trace"`
+	Record   string `json:"record" groups:"normal,long,trace"`
+	Revoked  bool   `json:"revoked,omitempty" groups:"short,normal,long,trace"` // empty p= tag
+}
+
+// Result is the consolidated email posture of a domain
+type Result struct {
+	// AcceptsMail is true if an exchange resolves to an address, the implicit MX of a domain without MX records
+	// (RFC 5321, section 5.1) isn't considered
+	AcceptsMail   bool               `json:"accepts_mail" groups:"short,normal,long,trace"`
+	NullMX        bool               `json:"null_mx,omitempty" groups:"short,normal,long,trace"`
+	MX            *mxlookup.MXResult `json:"mx,omitempty" groups:"short,normal,long,trace"`
+	SPF           *SPFResult         `json:"spf,omitempty" groups:"short,normal,long,trace"`
+	DMARC         *DMARCResult       `json:"dmarc,omitempty" groups:"short,normal,long,trace"`
+	DKIMSelectors []DKIMSelector     `json:"dkim_selectors,omitempty" groups:"short,normal,long,trace"`
+	Score         int                `json:"score" groups:"short,normal,long,trace"`
+	Verdict       string             `json:"verdict" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	emailMod := new(EmailAuditLookupModule)
+	cli.RegisterLookupModule("EMAILAUDIT", emailMod)
+}
+
+type EmailAuditLookupModule struct {
+	DKIMSelectors string `long:"dkim-selectors" default:"default,dkim,google,k1,k2,mail,s1,s2,selector1,selector2" description:"comma-separated DKIM selectors to probe under _domainkey"`
+	cli.BasicLookupModule
+
+	selectors []string
+	mx        mxlookup.MXLookupModule
+	dmarc     dmarc.DmarcLookupModule
+	txt       cli.BasicLookupModule
+	spfRe     *regexp.Regexp
+	allRe     *regexp.Regexp
+	dkimRe    *regexp.Regexp
+	revokedRe *regexp.Regexp
+	policyRe  *regexp.Regexp
+}
+
+// CLIInit initializes the EMAILAUDIT module and the MXLOOKUP and DMARC modules it composes
+func (emailMod *EmailAuditLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("EMAILAUDIT module does not support --all-nameservers")
+	}
+	emailMod.selectors = nil
+	for _, sel := range strings.Split(emailMod.DKIMSelectors, ",") {
+		if sel = strings.TrimSpace(sel); sel != "" {
+			emailMod.selectors = append(emailMod.selectors, sel)
+		}
+	}
+	emailMod.spfRe = regexp.MustCompile(spfRecordRegexp)
+	emailMod.allRe = regexp.MustCompile(spfAllRegexp)
+	emailMod.dkimRe = regexp.MustCompile(dkimKeyRegexp)
+	emailMod.revokedRe = regexp.MustCompile(dkimRevokedRegexp)
+	emailMod.policyRe = regexp.MustCompile(dmarcPolicyRegexp)
+
+	emailMod.mx.IPv4Lookup = true
+	if err := emailMod.mx.CLIInit(gc, rc); err != nil {
+		return errors.Wrap(err, "failed to initialize MXLOOKUP module")
+	}
+	if err := emailMod.dmarc.CLIInit(gc, rc); err != nil {
+		return errors.Wrap(err, "failed to initialize DMARC module")
+	}
+	emailMod.txt.DNSType = dns.TypeTXT
+	emailMod.txt.DNSClass = dns.ClassINET
+	if err := emailMod.txt.CLIInit(gc, rc); err != nil {
+		return errors.Wrap(err, "failed to initialize TXT lookups")
+	}
+	return emailMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup looks up the MX, SPF, DMARC and DKIM records of a domain and scores them. A failure of any lookup, other than
+// the record not existing, fails the audit since the verdict would be incomplete.
+func (emailMod *EmailAuditLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := &Result{}
+	mxRes, trace, status, err := emailMod.mx.Lookup(r, lookupName, nameServer)
+	if !recordLookupSucceeded(status) || status == zdns.StatusNXDomain {
+		// there's nothing to audit for a domain that doesn't exist
+		return nil, trace, status, err
+	}
+	if castedMXRes, ok := mxRes.(*mxlookup.MXResult); ok && status == zdns.StatusNoError {
+		res.MX = castedMXRes
+		for _, server := range res.MX.Servers {
+			if server.Name == "" {
+				// a single MX with the root as exchange declares the domain doesn't accept mail (RFC 7505)
+				res.NullMX = true
+				continue
+			}
+			if len(server.IPv4Addresses) > 0 || len(server.IPv6Addresses) > 0 {
+				res.AcceptsMail = true
+			}
+		}
+	}
+
+	txtRes, txtTrace, status, err := emailMod.txt.Lookup(r, lookupName, nameServer)
+	trace = append(trace, txtTrace...)
+	if !recordLookupSucceeded(status) {
+		return nil, trace, status, err
+	}
+	if castedTxtRes, ok := txtRes.(*zdns.SingleQueryResult); ok && status == zdns.StatusNoError {
+		res.SPF = emailMod.parseSPF(castedTxtRes)
+	}
+
+	dmarcRes, dmarcTrace, status, err := emailMod.dmarc.Lookup(r, "_dmarc."+lookupName, nameServer)
+	trace = append(trace, dmarcTrace...)
+	if !recordLookupSucceeded(status) {
+		return nil, trace, status, err
+	}
+	if castedDmarcRes, ok := dmarcRes.(dmarc.Result); ok && status == zdns.StatusNoError {
+		record := castedDmarcRes.Dmarc
+		res.DMARC = &DMARCResult{Record: record}
+		if m := emailMod.policyRe.FindStringSubmatch(record); m != nil {
+			res.DMARC.Policy = strings.ToLower(m[2])
+			res.DMARC.Enforced = res.DMARC.Policy == "quarantine" || res.DMARC.Policy == "reject"
+		}
+	}
+
+	for _, sel := range emailMod.selectors {
+		dkimRes, dkimTrace, status, err := emailMod.txt.Lookup(r, sel+"._domainkey."+lookupName, nameServer)
+		trace = append(trace, dkimTrace...)
+		if !recordLookupSucceeded(status) {
+			return nil, trace, status, err
+		}
+		castedDkimRes, ok := dkimRes.(*zdns.SingleQueryResult)
+		if !ok || status != zdns.StatusNoError {
+			continue
+		}
+		if record, err := zdns.FindTxtRecord(castedDkimRes, emailMod.dkimRe); err == nil {
+			res.DKIMSelectors = append(res.DKIMSelectors, DKIMSelector{Selector: sel, Record: record, Revoked: emailMod.revokedRe.MatchString(record)})
+		}
+	}
+
+	res.Score = score(res)
+	res.Verdict = verdict(res.Score)
+	return res, trace, zdns.StatusNoError, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (emailMod *EmailAuditLookupModule) ResultType() interface{} {
+	return &Result{}
+}
+
+// recordLookupSucceeded returns true if the lookup got an authoritative answer, even if that answer is that the record
+// doesn't exist
+func recordLookupSucceeded(status zdns.Status) bool {
+	switch status {
+	case zdns.StatusNoError, zdns.StatusNoRecord, zdns.StatusNoAnswer, zdns.StatusNXDomain:
+		return true
+	}
+	return false
+}
+
+func (emailMod *EmailAuditLookupModule) parseSPF(res *zdns.SingleQueryResult) *SPFResult {
+	var spfRes *SPFResult
+	for _, a := range res.Answers {
+		ans, ok := a.(zdns.Answer)
+		if !ok || !emailMod.spfRe.MatchString(ans.Answer) {
+			continue
+		}
+		if spfRes != nil {
+			spfRes.Valid = false
+			continue
+		}
+		spfRes = &SPFResult{Record: ans.Answer, Valid: true}
+		if m := emailMod.allRe.FindStringSubmatch(ans.Answer); m != nil {
+			spfRes.All = m[2]
+			if spfRes.All == "" {
+				spfRes.All = "+"
+			}
+		}
+	}
+	return spfRes
+}
+
+func score(res *Result) int {
+	points := 0
+	if res.SPF != nil && res.SPF.Valid {
+		points += spfPresentPoints
+		switch res.SPF.All {
+		case "-":
+			points += spfHardFailPoints
+		case "~":
+			points += spfSoftFailPoints
+		}
+	}
+	if res.DMARC != nil {
+		points += dmarcPresentPoints
+		switch res.DMARC.Policy {
+		case "reject":
+			points += dmarcRejectPoints
+		case "quarantine":
+			points += dmarcQuarantinePoints
+		}
+	}
+	for _, sel := range res.DKIMSelectors {
+		if !sel.Revoked {
+			points += dkimPresentPoints
+			break
+		}
+	}
+	return points
+}
+
+func verdict(score int) string {
+	switch {
+	case score >= strongScore:
+		return VerdictStrong
+	case score >= moderateScore:
+		return VerdictModerate
+	default:
+		return VerdictWeak
+	}
+}
+
+func (emailMod *EmailAuditLookupModule) Help() string {
+	return ""
+}
+
+func (emailMod *EmailAuditLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (emailMod *EmailAuditLookupModule) GetDescription() string {
+	return "EMAILAUDIT looks up the MX, SPF, DMARC and DKIM records of a domain and reports whether it accepts mail, " +
+		"whether SPF is valid, whether DMARC is enforced and which DKIM selectors exist, along with a score out of 100."
+}
+
+func (emailMod *EmailAuditLookupModule) NewFlags() interface{} {
+	return emailMod
+}
@@ -0,0 +1,151 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package emailaudit
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+type mockKey struct {
+	name  string
+	qType uint16
+}
+
+var mockResults map[mockKey]*zdns.SingleQueryResult
+var mockStatuses map[mockKey]zdns.Status
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	if status, ok := mockStatuses[mockKey{question.Name, question.Type}]; ok {
+		return &zdns.SingleQueryResult{}, nil, status, nil
+	}
+	if res, ok := mockResults[mockKey{question.Name, question.Type}]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+}
+
+func initTest(t *testing.T) (*zdns.Resolver, *EmailAuditLookupModule) {
+	mockResults = make(map[mockKey]*zdns.SingleQueryResult)
+	mockStatuses = make(map[mockKey]zdns.Status)
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	require.NoError(t, err)
+	emailMod := &EmailAuditLookupModule{DKIMSelectors: "google, selector1"}
+	require.NoError(t, emailMod.CLIInit(&cli.CLIConf{}, &rc))
+	return r, emailMod
+}
+
+func txtResult(name string, records ...string) *zdns.SingleQueryResult {
+	res := &zdns.SingleQueryResult{}
+	for _, rec := range records {
+		res.Answers = append(res.Answers, zdns.Answer{Name: name, Type: "TXT", Class: "IN", Answer: rec})
+	}
+	return res
+}
+
+func TestEmailAuditStrong(t *testing.T) {
+	r, emailMod := initTest(t)
+	mockResults[mockKey{"example.com", dns.TypeMX}] = &zdns.SingleQueryResult{Answers: []interface{}{
+		zdns.PrefAnswer{Answer: zdns.Answer{Name: "example.com", Type: "MX", Class: "IN", Answer: "mail.example.com."}, Preference: 10},
+	}}
+	mockResults[mockKey{"mail.example.com", dns.TypeA}] = &zdns.SingleQueryResult{Answers: []interface{}{
+		zdns.Answer{Name: "mail.example.com", Type: "A", Class: "IN", Answer: "192.0.2.1"},
+	}}
+	mockResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com", "google-site-verification=abc", "v=spf1 mx -all")
+	mockResults[mockKey{"_dmarc.example.com", dns.TypeTXT}] = txtResult("_dmarc.example.com", "v=DMARC1; p=reject; rua=mailto:d@example.com")
+	mockResults[mockKey{"selector1._domainkey.example.com", dns.TypeTXT}] = txtResult("selector1._domainkey.example.com", "v=DKIM1; k=rsa; p=MIGfMA0G")
+
+	res, _, status, err := emailMod.Lookup(r, "example.com", nil)
+	require.NoError(t, err)
+	require.Equal(t, zdns.StatusNoError, status)
+	audit := res.(*Result)
+	require.True(t, audit.AcceptsMail)
+	require.Equal(t, &SPFResult{Record: "v=spf1 mx -all", All: "-", Valid: true}, audit.SPF)
+	require.Equal(t, "reject", audit.DMARC.Policy)
+	require.True(t, audit.DMARC.Enforced)
+	require.Equal(t, []DKIMSelector{{Selector: "selector1", Record: "v=DKIM1; k=rsa; p=MIGfMA0G"}}, audit.DKIMSelectors)
+	require.Equal(t, 100, audit.Score)
+	require.Equal(t, VerdictStrong, audit.Verdict)
+}
+
+func TestEmailAuditWeak(t *testing.T) {
+	r, emailMod := initTest(t)
+	// null MX, two SPF records and a monitoring-only DMARC policy
+	mockResults[mockKey{"example.com", dns.TypeMX}] = &zdns.SingleQueryResult{Answers: []interface{}{
+		zdns.PrefAnswer{Answer: zdns.Answer{Name: "example.com", Type: "MX", Class: "IN", Answer: "."}, Preference: 0},
+	}}
+	mockResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com", "v=spf1 -all", "v=spf1 include:_spf.example.net ~all")
+	mockResults[mockKey{"_dmarc.example.com", dns.TypeTXT}] = txtResult("_dmarc.example.com", "v=DMARC1; p=none")
+	mockResults[mockKey{"google._domainkey.example.com", dns.TypeTXT}] = txtResult("google._domainkey.example.com", "v=DKIM1; p=")
+
+	res, _, status, err := emailMod.Lookup(r, "example.com", nil)
+	require.NoError(t, err)
+	require.Equal(t, zdns.StatusNoError, status)
+	audit := res.(*Result)
+	require.False(t, audit.AcceptsMail)
+	require.True(t, audit.NullMX)
+	require.False(t, audit.SPF.Valid)
+	require.False(t, audit.DMARC.Enforced)
+	require.Len(t, audit.DKIMSelectors, 1)
+	require.True(t, audit.DKIMSelectors[0].Revoked)
+	require.Equal(t, dmarcPresentPoints, audit.Score)
+	require.Equal(t, VerdictWeak, audit.Verdict)
+}
+
+func TestEmailAuditNXDomain(t *testing.T) {
+	r, emailMod := initTest(t)
+	res, _, status, _ := emailMod.Lookup(r, "example.com", nil)
+	require.Nil(t, res)
+	require.Equal(t, zdns.StatusNXDomain, status)
+}
+
+func TestEmailAuditNoMX(t *testing.T) {
+	r, emailMod := initTest(t)
+	mockStatuses[mockKey{"example.com", dns.TypeMX}] = zdns.StatusNoAnswer
+	mockResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com", "v=spf1 -all")
+
+	res, _, status, err := emailMod.Lookup(r, "example.com", nil)
+	require.NoError(t, err)
+	require.Equal(t, zdns.StatusNoError, status)
+	audit := res.(*Result)
+	require.Nil(t, audit.MX)
+	require.False(t, audit.AcceptsMail)
+	require.True(t, audit.SPF.Valid)
+}
+
+func TestEmailAuditMXServFail(t *testing.T) {
+	r, emailMod := initTest(t)
+	mockStatuses[mockKey{"example.com", dns.TypeMX}] = zdns.StatusServFail
+	mockResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com", "v=spf1 -all")
+
+	res, _, status, _ := emailMod.Lookup(r, "example.com", nil)
+	require.Nil(t, res)
+	require.Equal(t, zdns.StatusServFail, status)
+}
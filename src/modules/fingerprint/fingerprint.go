@@ -0,0 +1,145 @@
+/*
+ * ZDNS Copyright 2016 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package fingerprint
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// CHAOS-class TXT names name servers answer with details of their software and of the instance queried
+const (
+	VersionBindQueryName  = "VERSION.BIND"
+	HostnameBindQueryName = "HOSTNAME.BIND"
+	IDServerQueryName     = "ID.SERVER"
+	AuthorsBindQueryName  = "AUTHORS.BIND"
+)
+
+// Result is what a name server disclosed about itself, with the status of each query by name
+type Result struct {
+	Version  string            `json:"version,omitempty" groups:"short,normal,long,trace"`
+	Hostname string            `json:"hostname,omitempty" groups:"short,normal,long,trace"`
+	ID       string            `json:"id,omitempty" groups:"short,normal,long,trace"`
+	Authors  []string          `json:"authors,omitempty" groups:"short,normal,long,trace"`
+	Statuses map[string]string `json:"statuses" groups:"normal,long,trace"`
+}
+
+type FingerprintLookupModule struct {
+	cli.BasicLookupModule
+}
+
+func init() {
+	f := new(FingerprintLookupModule)
+	cli.RegisterLookupModule("FINGERPRINT", f)
+}
+
+// CLIInit initializes the Fingerprint lookup module
+func (fpMod *FingerprintLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("FINGERPRINT module does not support --all-nameservers")
+	}
+	return fpMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup sends each of the CHAOS TXT queries to the name server. The status is NOERROR if it answered any of them,
+// otherwise that of the version.bind query.
+func (fpMod *FingerprintLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := Result{Statuses: make(map[string]string)}
+	var trace zdns.Trace
+	var firstStatus zdns.Status
+	var firstErr error
+	answered := false
+	for _, name := range []string{VersionBindQueryName, HostnameBindQueryName, IDServerQueryName, AuthorsBindQueryName} {
+		innerRes, innerTrace, status, err := fpMod.chaosTXTLookup(r, name, nameServer)
+		trace = append(trace, innerTrace...)
+		var values []string
+		if status == zdns.StatusNoError {
+			values = txtValues(innerRes)
+			if len(values) == 0 {
+				status = zdns.StatusNoRecord
+			}
+		}
+		res.Statuses[name] = string(status)
+		if firstStatus == "" {
+			firstStatus, firstErr = status, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		answered = true
+		switch name {
+		case VersionBindQueryName:
+			res.Version = values[0]
+		case HostnameBindQueryName:
+			res.Hostname = values[0]
+		case IDServerQueryName:
+			res.ID = values[0]
+		case AuthorsBindQueryName:
+			res.Authors = values
+		}
+	}
+	if !answered {
+		return res, trace, firstStatus, firstErr
+	}
+	return res, trace, zdns.StatusNoError, nil
+}
+
+func (fpMod *FingerprintLookupModule) chaosTXTLookup(r *zdns.Resolver, name string, nameServer *zdns.NameServer) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	q := &zdns.Question{Name: name, Type: dns.TypeTXT, Class: dns.ClassCHAOS}
+	if fpMod.IsIterative {
+		return r.IterativeLookup(context.Background(), q)
+	}
+	return r.ExternalLookup(context.Background(), q, nameServer)
+}
+
+// txtValues returns the TXT answers of res
+func txtValues(res *zdns.SingleQueryResult) []string {
+	if res == nil {
+		return nil
+	}
+	var values []string
+	for _, a := range res.Answers {
+		if ans, ok := a.(zdns.Answer); ok && ans.RrType == dns.TypeTXT {
+			values = append(values, ans.Answer)
+		}
+	}
+	return values
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (fpMod *FingerprintLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+func (fpMod *FingerprintLookupModule) Help() string {
+	return ""
+}
+
+func (fpMod *FingerprintLookupModule) GetDescription() string {
+	return "FINGERPRINT sends the CHAOS-class TXT queries version.bind, hostname.bind, id.server and authors.bind to each name server, and reports what it disclosed about its software and instance"
+}
+
+func (fpMod *FingerprintLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (fpMod *FingerprintLookupModule) NewFlags() interface{} {
+	return fpMod
+}
@@ -0,0 +1,97 @@
+/*
+ * ZDNS Copyright 2022 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package fingerprint
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults map[string]*zdns.SingleQueryResult
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question)
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusRefused, nil
+}
+
+func InitTest(t *testing.T) *zdns.Resolver {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 53}},
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("1.1.1.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("192.168.1.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+	return r
+}
+
+func txtResult(name string, values ...string) *zdns.SingleQueryResult {
+	res := &zdns.SingleQueryResult{}
+	for _, v := range values {
+		res.Answers = append(res.Answers, zdns.Answer{Name: name, Type: "TXT", RrType: dns.TypeTXT, Class: "CHAOS", Answer: v})
+	}
+	return res
+}
+
+func TestFingerprintLookup(t *testing.T) {
+	resolver := InitTest(t)
+	mockResults[VersionBindQueryName] = txtResult(VersionBindQueryName, "9.18.24")
+	mockResults[HostnameBindQueryName] = txtResult(HostnameBindQueryName, "ns1.example.com")
+	mockResults[AuthorsBindQueryName] = txtResult(AuthorsBindQueryName, "Alice", "Bob")
+	fpMod := FingerprintLookupModule{}
+	res, _, status, err := fpMod.Lookup(resolver, "", &zdns.NameServer{IP: net.ParseIP("192.0.2.53"), Port: 53})
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Equal(t, len(queries), 4)
+	for _, q := range queries {
+		assert.Equal(t, q.Class, uint16(dns.ClassCHAOS))
+		assert.Equal(t, q.Type, dns.TypeTXT)
+	}
+	assert.DeepEqual(t, res.(Result), Result{
+		Version:  "9.18.24",
+		Hostname: "ns1.example.com",
+		Authors:  []string{"Alice", "Bob"},
+		Statuses: map[string]string{
+			VersionBindQueryName:  "NOERROR",
+			HostnameBindQueryName: "NOERROR",
+			IDServerQueryName:     "REFUSED",
+			AuthorsBindQueryName:  "NOERROR",
+		},
+	})
+}
+
+func TestFingerprintLookup_NothingDisclosed(t *testing.T) {
+	resolver := InitTest(t)
+	mockResults[VersionBindQueryName] = txtResult(VersionBindQueryName)
+	fpMod := FingerprintLookupModule{}
+	res, _, status, _ := fpMod.Lookup(resolver, "", &zdns.NameServer{IP: net.ParseIP("192.0.2.53"), Port: 53})
+	assert.Equal(t, zdns.StatusNoRecord, status, "the status of version.bind is reported")
+	assert.Equal(t, res.(Result).Statuses[IDServerQueryName], "REFUSED")
+}
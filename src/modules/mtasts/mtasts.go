@@ -0,0 +1,274 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package mtasts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const (
+	// the TXT record at _mta-sts.<domain> announcing a policy, RFC 8461 section 3.1
+	stsRecordRegexp = "^v[\x09\x20]*=[\x09\x20]*STSv1([\x09\x20]*;|[\x09\x20]*$)"
+	stsIDRegexp     = "(^|;)[\x09\x20]*id[\x09\x20]*=[\x09\x20]*([A-Za-z0-9]{1,32})[\x09\x20]*(;|$)"
+	// policies are small, a body larger than this isn't read, RFC 8461 section 3.3
+	maxPolicySize = 64 * 1024
+)
+
+const (
+	// StatusNoPolicy is returned when the domain announces a policy over DNS, but it couldn't be fetched over HTTPS
+	StatusNoPolicy zdns.Status = "NO_POLICY"
+	// StatusInvalidPolicy is returned when the policy fetched over HTTPS couldn't be parsed
+	StatusInvalidPolicy zdns.Status = "INVALID_POLICY"
+)
+
+// Policy is an MTA-STS policy, RFC 8461 section 3.2
+type Policy struct {
+	Version string   `json:"version" groups:"short,normal,long,trace"`
+	Mode    string   `json:"mode" groups:"short,normal,long,trace"`
+	MX      []string `json:"mx" groups:"short,normal,long,trace"`
+	MaxAge  int      `json:"max_age" groups:"short,normal,long,trace"` // seconds the policy may be cached for
+}
+
+type Result struct {
+	Record string  `json:"record,omitempty" groups:"short,normal,long,trace"`
+	ID     string  `json:"id,omitempty" groups:"short,normal,long,trace"` // changes whenever the policy does
+	Policy *Policy `json:"policy,omitempty" groups:"short,normal,long,trace"`
+	// PolicyError is why the policy couldn't be fetched or parsed
+	PolicyError string `json:"policy_error,omitempty" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("MTASTS", new(MTASTSLookupModule))
+}
+
+type MTASTSLookupModule struct {
+	cli.BasicLookupModule
+	recordRe *regexp.Regexp
+	idRe     *regexp.Regexp
+	client   *http.Client
+	// policyURL returns the URL of the policy of a domain, it's only replaced by tests
+	policyURL func(domain string) string
+	// whether the policy host's A and AAAA records are looked up, following --4 and --6
+	lookupA    bool
+	lookupAAAA bool
+}
+
+// policyAddrsKey is the key of the context value holding the addresses the policy host resolved to
+type policyAddrsKey struct{}
+
+// CLIInit initializes the MTASTS lookup module. The policy fetch is bounded by --timeout
+func (stsMod *MTASTSLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("MTASTS module does not support --all-nameservers")
+	}
+	stsMod.recordRe = regexp.MustCompile(stsRecordRegexp)
+	stsMod.idRe = regexp.MustCompile(stsIDRegexp)
+	// the policy host is resolved by the module's resolver rather than the system's, the dialer connects to the
+	// addresses it resolved to while the URL keeps the host name for SNI and the Host header
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialPolicyHost
+	stsMod.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(gc.Timeout) * time.Second,
+		// redirects must not be followed when fetching a policy, RFC 8461 section 3.3
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	stsMod.policyURL = func(domain string) string {
+		return "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	}
+	stsMod.lookupA = rc.IPVersionMode != zdns.IPv6Only
+	stsMod.lookupAAAA = rc.IPVersionMode != zdns.IPv4Only
+	stsMod.BasicLookupModule.DNSType = dns.TypeTXT
+	stsMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return stsMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup looks up the _mta-sts TXT record of lookupName and, if it announces a policy, fetches the policy over HTTPS
+// from mta-sts.<lookupName>, resolved with r. A missing record is reported with the status of the TXT lookup, a policy
+// that couldn't be fetched with StatusNoPolicy
+func (stsMod *MTASTSLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	domain := strings.ToLower(strings.TrimSuffix(lookupName, "."))
+	innerRes, trace, status, err := stsMod.BasicLookupModule.Lookup(r, "_mta-sts."+domain, nameServer)
+	castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+	if !ok {
+		return nil, trace, status, errors.New("lookup didn't return a single query result type")
+	}
+	record, status, err := zdns.CheckTxtRecords(castedInnerRes, status, stsMod.recordRe, err)
+	res := Result{Record: record}
+	if status != zdns.StatusNoError {
+		return res, trace, status, err
+	}
+	if m := stsMod.idRe.FindStringSubmatch(record); m != nil {
+		res.ID = m[2]
+	}
+
+	policyHost := "mta-sts." + domain
+	ips, ipTrace, ipStatus, err := r.DoTargetedLookup(policyHost, nameServer, stsMod.IsIterative, stsMod.lookupA, stsMod.lookupAAAA)
+	trace = append(trace, ipTrace...)
+	if ipStatus != zdns.StatusNoError || ips == nil || len(ips.IPv4Addresses)+len(ips.IPv6Addresses) == 0 {
+		res.PolicyError = fmt.Sprintf("could not resolve %s: %s", policyHost, ipStatus)
+		if err != nil {
+			res.PolicyError += ": " + err.Error()
+		}
+		if ipStatus == zdns.StatusTimeout {
+			return res, trace, zdns.StatusTimeout, nil
+		}
+		return res, trace, StatusNoPolicy, nil
+	}
+
+	body, err := stsMod.fetchPolicy(domain, append(ips.IPv4Addresses, ips.IPv6Addresses...))
+	if err != nil {
+		res.PolicyError = err.Error()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return res, trace, zdns.StatusTimeout, nil
+		}
+		return res, trace, StatusNoPolicy, nil
+	}
+	policy, err := parsePolicy(body)
+	if err != nil {
+		res.PolicyError = err.Error()
+		return res, trace, StatusInvalidPolicy, nil
+	}
+	res.Policy = policy
+	return res, trace, zdns.StatusNoError, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (stsMod *MTASTSLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// fetchPolicy fetches the policy of domain from the first of addrs, the addresses of its policy host, that accepts a
+// connection
+func (stsMod *MTASTSLookupModule) fetchPolicy(domain string, addrs []string) (string, error) {
+	ctx := context.WithValue(context.Background(), policyAddrsKey{}, addrs)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, stsMod.policyURL(domain), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch policy: %w", err)
+	}
+	resp, err := stsMod.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch policy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not fetch policy: HTTP status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize))
+	if err != nil {
+		return "", fmt.Errorf("could not read policy: %w", err)
+	}
+	return string(body), nil
+}
+
+// dialPolicyHost connects to the port of addr on the first of the addresses in ctx that accepts the connection
+func dialPolicyHost(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, _ := ctx.Value(policyAddrsKey{}).([]string)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses to connect to %s", addr)
+	}
+	var dialer net.Dialer
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// parsePolicy parses the "key: value" lines of a policy. The version, mode and max_age fields are required, mx is
+// required unless the mode is none
+func parsePolicy(body string) (*Policy, error) {
+	policy := &Policy{MX: []string{}}
+	hasMaxAge := false
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			policy.Version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			maxAge, err := strconv.Atoi(value)
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("invalid max_age %q", value)
+			}
+			policy.MaxAge = maxAge
+			hasMaxAge = true
+		}
+	}
+	if policy.Version != "STSv1" {
+		return nil, fmt.Errorf("invalid version %q", policy.Version)
+	}
+	switch policy.Mode {
+	case "enforce", "testing":
+		if len(policy.MX) == 0 {
+			return nil, fmt.Errorf("no mx in %s mode", policy.Mode)
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("invalid mode %q", policy.Mode)
+	}
+	if !hasMaxAge {
+		return nil, errors.New("missing max_age")
+	}
+	return policy, nil
+}
+
+func (stsMod *MTASTSLookupModule) Help() string {
+	return ""
+}
+
+func (stsMod *MTASTSLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (stsMod *MTASTSLookupModule) GetDescription() string {
+	return "MTASTS looks up the _mta-sts TXT record of a domain and fetches the MTA-STS policy it announces over HTTPS."
+}
+
+func (stsMod *MTASTSLookupModule) NewFlags() interface{} {
+	return stsMod
+}
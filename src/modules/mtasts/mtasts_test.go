@@ -0,0 +1,161 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package mtasts
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+	}
+}
+
+// InitTest serves handler as the policy of every domain, example.com's policy host resolves to the server
+func InitTest(t *testing.T, handler http.HandlerFunc) (*zdns.Resolver, *MTASTSLookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	stsMod := &MTASTSLookupModule{}
+	assert.NilError(t, stsMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	// the test certificate is valid for *.example.com, so the server is reached through the policy host's name
+	stsMod.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	serverURL, err := url.Parse(server.URL)
+	assert.NilError(t, err)
+	stsMod.policyURL = func(domain string) string {
+		return "https://mta-sts." + domain + ":" + serverURL.Port() + "/.well-known/mta-sts.txt"
+	}
+	mockResults["mta-sts.example.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{zdns.Answer{Name: "mta-sts.example.com", Type: "A", Class: "IN", Answer: serverURL.Hostname()}},
+	}
+	return r, stsMod
+}
+
+func servePolicy(policy string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(policy))
+	}
+}
+
+func txtRecord(name, record string) *zdns.SingleQueryResult {
+	return &zdns.SingleQueryResult{Answers: []interface{}{zdns.Answer{Name: name, Type: "TXT", Class: "IN", Answer: record}}}
+}
+
+func TestLookupPolicy(t *testing.T) {
+	r, stsMod := InitTest(t, servePolicy("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 604800\r\n"))
+	mockResults["_mta-sts.example.com"] = txtRecord("_mta-sts.example.com", "v=STSv1; id=20160831085700Z;")
+
+	res, _, status, err := stsMod.Lookup(r, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, status, zdns.StatusNoError)
+	result := res.(Result)
+	assert.Equal(t, result.ID, "20160831085700Z")
+	assert.DeepEqual(t, result.Policy, &Policy{Version: "STSv1", Mode: "enforce", MX: []string{"mail.example.com", "*.example.net"}, MaxAge: 604800})
+}
+
+func TestLookupNoRecord(t *testing.T) {
+	r, stsMod := InitTest(t, servePolicy("version: STSv1\nmode: none\nmax_age: 86400\n"))
+
+	_, _, status, _ := stsMod.Lookup(r, "example.com", nil)
+	assert.Equal(t, status, zdns.StatusNXDomain)
+
+	mockResults["_mta-sts.example.com"] = txtRecord("_mta-sts.example.com", "v=spf1 -all")
+	_, _, status, _ = stsMod.Lookup(r, "example.com", nil)
+	assert.Equal(t, status, zdns.StatusNoRecord)
+}
+
+func TestLookupNoPolicy(t *testing.T) {
+	r, stsMod := InitTest(t, http.NotFound)
+	mockResults["_mta-sts.example.com"] = txtRecord("_mta-sts.example.com", "v=STSv1; id=1")
+
+	res, _, status, err := stsMod.Lookup(r, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, status, StatusNoPolicy)
+	assert.Equal(t, res.(Result).ID, "1")
+	assert.Assert(t, res.(Result).Policy == nil)
+	assert.Equal(t, res.(Result).PolicyError, "could not fetch policy: HTTP status 404")
+}
+
+func TestLookupPolicyHostNotResolved(t *testing.T) {
+	r, stsMod := InitTest(t, servePolicy("version: STSv1\r\nmode: none\r\nmax_age: 86400\r\n"))
+	mockResults["_mta-sts.example.com"] = txtRecord("_mta-sts.example.com", "v=STSv1; id=1")
+	delete(mockResults, "mta-sts.example.com")
+	res, _, status, err := stsMod.Lookup(r, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, status, StatusNoPolicy)
+	assert.Assert(t, res.(Result).Policy == nil)
+	assert.Equal(t, res.(Result).PolicyError, "could not resolve mta-sts.example.com: NXDOMAIN")
+}
+
+func TestLookupRedirectNotFollowed(t *testing.T) {
+	r, stsMod := InitTest(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "https://elsewhere.example.com/.well-known/mta-sts.txt", http.StatusFound)
+	})
+	mockResults["_mta-sts.example.com"] = txtRecord("_mta-sts.example.com", "v=STSv1; id=1")
+
+	_, _, status, _ := stsMod.Lookup(r, "example.com", nil)
+	assert.Equal(t, status, StatusNoPolicy)
+}
+
+func TestLookupInvalidPolicy(t *testing.T) {
+	r, stsMod := InitTest(t, servePolicy("version: STSv1\nmode: enforce\nmax_age: 86400\n"))
+	mockResults["_mta-sts.example.com"] = txtRecord("_mta-sts.example.com", "v=STSv1; id=1")
+
+	res, _, status, _ := stsMod.Lookup(r, "example.com", nil)
+	assert.Equal(t, status, StatusInvalidPolicy)
+	assert.Equal(t, res.(Result).PolicyError, "no mx in enforce mode")
+}
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := parsePolicy("version: STSv1\nmode: none\nmax_age: 0\n")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, policy, &Policy{Version: "STSv1", Mode: "none", MX: []string{}, MaxAge: 0})
+
+	_, err = parsePolicy("version: STSv2\nmode: none\nmax_age: 86400\n")
+	assert.ErrorContains(t, err, "invalid version")
+	_, err = parsePolicy("version: STSv1\nmode: strict\nmax_age: 86400\n")
+	assert.ErrorContains(t, err, "invalid mode")
+	_, err = parsePolicy("version: STSv1\nmode: none\n")
+	assert.ErrorContains(t, err, "missing max_age")
+	_, err = parsePolicy("version: STSv1\nmode: none\nmax_age: a week\n")
+	assert.ErrorContains(t, err, "invalid max_age")
+}
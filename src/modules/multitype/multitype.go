@@ -0,0 +1,200 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package multitype
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// Result holds the outcome of the lookup of each requested type for a name, keyed by type
+type Result struct {
+	Types map[string]TypeResult `json:"types" groups:"short,normal,long,trace"`
+}
+
+// TypeResult is the outcome of the lookup of a single type. Each type's status is independent of the others'.
+type TypeResult struct {
+	Status string      `json:"status" groups:"short,normal,long,trace"`
+	Error  string      `json:"error,omitempty" groups:"short,normal,long,trace"`
+	Data   interface{} `json:"data,omitempty" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("MULTITYPE", new(MultiTypeLookupModule))
+}
+
+type MultiTypeLookupModule struct {
+	Types string `long:"types" default:"A,AAAA" description:"comma-separated list of record types to look up for each name, ex. A,AAAA,MX,TXT. The lookups of a name are sent at once"`
+	cli.BasicLookupModule
+
+	qTypes  []uint16
+	helpers helperPool
+}
+
+// CLIInit initializes the MULTITYPE module
+func (mtMod *MultiTypeLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	qTypes, err := parseTypes(mtMod.Types)
+	if err != nil {
+		return err
+	}
+	mtMod.qTypes = qTypes
+	mtMod.helpers = helperPool{config: rc, seeds: newHelperSeeds(rc.Seed)}
+	mtMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return mtMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// parseTypes parses a comma-separated list of record types
+func parseTypes(types string) ([]uint16, error) {
+	var qTypes []uint16
+	seen := make(map[uint16]struct{})
+	for _, t := range strings.Split(types, ",") {
+		t = strings.ToUpper(strings.TrimSpace(t))
+		qType, ok := dns.StringToType[t]
+		if !ok {
+			return nil, fmt.Errorf("invalid record type %q in --types", t)
+		}
+		if _, ok = seen[qType]; ok {
+			return nil, fmt.Errorf("record type %s is given more than once in --types", t)
+		}
+		seen[qType] = struct{}{}
+		qTypes = append(qTypes, qType)
+	}
+	if len(qTypes) == 0 {
+		return nil, errors.New("--types must list at least one record type")
+	}
+	return qTypes, nil
+}
+
+// Lookup looks up each of the module's types for lookupName at once, the first with r and the others with helper
+// resolvers. The status is NOERROR if any type's lookup succeeded, otherwise that of the first type.
+func (mtMod *MultiTypeLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := Result{Types: make(map[string]TypeResult, len(mtMod.qTypes))}
+	traces := make([]zdns.Trace, len(mtMod.qTypes))
+	statuses := make([]zdns.Status, len(mtMod.qTypes))
+	typeResults := make([]TypeResult, len(mtMod.qTypes))
+	var wg sync.WaitGroup
+	for i, qType := range mtMod.qTypes {
+		resolver := r
+		if i > 0 {
+			helper, err := mtMod.helpers.get()
+			if err != nil {
+				// look the type up once the others are done instead
+				wg.Wait()
+				typeResults[i], traces[i], statuses[i] = mtMod.lookupType(r, qType, lookupName, nameServer)
+				continue
+			}
+			defer mtMod.helpers.put(helper)
+			resolver = helper
+		}
+		wg.Add(1)
+		go func(i int, qType uint16, resolver *zdns.Resolver) {
+			defer wg.Done()
+			typeResults[i], traces[i], statuses[i] = mtMod.lookupType(resolver, qType, lookupName, nameServer)
+		}(i, qType, resolver)
+	}
+	wg.Wait()
+
+	var trace zdns.Trace
+	status := statuses[0]
+	for i, qType := range mtMod.qTypes {
+		res.Types[dns.TypeToString[qType]] = typeResults[i]
+		trace = append(trace, traces[i]...)
+		if statuses[i] == zdns.StatusNoError {
+			status = zdns.StatusNoError
+		}
+	}
+	return res, trace, status, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (mtMod *MultiTypeLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// lookupType looks up a single type for lookupName
+func (mtMod *MultiTypeLookupModule) lookupType(r *zdns.Resolver, qType uint16, lookupName string, nameServer *zdns.NameServer) (TypeResult, zdns.Trace, zdns.Status) {
+	typeMod := mtMod.BasicLookupModule
+	typeMod.DNSType = qType
+	innerRes, trace, status, err := typeMod.Lookup(r, lookupName, nameServer)
+	typeRes := TypeResult{Status: string(status), Data: innerRes}
+	if err != nil {
+		typeRes.Error = err.Error()
+	}
+	return typeRes, trace, status
+}
+
+// helperPool hands out the resolvers that look up the extra types of a name. Resolvers aren't safe for concurrent use,
+// so each helper is only used by one lookup at a time. Helpers share the cache of the resolver config.
+type helperPool struct {
+	sync.Mutex
+	config *zdns.ResolverConfig
+	idle   []*zdns.Resolver
+	seeds  *rand.Rand // seeds of new helpers, so they don't all make the same random choices
+}
+
+// newHelperSeeds returns the source of helper seeds for a pool created from a config with the given seed, or a random
+// one if it's 0
+func newHelperSeeds(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+func (p *helperPool) get() (*zdns.Resolver, error) {
+	p.Lock()
+	if n := len(p.idle); n > 0 {
+		helper := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.Unlock()
+		return helper, nil
+	}
+	config := *p.config
+	config.Seed = p.seeds.Int63()
+	p.Unlock()
+	return zdns.InitResolver(&config)
+}
+
+func (p *helperPool) put(helper *zdns.Resolver) {
+	p.Lock()
+	defer p.Unlock()
+	p.idle = append(p.idle, helper)
+}
+
+// Help
+func (mtMod *MultiTypeLookupModule) Help() string {
+	return ""
+}
+
+// Validate
+func (mtMod *MultiTypeLookupModule) Validate(args []string) error {
+	return nil
+}
+
+// Description
+func (mtMod *MultiTypeLookupModule) GetDescription() string {
+	return "MULTITYPE looks up several record types for each name at once, see --types, and reports each type's answers and status under one result."
+}
+
+func (mtMod *MultiTypeLookupModule) NewFlags() interface{} {
+	return mtMod
+}
@@ -0,0 +1,104 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package multitype
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// types are looked up concurrently, so the mock's state is guarded
+var mockMu sync.Mutex
+var mockResults = make(map[zdns.Question]*zdns.SingleQueryResult)
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	mockMu.Lock()
+	defer mockMu.Unlock()
+	queries = append(queries, question)
+	if res, ok := mockResults[question]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+	}
+}
+
+func InitTest(t *testing.T, mtMod *MultiTypeLookupModule) *zdns.Resolver {
+	mockResults = make(map[zdns.Question]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+	assert.NilError(t, mtMod.CLIInit(&cli.CLIConf{}, &rc))
+	return r
+}
+
+func TestMultiTypeLookup(t *testing.T) {
+	mtMod := &MultiTypeLookupModule{Types: "a, AAAA,mx"}
+	resolver := InitTest(t, mtMod)
+	aRes := &zdns.SingleQueryResult{Answers: []interface{}{zdns.Answer{Type: "A", RrType: dns.TypeA, Class: "IN", Name: "example.com", Answer: "192.0.2.1"}}}
+	mxRes := &zdns.SingleQueryResult{Answers: []interface{}{zdns.PrefAnswer{Answer: zdns.Answer{Type: "MX", RrType: dns.TypeMX, Class: "IN", Name: "example.com", Answer: "mail.example.com."}, Preference: 10}}}
+	mockResults[zdns.Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET}] = aRes
+	mockResults[zdns.Question{Name: "example.com", Type: dns.TypeMX, Class: dns.ClassINET}] = mxRes
+
+	for i := 0; i < 2; i++ {
+		// the second lookup reuses the helpers of the first
+		res, _, status, err := mtMod.Lookup(resolver, "example.com", nil)
+		assert.NilError(t, err)
+		assert.Equal(t, zdns.StatusNoError, status)
+		types := res.(Result).Types
+		assert.Equal(t, len(types), 3)
+		assert.DeepEqual(t, types["A"], TypeResult{Status: "NOERROR", Data: aRes})
+		assert.Equal(t, types["AAAA"].Status, "NXDOMAIN")
+		assert.DeepEqual(t, types["MX"], TypeResult{Status: "NOERROR", Data: mxRes})
+	}
+	assert.Equal(t, len(queries), 6)
+	assert.Equal(t, len(mtMod.helpers.idle), 2)
+}
+
+func TestMultiTypeLookup_NoTypeSucceeds(t *testing.T) {
+	mtMod := &MultiTypeLookupModule{Types: "TXT,A"}
+	resolver := InitTest(t, mtMod)
+	res, _, status, err := mtMod.Lookup(resolver, "missing.example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNXDomain, status)
+	assert.Equal(t, res.(Result).Types["TXT"].Status, "NXDOMAIN")
+	assert.Equal(t, res.(Result).Types["A"].Status, "NXDOMAIN")
+}
+
+func TestParseTypes(t *testing.T) {
+	qTypes, err := parseTypes("A,aaaa, TXT")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, qTypes, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT})
+
+	for _, types := range []string{"", "A,,MX", "A,NOTATYPE", "A,MX,a"} {
+		_, err = parseTypes(types)
+		assert.Assert(t, err != nil, "expected an error for %q", types)
+	}
+}
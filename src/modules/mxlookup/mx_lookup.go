@@ -78,9 +78,9 @@ func (mxMod *MXLookupModule) Init() {
 	}
 }
 
-func (mxMod *MXLookupModule) lookupIPs(r *zdns.Resolver, name string, nameServer *zdns.NameServer, ipMode zdns.IPVersionMode) (CachedAddresses, zdns.Trace) {
+func (mxMod *MXLookupModule) lookupIPs(r *zdns.Resolver, name string, nameServer *zdns.NameServer, lookupA, lookupAAAA bool) (CachedAddresses, zdns.Trace) {
 	retv := CachedAddresses{}
-	result, trace, status, _ := r.DoTargetedLookup(name, nameServer, mxMod.IsIterative, mxMod.IPv4Lookup, mxMod.IPv6Lookup)
+	result, trace, status, _ := r.DoTargetedLookup(name, nameServer, mxMod.IsIterative, lookupA, lookupAAAA)
 	if status == zdns.StatusNoError && result != nil {
 		retv.IPv4Addresses = result.IPv4Addresses
 		retv.IPv6Addresses = result.IPv6Addresses
@@ -88,8 +88,27 @@ func (mxMod *MXLookupModule) lookupIPs(r *zdns.Resolver, name string, nameServer
 	return retv, trace
 }
 
+// additionalAddresses returns the A and AAAA records of the additional section of an MX response, by owner name.
+// Servers often include the addresses of the exchanges there, saving a lookup per exchange.
+func additionalAddresses(res *zdns.SingleQueryResult) (ipv4s, ipv6s map[string][]string) {
+	ipv4s = make(map[string][]string)
+	ipv6s = make(map[string][]string)
+	for _, ans := range res.Additionals {
+		a, ok := ans.(zdns.Answer)
+		if !ok || !zdns.VerifyAddress(a.Type, a.Answer) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(a.Name, "."))
+		if a.Type == "A" {
+			ipv4s[name] = append(ipv4s[name], a.Answer)
+		} else if a.Type == "AAAA" {
+			ipv6s[name] = append(ipv6s[name], a.Answer)
+		}
+	}
+	return ipv4s, ipv6s
+}
+
 func (mxMod *MXLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
-	ipMode := zdns.GetIPVersionMode(mxMod.IPv4Lookup, mxMod.IPv6Lookup)
 	retv := MXResult{Servers: []MXRecord{}}
 	var res *zdns.SingleQueryResult
 	var trace zdns.Trace
@@ -104,20 +123,43 @@ func (mxMod *MXLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameSer
 		return nil, trace, status, err
 	}
 
+	ipv4s, ipv6s := additionalAddresses(res)
 	for _, ans := range res.Answers {
 		if mxAns, ok := ans.(zdns.PrefAnswer); ok {
 			lookupName = strings.TrimSuffix(mxAns.Answer.Answer, ".")
 			rec := MXRecord{TTL: mxAns.TTL, Type: mxAns.Type, Class: mxAns.Class, Name: lookupName, Preference: mxAns.Preference}
-			ips, secondTrace := mxMod.lookupIPs(r, lookupName, nameServer, ipMode)
-			rec.IPv4Addresses = ips.IPv4Addresses
-			rec.IPv6Addresses = ips.IPv6Addresses
+			// addresses in the additional section are used as is, the others are looked up
+			glueName := strings.ToLower(lookupName)
+			var findIPv4, findIPv6 bool
+			if mxMod.IPv4Lookup {
+				rec.IPv4Addresses = ipv4s[glueName]
+				findIPv4 = len(rec.IPv4Addresses) == 0
+			}
+			if mxMod.IPv6Lookup {
+				rec.IPv6Addresses = ipv6s[glueName]
+				findIPv6 = len(rec.IPv6Addresses) == 0
+			}
+			if findIPv4 || findIPv6 {
+				ips, secondTrace := mxMod.lookupIPs(r, lookupName, nameServer, findIPv4, findIPv6)
+				if findIPv4 {
+					rec.IPv4Addresses = ips.IPv4Addresses
+				}
+				if findIPv6 {
+					rec.IPv6Addresses = ips.IPv6Addresses
+				}
+				trace = append(trace, secondTrace...)
+			}
 			retv.Servers = append(retv.Servers, rec)
-			trace = append(trace, secondTrace...)
 		}
 	}
 	return &retv, trace, zdns.StatusNoError, nil
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (mxMod *MXLookupModule) ResultType() interface{} {
+	return &MXResult{}
+}
+
 func (mxMod *MXLookupModule) Help() string {
 	return ""
 }
@@ -127,7 +169,7 @@ func (mxMod *MXLookupModule) Validate(args []string) error {
 }
 
 func (mxMod *MXLookupModule) GetDescription() string {
-	return "MXLOOKUP will additionally do an A lookup for the IP addresses that correspond with an exchange record."
+	return "MXLOOKUP will additionally do an A lookup for the IP addresses that correspond with an exchange record, unless the response already lists them in its additional section."
 }
 
 func (mxMod *MXLookupModule) NewFlags() interface{} {
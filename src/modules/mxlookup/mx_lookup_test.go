@@ -0,0 +1,115 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package mxlookup
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[dns.Type]map[string]*zdns.SingleQueryResult)
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question)
+	if res, ok := mockResults[dns.Type(question.Type)][question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+}
+
+func InitTest(t *testing.T, mxMod *MXLookupModule) *zdns.Resolver {
+	mockResults = map[dns.Type]map[string]*zdns.SingleQueryResult{
+		dns.Type(dns.TypeMX):   {},
+		dns.Type(dns.TypeA):    {},
+		dns.Type(dns.TypeAAAA): {},
+	}
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+	assert.NilError(t, mxMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r
+}
+
+func mxAnswer(preference uint16, exchange string) zdns.PrefAnswer {
+	return zdns.PrefAnswer{
+		Answer:     zdns.Answer{Name: "example.com", Type: "MX", RrType: dns.TypeMX, Class: "IN", TTL: 300, Answer: exchange + "."},
+		Preference: preference,
+	}
+}
+
+func addressAnswer(name, rrType, ip string) zdns.Answer {
+	return zdns.Answer{Name: name + ".", Type: rrType, RrType: dns.StringToType[rrType], Class: "IN", Answer: ip}
+}
+
+func TestMXLookup_UsesAdditionalAddresses(t *testing.T) {
+	mxMod := &MXLookupModule{IPv4Lookup: true, IPv6Lookup: true}
+	resolver := InitTest(t, mxMod)
+	mockResults[dns.Type(dns.TypeMX)]["example.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{mxAnswer(10, "mx1.example.com"), mxAnswer(20, "mx2.example.com")},
+		Additionals: []interface{}{
+			addressAnswer("mx1.example.com", "A", "192.0.2.1"),
+			addressAnswer("MX1.example.com", "AAAA", "2001:db8::1"),
+			addressAnswer("mx2.example.com", "A", "192.0.2.2"),
+		},
+	}
+	mockResults[dns.Type(dns.TypeAAAA)]["mx2.example.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{addressAnswer("mx2.example.com", "AAAA", "2001:db8::2")},
+	}
+	res, _, status, err := mxMod.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.DeepEqual(t, res.(*MXResult).Servers, []MXRecord{
+		{Name: "mx1.example.com", Type: "MX", Class: "IN", Preference: 10, IPv4Addresses: []string{"192.0.2.1"}, IPv6Addresses: []string{"2001:db8::1"}, TTL: 300},
+		{Name: "mx2.example.com", Type: "MX", Class: "IN", Preference: 20, IPv4Addresses: []string{"192.0.2.2"}, IPv6Addresses: []string{"2001:db8::2"}, TTL: 300},
+	})
+	// only the AAAA records missing from the additional section were looked up
+	assert.Equal(t, len(queries), 2)
+	assert.Equal(t, queries[1].Type, dns.TypeAAAA)
+	assert.Equal(t, queries[1].Name, "mx2.example.com")
+}
+
+func TestMXLookup_LooksUpAddressesWithoutGlue(t *testing.T) {
+	mxMod := &MXLookupModule{}
+	resolver := InitTest(t, mxMod)
+	mockResults[dns.Type(dns.TypeMX)]["example.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{mxAnswer(10, "mx.example.net")},
+	}
+	mockResults[dns.Type(dns.TypeA)]["mx.example.net"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{addressAnswer("mx.example.net", "A", "198.51.100.1")},
+	}
+	res, _, status, err := mxMod.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	servers := res.(*MXResult).Servers
+	assert.Equal(t, len(servers), 1)
+	assert.DeepEqual(t, servers[0].IPv4Addresses, []string{"198.51.100.1"})
+	assert.Assert(t, servers[0].IPv6Addresses == nil, "only A lookups are done by default")
+}
@@ -0,0 +1,146 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package naptr
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// Rule is a single NAPTR record, RFC 3403
+type Rule struct {
+	Order       uint16 `json:"order" groups:"short,normal,long,trace"`
+	Preference  uint16 `json:"preference" groups:"short,normal,long,trace"`
+	Flags       string `json:"flags" groups:"short,normal,long,trace"`
+	Service     string `json:"service" groups:"short,normal,long,trace"`
+	Regexp      string `json:"regexp,omitempty" groups:"short,normal,long,trace"`
+	Replacement string `json:"replacement,omitempty" groups:"short,normal,long,trace"`
+	// Terminal is set if the flags end the rewriting, ex. "S" leads to SRV records and "U" to a URI. Non-terminal
+	// rules continue with a NAPTR lookup of the replacement
+	Terminal bool   `json:"terminal" groups:"short,normal,long,trace"`
+	TTL      uint32 `json:"ttl" groups:"ttl,normal,long,trace"`
+	// Next are the rules at the replacement of a non-terminal rule, with --follow-replacement
+	Next       []Rule `json:"next,omitempty" groups:"short,normal,long,trace"`
+	NextStatus string `json:"next_status,omitempty" groups:"short,normal,long,trace"` // status of the lookup of the replacement, if it failed
+}
+
+// Result is the set of NAPTR rules of a name, in the order they're to be processed
+type Result struct {
+	Rules []Rule `json:"rules" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("NAPTR", new(NAPTRLookupModule))
+}
+
+type NAPTRLookupModule struct {
+	FollowReplacement bool `long:"follow-replacement" description:"for non-terminal rules, those with empty flags, also look up the NAPTR rules at the replacement, one hop"`
+	cli.BasicLookupModule
+}
+
+// CLIInit initializes the NAPTR lookup module
+func (naptrMod *NAPTRLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("NAPTR module does not support --all-nameservers")
+	}
+	naptrMod.BasicLookupModule.DNSType = dns.TypeNAPTR
+	naptrMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return naptrMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup queries the NAPTR rules of lookupName and, with FollowReplacement, those at the replacement of each
+// non-terminal rule
+func (naptrMod *NAPTRLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	rules, trace, status, err := naptrMod.lookupRules(r, lookupName, nameServer)
+	res := Result{Rules: rules}
+	if status != zdns.StatusNoError || err != nil {
+		return res, trace, status, err
+	}
+	if len(rules) == 0 {
+		return res, trace, zdns.StatusNoRecord, nil
+	}
+	if !naptrMod.FollowReplacement {
+		return res, trace, status, nil
+	}
+	for i := range res.Rules {
+		rule := &res.Rules[i]
+		if rule.Terminal || rule.Replacement == "" {
+			continue
+		}
+		next, nextTrace, nextStatus, _ := naptrMod.lookupRules(r, rule.Replacement, nameServer)
+		trace = append(trace, nextTrace...)
+		rule.Next = next
+		if nextStatus != zdns.StatusNoError {
+			rule.NextStatus = string(nextStatus)
+		}
+	}
+	return res, trace, zdns.StatusNoError, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (naptrMod *NAPTRLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+func (naptrMod *NAPTRLookupModule) lookupRules(r *zdns.Resolver, name string, nameServer *zdns.NameServer) ([]Rule, zdns.Trace, zdns.Status, error) {
+	rules := []Rule{}
+	innerRes, trace, status, err := naptrMod.BasicLookupModule.Lookup(r, name, nameServer)
+	if status != zdns.StatusNoError || err != nil {
+		return rules, trace, status, err
+	}
+	castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+	if !ok {
+		return rules, trace, status, errors.New("lookup didn't return a single query result type")
+	}
+	for _, a := range castedInnerRes.Answers {
+		if ans, ok := a.(zdns.NAPTRAnswer); ok && ans.RrType == dns.TypeNAPTR {
+			rules = append(rules, makeRule(ans))
+		}
+	}
+	// rules are processed by increasing order, then by increasing preference, RFC 3403 section 4.1
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Order != rules[j].Order {
+			return rules[i].Order < rules[j].Order
+		}
+		return rules[i].Preference < rules[j].Preference
+	})
+	return rules, trace, status, nil
+}
+
+func makeRule(ans zdns.NAPTRAnswer) Rule {
+	replacement := strings.TrimSuffix(ans.Replacement, ".")
+	return Rule{
+		Order:       ans.Order,
+		Preference:  ans.Preference,
+		Flags:       ans.Flags,
+		Service:     ans.Service,
+		Regexp:      ans.Regexp,
+		Replacement: replacement,
+		Terminal:    isTerminal(ans.Flags),
+		TTL:         ans.TTL,
+	}
+}
+
+// isTerminal returns whether a rule's flags end the rewriting. "S", "A" and "U" are terminal, RFC 3404 section 4.3,
+// and "P" hands the rule to the application's own protocol
+func isTerminal(flags string) bool {
+	return strings.ContainsAny(strings.ToUpper(flags), "SAUP")
+}
@@ -0,0 +1,112 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package naptr
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+var queries []string
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question.Name)
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+	}
+}
+
+func InitTest(t *testing.T, followReplacement bool) (*zdns.Resolver, *NAPTRLookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	naptrMod := &NAPTRLookupModule{FollowReplacement: followReplacement}
+	assert.NilError(t, naptrMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r, naptrMod
+}
+
+func naptrAnswer(t *testing.T, rr string) zdns.NAPTRAnswer {
+	parsed, err := dns.NewRR(rr)
+	assert.NilError(t, err)
+	return zdns.ParseAnswer(parsed).(zdns.NAPTRAnswer)
+}
+
+func TestNAPTRLookup_SortsRules(t *testing.T) {
+	resolver, naptrMod := InitTest(t, false)
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			naptrAnswer(t, `zdns-testing.com. 300 IN NAPTR 100 20 "s" "SIP+D2T" "" _sip._tcp.zdns-testing.com.`),
+			naptrAnswer(t, `zdns-testing.com. 300 IN NAPTR 100 10 "s" "SIP+D2U" "" _sip._udp.zdns-testing.com.`),
+			naptrAnswer(t, `zdns-testing.com. 300 IN NAPTR 50 50 "u" "E2U+sip" "!^.*$!sip:info@zdns-testing.com!" .`),
+		},
+	}
+	res, _, status, err := naptrMod.Lookup(resolver, "zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	rules := res.(Result).Rules
+	assert.Equal(t, len(rules), 3)
+	assert.DeepEqual(t, rules[0], Rule{
+		Order: 50, Preference: 50, Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:info@zdns-testing.com!", Terminal: true, TTL: 300,
+	})
+	assert.Equal(t, rules[1].Service, "SIP+D2U")
+	assert.Equal(t, rules[1].Replacement, "_sip._udp.zdns-testing.com")
+	assert.Equal(t, rules[2].Service, "SIP+D2T")
+	assert.DeepEqual(t, queries, []string{"zdns-testing.com"})
+}
+
+func TestNAPTRLookup_FollowsNonTerminalRules(t *testing.T) {
+	resolver, naptrMod := InitTest(t, true)
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			naptrAnswer(t, `zdns-testing.com. 300 IN NAPTR 100 10 "" "" "" sip.zdns-testing.com.`),
+			naptrAnswer(t, `zdns-testing.com. 300 IN NAPTR 100 20 "" "" "" missing.zdns-testing.com.`),
+			naptrAnswer(t, `zdns-testing.com. 300 IN NAPTR 100 30 "s" "SIP+D2U" "" _sip._udp.zdns-testing.com.`),
+		},
+	}
+	mockResults["sip.zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			naptrAnswer(t, `sip.zdns-testing.com. 300 IN NAPTR 10 10 "s" "SIP+D2T" "" _sip._tcp.zdns-testing.com.`),
+		},
+	}
+	res, _, status, err := naptrMod.Lookup(resolver, "zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	rules := res.(Result).Rules
+	assert.Equal(t, len(rules[0].Next), 1)
+	assert.Equal(t, rules[0].Next[0].Replacement, "_sip._tcp.zdns-testing.com")
+	assert.Equal(t, rules[1].NextStatus, string(zdns.StatusNXDomain))
+	assert.Equal(t, len(rules[2].Next), 0, "terminal rules aren't followed")
+	assert.DeepEqual(t, queries, []string{"zdns-testing.com", "sip.zdns-testing.com", "missing.zdns-testing.com"})
+}
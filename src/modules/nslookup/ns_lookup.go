@@ -74,6 +74,11 @@ func (nsMod *NSLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameSer
 	return res, trace, status, err
 }
 
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (nsMod *NSLookupModule) ResultType() interface{} {
+	return &zdns.NSResult{}
+}
+
 // Help returns the module's help string
 func (nsMod *NSLookupModule) Help() string {
 	return ""
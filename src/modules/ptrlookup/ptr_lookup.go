@@ -0,0 +1,187 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package ptrlookup
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// Result holds the PTR names of an address, or of every address in a CIDR
+type Result struct {
+	Prefix    string          `json:"prefix,omitempty" groups:"short,normal,long,trace"` // the CIDR looked up, in canonical form, if one was given
+	Addresses []AddressResult `json:"addresses" groups:"short,normal,long,trace"`
+}
+
+// AddressResult is the outcome of the PTR lookup of a single address
+type AddressResult struct {
+	IP     string   `json:"ip" groups:"short,normal,long,trace"`
+	Names  []string `json:"names,omitempty" groups:"short,normal,long,trace"`
+	Status string   `json:"status" groups:"short,normal,long,trace"`
+	Error  string   `json:"error,omitempty" groups:"short,normal,long,trace"`
+}
+
+// the addresses of a CIDR are looked up one after another by a single thread, the limits keep a line to at most 65,536
+const (
+	minIPv4PrefixLimit = 16
+	minIPv6PrefixLimit = 112
+)
+
+func init() {
+	cli.RegisterLookupModule("PTRLOOKUP", new(PTRLookupModule))
+}
+
+type PTRLookupModule struct {
+	IPv4PrefixLimit int `long:"ipv4-prefix-limit" default:"24" description:"shortest IPv4 prefix length that is expanded, at least 16. The default of 24 allows at most 256 addresses per CIDR, which are looked up in turn by one thread. Shorter CIDRs are rejected"`
+	IPv6PrefixLimit int `long:"ipv6-prefix-limit" description:"shortest IPv6 prefix length that is expanded, ex. 120 for at most 256 addresses, at least 112. Shorter CIDRs are rejected. IPv6 CIDRs are only expanded if this is set"`
+	cli.BasicLookupModule
+}
+
+// CLIInit initializes the PTRLOOKUP module
+func (ptrMod *PTRLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("PTRLOOKUP module does not support --all-nameservers")
+	}
+	if ptrMod.IPv4PrefixLimit < minIPv4PrefixLimit || ptrMod.IPv4PrefixLimit > 32 {
+		return fmt.Errorf("--ipv4-prefix-limit must be between %d and 32", minIPv4PrefixLimit)
+	}
+	if ptrMod.IPv6PrefixLimit != 0 && (ptrMod.IPv6PrefixLimit < minIPv6PrefixLimit || ptrMod.IPv6PrefixLimit > 128) {
+		return fmt.Errorf("--ipv6-prefix-limit must be between %d and 128", minIPv6PrefixLimit)
+	}
+	ptrMod.BasicLookupModule.DNSType = dns.TypePTR
+	ptrMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return ptrMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup looks up the PTR names of lookupName, either a single IP address or a CIDR whose addresses are each looked
+// up in turn. The status is NOERROR if any address has a PTR record, otherwise that of the first address.
+func (ptrMod *PTRLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := Result{Addresses: []AddressResult{}}
+	ips, prefix, err := ptrMod.expand(lookupName)
+	if err != nil {
+		return res, nil, zdns.StatusIllegalInput, err
+	}
+	res.Prefix = prefix
+	var trace zdns.Trace
+	status := zdns.StatusNoError
+	found := false
+	for i, ip := range ips {
+		addr, addrTrace, addrStatus := ptrMod.lookupAddress(r, ip, nameServer)
+		trace = append(trace, addrTrace...)
+		res.Addresses = append(res.Addresses, addr)
+		if i == 0 {
+			status = addrStatus
+		}
+		found = found || len(addr.Names) > 0
+	}
+	if found {
+		status = zdns.StatusNoError
+	}
+	return res, trace, status, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (ptrMod *PTRLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// lookupAddress returns the PTR names of a single address
+func (ptrMod *PTRLookupModule) lookupAddress(r *zdns.Resolver, ip net.IP, nameServer *zdns.NameServer) (AddressResult, zdns.Trace, zdns.Status) {
+	addr := AddressResult{IP: ip.String()}
+	innerRes, trace, status, err := ptrMod.BasicLookupModule.Lookup(r, addr.IP, nameServer)
+	if err != nil {
+		addr.Error = err.Error()
+	}
+	if castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult); ok && status == zdns.StatusNoError {
+		for _, a := range castedInnerRes.Answers {
+			if ans, ok := a.(zdns.Answer); ok && ans.RrType == dns.TypePTR {
+				addr.Names = append(addr.Names, strings.TrimSuffix(ans.Answer, "."))
+			}
+		}
+		if len(addr.Names) == 0 {
+			status = zdns.StatusNoRecord
+		}
+	}
+	addr.Status = string(status)
+	return addr, trace, status
+}
+
+// expand returns the addresses to look up for name, an IP address or a CIDR, and the CIDR in canonical form if it's one
+func (ptrMod *PTRLookupModule) expand(name string) ([]net.IP, string, error) {
+	if !strings.Contains(name, "/") {
+		ip := net.ParseIP(name)
+		if ip == nil {
+			return nil, "", fmt.Errorf("invalid IP address: %s", name)
+		}
+		return []net.IP{ip}, "", nil
+	}
+	_, ipNet, err := net.ParseCIDR(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid CIDR: %s", name)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits == 32 && ones < ptrMod.IPv4PrefixLimit {
+		return nil, "", fmt.Errorf("CIDR %s is larger than the --ipv4-prefix-limit of /%d", name, ptrMod.IPv4PrefixLimit)
+	}
+	if bits == 128 && ptrMod.IPv6PrefixLimit == 0 {
+		return nil, "", fmt.Errorf("IPv6 CIDRs like %s are only expanded with --ipv6-prefix-limit", name)
+	}
+	if bits == 128 && ones < ptrMod.IPv6PrefixLimit {
+		return nil, "", fmt.Errorf("CIDR %s is larger than the --ipv6-prefix-limit of /%d", name, ptrMod.IPv6PrefixLimit)
+	}
+	return enumerate(ipNet), ipNet.String(), nil
+}
+
+// enumerate returns every address of ipNet, in order. The caller bounds its size.
+func enumerate(ipNet *net.IPNet) []net.IP {
+	ones, bits := ipNet.Mask.Size()
+	count := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)).Int64()
+	first := new(big.Int).SetBytes(ipNet.IP)
+	ips := make([]net.IP, 0, count)
+	for i := int64(0); i < count; i++ {
+		b := new(big.Int).Add(first, big.NewInt(i)).Bytes()
+		ip := make(net.IP, bits/8)
+		copy(ip[len(ip)-len(b):], b)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// Help
+func (ptrMod *PTRLookupModule) Help() string {
+	return ""
+}
+
+// Validate
+func (ptrMod *PTRLookupModule) Validate(args []string) error {
+	return nil
+}
+
+// Description
+func (ptrMod *PTRLookupModule) GetDescription() string {
+	return "PTRLOOKUP returns the PTR names of an IP address, or of every address in a CIDR such as 192.0.2.0/24."
+}
+
+func (ptrMod *PTRLookupModule) NewFlags() interface{} {
+	return ptrMod
+}
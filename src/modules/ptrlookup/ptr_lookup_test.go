@@ -0,0 +1,131 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package ptrlookup
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+var queries []string
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question.Name)
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+	}
+}
+
+func InitTest(t *testing.T, ptrMod *PTRLookupModule) *zdns.Resolver {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+	assert.NilError(t, ptrMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r
+}
+
+func ptrResult(names ...string) *zdns.SingleQueryResult {
+	res := &zdns.SingleQueryResult{}
+	for _, name := range names {
+		res.Answers = append(res.Answers, zdns.Answer{Type: "PTR", RrType: dns.TypePTR, Class: "IN", Answer: name + "."})
+	}
+	return res
+}
+
+func TestPTRLookup_SingleAddress(t *testing.T) {
+	ptrMod := &PTRLookupModule{IPv4PrefixLimit: 16}
+	resolver := InitTest(t, ptrMod)
+	mockResults["192.0.2.1"] = ptrResult("host.example.com", "alias.example.com")
+	res, _, status, err := ptrMod.Lookup(resolver, "192.0.2.1", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.DeepEqual(t, res.(Result), Result{Addresses: []AddressResult{
+		{IP: "192.0.2.1", Names: []string{"host.example.com", "alias.example.com"}, Status: "NOERROR"},
+	}})
+
+	res, _, status, err = ptrMod.Lookup(resolver, "192.0.2.2", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNXDomain, status)
+	assert.Equal(t, res.(Result).Addresses[0].Status, "NXDOMAIN")
+}
+
+func TestPTRLookup_ExpandsIPv4CIDR(t *testing.T) {
+	ptrMod := &PTRLookupModule{IPv4PrefixLimit: 16}
+	resolver := InitTest(t, ptrMod)
+	mockResults["192.0.2.5"] = ptrResult("five.example.com")
+	res, _, status, err := ptrMod.Lookup(resolver, "192.0.2.6/30", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	result := res.(Result)
+	assert.Equal(t, result.Prefix, "192.0.2.4/30")
+	assert.DeepEqual(t, queries, []string{"192.0.2.4", "192.0.2.5", "192.0.2.6", "192.0.2.7"})
+	assert.Equal(t, len(result.Addresses), 4)
+	assert.DeepEqual(t, result.Addresses[1], AddressResult{IP: "192.0.2.5", Names: []string{"five.example.com"}, Status: "NOERROR"})
+	assert.Equal(t, result.Addresses[0].Status, "NXDOMAIN")
+}
+
+func TestPTRLookup_NoAddressHasARecord(t *testing.T) {
+	ptrMod := &PTRLookupModule{IPv4PrefixLimit: 16}
+	resolver := InitTest(t, ptrMod)
+	_, _, status, err := ptrMod.Lookup(resolver, "192.0.2.0/31", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNXDomain, status)
+}
+
+func TestPTRLookup_PrefixLimits(t *testing.T) {
+	ptrMod := &PTRLookupModule{IPv4PrefixLimit: 24}
+	resolver := InitTest(t, ptrMod)
+	_, _, status, _ := ptrMod.Lookup(resolver, "192.0.0.0/16", nil)
+	assert.Equal(t, zdns.StatusIllegalInput, status)
+	_, _, status, _ = ptrMod.Lookup(resolver, "not-an-ip", nil)
+	assert.Equal(t, zdns.StatusIllegalInput, status)
+	// IPv6 CIDRs need an explicit limit
+	_, _, status, _ = ptrMod.Lookup(resolver, "2001:db8::/126", nil)
+	assert.Equal(t, zdns.StatusIllegalInput, status)
+	assert.Equal(t, len(queries), 0)
+
+	ptrMod.IPv6PrefixLimit = 120
+	res, _, _, err := ptrMod.Lookup(resolver, "2001:db8::/126", nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, queries, []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3"})
+	assert.Equal(t, res.(Result).Prefix, "2001:db8::/126")
+	_, _, status, _ = ptrMod.Lookup(resolver, "2001:db8::/112", nil)
+	assert.Equal(t, zdns.StatusIllegalInput, status)
+}
+
+func TestPTRLookup_ValidatesLimits(t *testing.T) {
+	assert.ErrorContains(t, (&PTRLookupModule{IPv4PrefixLimit: 33}).CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}), "ipv4-prefix-limit")
+	assert.ErrorContains(t, (&PTRLookupModule{IPv4PrefixLimit: 8}).CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}), "ipv4-prefix-limit")
+	assert.ErrorContains(t, (&PTRLookupModule{IPv4PrefixLimit: 24, IPv6PrefixLimit: 96}).CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}), "ipv6-prefix-limit")
+}
@@ -14,20 +14,54 @@
 package spf
 
 import (
-	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 
 	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/modules/mxlookup"
 	"github.com/zmap/zdns/src/zdns"
 )
 
 const spfPrefixRegexp = "(?i)^v=spf1"
 
+// lookupLimit is the most mechanisms and modifiers that cause DNS lookups an SPF check may evaluate, counting those
+// of included records, RFC 7208 section 4.6.4
+const lookupLimit = 10
+
 // result to be returned by scan of host
 type Result struct {
-	Spf string `json:"spf,omitempty" groups:"short,normal,long,trace"`
+	Spf       string     `json:"spf,omitempty" groups:"short,normal,long,trace"`
+	Expansion *Expansion `json:"expansion,omitempty" groups:"short,normal,long,trace"`
+}
+
+// Expansion is an SPF record flattened by following its include, redirect, a and mx terms
+type Expansion struct {
+	// AuthorizedIPs are the addresses and networks allowed to send mail for the domain, from the ip4, ip6, a and mx
+	// mechanisms of the record and the records it includes
+	AuthorizedIPs []string `json:"authorized_ips,omitempty" groups:"short,normal,long,trace"`
+	// Unexpanded are the mechanisms that can't be resolved to addresses without the sender of a message, ex. ptr,
+	// exists and those with macros
+	Unexpanded []string `json:"unexpanded,omitempty" groups:"short,normal,long,trace"`
+	// LookupCount is the number of terms causing DNS lookups that were evaluated, at most one past the limit
+	LookupCount         int      `json:"lookup_count" groups:"short,normal,long,trace"`
+	LookupLimitExceeded bool     `json:"lookup_limit_exceeded" groups:"short,normal,long,trace"`
+	Depth               int      `json:"depth" groups:"short,normal,long,trace"`           // deepest level of includes and redirects
+	Loops               []string `json:"loops,omitempty" groups:"short,normal,long,trace"` // domains included again by a record they include
+	Tree                *Node    `json:"tree" groups:"normal,long,trace"`
+}
+
+// Node is an SPF record in the tree of includes and redirects
+type Node struct {
+	Domain string `json:"domain" groups:"short,normal,long,trace"`
+	// Mechanism is how the parent record reached this one, include or redirect. Empty for the queried domain
+	Mechanism string  `json:"mechanism,omitempty" groups:"short,normal,long,trace"`
+	Record    string  `json:"record,omitempty" groups:"short,normal,long,trace"`
+	Status    string  `json:"status,omitempty" groups:"short,normal,long,trace"` // status of the record's lookup, if it failed
+	Children  []*Node `json:"children,omitempty" groups:"short,normal,long,trace"`
 }
 
 func init() {
@@ -36,8 +70,10 @@ func init() {
 }
 
 type SpfLookupModule struct {
+	NoExpand bool `long:"no-expand" description:"only report the SPF record, without expanding its includes, redirects, a and mx mechanisms into the addresses it authorizes"`
 	cli.BasicLookupModule
 	re *regexp.Regexp
+	mx mxlookup.MXLookupModule
 }
 
 // CLIInit initializes the SPF lookup module
@@ -48,18 +84,215 @@ func (spfMod *SpfLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig)
 	spfMod.re = regexp.MustCompile(spfPrefixRegexp)
 	spfMod.BasicLookupModule.DNSType = dns.TypeTXT
 	spfMod.BasicLookupModule.DNSClass = dns.ClassINET
+	spfMod.mx.IPv4Lookup = true
+	spfMod.mx.IPv6Lookup = true
+	if err := spfMod.mx.CLIInit(gc, rc); err != nil {
+		return errors.Wrap(err, "failed to initialize MXLOOKUP module")
+	}
 	return spfMod.BasicLookupModule.CLIInit(gc, rc)
 }
 
 func (spfMod *SpfLookupModule) Lookup(r *zdns.Resolver, name string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	resString, trace, resStatus, err := spfMod.lookupRecord(r, name, nameServer)
+	res := Result{Spf: resString}
+	if resStatus != zdns.StatusNoError || spfMod.NoExpand {
+		return res, trace, resStatus, err
+	}
+	e := expander{
+		mod:        spfMod,
+		r:          r,
+		nameServer: nameServer,
+		exp:        &Expansion{Tree: &Node{Domain: strings.ToLower(strings.TrimSuffix(name, ".")), Record: resString}},
+		seenIPs:    make(map[string]bool),
+		chain:      make(map[string]bool),
+		trace:      trace,
+	}
+	e.expand(e.exp.Tree, 0)
+	res.Expansion = e.exp
+	return res, e.trace, resStatus, err
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (spfMod *SpfLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// lookupRecord returns the SPF record of name
+func (spfMod *SpfLookupModule) lookupRecord(r *zdns.Resolver, name string, nameServer *zdns.NameServer) (string, zdns.Trace, zdns.Status, error) {
 	innerRes, trace, status, err := spfMod.BasicLookupModule.Lookup(r, name, nameServer)
 	castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
 	if !ok {
-		return nil, trace, status, errors.New("lookup didn't return a single query result type")
+		return "", trace, status, errors.New("lookup didn't return a single query result type")
 	}
 	resString, resStatus, err := zdns.CheckTxtRecords(castedInnerRes, status, spfMod.re, err)
-	res := Result{Spf: resString}
-	return res, trace, resStatus, err
+	return resString, trace, resStatus, err
+}
+
+// expander flattens an SPF record, RFC 7208 section 5, without a sender to evaluate it against
+type expander struct {
+	mod        *SpfLookupModule
+	r          *zdns.Resolver
+	nameServer *zdns.NameServer
+	exp        *Expansion
+	seenIPs    map[string]bool
+	chain      map[string]bool // domains of the records being expanded, a record including one of them is a loop
+	trace      zdns.Trace
+}
+
+// expand adds the addresses authorized by node's record and the records it includes or redirects to
+func (e *expander) expand(node *Node, depth int) {
+	e.exp.Depth = max(e.exp.Depth, depth)
+	e.chain[node.Domain] = true
+	defer delete(e.chain, node.Domain)
+
+	terms := strings.Fields(node.Record)[1:]
+	redirect := ""
+	hasAll := false
+	for _, term := range terms {
+		name, value := parseTerm(term)
+		switch name {
+		case "all":
+			hasAll = true
+		case "ip4", "ip6":
+			e.addIP(value)
+		case "a", "mx":
+			domain, cidr4, cidr6 := splitDomainSpec(value, node.Domain)
+			if !e.countLookup() {
+				return
+			}
+			if strings.Contains(domain, "%") {
+				e.exp.Unexpanded = append(e.exp.Unexpanded, term)
+				continue
+			}
+			if name == "a" {
+				e.expandA(domain, cidr4, cidr6)
+			} else {
+				e.expandMX(domain, cidr4, cidr6)
+			}
+		case "ptr", "exists":
+			if !e.countLookup() {
+				return
+			}
+			e.exp.Unexpanded = append(e.exp.Unexpanded, term)
+		case "include":
+			if !e.countLookup() {
+				return
+			}
+			if !e.expandChild(node, name, value, depth) {
+				return
+			}
+		case "redirect":
+			redirect = value
+		}
+	}
+	// redirect is ignored if the record has an all mechanism, RFC 7208 section 6.1
+	if redirect != "" && !hasAll && e.countLookup() {
+		e.expandChild(node, "redirect", redirect, depth)
+	}
+}
+
+// expandChild looks up the record domain refers to with an include or redirect, and expands it under node. Returns
+// false if the lookup limit was exceeded while expanding it
+func (e *expander) expandChild(node *Node, mechanism, domain string, depth int) bool {
+	if domain == "" || strings.Contains(domain, "%") {
+		e.exp.Unexpanded = append(e.exp.Unexpanded, mechanism+":"+domain)
+		return true
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if e.chain[domain] {
+		e.exp.Loops = append(e.exp.Loops, domain)
+		return true
+	}
+	child := &Node{Domain: domain, Mechanism: mechanism}
+	node.Children = append(node.Children, child)
+	record, trace, status, _ := e.mod.lookupRecord(e.r, domain, e.nameServer)
+	e.trace = append(e.trace, trace...)
+	if status != zdns.StatusNoError {
+		child.Status = string(status)
+		return true
+	}
+	child.Record = record
+	e.expand(child, depth+1)
+	return !e.exp.LookupLimitExceeded
+}
+
+func (e *expander) expandA(domain, cidr4, cidr6 string) {
+	res, trace, status, _ := e.r.DoTargetedLookup(domain, e.nameServer, e.mod.IsIterative, true, true)
+	e.trace = append(e.trace, trace...)
+	if status != zdns.StatusNoError || res == nil {
+		return
+	}
+	e.addIPs(res.IPv4Addresses, cidr4)
+	e.addIPs(res.IPv6Addresses, cidr6)
+}
+
+func (e *expander) expandMX(domain, cidr4, cidr6 string) {
+	res, trace, status, _ := e.mod.mx.Lookup(e.r, domain, e.nameServer)
+	e.trace = append(e.trace, trace...)
+	mxRes, ok := res.(*mxlookup.MXResult)
+	if status != zdns.StatusNoError || !ok {
+		return
+	}
+	for _, server := range mxRes.Servers {
+		e.addIPs(server.IPv4Addresses, cidr4)
+		e.addIPs(server.IPv6Addresses, cidr6)
+	}
+}
+
+// countLookup counts a term causing a DNS lookup, and returns false if it's past the limit and expansion should stop
+func (e *expander) countLookup() bool {
+	e.exp.LookupCount++
+	if e.exp.LookupCount > lookupLimit {
+		e.exp.LookupLimitExceeded = true
+		return false
+	}
+	return true
+}
+
+func (e *expander) addIPs(ips []string, cidr string) {
+	for _, ip := range ips {
+		if cidr != "" {
+			ip = fmt.Sprintf("%s/%s", ip, cidr)
+		}
+		e.addIP(ip)
+	}
+}
+
+func (e *expander) addIP(ip string) {
+	if ip == "" || e.seenIPs[ip] {
+		return
+	}
+	e.seenIPs[ip] = true
+	e.exp.AuthorizedIPs = append(e.exp.AuthorizedIPs, ip)
+}
+
+// parseTerm splits an SPF term into its lowercased mechanism or modifier name and its value, dropping the qualifier
+// of a mechanism. ex. "-include:example.com" is ("include", "example.com") and "a/24" is ("a", "/24")
+func parseTerm(term string) (string, string) {
+	if i := strings.IndexAny(term, ":=/"); i >= 0 && term[i] == '=' {
+		// a modifier, RFC 7208 section 6
+		return strings.ToLower(term[:i]), term[i+1:]
+	}
+	term = strings.TrimLeft(term, "+-~?")
+	i := strings.IndexAny(term, ":/")
+	if i < 0 {
+		return strings.ToLower(term), ""
+	}
+	if term[i] == ':' {
+		return strings.ToLower(term[:i]), term[i+1:]
+	}
+	return strings.ToLower(term[:i]), term[i:]
+}
+
+// splitDomainSpec splits the value of an a or mx mechanism into its domain, defaulting to domain, and its IPv4 and IPv6
+// prefix lengths, ex. "example.com/24//64" is ("example.com", "24", "64")
+func splitDomainSpec(value, domain string) (string, string, string) {
+	target, cidrs, _ := strings.Cut(value, "/")
+	if target == "" {
+		target = domain
+	}
+	cidr4, cidr6, _ := strings.Cut("/"+cidrs, "//")
+	return target, strings.TrimPrefix(cidr4, "/"), cidr6
 }
 
 // Help
@@ -74,7 +307,7 @@ func (spfMod *SpfLookupModule) Validate(args []string) error {
 
 // Description
 func (spfMod *SpfLookupModule) GetDescription() string {
-	return ""
+	return "SPF returns the SPF record of a domain, and the addresses it authorizes to send mail after following its includes, redirects, a and mx mechanisms."
 }
 
 func (spfMod *SpfLookupModule) NewFlags() interface{} {
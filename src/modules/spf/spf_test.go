@@ -16,6 +16,7 @@ package spf
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"testing"
 
@@ -31,13 +32,24 @@ type QueryRecord struct {
 	NameServer *zdns.NameServer
 }
 
+type mockKey struct {
+	name   string
+	rrType uint16
+}
+
 var mockResults = make(map[string]*zdns.SingleQueryResult)
+
+// mockTypedResults answer a specific type of question for a name, they take precedence over mockResults
+var mockTypedResults = make(map[mockKey]*zdns.SingleQueryResult)
 var queries []QueryRecord
 
 type MockLookup struct{}
 
 func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
 	queries = append(queries, QueryRecord{question, &nameServers[0]})
+	if res, ok := mockTypedResults[mockKey{question.Name, question.Type}]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	}
 	if res, ok := mockResults[question.Name]; ok {
 		return res, nil, zdns.StatusNoError, nil
 	} else {
@@ -47,6 +59,7 @@ func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, q
 
 func InitTest(t *testing.T) *zdns.Resolver {
 	mockResults = make(map[string]*zdns.SingleQueryResult)
+	mockTypedResults = make(map[mockKey]*zdns.SingleQueryResult)
 	queries = make([]QueryRecord, 0)
 	rc := zdns.ResolverConfig{
 		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
@@ -154,3 +167,144 @@ func TestLookup_DoTxtLookup_NoTXT(t *testing.T) {
 	assert.Equal(t, zdns.StatusNoAnswer, status)
 	assert.Equal(t, res.(Result).Spf, "")
 }
+
+func txtResult(name string, records ...string) *zdns.SingleQueryResult {
+	res := &zdns.SingleQueryResult{}
+	for _, rec := range records {
+		res.Answers = append(res.Answers, zdns.Answer{Name: name, Type: "TXT", Class: "IN", Answer: rec})
+	}
+	return res
+}
+
+func addressResult(name, rrType string, addresses ...string) *zdns.SingleQueryResult {
+	res := &zdns.SingleQueryResult{}
+	for _, addr := range addresses {
+		res.Answers = append(res.Answers, zdns.Answer{Name: name, Type: rrType, Class: "IN", Answer: addr})
+	}
+	return res
+}
+
+func TestLookup_Expand(t *testing.T) {
+	resolver := InitTest(t)
+	mockTypedResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com",
+		"v=spf1 ip4:192.0.2.0/24 a mx/28 include:_spf.example.net redirect=ignored.example.org -all")
+	mockTypedResults[mockKey{"example.com", dns.TypeA}] = addressResult("example.com", "A", "198.51.100.1")
+	mockTypedResults[mockKey{"example.com", dns.TypeMX}] = &zdns.SingleQueryResult{Answers: []interface{}{
+		zdns.PrefAnswer{Answer: zdns.Answer{Name: "example.com", Type: "MX", Class: "IN", Answer: "mail.example.com."}, Preference: 10},
+	}}
+	mockTypedResults[mockKey{"mail.example.com", dns.TypeA}] = addressResult("mail.example.com", "A", "198.51.100.2")
+	mockTypedResults[mockKey{"_spf.example.net", dns.TypeTXT}] = txtResult("_spf.example.net", "v=spf1 ip6:2001:db8::/32 ip4:192.0.2.0/24 ptr ~all")
+
+	spfModule := SpfLookupModule{}
+	err := spfModule.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{LookupClient: MockLookup{}})
+	assert.NilError(t, err)
+	res, _, status, err := spfModule.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+
+	exp := res.(Result).Expansion
+	assert.DeepEqual(t, exp.AuthorizedIPs, []string{"192.0.2.0/24", "198.51.100.1", "198.51.100.2/28", "2001:db8::/32"})
+	assert.DeepEqual(t, exp.Unexpanded, []string{"ptr"})
+	// a, mx, include and ptr, the redirect is ignored because of the all mechanism
+	assert.Equal(t, exp.LookupCount, 4)
+	assert.Equal(t, exp.LookupLimitExceeded, false)
+	assert.Equal(t, exp.Depth, 1)
+	assert.Equal(t, len(exp.Tree.Children), 1)
+	assert.Equal(t, exp.Tree.Children[0].Domain, "_spf.example.net")
+	assert.Equal(t, exp.Tree.Children[0].Mechanism, "include")
+}
+
+func TestLookup_ExpandRedirectAndLoop(t *testing.T) {
+	resolver := InitTest(t)
+	mockTypedResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com", "v=spf1 redirect=_spf.example.com")
+	mockTypedResults[mockKey{"_spf.example.com", dns.TypeTXT}] = txtResult("_spf.example.com", "v=spf1 ip4:192.0.2.1 include:example.com include:missing.example.com -all")
+
+	spfModule := SpfLookupModule{}
+	err := spfModule.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{LookupClient: MockLookup{}})
+	assert.NilError(t, err)
+	res, _, status, err := spfModule.Lookup(resolver, "example.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+
+	exp := res.(Result).Expansion
+	assert.DeepEqual(t, exp.AuthorizedIPs, []string{"192.0.2.1"})
+	assert.DeepEqual(t, exp.Loops, []string{"example.com"})
+	assert.Equal(t, exp.LookupCount, 3)
+	assert.Equal(t, exp.Depth, 1)
+	redirected := exp.Tree.Children[0]
+	assert.Equal(t, redirected.Mechanism, "redirect")
+	assert.Equal(t, len(redirected.Children), 1)
+	assert.Equal(t, redirected.Children[0].Domain, "missing.example.com")
+	assert.Equal(t, redirected.Children[0].Status, string(zdns.StatusNoAnswer))
+}
+
+func TestLookup_ExpandLookupLimit(t *testing.T) {
+	resolver := InitTest(t)
+	// each record includes the next, 12 lookups deep
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("spf%d.example.com", i)
+		mockTypedResults[mockKey{name, dns.TypeTXT}] = txtResult(name, fmt.Sprintf("v=spf1 ip4:192.0.2.%d include:spf%d.example.com -all", i, i+1))
+	}
+
+	spfModule := SpfLookupModule{}
+	err := spfModule.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{LookupClient: MockLookup{}})
+	assert.NilError(t, err)
+	res, _, status, _ := spfModule.Lookup(resolver, "spf0.example.com", nil)
+	assert.Equal(t, zdns.StatusNoError, status)
+
+	exp := res.(Result).Expansion
+	assert.Equal(t, exp.LookupLimitExceeded, true)
+	assert.Equal(t, exp.LookupCount, 11)
+	assert.Equal(t, exp.Depth, 10)
+	assert.Equal(t, len(exp.AuthorizedIPs), 11)
+}
+
+func TestLookup_NoExpand(t *testing.T) {
+	resolver := InitTest(t)
+	mockTypedResults[mockKey{"example.com", dns.TypeTXT}] = txtResult("example.com", "v=spf1 include:_spf.example.net -all")
+
+	spfModule := SpfLookupModule{NoExpand: true}
+	err := spfModule.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{LookupClient: MockLookup{}})
+	assert.NilError(t, err)
+	res, _, status, _ := spfModule.Lookup(resolver, "example.com", nil)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Assert(t, res.(Result).Expansion == nil)
+	assert.Equal(t, len(queries), 1)
+}
+
+func TestParseTerm(t *testing.T) {
+	tests := []struct {
+		term, name, value string
+	}{
+		{"-all", "all", ""},
+		{"~include:_spf.example.com", "include", "_spf.example.com"},
+		{"ip4:192.0.2.0/24", "ip4", "192.0.2.0/24"},
+		{"a/24", "a", "/24"},
+		{"MX:example.com//64", "mx", "example.com//64"},
+		{"redirect=_spf.example.com", "redirect", "_spf.example.com"},
+		{"exp=explain._spf.%{d}", "exp", "explain._spf.%{d}"},
+	}
+	for _, test := range tests {
+		name, value := parseTerm(test.term)
+		assert.Equal(t, name, test.name, test.term)
+		assert.Equal(t, value, test.value, test.term)
+	}
+}
+
+func TestSplitDomainSpec(t *testing.T) {
+	tests := []struct {
+		value, domain, cidr4, cidr6 string
+	}{
+		{"", "example.com", "", ""},
+		{"/24", "example.com", "24", ""},
+		{"//64", "example.com", "", "64"},
+		{"mail.example.com/24//64", "mail.example.com", "24", "64"},
+		{"mail.example.com", "mail.example.com", "", ""},
+	}
+	for _, test := range tests {
+		domain, cidr4, cidr6 := splitDomainSpec(test.value, "example.com")
+		assert.Equal(t, domain, test.domain, test.value)
+		assert.Equal(t, cidr4, test.cidr4, test.value)
+		assert.Equal(t, cidr6, test.cidr6, test.value)
+	}
+}
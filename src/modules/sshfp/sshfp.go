@@ -0,0 +1,151 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package sshfp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// algorithmNames are the SSHFP public key algorithms, RFC 4255, RFC 6594 and RFC 7479
+var algorithmNames = map[uint8]string{
+	1: "RSA",
+	2: "DSA",
+	3: "ECDSA",
+	4: "Ed25519",
+	6: "Ed448",
+}
+
+// fingerprintTypeNames are the SSHFP fingerprint types, RFC 4255 and RFC 6594
+var fingerprintTypeNames = map[uint8]string{
+	1: "SHA-1",
+	2: "SHA-256",
+}
+
+// Fingerprint is a single SSHFP record of a host
+type Fingerprint struct {
+	Algorithm           uint8  `json:"algorithm" groups:"short,normal,long,trace"`
+	AlgorithmName       string `json:"algorithm_name" groups:"short,normal,long,trace"` // ex. Ed25519, or the number if unassigned
+	FingerprintType     uint8  `json:"fingerprint_type" groups:"short,normal,long,trace"`
+	FingerprintTypeName string `json:"fingerprint_type_name" groups:"short,normal,long,trace"` // ex. SHA-256, or the number if unassigned
+	Fingerprint         string `json:"fingerprint" groups:"short,normal,long,trace"`           // lowercase hex
+	// Trusted is set if the SSHFP RRset was authenticated with DNSSEC, only checked with --dnssec or --validate-dnssec
+	Trusted bool   `json:"trusted" groups:"short,normal,long,trace"`
+	TTL     uint32 `json:"ttl" groups:"ttl,normal,long,trace"`
+}
+
+// Result is the set of SSHFP records of a host
+type Result struct {
+	Fingerprints []Fingerprint `json:"fingerprints" groups:"short,normal,long,trace"`
+	// TrustedBy is how the records were authenticated: "validation" if zdns validated them with --validate-dnssec,
+	// or "resolver" if the resolver set the AD flag with --dnssec. Empty if they weren't
+	TrustedBy string `json:"trusted_by,omitempty" groups:"short,normal,long,trace"`
+}
+
+const (
+	trustedByValidation = "validation"
+	trustedByResolver   = "resolver"
+)
+
+func init() {
+	cli.RegisterLookupModule("SSHFP", new(SSHFPLookupModule))
+}
+
+type SSHFPLookupModule struct {
+	cli.BasicLookupModule
+	checkDNSSEC bool
+}
+
+// CLIInit initializes the SSHFP lookup module
+func (sshfpMod *SSHFPLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("SSHFP module does not support --all-nameservers")
+	}
+	sshfpMod.checkDNSSEC = gc.Dnssec || gc.ValidateDNSSEC
+	sshfpMod.BasicLookupModule.DNSType = dns.TypeSSHFP
+	sshfpMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return sshfpMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup queries the SSHFP records of lookupName. With DNSSEC, the fingerprints are marked as trusted only if the
+// RRset was authenticated.
+func (sshfpMod *SSHFPLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := Result{Fingerprints: []Fingerprint{}}
+	innerRes, trace, status, err := sshfpMod.BasicLookupModule.Lookup(r, lookupName, nameServer)
+	if status != zdns.StatusNoError || err != nil {
+		return res, trace, status, err
+	}
+	castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+	if !ok {
+		return nil, trace, status, errors.New("lookup didn't return a single query result type")
+	}
+	if sshfpMod.checkDNSSEC {
+		res.TrustedBy = trustedBy(castedInnerRes)
+	}
+	for _, a := range castedInnerRes.Answers {
+		if ans, ok := a.(zdns.SSHFPAnswer); ok && ans.RrType == dns.TypeSSHFP {
+			res.Fingerprints = append(res.Fingerprints, makeFingerprint(ans, res.TrustedBy != ""))
+		}
+	}
+	if len(res.Fingerprints) == 0 {
+		return res, trace, zdns.StatusNoRecord, nil
+	}
+	return res, trace, zdns.StatusNoError, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (sshfpMod *SSHFPLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// trustedBy returns how the answer was authenticated, or an empty string if it wasn't. zdns' own validation takes
+// precedence over the resolver's AD flag, since a Bogus or Insecure result means the flag can't be relied upon.
+func trustedBy(res *zdns.SingleQueryResult) string {
+	if res.DNSSECResult != nil {
+		if res.DNSSECResult.Status == zdns.DNSSECSecure {
+			return trustedByValidation
+		}
+		return ""
+	}
+	if res.Flags.Authenticated {
+		return trustedByResolver
+	}
+	return ""
+}
+
+func makeFingerprint(ans zdns.SSHFPAnswer, trusted bool) Fingerprint {
+	return Fingerprint{
+		Algorithm:           ans.Algorithm,
+		AlgorithmName:       nameOrNumber(algorithmNames, ans.Algorithm),
+		FingerprintType:     ans.Type,
+		FingerprintTypeName: nameOrNumber(fingerprintTypeNames, ans.Type),
+		Fingerprint:         strings.ToLower(ans.FingerPrint),
+		Trusted:             trusted,
+		TTL:                 ans.TTL,
+	}
+}
+
+func nameOrNumber(names map[uint8]string, n uint8) string {
+	if name, ok := names[n]; ok {
+		return name
+	}
+	return strconv.Itoa(int(n))
+}
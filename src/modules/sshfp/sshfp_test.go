@@ -0,0 +1,128 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package sshfp
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNoAnswer, nil
+	}
+}
+
+func InitTest(t *testing.T, gc *cli.CLIConf) (*zdns.Resolver, *SSHFPLookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	sshfpMod := new(SSHFPLookupModule)
+	assert.NilError(t, sshfpMod.CLIInit(gc, &zdns.ResolverConfig{}))
+	return r, sshfpMod
+}
+
+func sshfpAnswer(t *testing.T, rr string) zdns.SSHFPAnswer {
+	parsed, err := dns.NewRR(rr)
+	assert.NilError(t, err)
+	return zdns.ParseAnswer(parsed).(zdns.SSHFPAnswer)
+}
+
+func TestSSHFPLookup_MultipleRecords(t *testing.T) {
+	resolver, sshfpMod := InitTest(t, &cli.CLIConf{})
+	mockResults["host.zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			sshfpAnswer(t, "host.zdns-testing.com. 300 IN SSHFP 4 2 ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789"),
+			sshfpAnswer(t, "host.zdns-testing.com. 300 IN SSHFP 9 1 0123456789abcdef0123456789abcdef01234567"),
+		},
+		Flags: zdns.DNSFlags{Authenticated: true},
+	}
+	res, _, status, err := sshfpMod.Lookup(resolver, "host.zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	result := res.(Result)
+	assert.Equal(t, len(result.Fingerprints), 2)
+	assert.DeepEqual(t, result.Fingerprints[0], Fingerprint{
+		Algorithm:           4,
+		AlgorithmName:       "Ed25519",
+		FingerprintType:     2,
+		FingerprintTypeName: "SHA-256",
+		Fingerprint:         "abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+		TTL:                 300,
+	})
+	assert.Equal(t, result.Fingerprints[1].AlgorithmName, "9")
+	// without --dnssec, the AD flag isn't looked at
+	assert.Equal(t, result.TrustedBy, "")
+	assert.Equal(t, result.Fingerprints[1].Trusted, false)
+}
+
+func TestSSHFPLookup_TrustedByResolver(t *testing.T) {
+	resolver, sshfpMod := InitTest(t, &cli.CLIConf{QueryOptions: cli.QueryOptions{Dnssec: true}})
+	mockResults["host.zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			sshfpAnswer(t, "host.zdns-testing.com. 300 IN SSHFP 1 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+		},
+		Flags: zdns.DNSFlags{Authenticated: true},
+	}
+	res, _, _, err := sshfpMod.Lookup(resolver, "host.zdns-testing.com", nil)
+	assert.NilError(t, err)
+	result := res.(Result)
+	assert.Equal(t, result.TrustedBy, trustedByResolver)
+	assert.Equal(t, result.Fingerprints[0].Trusted, true)
+}
+
+func TestSSHFPLookup_NotTrustedIfValidationFails(t *testing.T) {
+	resolver, sshfpMod := InitTest(t, &cli.CLIConf{QueryOptions: cli.QueryOptions{Dnssec: true}})
+	mockResults["host.zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			sshfpAnswer(t, "host.zdns-testing.com. 300 IN SSHFP 1 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+		},
+		Flags:        zdns.DNSFlags{Authenticated: true},
+		DNSSECResult: &zdns.DNSSECResult{Status: zdns.DNSSECBogus},
+	}
+	res, _, _, err := sshfpMod.Lookup(resolver, "host.zdns-testing.com", nil)
+	assert.NilError(t, err)
+	result := res.(Result)
+	assert.Equal(t, result.TrustedBy, "")
+	assert.Equal(t, result.Fingerprints[0].Trusted, false)
+}
+
+func TestSSHFPLookup_NoRecords(t *testing.T) {
+	resolver, sshfpMod := InitTest(t, &cli.CLIConf{})
+	mockResults["host.zdns-testing.com"] = &zdns.SingleQueryResult{}
+	_, _, status, err := sshfpMod.Lookup(resolver, "host.zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoRecord, status)
+}
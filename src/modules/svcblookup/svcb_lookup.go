@@ -0,0 +1,193 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package svcblookup
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// ServiceRecord is a single SVCB or HTTPS record, with its well-known SvcParams broken out
+type ServiceRecord struct {
+	Priority      uint16   `json:"priority" groups:"short,normal,long,trace"`
+	Target        string   `json:"target" groups:"short,normal,long,trace"`
+	ALPN          []string `json:"alpn,omitempty" groups:"short,normal,long,trace"`
+	NoDefaultALPN bool     `json:"no_default_alpn,omitempty" groups:"short,normal,long,trace"`
+	Port          uint16   `json:"port,omitempty" groups:"short,normal,long,trace"`
+	IPv4Hints     []string `json:"ipv4hint,omitempty" groups:"short,normal,long,trace"`
+	IPv6Hints     []string `json:"ipv6hint,omitempty" groups:"short,normal,long,trace"`
+	ECH           string   `json:"ech,omitempty" groups:"short,normal,long,trace"`
+	TTL           uint32   `json:"ttl" groups:"ttl,normal,long,trace"`
+}
+
+// Result is the set of ServiceMode records for a name, found after following any AliasMode records
+type Result struct {
+	Name       string          `json:"name" groups:"short,normal,long,trace"`
+	AliasChain []string        `json:"alias_chain,omitempty" groups:"short,normal,long,trace"`
+	Records    []ServiceRecord `json:"records" groups:"short,normal,long,trace"`
+}
+
+func init() {
+	cli.RegisterLookupModule("SVCBLOOKUP", &SvcbLookupModule{dnsType: dns.TypeSVCB})
+	cli.RegisterLookupModule("HTTPSLOOKUP", &SvcbLookupModule{dnsType: dns.TypeHTTPS})
+}
+
+type SvcbLookupModule struct {
+	MaxAliasDepth int `long:"max-alias-depth" default:"8" description:"maximum number of AliasMode records to follow"`
+	cli.BasicLookupModule
+	dnsType uint16
+}
+
+// CLIInit initializes the SVCB/HTTPS lookup module
+func (svcbMod *SvcbLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return fmt.Errorf("%s module does not support --all-nameservers", dns.TypeToString[svcbMod.dnsType])
+	}
+	if svcbMod.MaxAliasDepth < 0 {
+		return errors.New("--max-alias-depth cannot be negative")
+	}
+	svcbMod.BasicLookupModule.DNSType = svcbMod.dnsType
+	svcbMod.BasicLookupModule.DNSClass = dns.ClassINET
+	return svcbMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup queries lookupName for SVCB or HTTPS records. If the name has an AliasMode record (priority 0), its target is
+// queried in turn, up to MaxAliasDepth times.
+func (svcbMod *SvcbLookupModule) Lookup(r *zdns.Resolver, lookupName string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	res := Result{Name: lookupName, Records: []ServiceRecord{}}
+	visited := map[string]struct{}{strings.ToLower(lookupName): {}}
+	var trace zdns.Trace
+	for {
+		innerRes, innerTrace, status, err := svcbMod.BasicLookupModule.Lookup(r, res.Name, nameServer)
+		trace = append(trace, innerTrace...)
+		if status != zdns.StatusNoError || err != nil {
+			return res, trace, status, err
+		}
+		castedInnerRes, ok := innerRes.(*zdns.SingleQueryResult)
+		if !ok {
+			return nil, trace, status, errors.New("lookup didn't return a single query result type")
+		}
+		alias, records := parseServiceRecords(castedInnerRes, svcbMod.dnsType)
+		if alias == nil {
+			for i := range records {
+				if records[i].Target == "" {
+					// a ServiceMode target of "." is the owner name
+					records[i].Target = res.Name
+				}
+			}
+			res.Records = records
+			if len(records) == 0 {
+				return res, trace, zdns.StatusNoRecord, nil
+			}
+			return res, trace, zdns.StatusNoError, nil
+		}
+		if alias.Target == "" {
+			// an AliasMode target of "." means the service isn't available, RFC 9460 section 2.5.1
+			return res, trace, zdns.StatusNoRecord, nil
+		}
+		if len(res.AliasChain) >= svcbMod.MaxAliasDepth {
+			return res, trace, zdns.StatusError, fmt.Errorf("AliasMode chain from %s is longer than %d", lookupName, svcbMod.MaxAliasDepth)
+		}
+		if _, seen := visited[strings.ToLower(alias.Target)]; seen {
+			return res, trace, zdns.StatusCircular, fmt.Errorf("AliasMode loop at %s", alias.Target)
+		}
+		visited[strings.ToLower(alias.Target)] = struct{}{}
+		res.AliasChain = append(res.AliasChain, alias.Target)
+		res.Name = alias.Target
+	}
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (svcbMod *SvcbLookupModule) ResultType() interface{} {
+	return Result{}
+}
+
+// parseServiceRecords returns the AliasMode record among the answers, if any, and otherwise the ServiceMode records
+func parseServiceRecords(res *zdns.SingleQueryResult, dnsType uint16) (*ServiceRecord, []ServiceRecord) {
+	records := make([]ServiceRecord, 0, len(res.Answers))
+	for _, a := range res.Answers {
+		ans, ok := a.(zdns.SVCBAnswer)
+		if !ok || ans.RrType != dnsType {
+			continue
+		}
+		rec := makeServiceRecord(ans)
+		if rec.Priority == 0 {
+			return &rec, nil
+		}
+		records = append(records, rec)
+	}
+	return nil, records
+}
+
+func makeServiceRecord(ans zdns.SVCBAnswer) ServiceRecord {
+	rec := ServiceRecord{
+		Priority: ans.Priority,
+		Target:   strings.TrimSuffix(ans.Target, "."),
+		TTL:      ans.TTL,
+	}
+	for key, value := range ans.SVCParams {
+		switch v := value.(type) {
+		case []string:
+			if key == dns.SVCB_ALPN.String() {
+				rec.ALPN = v
+			}
+		case bool:
+			rec.NoDefaultALPN = key == dns.SVCB_NO_DEFAULT_ALPN.String() && v
+		case uint16:
+			if key == dns.SVCB_PORT.String() {
+				rec.Port = v
+			}
+		case []net.IP:
+			hints := make([]string, len(v))
+			for i, ip := range v {
+				hints[i] = ip.String()
+			}
+			if key == dns.SVCB_IPV4HINT.String() {
+				rec.IPv4Hints = hints
+			} else if key == dns.SVCB_IPV6HINT.String() {
+				rec.IPv6Hints = hints
+			}
+		case []byte:
+			if key == dns.SVCB_ECHCONFIG.String() {
+				rec.ECH = base64.StdEncoding.EncodeToString(v)
+			}
+		}
+	}
+	return rec
+}
+
+func (svcbMod *SvcbLookupModule) Help() string {
+	return ""
+}
+
+func (svcbMod *SvcbLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (svcbMod *SvcbLookupModule) GetDescription() string {
+	return fmt.Sprintf("%sLOOKUP parses the SvcParams of %s records, following AliasMode records to the service.", dns.TypeToString[svcbMod.dnsType], dns.TypeToString[svcbMod.dnsType])
+}
+
+func (svcbMod *SvcbLookupModule) NewFlags() interface{} {
+	return svcbMod
+}
@@ -0,0 +1,151 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package svcblookup
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"gotest.tools/v3/assert"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+var mockResults = make(map[string]*zdns.SingleQueryResult)
+var queries []zdns.Question
+
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	queries = append(queries, question)
+	if res, ok := mockResults[question.Name]; ok {
+		return res, nil, zdns.StatusNoError, nil
+	} else {
+		return &zdns.SingleQueryResult{}, nil, zdns.StatusNoAnswer, nil
+	}
+}
+
+func InitTest(t *testing.T) (*zdns.Resolver, *SvcbLookupModule) {
+	mockResults = make(map[string]*zdns.SingleQueryResult)
+	queries = nil
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	assert.NilError(t, err)
+
+	svcbMod := &SvcbLookupModule{dnsType: dns.TypeHTTPS, MaxAliasDepth: 2}
+	assert.NilError(t, svcbMod.CLIInit(&cli.CLIConf{}, &zdns.ResolverConfig{}))
+	return r, svcbMod
+}
+
+func httpsAnswer(t *testing.T, rr string) zdns.SVCBAnswer {
+	parsed, err := dns.NewRR(rr)
+	assert.NilError(t, err)
+	return zdns.ParseAnswer(parsed).(zdns.SVCBAnswer)
+}
+
+func TestSvcbLookup_ServiceMode(t *testing.T) {
+	resolver, svcbMod := InitTest(t)
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{
+			httpsAnswer(t, `zdns-testing.com. 300 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech=AEX+DQ==`),
+			httpsAnswer(t, "zdns-testing.com. 300 IN HTTPS 2 backup.zdns-testing.com. no-default-alpn"),
+		},
+	}
+	res, _, status, err := svcbMod.Lookup(resolver, "zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+	assert.Equal(t, queries[0].Type, dns.TypeHTTPS)
+
+	result := res.(Result)
+	assert.Equal(t, len(result.Records), 2)
+	assert.DeepEqual(t, result.Records[0], ServiceRecord{
+		Priority:  1,
+		Target:    "zdns-testing.com",
+		ALPN:      []string{"h3", "h2"},
+		Port:      8443,
+		IPv4Hints: []string{"192.0.2.1"},
+		IPv6Hints: []string{"2001:db8::1"},
+		ECH:       "AEX+DQ==",
+		TTL:       300,
+	})
+	assert.Equal(t, result.Records[1].Target, "backup.zdns-testing.com")
+	assert.Equal(t, result.Records[1].NoDefaultALPN, true)
+}
+
+func TestSvcbLookup_FollowsAlias(t *testing.T) {
+	resolver, svcbMod := InitTest(t)
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{httpsAnswer(t, "zdns-testing.com. 300 IN HTTPS 0 cdn.zdns-testing.net.")},
+	}
+	mockResults["cdn.zdns-testing.net"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{httpsAnswer(t, `cdn.zdns-testing.net. 60 IN HTTPS 1 . alpn="h2"`)},
+	}
+	res, _, status, err := svcbMod.Lookup(resolver, "zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoError, status)
+
+	result := res.(Result)
+	assert.Equal(t, result.Name, "cdn.zdns-testing.net")
+	assert.DeepEqual(t, result.AliasChain, []string{"cdn.zdns-testing.net"})
+	assert.Equal(t, len(result.Records), 1)
+	assert.Equal(t, result.Records[0].Target, "cdn.zdns-testing.net")
+}
+
+func TestSvcbLookup_AliasLoop(t *testing.T) {
+	resolver, svcbMod := InitTest(t)
+	mockResults["a.zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{httpsAnswer(t, "a.zdns-testing.com. 300 IN HTTPS 0 b.zdns-testing.com.")},
+	}
+	mockResults["b.zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{httpsAnswer(t, "b.zdns-testing.com. 300 IN HTTPS 0 a.zdns-testing.com.")},
+	}
+	_, _, status, err := svcbMod.Lookup(resolver, "a.zdns-testing.com", nil)
+	assert.Equal(t, zdns.StatusCircular, status)
+	assert.ErrorContains(t, err, "loop")
+}
+
+func TestSvcbLookup_AliasDepth(t *testing.T) {
+	resolver, svcbMod := InitTest(t)
+	for _, rr := range []string{
+		"a.zdns-testing.com. 300 IN HTTPS 0 b.zdns-testing.com.",
+		"b.zdns-testing.com. 300 IN HTTPS 0 c.zdns-testing.com.",
+		"c.zdns-testing.com. 300 IN HTTPS 0 d.zdns-testing.com.",
+	} {
+		ans := httpsAnswer(t, rr)
+		mockResults[ans.Name] = &zdns.SingleQueryResult{Answers: []interface{}{ans}}
+	}
+	_, _, status, err := svcbMod.Lookup(resolver, "a.zdns-testing.com", nil)
+	assert.Equal(t, zdns.StatusError, status)
+	assert.ErrorContains(t, err, "longer than 2")
+	assert.Equal(t, len(queries), 3)
+}
+
+func TestSvcbLookup_ServiceUnavailable(t *testing.T) {
+	resolver, svcbMod := InitTest(t)
+	mockResults["zdns-testing.com"] = &zdns.SingleQueryResult{
+		Answers: []interface{}{httpsAnswer(t, "zdns-testing.com. 300 IN HTTPS 0 .")},
+	}
+	_, _, status, err := svcbMod.Lookup(resolver, "zdns-testing.com", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, zdns.StatusNoRecord, status)
+}
@@ -0,0 +1,157 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+package wildcard
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+const probeLabelLength = 16
+
+// Result reports whether names that can't exist under a zone resolve, i.e. the zone has a wildcard (RFC 4592)
+type Result struct {
+	Wildcard         bool          `json:"wildcard" groups:"short,normal,long,trace"`
+	Probes           int           `json:"probes" groups:"short,normal,long,trace"`
+	Resolved         int           `json:"resolved" groups:"short,normal,long,trace"` // probes answered with NOERROR
+	ResolvedFraction float64       `json:"resolved_fraction" groups:"short,normal,long,trace"`
+	Answers          []interface{} `json:"answers,omitempty" groups:"short,normal,long,trace"` // distinct records the probes resolved to, with probe owner names as *.<zone>
+	ProbeNames       []string      `json:"probe_names,omitempty" groups:"long,trace"`
+}
+
+func init() {
+	wcMod := new(WildcardLookupModule)
+	cli.RegisterLookupModule("WILDCARD", wcMod)
+}
+
+type WildcardLookupModule struct {
+	Probes    int    `long:"probes" default:"3" description:"number of random labels to query under each zone"`
+	QueryType string `long:"query-type" default:"A" description:"record type to query the random labels with"`
+	cli.BasicLookupModule
+
+	randMu sync.Mutex
+	rand   *rand.Rand // source of the probe labels, seeded with --seed
+}
+
+// CLIInit initializes the WILDCARD module
+func (wcMod *WildcardLookupModule) CLIInit(gc *cli.CLIConf, rc *zdns.ResolverConfig) error {
+	if gc.LookupAllNameServers {
+		return errors.New("WILDCARD module does not support --all-nameservers")
+	}
+	if wcMod.Probes < 1 {
+		return fmt.Errorf("--probes must be at least 1, got %d", wcMod.Probes)
+	}
+	qType, ok := dns.StringToType[strings.ToUpper(wcMod.QueryType)]
+	if !ok {
+		return fmt.Errorf("invalid --query-type: %s", wcMod.QueryType)
+	}
+	wcMod.DNSType = qType
+	wcMod.DNSClass = dns.ClassINET
+	seed := rc.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	wcMod.rand = rand.New(rand.NewSource(seed))
+	return wcMod.BasicLookupModule.CLIInit(gc, rc)
+}
+
+// Lookup queries random labels under zone. A probe that fails, ex. times out, doesn't count towards the fraction, and
+// the zone's status is that of the last failure if every probe failed.
+func (wcMod *WildcardLookupModule) Lookup(r *zdns.Resolver, zone string, nameServer *zdns.NameServer) (interface{}, zdns.Trace, zdns.Status, error) {
+	zone = strings.TrimSuffix(zone, ".")
+	res := &Result{}
+	var trace zdns.Trace
+	seen := make(map[string]struct{})
+	var lastStatus zdns.Status
+	var lastErr error
+	for i := 0; i < wcMod.Probes; i++ {
+		probeName := wcMod.randomLabel() + "." + zone
+		innerRes, probeTrace, status, err := wcMod.BasicLookupModule.Lookup(r, probeName, nameServer)
+		trace = append(trace, probeTrace...)
+		if status != zdns.StatusNoError && status != zdns.StatusNXDomain {
+			lastStatus, lastErr = status, err
+			continue
+		}
+		res.Probes++
+		res.ProbeNames = append(res.ProbeNames, probeName)
+		if status != zdns.StatusNoError {
+			continue
+		}
+		// NOERROR, even without records of the queried type, means the name exists
+		res.Resolved++
+		castedRes, ok := innerRes.(*zdns.SingleQueryResult)
+		if !ok {
+			continue
+		}
+		for _, a := range castedRes.Answers {
+			if ans, ok := a.(zdns.Answer); ok && strings.EqualFold(ans.Name, probeName) {
+				ans.Name = "*." + zone
+				a = ans
+			}
+			key := fmt.Sprintf("%#v", a)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				res.Answers = append(res.Answers, a)
+			}
+		}
+	}
+	if res.Probes == 0 {
+		return nil, trace, lastStatus, lastErr
+	}
+	res.Wildcard = res.Resolved > 0
+	res.ResolvedFraction = float64(res.Resolved) / float64(res.Probes)
+	return res, trace, zdns.StatusNoError, nil
+}
+
+// ResultType returns a zero value of the data type of the module's results, for --dump-schema
+func (wcMod *WildcardLookupModule) ResultType() interface{} {
+	return &Result{}
+}
+
+// randomLabel returns a label that's vanishingly unlikely to exist in any zone
+func (wcMod *WildcardLookupModule) randomLabel() string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	wcMod.randMu.Lock()
+	defer wcMod.randMu.Unlock()
+	b := make([]byte, probeLabelLength)
+	for i := range b {
+		b[i] = alphabet[wcMod.rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func (wcMod *WildcardLookupModule) Help() string {
+	return ""
+}
+
+func (wcMod *WildcardLookupModule) Validate(args []string) error {
+	return nil
+}
+
+func (wcMod *WildcardLookupModule) GetDescription() string {
+	return "WILDCARD queries random labels under each zone and reports whether they resolve, i.e. the zone has a " +
+		"wildcard, along with the records they resolve to and the fraction of labels that resolved."
+}
+
+func (wcMod *WildcardLookupModule) NewFlags() interface{} {
+	return wcMod
+}
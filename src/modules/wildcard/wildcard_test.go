@@ -0,0 +1,82 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package wildcard
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zmap/zdns/src/cli"
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// MockLookup answers every name under wildcard.example.com with the same A record, and NXDOMAIN for everything else
+type MockLookup struct{}
+
+func (ml MockLookup) DoDstServersLookup(ctx context.Context, r *zdns.Resolver, question zdns.Question, nameServers []zdns.NameServer, isIterative bool) (*zdns.SingleQueryResult, zdns.Trace, zdns.Status, error) {
+	if question.Type == dns.TypeA && strings.HasSuffix(question.Name, ".wildcard.example.com") {
+		return &zdns.SingleQueryResult{Answers: []interface{}{
+			zdns.Answer{Name: question.Name, Type: "A", RrType: dns.TypeA, Class: "IN", RrClass: dns.ClassINET, TTL: 300, Answer: "192.0.2.1"},
+		}}, nil, zdns.StatusNoError, nil
+	}
+	return &zdns.SingleQueryResult{}, nil, zdns.StatusNXDomain, nil
+}
+
+func initTest(t *testing.T) (*zdns.Resolver, *WildcardLookupModule) {
+	rc := zdns.ResolverConfig{
+		RootNameServersV4:     []zdns.NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+		ExternalNameServersV4: []zdns.NameServer{{IP: net.ParseIP("127.0.0.1"), Port: 53}},
+		LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+		IPVersionMode:         zdns.IPv4Only,
+		LookupClient:          MockLookup{}}
+	r, err := zdns.InitResolver(&rc)
+	require.NoError(t, err)
+	wcMod := &WildcardLookupModule{Probes: 4, QueryType: "A"}
+	require.NoError(t, wcMod.CLIInit(&cli.CLIConf{}, &rc))
+	return r, wcMod
+}
+
+func TestWildcardDetected(t *testing.T) {
+	r, wcMod := initTest(t)
+	res, _, status, err := wcMod.Lookup(r, "wildcard.example.com", nil)
+	require.NoError(t, err)
+	require.Equal(t, zdns.StatusNoError, status)
+	wc := res.(*Result)
+	require.True(t, wc.Wildcard)
+	require.Equal(t, 4, wc.Probes)
+	require.Equal(t, 4, wc.Resolved)
+	require.Equal(t, 1.0, wc.ResolvedFraction)
+	require.Len(t, wc.ProbeNames, 4)
+	require.Len(t, wc.Answers, 1, "the same record from every probe is reported once")
+	require.Equal(t, "*.wildcard.example.com", wc.Answers[0].(zdns.Answer).Name)
+	require.Equal(t, "192.0.2.1", wc.Answers[0].(zdns.Answer).Answer)
+}
+
+func TestNoWildcard(t *testing.T) {
+	r, wcMod := initTest(t)
+	res, _, status, err := wcMod.Lookup(r, "example.com", nil)
+	require.NoError(t, err)
+	require.Equal(t, zdns.StatusNoError, status)
+	wc := res.(*Result)
+	require.False(t, wc.Wildcard)
+	require.Equal(t, 4, wc.Probes)
+	require.Zero(t, wc.ResolvedFraction)
+	require.Empty(t, wc.Answers)
+}
@@ -15,6 +15,8 @@
 package zdns
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"net"
@@ -95,10 +97,12 @@ func (r *DNSKEYAnswer) ToVanillaType() *dns.DNSKEY {
 
 type DSAnswer struct {
 	Answer
-	KeyTag     uint16 `json:"key_tag" groups:"short,normal,long,trace"`
-	Algorithm  uint8  `json:"algorithm" groups:"short,normal,long,trace"`
-	DigestType uint8  `json:"digest_type" groups:"short,normal,long,trace"`
-	Digest     string `json:"digest" groups:"short,normal,long,trace"`
+	KeyTag         uint16 `json:"key_tag" groups:"short,normal,long,trace"`
+	Algorithm      uint8  `json:"algorithm" groups:"short,normal,long,trace"`
+	AlgorithmName  string `json:"algorithm_name" groups:"short,normal,long,trace"` // mnemonic of Algorithm, ex. RSASHA256
+	DigestType     uint8  `json:"digest_type" groups:"short,normal,long,trace"`
+	DigestTypeName string `json:"digest_type_name" groups:"short,normal,long,trace"` // mnemonic of DigestType, ex. SHA256
+	Digest         string `json:"digest" groups:"short,normal,long,trace"`
 }
 
 func (r *DSAnswer) ToVanillaType() *dns.DS {
@@ -287,6 +291,13 @@ type RPAnswer struct {
 	Txt  string `json:"txt" groups:"short,normal,long,trace"`
 }
 
+// TXTAnswer is a TXT record with its character-strings concatenated into Answer, the way SPF (RFC 7208) and DKIM
+// (RFC 6376) records are read, and kept as sent under Segments
+type TXTAnswer struct {
+	Answer
+	Segments []string `json:"segments" groups:"short,normal,long,trace"`
+}
+
 type SMIMEAAnswer struct {
 	Answer
 	Usage        uint8  `json:"usage" groups:"short,normal,long,trace"`
@@ -306,6 +317,16 @@ type SOAAnswer struct {
 	Minttl  uint32 `json:"min_ttl" groups:"short,normal,long,trace"`
 }
 
+// DHCIDAnswer is a DHCID record decoded per RFC 4701, section 3. Answer holds the base64 RDATA as it appears in zone files.
+type DHCIDAnswer struct {
+	Answer
+	IdentifierType     uint16 `json:"identifier_type" groups:"short,normal,long,trace"`
+	IdentifierTypeName string `json:"identifier_type_name" groups:"short,normal,long,trace"` // ex. DUID, or the number if unassigned
+	DigestType         uint8  `json:"digest_type" groups:"short,normal,long,trace"`
+	DigestTypeName     string `json:"digest_type_name" groups:"short,normal,long,trace"` // ex. SHA256, or the number if unassigned
+	Digest             string `json:"digest" groups:"short,normal,long,trace"`           // hex
+}
+
 type SSHFPAnswer struct {
 	Answer
 	Algorithm   uint8  `json:"algorithm" groups:"short,normal,long,trace"`
@@ -476,6 +497,59 @@ func makeBitArray(s string) []uint16 {
 	return retv
 }
 
+// dnssecAlgorithmName returns the mnemonic for a DNSSEC algorithm number, or the number itself if it is unassigned
+func dnssecAlgorithmName(alg uint8) string {
+	if name, ok := dns.AlgorithmToString[alg]; ok {
+		return name
+	}
+	return strconv.Itoa(int(alg))
+}
+
+// DHCID identifier type codes, RFC 4701 section 3.3
+var dhcidIdentifierTypeNames = map[uint16]string{
+	0x0000: "HTYPE_CHADDR", // the 1-octet htype followed by hlen octets of chaddr from a DHCPv4 message
+	0x0001: "CLIENT_ID",    // the data octets of a DHCPv4 client identifier option
+	0x0002: "DUID",         // the client's DUID from a DHCPv6 client identifier option
+}
+
+// DHCID digest type codes, RFC 4701 section 3.5, which aren't the same registry as DS digest types
+var dhcidDigestTypeNames = map[uint8]string{
+	1: "SHA256",
+}
+
+// parseDHCID decodes the base64 RDATA of a DHCID record, a 2-octet identifier type, a 1-octet digest type and the
+// digest. Records that don't decode are returned as a base Answer.
+func parseDHCID(rr *dns.DHCID) interface{} {
+	base := makeBaseAnswer(&rr.Hdr, rr.Digest)
+	rdata, err := base64.StdEncoding.DecodeString(rr.Digest)
+	if err != nil || len(rdata) < 3 {
+		return base
+	}
+	ans := DHCIDAnswer{
+		Answer:         base,
+		IdentifierType: binary.BigEndian.Uint16(rdata[0:2]),
+		DigestType:     rdata[2],
+		Digest:         strings.ToUpper(hex.EncodeToString(rdata[3:])),
+	}
+	ans.IdentifierTypeName = strconv.Itoa(int(ans.IdentifierType))
+	if name, ok := dhcidIdentifierTypeNames[ans.IdentifierType]; ok {
+		ans.IdentifierTypeName = name
+	}
+	ans.DigestTypeName = strconv.Itoa(int(ans.DigestType))
+	if name, ok := dhcidDigestTypeNames[ans.DigestType]; ok {
+		ans.DigestTypeName = name
+	}
+	return ans
+}
+
+// dsDigestTypeName returns the mnemonic for a DS digest type, or the number itself if it is unassigned
+func dsDigestTypeName(digestType uint8) string {
+	if name, ok := dns.HashToString[digestType]; ok {
+		return name
+	}
+	return strconv.Itoa(int(digestType))
+}
+
 func makeBaseAnswer(hdr *dns.RR_Header, answer string) Answer {
 	return Answer{
 		TTL:     hdr.Ttl,
@@ -593,6 +667,8 @@ func makeEDNSAnswer(cAns *dns.OPT) EDNSAnswer {
 			optRes.Expire = &Edns0Expire{
 				Code:   opt.Code,
 				Expire: opt.Expire,
+				Empty:  opt.Empty,
+				Low:    !opt.Empty && opt.Expire < edns0ExpireLowThreshold,
 			}
 		case *dns.EDNS0_COOKIE: //OPT 11
 			optRes.Cookie = &Edns0Cookie{Cookie: opt.Cookie}
@@ -610,6 +686,11 @@ func makeEDNSAnswer(cAns *dns.OPT) EDNSAnswer {
 				ErrorCodeText: dns.ExtendedErrorCodeToString[opt.InfoCode],
 				ExtraText:     opt.ExtraText,
 			})
+		case *dns.EDNS0_LOCAL: // options of codes without their own type
+			optRes.Local = append(optRes.Local, &Edns0Local{
+				Code: opt.Code,
+				Data: hex.EncodeToString(opt.Data),
+			})
 		}
 	}
 	return optRes
@@ -687,19 +768,23 @@ func ParseAnswer(ans dns.RR) interface{} {
 		return makeBaseAnswer(&cAns.Hdr, cAns.String())
 	case *dns.DS:
 		return DSAnswer{
-			Answer:     makeBaseAnswer(&cAns.Hdr, ""),
-			KeyTag:     cAns.KeyTag,
-			Algorithm:  cAns.Algorithm,
-			DigestType: cAns.DigestType,
-			Digest:     cAns.Digest,
+			Answer:         makeBaseAnswer(&cAns.Hdr, ""),
+			KeyTag:         cAns.KeyTag,
+			Algorithm:      cAns.Algorithm,
+			AlgorithmName:  dnssecAlgorithmName(cAns.Algorithm),
+			DigestType:     cAns.DigestType,
+			DigestTypeName: dsDigestTypeName(cAns.DigestType),
+			Digest:         cAns.Digest,
 		}
 	case *dns.CDS:
 		return DSAnswer{
-			Answer:     makeBaseAnswer(&cAns.Hdr, ""),
-			KeyTag:     cAns.KeyTag,
-			Algorithm:  cAns.Algorithm,
-			DigestType: cAns.DigestType,
-			Digest:     cAns.Digest,
+			Answer:         makeBaseAnswer(&cAns.Hdr, ""),
+			KeyTag:         cAns.KeyTag,
+			Algorithm:      cAns.Algorithm,
+			AlgorithmName:  dnssecAlgorithmName(cAns.Algorithm),
+			DigestType:     cAns.DigestType,
+			DigestTypeName: dsDigestTypeName(cAns.DigestType),
+			Digest:         cAns.Digest,
 		}
 	case *dns.RRSIG:
 		return RRSIGAnswer{
@@ -742,7 +827,7 @@ func ParseAnswer(ans dns.RR) interface{} {
 	case *dns.UINFO:
 		return makeBaseAnswer(&cAns.Hdr, cAns.Uinfo)
 	case *dns.DHCID:
-		return makeBaseAnswer(&cAns.Hdr, cAns.Digest)
+		return parseDHCID(cAns)
 	case *dns.NINFO:
 		return makeBaseAnswer(&cAns.Hdr, strings.Join(cAns.ZSData, "\n"))
 	case *dns.TKEY:
@@ -1045,3 +1130,36 @@ func ParseAnswer(ans dns.RR) interface{} {
 		}
 	}
 }
+
+// ConcatenateTXTAnswers returns a copy of res with each TXT record replaced by a TXTAnswer whose answer is the
+// concatenation of its character-strings. ParseAnswer joins them with newlines, which can't occur within a string since
+// non-printable bytes are escaped, so the strings are recovered by splitting on newlines.
+func ConcatenateTXTAnswers(res *SingleQueryResult) *SingleQueryResult {
+	if res == nil {
+		return nil
+	}
+	concatenated := *res
+	concatenated.Answers = concatenateTXTRecords(res.Answers)
+	concatenated.Additionals = concatenateTXTRecords(res.Additionals)
+	concatenated.Authorities = concatenateTXTRecords(res.Authorities)
+	concatenated.ExtraAnswers = concatenateTXTRecords(res.ExtraAnswers)
+	return &concatenated
+}
+
+func concatenateTXTRecords(records []interface{}) []interface{} {
+	if records == nil {
+		return nil
+	}
+	out := make([]interface{}, 0, len(records))
+	for _, rec := range records {
+		ans, ok := rec.(Answer)
+		if !ok || ans.RrType != dns.TypeTXT {
+			out = append(out, rec)
+			continue
+		}
+		segments := strings.Split(ans.Answer, "\n")
+		ans.Answer = strings.Join(segments, "")
+		out = append(out, TXTAnswer{Answer: ans, Segments: segments})
+	}
+	return out
+}
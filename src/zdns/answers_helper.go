@@ -54,6 +54,7 @@ func (ans APLAnswer) BaseAns() *Answer        { return &ans.Answer }
 func (ans CAAAnswer) BaseAns() *Answer        { return &ans.Answer }
 func (ans CERTAnswer) BaseAns() *Answer       { return &ans.Answer }
 func (ans CSYNCAnswer) BaseAns() *Answer      { return &ans.Answer }
+func (ans DHCIDAnswer) BaseAns() *Answer      { return &ans.Answer }
 func (ans DNSKEYAnswer) BaseAns() *Answer     { return &ans.Answer }
 func (ans DSAnswer) BaseAns() *Answer         { return &ans.Answer }
 func (ans GPOSAnswer) BaseAns() *Answer       { return &ans.Answer }
@@ -79,5 +80,6 @@ func (ans SVCBAnswer) BaseAns() *Answer       { return &ans.Answer }
 func (ans TALINKAnswer) BaseAns() *Answer     { return &ans.Answer }
 func (ans TKEYAnswer) BaseAns() *Answer       { return &ans.Answer }
 func (ans TLSAAnswer) BaseAns() *Answer       { return &ans.Answer }
+func (ans TXTAnswer) BaseAns() *Answer        { return &ans.Answer }
 func (ans URIAnswer) BaseAns() *Answer        { return &ans.Answer }
 func (ans ZONEMDAnswer) BaseAns() *Answer     { return &ans.Answer }
@@ -25,6 +25,9 @@ import (
 	"github.com/zmap/zdns/src/internal/util"
 )
 
+// cacheSweepLimit is the most expired entries removed from a shard each time an entry is added to it
+const cacheSweepLimit = 8
+
 type IsCached bool
 
 type CachedKey struct {
@@ -39,6 +42,16 @@ type CachedResult struct {
 	Additionals  []TimedAnswer
 	Flags        DNSFlags
 	DNSSECResult *DNSSECResult
+	Resolver     string // name server the result was received from, reported for cache hits in iterative lookups
+	// NXDomain marks a negatively cached name that doesn't exist, RFC 2308. NODATA answers are cached as results
+	// without answers
+	NXDomain bool
+	// ExpiresAt is when the record with the lowest TTL expires, after which the whole result is a cache miss
+	ExpiresAt time.Time
+}
+
+func (r *CachedResult) isExpired(now time.Time) bool {
+	return r.ExpiresAt.Before(now)
 }
 
 type TimedAnswer struct {
@@ -66,9 +79,19 @@ func (s *Cache) VerboseLog(depth int, args ...interface{}) {
 func (s *Cache) addCachedAnswer(q Question, nameServer string, isAuthority bool, result *CachedResult, depth int) {
 	cacheKey := CachedKey{q, nameServer, isAuthority}
 	s.IterativeCache.Lock(cacheKey)
+	// lazily sweep expired entries that haven't been used in a while, so they don't take space from live ones
+	now := time.Now()
+	expired := s.IterativeCache.EjectWhile(cacheKey, func(_ interface{}, v interface{}) bool {
+		cachedRes, ok := v.(CachedResult)
+		return ok && cachedRes.isExpired(now)
+	}, cacheSweepLimit)
 	// this record will replace any existing record with the exact same cache key
 	didExist, didEject := s.IterativeCache.Add(cacheKey, *result)
 	s.IterativeCache.Unlock(cacheKey)
+	if expired > 0 {
+		s.VerboseLog(depth+1, "removed ", expired, " expired cache entries")
+		s.Stats.IncrementExpired(expired)
+	}
 	if didExist && didEject {
 		log.Panic("cache entry shouldn't be both replaced and evicted: ", q, " ", nameServer, " ", isAuthority)
 	} else if didExist {
@@ -85,27 +108,23 @@ func (s *Cache) addCachedAnswer(q Question, nameServer string, isAuthority bool,
 }
 
 func (s *Cache) GetCachedAuthority(authorityName string, ns *NameServer, depth int) (retv *SingleQueryResult, isFound bool) {
-	retv, isFound, partiallyExpired := s.getCachedResult(Question{Name: authorityName, Type: dns.TypeNS, Class: dns.ClassINET}, ns, true, depth)
-	if partiallyExpired {
-		// if the authority is partially expired, we'll re-query it and update the cache. This prevents a cache with only part of a non-expired answer
-		return nil, false
-	}
+	retv, _, isFound = s.getCachedResult(Question{Name: authorityName, Type: dns.TypeNS, Class: dns.ClassINET}, ns, true, depth)
 	return retv, isFound
 }
 
 func (s *Cache) GetCachedResults(q Question, ns *NameServer, depth int) (retv *SingleQueryResult, isFound bool) {
-	retv, isFound, partiallyExpired := s.getCachedResult(q, ns, false, depth)
-	if partiallyExpired {
-		// if the authority is partially expired, we'll re-query it and update the cache. This prevents a cache with only part of a non-expired answer
-		return nil, false
-	}
+	retv, _, isFound = s.getCachedResult(q, ns, false, depth)
 	return retv, isFound
 }
 
-func (s *Cache) getCachedResult(q Question, ns *NameServer, isAuthority bool, depth int) (retv *SingleQueryResult, isFound, partiallyExpired bool) {
+// GetCachedResultsWithStatus is GetCachedResults, also returning the status of the cached answer: StatusNXDomain for
+// negatively cached names that don't exist, StatusNoError otherwise
+func (s *Cache) GetCachedResultsWithStatus(q Question, ns *NameServer, depth int) (retv *SingleQueryResult, status Status, isFound bool) {
+	return s.getCachedResult(q, ns, false, depth)
+}
+
+func (s *Cache) getCachedResult(q Question, ns *NameServer, isAuthority bool, depth int) (retv *SingleQueryResult, status Status, isFound bool) {
 	retv = &SingleQueryResult{}
-	isFound = false
-	partiallyExpired = false
 	cacheKey := CachedKey{q, "", isAuthority}
 	if ns != nil {
 		cacheKey.NameServer = ns.String()
@@ -126,56 +145,46 @@ func (s *Cache) getCachedResult(q Question, ns *NameServer, isAuthority bool, de
 	if !ok { // nothing found
 		s.VerboseLog(depth+2, "-> no entry found in cache for ", q.Name)
 		s.Stats.IncrementMisses()
-		return retv, false, false
+		return retv, "", false
 	}
-	s.Stats.IncrementHits()
 	cachedRes, ok := unres.(CachedResult)
 	if !ok {
 		log.Panic("unable to cast cached result for ", q.Name)
 	}
+	if cachedRes.isExpired(time.Now()) {
+		// if part of the result expired, we'll re-query it and update the cache. This prevents returning only part of
+		// a non-expired answer
+		s.IterativeCache.Delete(cacheKey)
+		s.VerboseLog(depth+2, "-> cache entry for ", cacheKey, " has expired, removing from cache")
+		s.Stats.IncrementExpired(1)
+		s.Stats.IncrementMisses()
+		return nil, "", false
+	}
+	s.Stats.IncrementHits()
 	retv = new(SingleQueryResult)
 	retv.Answers = make([]interface{}, 0, len(cachedRes.Answers))
 	retv.Authorities = make([]interface{}, 0, len(cachedRes.Authorities))
 	retv.Additionals = make([]interface{}, 0, len(cachedRes.Additionals))
 	retv.Flags = cachedRes.Flags
 	retv.DNSSECResult = cachedRes.DNSSECResult
-	// great we have a result. let's go through the entries and build a result. In the process, throw away anything
-	// that's expired
-	now := time.Now()
+	retv.Resolver = cachedRes.Resolver
+	// great we have a result, none of whose records have expired. let's go through the entries and build a result
 	for _, cachedAnswer := range cachedRes.Answers {
-		if cachedAnswer.ExpiresAt.Before(now) {
-			partiallyExpired = true
-			s.VerboseLog(depth+2, "expiring cache answer ", cachedAnswer.Answer.BaseAns().Name)
-		} else {
-			retv.Answers = append(retv.Answers, cachedAnswer.Answer)
-		}
+		retv.Answers = append(retv.Answers, cachedAnswer.Answer)
 	}
 	for _, cachedAuthority := range cachedRes.Authorities {
-		if cachedAuthority.ExpiresAt.Before(now) {
-			partiallyExpired = true
-			s.VerboseLog(depth+2, "expiring cache authority ", cachedAuthority.Answer.BaseAns().Name)
-		} else {
-			retv.Authorities = append(retv.Authorities, cachedAuthority.Answer)
-		}
+		retv.Authorities = append(retv.Authorities, cachedAuthority.Answer)
 	}
 	for _, cachedAdditional := range cachedRes.Additionals {
-		if cachedAdditional.ExpiresAt.Before(now) {
-			partiallyExpired = true
-			s.VerboseLog(depth+2, "expiring cache additional ", cachedAdditional.Answer.BaseAns().Name)
-		} else {
-			retv.Additionals = append(retv.Additionals, cachedAdditional.Answer)
-		}
-	}
-	// Don't return an empty response.
-	if len(retv.Answers) == 0 && len(retv.Authorities) == 0 && len(retv.Additionals) == 0 {
-		// remove from cache since it's completely expired
-		s.IterativeCache.Delete(cacheKey)
-		s.VerboseLog(depth+2, "-> no entry found in cache, after expiration for ", cacheKey, ", removing from cache")
-		return nil, false, false
+		retv.Additionals = append(retv.Additionals, cachedAdditional.Answer)
 	}
 
-	s.VerboseLog(depth+2, "Cache hit for ", q.Name, ": ", *retv)
-	return retv, true, partiallyExpired
+	status = StatusNoError
+	if cachedRes.NXDomain {
+		status = StatusNXDomain
+	}
+	s.VerboseLog(depth+2, "Cache hit for ", q.Name, " (", status, "): ", *retv)
+	return retv, status, true
 }
 
 func isCacheableType(ans WithBaseAnswer) bool {
@@ -193,6 +202,13 @@ func (s *Cache) buildCachedResult(res *SingleQueryResult, depth int, layer strin
 	cachedRes := CachedResult{}
 	cachedRes.Flags = res.Flags
 	cachedRes.DNSSECResult = res.DNSSECResult
+	cachedRes.Resolver = res.Resolver
+	var addTimedAnswer = func(section []TimedAnswer, ans WithBaseAnswer, expiresAt time.Time) []TimedAnswer {
+		if cachedRes.ExpiresAt.IsZero() || expiresAt.Before(cachedRes.ExpiresAt) {
+			cachedRes.ExpiresAt = expiresAt
+		}
+		return append(section, TimedAnswer{Answer: ans, ExpiresAt: expiresAt})
+	}
 
 	cachedRes.Answers = make([]TimedAnswer, 0, len(res.Answers))
 	var getExpirationForSafeAnswer = func(a any) (WithBaseAnswer, time.Time) {
@@ -213,30 +229,21 @@ func (s *Cache) buildCachedResult(res *SingleQueryResult, depth int, layer strin
 	for _, a := range res.Answers {
 		castAns, expiresAt := getExpirationForSafeAnswer(a)
 		if castAns != nil {
-			cachedRes.Answers = append(cachedRes.Answers, TimedAnswer{
-				Answer:    castAns,
-				ExpiresAt: expiresAt,
-			})
+			cachedRes.Answers = addTimedAnswer(cachedRes.Answers, castAns, expiresAt)
 		}
 	}
 	cachedRes.Authorities = make([]TimedAnswer, 0, len(res.Authorities))
 	for _, a := range res.Authorities {
 		castAns, expiresAt := getExpirationForSafeAnswer(a)
 		if castAns != nil {
-			cachedRes.Authorities = append(cachedRes.Authorities, TimedAnswer{
-				Answer:    castAns,
-				ExpiresAt: expiresAt,
-			})
+			cachedRes.Authorities = addTimedAnswer(cachedRes.Authorities, castAns, expiresAt)
 		}
 	}
 	cachedRes.Additionals = make([]TimedAnswer, 0, len(res.Additionals))
 	for _, a := range res.Additionals {
 		castAns, expiresAt := getExpirationForSafeAnswer(a)
 		if castAns != nil {
-			cachedRes.Additionals = append(cachedRes.Additionals, TimedAnswer{
-				Answer:    castAns,
-				ExpiresAt: expiresAt,
-			})
+			cachedRes.Additionals = addTimedAnswer(cachedRes.Additionals, castAns, expiresAt)
 		}
 	}
 	return &cachedRes
@@ -286,6 +293,75 @@ func (s *Cache) SafeAddCachedAnswer(q Question, res *SingleQueryResult, ns *Name
 	s.addCachedAnswer(q, nsString, false, cachedRes, depth)
 }
 
+// SafeAddCachedNegativeAnswer caches an authoritative NXDOMAIN or NODATA answer to q, RFC 2308. The whole entry expires
+// after the negative TTL, the lesser of the TTL and minimum field of the SOA record in the authority section. Answers
+// without an SOA record for a zone at or beneath layer aren't cached.
+func (s *Cache) SafeAddCachedNegativeAnswer(q Question, res *SingleQueryResult, ns *NameServer, layer string, status Status, depth int) {
+	if res.DNSSECResult != nil && res.DNSSECResult.Status == DNSSECBogus {
+		panic("attempting to cache a bogus result")
+	}
+	if status != StatusNXDomain && status != StatusNoError {
+		s.VerboseLog(depth+1, "SafeAddCachedNegativeAnswer: not a negative answer status: ", status, ", aborting")
+		return
+	}
+	if len(res.Answers) > 0 {
+		// an NXDOMAIN with answers is for the target of an alias, and a NOERROR with answers isn't NODATA
+		s.VerboseLog(depth+1, "SafeAddCachedNegativeAnswer: answer section isn't empty, aborting: ", q)
+		return
+	}
+	if !res.Flags.Authoritative {
+		s.VerboseLog(depth+1, "SafeAddCachedNegativeAnswer: aborting since response is non-authoritative: ", q)
+		return
+	}
+	ttl, ok := negativeCacheTTL(res, layer)
+	if !ok {
+		s.VerboseLog(depth+1, "SafeAddCachedNegativeAnswer: no SOA record beneath ", layer, " in the authority section, aborting")
+		return
+	}
+	if ttl == 0 {
+		s.VerboseLog(depth+1, "SafeAddCachedNegativeAnswer: negative TTL is zero, aborting: ", q)
+		return
+	}
+	nsString := ""
+	if ns != nil {
+		nsString = ns.String()
+	}
+	expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	cachedRes := CachedResult{
+		Answers:      []TimedAnswer{},
+		Authorities:  make([]TimedAnswer, 0, len(res.Authorities)),
+		Additionals:  []TimedAnswer{},
+		Flags:        res.Flags,
+		DNSSECResult: res.DNSSECResult,
+		Resolver:     res.Resolver,
+		NXDomain:     status == StatusNXDomain,
+		ExpiresAt:    expiresAt,
+	}
+	// keep the SOA and any denial of existence records, so a cache hit looks like the answer from the wire
+	for _, a := range res.Authorities {
+		if castAns, ok := a.(WithBaseAnswer); ok {
+			cachedRes.Authorities = append(cachedRes.Authorities, TimedAnswer{Answer: castAns, ExpiresAt: expiresAt})
+		}
+	}
+	s.addCachedAnswer(q, nsString, false, &cachedRes, depth)
+}
+
+// negativeCacheTTL returns the TTL of a negative answer, the lesser of the TTL and minimum field of the SOA record in the
+// authority section, RFC 2308 Section 5. Returns false if there's no SOA record for a zone at or beneath layer.
+func negativeCacheTTL(res *SingleQueryResult, layer string) (uint32, bool) {
+	for _, a := range res.Authorities {
+		soa, ok := a.(SOAAnswer)
+		if !ok {
+			continue
+		}
+		if beneath, _ := nameIsBeneath(soa.Name, layer); !beneath {
+			continue
+		}
+		return min(soa.TTL, soa.Minttl), true
+	}
+	return 0, false
+}
+
 // SafeAddCachedAuthority Writes an authority to the cache. This is a special case where the result should only have
 // authorities and additionals records. What layer this authority is for is gathered from the Authority.Name field.
 // This Authority.Name must be below the current layer.
@@ -0,0 +1,104 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// cacheFileVersion is bumped whenever the encoding of cache files changes, files of other versions aren't loaded
+const cacheFileVersion = 1
+
+type cacheFileHeader struct {
+	Version int
+}
+
+type cacheFileEntry struct {
+	Key    CachedKey
+	Result CachedResult
+}
+
+func init() {
+	// the answer types isCacheableType lets into the cache
+	gob.Register(Answer{})
+	gob.Register(DSAnswer{})
+	gob.Register(DNSKEYAnswer{})
+	gob.Register(NSECAnswer{})
+	gob.Register(NSEC3Answer{})
+	// the authority section of negative answers
+	gob.Register(SOAAnswer{})
+	gob.Register(RRSIGAnswer{})
+}
+
+// Save writes the unexpired entries of the cache to w, with their expiration times, so they can be loaded by a later
+// run with Load. It's safe to call while the cache is in use.
+// Returns the number of entries written.
+func (s *Cache) Save(w io.Writer) (int, error) {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(cacheFileHeader{Version: cacheFileVersion}); err != nil {
+		return 0, fmt.Errorf("could not write cache file header: %w", err)
+	}
+	now := time.Now()
+	saved := 0
+	var err error
+	s.IterativeCache.Range(func(k interface{}, v interface{}) bool {
+		key, keyOK := k.(CachedKey)
+		res, resOK := v.(CachedResult)
+		if !keyOK || !resOK || res.isExpired(now) {
+			return true
+		}
+		if err = enc.Encode(cacheFileEntry{Key: key, Result: res}); err != nil {
+			err = fmt.Errorf("could not write cache entry for %v: %w", key, err)
+			return false
+		}
+		saved++
+		return true
+	})
+	return saved, err
+}
+
+// Load adds the entries in r, written by Save, to the cache. Entries that have expired since are skipped.
+// Returns the number of entries added.
+func (s *Cache) Load(r io.Reader) (int, error) {
+	dec := gob.NewDecoder(r)
+	var header cacheFileHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("could not read cache file header: %w", err)
+	}
+	if header.Version != cacheFileVersion {
+		return 0, fmt.Errorf("unsupported cache file version %d, expected %d", header.Version, cacheFileVersion)
+	}
+	now := time.Now()
+	loaded := 0
+	for {
+		var entry cacheFileEntry
+		if err := dec.Decode(&entry); errors.Is(err, io.EOF) {
+			return loaded, nil
+		} else if err != nil {
+			return loaded, fmt.Errorf("could not read cache entry: %w", err)
+		}
+		if entry.Result.isExpired(now) {
+			continue
+		}
+		s.IterativeCache.Lock(entry.Key)
+		s.IterativeCache.Add(entry.Key, entry.Result)
+		s.IterativeCache.Unlock(entry.Key)
+		loaded++
+	}
+}
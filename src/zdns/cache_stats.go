@@ -24,6 +24,7 @@ type CacheStatistics struct {
 	misses                  atomic.Uint64 // number of reads to the cache that result in a miss
 	writes                  atomic.Uint64 // number of writes to the cache
 	ejects                  atomic.Uint64 // number of cache entries that are ejected due to insertions
+	expired                 atomic.Uint64 // number of cache entries that are removed because their TTL ran out
 }
 
 type CacheStatisticsMetadata struct {
@@ -31,6 +32,7 @@ type CacheStatisticsMetadata struct {
 	Misses   uint64  `json:"misses"`
 	Writes   uint64  `json:"writes"`
 	Ejects   uint64  `json:"ejects"`
+	Expired  uint64  `json:"expired"`
 	HitRate  float64 `json:"hit_rate"`
 	MissRate float64 `json:"miss_rate"`
 }
@@ -67,16 +69,24 @@ func (s *CacheStatistics) IncrementEjects() {
 	}
 }
 
+func (s *CacheStatistics) IncrementExpired(n int) {
+	if s.shouldCaptureStatistics {
+		s.expired.Add(uint64(n))
+	}
+}
+
 func (s *CacheStatistics) GetStatistics() *CacheStatisticsMetadata {
 	hits := s.hits.Load()
 	misses := s.misses.Load()
 	writes := s.writes.Load()
 	ejects := s.ejects.Load()
+	expired := s.expired.Load()
 	metadata := CacheStatisticsMetadata{
-		Hits:   hits,
-		Misses: misses,
-		Writes: writes,
-		Ejects: ejects,
+		Hits:    hits,
+		Misses:  misses,
+		Writes:  writes,
+		Ejects:  ejects,
+		Expired: expired,
 	}
 	total := hits + misses
 	if total == 0 {
@@ -14,12 +14,17 @@
 package zdns
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCheckForNonExistentKey(t *testing.T) {
@@ -148,3 +153,195 @@ func TestNoNameServerLookupNotAuthoritative(t *testing.T) {
 	_, found = cache.GetCachedResults(Question{1, 1, "google.com"}, nil, 0)
 	assert.True(t, found, "should cache non-authoritative answers")
 }
+
+func TestCachedResultKeepsResolver(t *testing.T) {
+	res := SingleQueryResult{
+		Answers: []interface{}{Answer{
+			TTL:     3600,
+			RrType:  1,
+			RrClass: 1,
+			Name:    "google.com",
+			Answer:  "192.0.2.1",
+		}},
+		Resolver: "216.239.32.10:53",
+		Flags:    DNSFlags{Authoritative: true},
+	}
+	cache := Cache{}
+	cache.Init(4096)
+	cache.SafeAddCachedAnswer(Question{Type: dns.TypeA, Name: "google.com", Class: dns.ClassINET}, &res, nil, "google.com", 0, false)
+	cached, found := cache.GetCachedResults(Question{dns.TypeA, 1, "google.com"}, nil, 0)
+	assert.True(t, found, "Expected cache entry")
+	assert.Equal(t, "216.239.32.10:53", cached.Resolver, "cache hits should report the name server that answered")
+}
+
+func TestCachedResultExpiresWithLowestTTL(t *testing.T) {
+	res := SingleQueryResult{
+		Answers: []interface{}{
+			Answer{TTL: 3600, RrType: dns.TypeA, RrClass: dns.ClassINET, Name: "google.com", Answer: "192.0.2.1"},
+			Answer{TTL: 0, RrType: dns.TypeA, RrClass: dns.ClassINET, Name: "google.com", Answer: "192.0.2.2"},
+		},
+		Flags: DNSFlags{Authoritative: true},
+	}
+	cache := Cache{}
+	cache.Init(4096)
+	cache.Stats.CaptureStatistics()
+	cache.SafeAddCachedAnswer(Question{Type: dns.TypeA, Name: "google.com", Class: dns.ClassINET}, &res, nil, "google.com", 0, false)
+	_, found := cache.GetCachedResults(Question{dns.TypeA, dns.ClassINET, "google.com"}, nil, 0)
+	assert.False(t, found, "entry should expire with its lowest TTL record")
+	assert.Equal(t, uint64(1), cache.Stats.GetStatistics().Expired)
+	assert.False(t, cache.IterativeCache.Has(CachedKey{Question{dns.TypeA, dns.ClassINET, "google.com"}, "", false}), "expired entry should be removed")
+}
+
+func TestExpiredEntriesSweptOnAdd(t *testing.T) {
+	cache := Cache{}
+	// a single shard, so every entry is swept from the same LRU list
+	cache.IterativeCache.Init(16, 1)
+	cache.Stats.CaptureStatistics()
+	for i, ttl := range []uint32{0, 0, 3600} {
+		name := fmt.Sprintf("name%d.com", i)
+		res := SingleQueryResult{
+			Answers: []interface{}{Answer{TTL: ttl, RrType: dns.TypeA, RrClass: dns.ClassINET, Name: name, Answer: "192.0.2.1"}},
+			Flags:   DNSFlags{Authoritative: true},
+		}
+		cache.SafeAddCachedAnswer(Question{Type: dns.TypeA, Name: name, Class: dns.ClassINET}, &res, nil, name, 0, false)
+	}
+	// adding name2.com swept name0.com, and possibly name1.com if it had already expired
+	assert.False(t, cache.IterativeCache.Has(CachedKey{Question{dns.TypeA, dns.ClassINET, "name0.com"}, "", false}))
+	_, found := cache.GetCachedResults(Question{dns.TypeA, dns.ClassINET, "name2.com"}, nil, 0)
+	assert.True(t, found)
+	assert.GreaterOrEqual(t, cache.Stats.GetStatistics().Expired, uint64(1))
+}
+
+func TestCacheSaveAndLoad(t *testing.T) {
+	ds, err := dns.NewRR("example.com. 3600 IN DS 370 13 2 BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C")
+	require.NoError(t, err)
+	nsec3, err := dns.NewRR("2vptu5timamqttgl4luu9kg21e0aor3s.example.com. 3600 IN NSEC3 1 0 0 - 2VPTU5TIMAMQTTGL4LUU9KG21E0AOR3T A RRSIG")
+	require.NoError(t, err)
+	res := SingleQueryResult{
+		Answers:     []interface{}{Answer{TTL: 3600, Type: "A", RrType: dns.TypeA, RrClass: dns.ClassINET, Name: "example.com", Answer: "192.0.2.1"}, ParseAnswer(ds)},
+		Authorities: []interface{}{ParseAnswer(nsec3)},
+		Resolver:    "192.0.2.53:53",
+		Flags:       DNSFlags{Authoritative: true},
+		DNSSECResult: &DNSSECResult{
+			Status: DNSSECSecure,
+			Chain:  []DNSSECChainLink{{Zone: "example.com", KSKKeyTag: 370}},
+		},
+	}
+	q := Question{Type: dns.TypeA, Name: "example.com", Class: dns.ClassINET}
+	cache := Cache{}
+	cache.Init(4096)
+	cache.SafeAddCachedAnswer(q, &res, nil, "example.com", 0, false)
+	expired := SingleQueryResult{
+		Answers: []interface{}{Answer{TTL: 0, RrType: dns.TypeA, RrClass: dns.ClassINET, Name: "expired.com", Answer: "192.0.2.2"}},
+		Flags:   DNSFlags{Authoritative: true},
+	}
+	cache.SafeAddCachedAnswer(Question{Type: dns.TypeA, Name: "expired.com", Class: dns.ClassINET}, &expired, nil, "expired.com", 0, false)
+
+	var buf bytes.Buffer
+	saved, err := cache.Save(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, saved, "expired entries shouldn't be saved")
+
+	loadedCache := Cache{}
+	loadedCache.Init(4096)
+	loaded, err := loadedCache.Load(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, loaded)
+	before, found := cache.GetCachedResults(q, nil, 0)
+	require.True(t, found)
+	after, found := loadedCache.GetCachedResults(q, nil, 0)
+	require.True(t, found, "Expected loaded cache entry")
+	assert.Equal(t, before, after)
+}
+
+func TestCacheLoadRejectsOtherVersions(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(cacheFileHeader{Version: cacheFileVersion + 1}))
+	cache := Cache{}
+	cache.Init(4096)
+	_, err := cache.Load(&buf)
+	assert.Error(t, err)
+}
+
+func TestNegativeAnswerCachedWithSOAMinimum(t *testing.T) {
+	soa, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300")
+	require.NoError(t, err)
+	res := SingleQueryResult{
+		Authorities: []interface{}{ParseAnswer(soa)},
+		Resolver:    "192.0.2.53:53",
+		Flags:       DNSFlags{Authoritative: true},
+	}
+	q := Question{Type: dns.TypeA, Name: "missing.example.com", Class: dns.ClassINET}
+	cache := Cache{}
+	cache.Init(4096)
+	cache.SafeAddCachedNegativeAnswer(q, &res, nil, "example.com", StatusNXDomain, 0)
+	cached, status, found := cache.GetCachedResultsWithStatus(q, nil, 0)
+	require.True(t, found, "Expected negative cache entry")
+	assert.Equal(t, StatusNXDomain, status)
+	assert.Empty(t, cached.Answers)
+	assert.Len(t, cached.Authorities, 1, "the SOA record should be kept")
+
+	unres, ok := cache.IterativeCache.Get(CachedKey{q, "", false})
+	require.True(t, ok)
+	ttl := time.Until(unres.(CachedResult).ExpiresAt)
+	assert.LessOrEqual(t, ttl, 300*time.Second, "negative TTL should be the SOA minimum")
+	assert.Greater(t, ttl, 290*time.Second)
+
+	// NODATA is cached under the same rules, but is a NOERROR answer
+	nodata := Question{Type: dns.TypeAAAA, Name: "example.com", Class: dns.ClassINET}
+	cache.SafeAddCachedNegativeAnswer(nodata, &res, nil, "example.com", StatusNoError, 0)
+	_, status, found = cache.GetCachedResultsWithStatus(nodata, nil, 0)
+	require.True(t, found, "Expected NODATA cache entry")
+	assert.Equal(t, StatusNoError, status)
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	soa := func(ttl, minTTL uint32, name string) SOAAnswer {
+		return SOAAnswer{Answer: Answer{TTL: ttl, RrType: dns.TypeSOA, Name: name}, Minttl: minTTL}
+	}
+	tests := []struct {
+		name        string
+		authorities []interface{}
+		layer       string
+		expectedTTL uint32
+		expectedOK  bool
+	}{
+		{"minimum below TTL", []interface{}{soa(3600, 300, "example.com")}, "example.com", 300, true},
+		{"capped by SOA TTL", []interface{}{soa(60, 300, "example.com")}, "example.com", 60, true},
+		{"no SOA", []interface{}{Answer{TTL: 3600, RrType: dns.TypeNS, Name: "example.com"}}, "example.com", 0, false},
+		{"SOA outside layer", []interface{}{soa(3600, 300, "example.net")}, "example.com", 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ttl, ok := negativeCacheTTL(&SingleQueryResult{Authorities: tc.authorities}, tc.layer)
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expectedTTL, ttl)
+		})
+	}
+}
+
+func TestNegativeAnswerNotCached(t *testing.T) {
+	soa := SOAAnswer{Answer: Answer{TTL: 3600, RrType: dns.TypeSOA, Name: "example.com"}, Minttl: 300}
+	q := Question{Type: dns.TypeA, Name: "missing.example.com", Class: dns.ClassINET}
+	tests := []struct {
+		name string
+		res  SingleQueryResult
+	}{
+		{"non-authoritative", SingleQueryResult{Authorities: []interface{}{soa}}},
+		{"zero minimum", SingleQueryResult{Authorities: []interface{}{SOAAnswer{Answer: soa.Answer}}, Flags: DNSFlags{Authoritative: true}}},
+		{"alias answers", SingleQueryResult{
+			Answers:     []interface{}{Answer{TTL: 3600, RrType: dns.TypeCNAME, Name: "missing.example.com", Answer: "target.example.com"}},
+			Authorities: []interface{}{soa},
+			Flags:       DNSFlags{Authoritative: true},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := Cache{}
+			cache.Init(4096)
+			cache.SafeAddCachedNegativeAnswer(q, &tc.res, nil, "example.com", StatusNXDomain, 0)
+			_, found := cache.GetCachedResults(q, nil, 0)
+			assert.False(t, found)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+
+	"github.com/zmap/zdns/src/internal/util"
+)
+
+// CDInferredState is the DNSSEC state of a name as inferred from how a validating resolver answers with and without the CD bit
+type CDInferredState string
+
+const (
+	// CDStateBogus - the resolver SERVFAILs without CD but answers with CD, so it's discarding data that fails validation
+	CDStateBogus CDInferredState = "Bogus"
+	// CDStateSecure - the resolver answered without CD and set the AD bit
+	CDStateSecure CDInferredState = "Secure"
+	// CDStateNotValidated - the resolver answered without CD but didn't set AD, the name is unsigned or the resolver isn't validating
+	CDStateNotValidated CDInferredState = "NotValidated"
+	// CDStateServFail - the resolver SERVFAILs with and without CD, the failure isn't DNSSEC-related
+	CDStateServFail CDInferredState = "ServFail"
+	// CDStateIndeterminate - any other combination, ex. a timeout on either query
+	CDStateIndeterminate CDInferredState = "Indeterminate"
+)
+
+// CDQueryResult is the outcome of one of the two queries in a CD comparison
+type CDQueryResult struct {
+	Status        Status        `json:"status" groups:"short,normal,long,trace"`
+	Authenticated bool          `json:"authenticated_data" groups:"short,normal,long,trace"` // AD bit of the response
+	Answers       []interface{} `json:"answers,omitempty" groups:"short,normal,long,trace"`
+	Resolver      string        `json:"resolver" groups:"resolver,normal,long,trace"`
+}
+
+// CDComparisonResult holds the responses to the same question sent with and without the CD bit, and the DNSSEC state
+// inferred from the pair
+type CDComparisonResult struct {
+	WithoutCD     CDQueryResult   `json:"without_cd" groups:"short,normal,long,trace"`
+	WithCD        CDQueryResult   `json:"with_cd" groups:"short,normal,long,trace"`
+	InferredState CDInferredState `json:"inferred_dnssec_state" groups:"short,normal,long,trace"`
+}
+
+// DoCDComparisonLookup sends q to nameServer twice, first without and then with the Checking Disabled bit set, and
+// compares the responses. If nameServer is a validating resolver, a SERVFAIL without CD that turns into an answer with
+// CD means the name fails DNSSEC validation. This lets callers detect DNSSEC-invalid names without validating locally.
+// The cache is bypassed for both queries so neither answer is served from, or leaks into, normal lookups.
+func (r *Resolver) DoCDComparisonLookup(q *Question, nameServer *NameServer) (*CDComparisonResult, Trace, Status, error) {
+	prevCD := r.checkingDisabledBit
+	prevBypass := r.bypassCache
+	defer func() {
+		r.checkingDisabledBit = prevCD
+		r.bypassCache = prevBypass
+	}()
+	r.bypassCache = true
+
+	r.checkingDisabledBit = false
+	withoutCD, withoutCDTrace, withoutCDStatus, err := r.ExternalLookup(context.Background(), q, nameServer)
+	if err != nil {
+		return nil, withoutCDTrace, withoutCDStatus, err
+	}
+	r.checkingDisabledBit = true
+	withCD, withCDTrace, withCDStatus, err := r.ExternalLookup(context.Background(), q, nameServer)
+	trace := util.Concat(withoutCDTrace, withCDTrace)
+	if err != nil {
+		return nil, trace, withCDStatus, err
+	}
+
+	res := &CDComparisonResult{
+		WithoutCD: makeCDQueryResult(withoutCD, withoutCDStatus),
+		WithCD:    makeCDQueryResult(withCD, withCDStatus),
+	}
+	res.InferredState = inferCDState(res.WithoutCD, res.WithCD)
+	return res, trace, StatusNoError, nil
+}
+
+func makeCDQueryResult(res *SingleQueryResult, status Status) CDQueryResult {
+	cdRes := CDQueryResult{Status: status}
+	if res != nil {
+		cdRes.Authenticated = res.Flags.Authenticated
+		cdRes.Answers = res.Answers
+		cdRes.Resolver = res.Resolver
+	}
+	return cdRes
+}
+
+func inferCDState(withoutCD, withCD CDQueryResult) CDInferredState {
+	withoutCDAnswered := isStatusAnswer(withoutCD.Status)
+	withCDAnswered := isStatusAnswer(withCD.Status)
+	switch {
+	case withoutCD.Status == StatusServFail && withCDAnswered:
+		return CDStateBogus
+	case withoutCDAnswered && withoutCD.Authenticated:
+		return CDStateSecure
+	case withoutCDAnswered:
+		return CDStateNotValidated
+	case withoutCD.Status == StatusServFail && withCD.Status == StatusServFail:
+		return CDStateServFail
+	default:
+		return CDStateIndeterminate
+	}
+}
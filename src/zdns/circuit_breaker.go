@@ -0,0 +1,136 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NameServerCircuitBreaker keeps lookups away from external name servers that stopped answering. After threshold
+// consecutive failed queries a name server is tripped and left out of name server selection for the cooldown. Once the
+// cooldown is over it's selected again, and the next query to it is the probe: a failure trips it right away, a
+// response closes the breaker. It's safe for concurrent use and meant to be shared between resolvers.
+type NameServerCircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	sync.Mutex
+	servers map[string]*nameServerHealth
+}
+
+type nameServerHealth struct {
+	consecutiveFailures int
+	trippedUntil        time.Time // zero unless the name server was tripped
+	trips               int
+}
+
+// NameServerTrips reports a name server that was tripped by a NameServerCircuitBreaker
+type NameServerTrips struct {
+	NameServer string `json:"name_server"`
+	Trips      int    `json:"trips"`   // how many times the name server was tripped
+	Tripped    bool   `json:"tripped"` // whether the name server was still tripped when the statistics were taken
+}
+
+// NewNameServerCircuitBreaker returns a circuit breaker that trips a name server after threshold consecutive failures
+// and keeps it out of selection for cooldown
+func NewNameServerCircuitBreaker(threshold int, cooldown time.Duration) *NameServerCircuitBreaker {
+	return &NameServerCircuitBreaker{threshold: threshold, cooldown: cooldown, servers: make(map[string]*nameServerHealth)}
+}
+
+// available returns the name servers that aren't tripped. If every name server is tripped they're all returned, a
+// lookup against a failing name server is still better than no lookup at all.
+func (b *NameServerCircuitBreaker) available(nameServers []NameServer) []NameServer {
+	if b == nil {
+		return nameServers
+	}
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	var healthy []NameServer
+	for _, ns := range nameServers {
+		if h, ok := b.servers[ns.String()]; !ok || !now.Before(h.trippedUntil) {
+			healthy = append(healthy, ns)
+		}
+	}
+	if len(healthy) == 0 {
+		return nameServers
+	}
+	return healthy
+}
+
+// isTripped returns whether nameServer is tripped and shouldn't be selected
+func (b *NameServerCircuitBreaker) isTripped(nameServer *NameServer) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	h, ok := b.servers[nameServer.String()]
+	return ok && time.Now().Before(h.trippedUntil)
+}
+
+// recordResult counts a query sent to nameServer, failed being whether it got no response
+func (b *NameServerCircuitBreaker) recordResult(nameServer *NameServer, failed bool) {
+	if b == nil {
+		return
+	}
+	key := nameServer.String()
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	h, ok := b.servers[key]
+	if !ok {
+		if !failed {
+			// nothing to track for a name server that's never failed
+			return
+		}
+		h = &nameServerHealth{}
+		b.servers[key] = h
+	}
+	if !failed {
+		h.consecutiveFailures = 0
+		h.trippedUntil = time.Time{}
+		return
+	}
+	h.consecutiveFailures++
+	// queries sent before the name server was tripped may still be failing, they don't extend its cooldown
+	if h.consecutiveFailures >= b.threshold && !now.Before(h.trippedUntil) {
+		h.trippedUntil = now.Add(b.cooldown)
+		h.trips++
+		log.Warnf("name server %s failed %d consecutive queries, not selecting it for %s", key, h.consecutiveFailures, b.cooldown)
+	}
+}
+
+// Trips returns the name servers that were tripped at least once, sorted by name server
+func (b *NameServerCircuitBreaker) Trips() []NameServerTrips {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	var trips []NameServerTrips
+	for ns, h := range b.servers {
+		if h.trips > 0 {
+			trips = append(trips, NameServerTrips{NameServer: ns, Trips: h.trips, Tripped: now.Before(h.trippedUntil)})
+		}
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].NameServer < trips[j].NameServer })
+	return trips
+}
@@ -0,0 +1,83 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameServerCircuitBreaker(t *testing.T) {
+	b := NewNameServerCircuitBreaker(3, time.Hour)
+	nameServers := testNameServers()
+	down := &nameServers[1]
+
+	b.recordResult(down, true)
+	b.recordResult(down, true)
+	b.recordResult(down, false)
+	b.recordResult(down, true)
+	b.recordResult(down, true)
+	require.False(t, b.isTripped(down), "a response resets the consecutive failures")
+	require.Empty(t, b.Trips())
+
+	b.recordResult(down, true)
+	require.True(t, b.isTripped(down))
+	require.Equal(t, []NameServer{nameServers[0], nameServers[2]}, b.available(nameServers))
+	require.Equal(t, []NameServerTrips{{NameServer: down.String(), Trips: 1, Tripped: true}}, b.Trips())
+
+	// failures of queries sent before it was tripped don't count as new trips
+	b.recordResult(down, true)
+	require.Equal(t, 1, b.Trips()[0].Trips)
+
+	// with every name server tripped, lookups still go out
+	for i := range nameServers {
+		for j := 0; j < 3; j++ {
+			b.recordResult(&nameServers[i], true)
+		}
+	}
+	require.Equal(t, nameServers, b.available(nameServers))
+}
+
+func TestNameServerCircuitBreakerCooldown(t *testing.T) {
+	b := NewNameServerCircuitBreaker(2, 10*time.Millisecond)
+	nameServers := testNameServers()
+	down := &nameServers[0]
+	b.recordResult(down, true)
+	b.recordResult(down, true)
+	require.True(t, b.isTripped(down))
+
+	time.Sleep(20 * time.Millisecond)
+	require.False(t, b.isTripped(down), "selected again once the cooldown is over")
+	// the probe failing trips it right away
+	b.recordResult(down, true)
+	require.True(t, b.isTripped(down))
+	require.Equal(t, 2, b.Trips()[0].Trips)
+
+	time.Sleep(20 * time.Millisecond)
+	b.recordResult(down, false)
+	require.False(t, b.isTripped(down))
+	require.Equal(t, []NameServerTrips{{NameServer: down.String(), Trips: 2, Tripped: false}}, b.Trips())
+}
+
+func TestNilNameServerCircuitBreaker(t *testing.T) {
+	var b *NameServerCircuitBreaker
+	nameServers := testNameServers()
+	b.recordResult(&nameServers[0], true)
+	require.False(t, b.isTripped(&nameServers[0]))
+	require.Equal(t, nameServers, b.available(nameServers))
+	require.Nil(t, b.Trips())
+}
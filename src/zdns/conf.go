@@ -50,11 +50,39 @@ const (
 	StatusNoAuth       Status = "NOAUTH"
 	StatusNoNeededGlue Status = "NONEEDEDGLUE" // When a nameserver is authoritative for itself and the parent nameserver doesn't provide the glue to look it up
 	StatusCircular     Status = "CIRCULAR"     // When circular query dependencies are detected
+
+	StatusLameDelegation Status = "LAME_DELEGATION" // Every name server delegated the zone during iteration turned out not to serve it
+
+	StatusQuestionMismatch Status = "QUESTION_MISMATCH" // The response's question section doesn't match the query, ex. a spoofed or misrouted response
+
+	StatusCNAMETargetNXDomain Status = "CNAME_TARGET_NXDOMAIN" // The queried name exists, but the CNAME/DNAME chain from it leads to a name that doesn't
+	StatusCNAMELoop           Status = "CNAME_LOOP"            // The CNAME/DNAME chain from the queried name leads back to a name already in it
+	StatusDNSSECNotSecure     Status = "DNSSEC_NOT_SECURE"     // The lookup succeeded but DNSSEC validation didn't find the answer Secure, reported by the CLI's --require-dnssec-secure
 )
 
 func isStatusRetryable(status Status) bool {
 	switch status {
-	case StatusServFail, StatusNXDomain, StatusRefused, StatusTruncated, StatusError, StatusTimeout, StatusIterTimeout:
+	case StatusServFail, StatusRefused, StatusTruncated, StatusError, StatusTimeout, StatusIterTimeout, StatusQuestionMismatch:
+		return true
+	}
+	return false
+}
+
+// IsStatusError returns true if the status indicates the lookup failed to get a usable response, ex. a timeout,
+// SERVFAIL, or malformed response. NOERROR and NXDOMAIN are answers and are not considered errors.
+func IsStatusError(status Status) bool {
+	switch status {
+	case StatusNoError, StatusNXDomain, StatusCNAMETargetNXDomain, StatusNoOutput:
+		return false
+	}
+	return true
+}
+
+// IsStatusTransientError returns true if the status indicates a failure that may succeed if the lookup is retried
+// later, ex. a timeout or SERVFAIL
+func IsStatusTransientError(status Status) bool {
+	switch status {
+	case StatusTimeout, StatusIterTimeout, StatusServFail:
 		return true
 	}
 	return false
@@ -0,0 +1,96 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const clientCookieHexLen = 16 // client cookies are 8 bytes, RFC 7873 section 4.1
+
+// DNSCookie is the DNS cookie, RFC 7873, returned by a name server
+type DNSCookie struct {
+	Client string `json:"client" groups:"cookie,long,trace"`
+	Server string `json:"server,omitempty" groups:"cookie,long,trace"`
+	// ClientMatches is false if the response echoed a different client cookie than the one sent, a sign that it may be
+	// an off-path spoofed response
+	ClientMatches bool `json:"client_matches" groups:"cookie,long,trace"`
+}
+
+// cookieJar holds the client cookie secret and the server cookies learned from each name server. It belongs to a
+// single Resolver and isn't safe for concurrent use.
+type cookieJar struct {
+	secret        []byte
+	serverCookies map[string]string // keyed by name server address
+}
+
+func newCookieJar() (*cookieJar, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("could not generate DNS cookie secret: %w", err)
+	}
+	return &cookieJar{secret: secret, serverCookies: make(map[string]string)}, nil
+}
+
+// clientCookie returns the client cookie for a name server. It's derived from the server's IP, so different servers
+// can't correlate our queries, RFC 7873 section 4.1
+func (j *cookieJar) clientCookie(nameServer *NameServer) string {
+	h := sha256.New()
+	h.Write(j.secret)
+	h.Write(nameServer.IP)
+	return hex.EncodeToString(h.Sum(nil)[:clientCookieHexLen/2])
+}
+
+// addCookie adds a COOKIE option to the query m for nameServer, with its server cookie if we've learned one
+func (j *cookieJar) addCookie(m *dns.Msg, nameServer *NameServer) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	cookie := j.clientCookie(nameServer) + j.serverCookies[nameServer.String()]
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+// recordCookie returns the cookie in a response from nameServer, if any, and remembers its server cookie for later
+// queries if the response echoed our client cookie
+func (j *cookieJar) recordCookie(resp *dns.Msg, nameServer *NameServer) *DNSCookie {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		value := strings.ToLower(c.Cookie)
+		if len(value) < clientCookieHexLen {
+			return &DNSCookie{Client: value}
+		}
+		cookie := &DNSCookie{Client: value[:clientCookieHexLen], Server: value[clientCookieHexLen:]}
+		cookie.ClientMatches = cookie.Client == j.clientCookie(nameServer)
+		if cookie.ClientMatches && cookie.Server != "" {
+			j.serverCookies[nameServer.String()] = cookie.Server
+		}
+		return cookie
+	}
+	return nil
+}
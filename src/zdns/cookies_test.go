@@ -0,0 +1,78 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func cookieResponse(cookie string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetEdns0(1232, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return resp
+}
+
+func queryCookie(t *testing.T, m *dns.Msg) string {
+	for _, o := range m.IsEdns0().Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+	t.Fatal("query has no cookie option")
+	return ""
+}
+
+func TestCookieJarReusesServerCookie(t *testing.T) {
+	jar, err := newCookieJar()
+	require.NoError(t, err)
+	ns := &NameServer{IP: net.ParseIP("192.0.2.53"), Port: 53}
+	other := &NameServer{IP: net.ParseIP("198.51.100.53"), Port: 53}
+	client := jar.clientCookie(ns)
+	require.Len(t, client, clientCookieHexLen)
+	require.NotEqual(t, client, jar.clientCookie(other), "client cookies should differ between servers")
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	jar.addCookie(m, ns)
+	require.Equal(t, client, queryCookie(t, m))
+
+	cookie := jar.recordCookie(cookieResponse(client+"0102030405060708"), ns)
+	require.Equal(t, &DNSCookie{Client: client, Server: "0102030405060708", ClientMatches: true}, cookie)
+
+	m = new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	jar.addCookie(m, ns)
+	require.Equal(t, client+"0102030405060708", queryCookie(t, m))
+}
+
+func TestCookieJarIgnoresMismatchedClientCookie(t *testing.T) {
+	jar, err := newCookieJar()
+	require.NoError(t, err)
+	ns := &NameServer{IP: net.ParseIP("192.0.2.53"), Port: 53}
+
+	cookie := jar.recordCookie(cookieResponse("00000000000000000102030405060708"), ns)
+	require.False(t, cookie.ClientMatches)
+	require.Empty(t, jar.serverCookies, "server cookie of a possibly spoofed response shouldn't be reused")
+
+	require.Nil(t, jar.recordCookie(new(dns.Msg), ns), "responses without EDNS0 carry no cookie")
+}
@@ -63,6 +63,7 @@ const NSEC3OptOutFlag = 0x01
 //   - Status: Overall DNSSEC validation status (Secure/Insecure/Bogus/Indeterminate)
 //   - DS: Collection of DS records actually used during validation
 //   - DNSKEYs: Collection of DNSKEY records actually used during validation
+//   - Chain: Chain of trust from the root down to the zones whose keys were used
 //   - Answers/Additionals/Authorities: Per-RRset validation results
 //
 // - Trace: Updated trace context containing validation path
@@ -98,20 +99,36 @@ func (v *dNSSECValidator) validate(layer string, msg *dns.Msg, nameServer *NameS
 
 		// Validate the answer section
 		var sectionRes []DNSSECPerSetResult
-		sectionRes, trace = v.validateSection(v.msg.Answer, depth, trace)
-		result.Answers = sectionRes
+		if v.r.shouldValidateDNSSECSection(DNSSECSectionAnswer) {
+			sectionRes, trace = v.validateSection(v.msg.Answer, depth, trace)
+			result.Answers = sectionRes
+			result.ValidatedSections = append(result.ValidatedSections, DNSSECSectionAnswer)
+		}
 
 		// If the message is authoritative, we drop the additional and authoritative sections
 		// in Resolver.iterativeLookup, hence no need to validate them here. Validating them
 		// causes circular lookups in some cases and can confuse the user.
 		if !v.msg.Authoritative {
 			// Validate the additional section
-			sectionRes, trace = v.validateSection(v.msg.Extra, depth, trace)
-			result.Additionals = sectionRes
+			if v.r.shouldValidateDNSSECSection(DNSSECSectionAdditional) {
+				sectionRes, trace = v.validateSection(v.msg.Extra, depth, trace)
+				result.Additionals = sectionRes
+				result.ValidatedSections = append(result.ValidatedSections, DNSSECSectionAdditional)
+			}
 
 			// Validate the authoritative section
-			sectionRes, trace = v.validateSection(v.msg.Ns, depth, trace)
-			result.Authorities = sectionRes
+			if v.r.shouldValidateDNSSECSection(DNSSECSectionAuthority) {
+				sectionRes, trace = v.validateSection(v.msg.Ns, depth, trace)
+				result.Authorities = sectionRes
+				result.ValidatedSections = append(result.ValidatedSections, DNSSECSectionAuthority)
+			}
+		}
+
+		// A negative answer has no RRset to validate, it's only secure if NSEC or NSEC3 records prove it
+		var denialStatus DNSSECStatus
+		var denialReason string
+		if name, nxdomain, ok := deniedName(v.msg); ok && v.r.shouldValidateDNSSECSection(DNSSECSectionAnswer) {
+			denialStatus, denialReason, trace = v.validateDenial(name, nxdomain, result, depth, trace)
 		}
 
 		for ds := range v.ds {
@@ -122,8 +139,10 @@ func (v *dNSSECValidator) validate(layer string, msg *dns.Msg, nameServer *NameS
 			parsed := ParseAnswer(&dnskey).(DNSKEYAnswer) //nolint:golint,errcheck
 			result.DNSKEYs = append(result.DNSKEYs, &parsed)
 		}
+		result.Chain = v.chainOfTrust()
 
 		result.populateStatus()
+		result.applyDenialStatus(denialStatus, denialReason)
 	}
 
 	// DNSKEY/DS queries may have failed, so we need to check the status again here
@@ -286,7 +305,7 @@ func (v *dNSSECValidator) findSEPsFromAnswer(rrSet []dns.RR, signerDomain string
 		return nil, trace, err
 	}
 
-	return sepKeys, nil, nil
+	return sepKeys, trace, nil
 }
 
 // getDNSKEYs retrieves and validates DNSKEY records from the signer domain.
@@ -318,7 +337,8 @@ func (v *dNSSECValidator) getDNSKEYs(signerDomain string, trace Trace, depth int
 		RetriesRemaining: &v.r.retriesRemaining,
 	}
 
-	res, trace, status, err := v.r.lookup(v.ctx, &dnskeyQuestion, v.r.rootNameServers, v.isIterative, trace)
+	res, fetchTrace, status, err := v.lookupSignerRRset(&dnskeyQuestion)
+	trace = append(trace, fetchTrace...)
 	if status != StatusNoError {
 		v.r.verboseLog(depth, fmt.Sprintf("DNSSEC: Failed to get DNSKEYs for signer domain %s, query status: %s", signerDomain, status))
 		return nil, nil, trace, fmt.Errorf("DNSKEY fetch failed, query status: %s", status)
@@ -375,6 +395,10 @@ func (v *dNSSECValidator) getDNSKEYs(signerDomain string, trace Trace, depth int
 func (v *dNSSECValidator) fetchDSRecords(signerDomain string, trace Trace, depth int) (map[uint16]dns.DS, bool, Trace, error) {
 	nameWithoutTrailingDot := removeTrailingDotIfNotRoot(signerDomain)
 
+	if anchors, ok := v.r.trustAnchors[signerDomain]; ok {
+		// configured trust anchor, the chain of trust starts here
+		return anchors, false, trace, nil
+	}
 	if signerDomain == rootZone {
 		// Root zone, use the root anchors
 		return rootanchors.GetValidDSRecords(), false, trace, nil
@@ -389,8 +413,8 @@ func (v *dNSSECValidator) fetchDSRecords(signerDomain string, trace Trace, depth
 		RetriesRemaining: &v.r.retriesRemaining,
 	}
 
-	res, newTrace, status, err := v.r.lookup(v.ctx, &dsQuestion, v.r.rootNameServers, v.isIterative, trace)
-	trace = newTrace
+	res, fetchTrace, status, err := v.lookupSignerRRset(&dsQuestion)
+	trace = append(trace, fetchTrace...)
 	// Empirically, DS records may present in the answer section in some cases
 	res.Authorities = append(res.Authorities, res.Answers...)
 
@@ -444,6 +468,7 @@ func (v *dNSSECValidator) fetchDSRecords(signerDomain string, trace Trace, depth
 
 	// Process DS records from answer section
 	dsRecords := make(map[uint16]dns.DS)
+	var ignored []dns.DS
 	for _, rr := range res.Authorities {
 		zTypedDS, ok := rr.(DSAnswer)
 		if !ok {
@@ -451,12 +476,45 @@ func (v *dNSSECValidator) fetchDSRecords(signerDomain string, trace Trace, depth
 			continue
 		}
 		ds := zTypedDS.ToVanillaType()
-		dsRecords[ds.KeyTag] = *ds
+		current, ok := dsRecords[ds.KeyTag]
+		if !ok {
+			dsRecords[ds.KeyTag] = *ds
+			continue
+		}
+		// downgrade protection, RFC 6840 section 5.2: only the strongest digest of a key is checked, so a forged
+		// record with a weak digest can't stand in for it
+		if dsDigestStrength(ds.DigestType) > dsDigestStrength(current.DigestType) {
+			dsRecords[ds.KeyTag] = *ds
+			ignored = append(ignored, current)
+		} else if dsDigestStrength(ds.DigestType) < dsDigestStrength(current.DigestType) {
+			ignored = append(ignored, *ds)
+		}
+	}
+	for _, ds := range ignored {
+		v.r.verboseLog(depth, fmt.Sprintf("DNSSEC: Ignoring DS record with KeyTag %d and weaker digest type %d for signer domain %s", ds.KeyTag, ds.DigestType, signerDomain))
+	}
+	if v.ignoredDS == nil {
+		v.ignoredDS = make(map[string][]dns.DS)
 	}
+	v.ignoredDS[signerDomain] = ignored
 
 	return dsRecords, false, trace, nil
 }
 
+// dsDigestStrength ranks the DS digest types validation supports, stronger digests rank higher and unsupported ones
+// rank 0
+func dsDigestStrength(digestType uint8) int {
+	switch digestType {
+	case dns.SHA384:
+		return 3
+	case dns.SHA256:
+		return 2
+	case dns.SHA1:
+		return 1
+	}
+	return 0
+}
+
 // findSEPs validates DS records against DNSKEY records,
 // to find the SEP (Secure Entry Point) keys for a given signer domain.
 //
@@ -503,6 +561,16 @@ func (v *dNSSECValidator) findSEPs(signerDomain string, dnskeyMap map[uint16]*dn
 
 			v.ds[*actualDS] = struct{}{}
 			sepKeys[key.KeyTag()] = key
+			if link := v.chainLink(signerDomain); link.DS == nil {
+				parsed := ParseAnswer(actualDS).(DSAnswer) //nolint:golint,errcheck
+				link.DS = &parsed
+				link.KSKKeyTag = key.KeyTag()
+				for _, ds := range v.ignoredDS[signerDomain] {
+					if ds.KeyTag == key.KeyTag() {
+						link.IgnoredDigestTypes = append(link.IgnoredDigestTypes, dsDigestTypeName(ds.DigestType))
+					}
+				}
+			}
 		}
 	}
 
@@ -516,7 +584,9 @@ func (v *dNSSECValidator) findSEPs(signerDomain string, dnskeyMap map[uint16]*dn
 
 // validateRRSIG verifies RRSIGs for a given RRset using appropriate DNSKEYs.
 // For DNSKEY RRsets, SEPs from the answer are used. For other types,
-// ZSKs are retrieved from the signer domain.
+// ZSKs are retrieved from the signer domain. The RRSIGs may come from
+// different signers, ex. during a signer transition, so each signer's keys
+// are looked up once and each RRSIG is checked against its own signer's keys.
 //
 // Parameters:
 // - rrSetType: Type of records being validated
@@ -530,35 +600,53 @@ func (v *dNSSECValidator) findSEPs(signerDomain string, dnskeyMap map[uint16]*dn
 // - Trace: Updated trace context
 // - error: Error if no RRSIG could be validated
 func (v *dNSSECValidator) validateRRSIG(rrSetType uint16, rrSet []dns.RR, rrsigs []*dns.RRSIG, trace Trace, depth int) (*dns.RRSIG, Trace, error) {
-	var dnskeyMap map[uint16]*dns.DNSKEY
-	var err error
+	// DNSKEYs of each signer, and the error looking them up if it failed, keyed by canonical signer name
+	signerKeys := make(map[string]map[uint16]*dns.DNSKEY)
+	signerErrs := make(map[string]error)
 
 	// Attempt to verify each RRSIG using only the DNSKEY matching its KeyTag
 	lastErr := errors.New("no RRSIG to verify")
 	for _, rrsig := range rrsigs {
-		// If RRset type is DNSKEY, use SEPs found from the answer directly
-		if rrSetType == dns.TypeDNSKEY {
-			dnskeyMap, trace, err = v.findSEPsFromAnswer(rrSet, rrsig.SignerName, depth, trace)
-			if err != nil {
-				return nil, trace, err
+		if !v.r.isDNSSECAlgorithmAllowed(rrsig.Algorithm) {
+			// checked before any DNSKEY lookup, the RRSIG can't count however its keys turn out
+			lastErr = fmt.Errorf("RRSIG with keytag=%d is made with disallowed algorithm %s", rrsig.KeyTag, dnssecAlgorithmName(rrsig.Algorithm))
+			v.r.verboseLog(depth, "DNSSEC:", lastErr)
+			continue
+		}
+		signer := dns.CanonicalName(rrsig.SignerName)
+		if len(rrSet) > 0 && !dns.IsSubDomain(signer, rrSet[0].Header().Name) {
+			// the signer must be the zone containing the RRset, RFC 4035 section 5.3.1
+			lastErr = fmt.Errorf("RRSIG signer %s is not an ancestor of %s", rrsig.SignerName, rrSet[0].Header().Name)
+			v.r.verboseLog(depth, "DNSSEC:", lastErr)
+			continue
+		}
+		if err, failed := signerErrs[signer]; failed {
+			lastErr = err
+			continue
+		}
+		dnskeyMap, fetched := signerKeys[signer]
+		if !fetched {
+			var err error
+			if rrSetType == dns.TypeDNSKEY {
+				// If RRset type is DNSKEY, use SEPs found from the answer directly
+				dnskeyMap, trace, err = v.findSEPsFromAnswer(rrSet, rrsig.SignerName, depth, trace)
+			} else {
+				// For other RRset types, fetch DNSKEYs for each RRSIG's signer domain
+				v.r.verboseLog(depth, "DNSSEC: Verifying RRSIG with signer", rrsig.SignerName)
+				_, dnskeyMap, trace, err = v.getDNSKEYs(rrsig.SignerName, trace, depth+1)
 			}
-		} else {
-			// For other RRset types, fetch DNSKEYs for each RRSIG's signer domain
-			v.r.verboseLog(depth, "DNSSEC: Verifying RRSIG with signer", rrsig.SignerName)
-
-			_, zskMap, updatedTrace, err := v.getDNSKEYs(rrsig.SignerName, trace, depth+1)
-			dnskeyMap = zskMap
 			if err != nil {
+				signerErrs[signer] = err
 				lastErr = err
 				continue
 			}
-			trace = updatedTrace
+			signerKeys[signer] = dnskeyMap
 		}
 
 		keyTag := rrsig.KeyTag
 
 		// Check if the RRSIG is still valid
-		if !rrsig.ValidityPeriod(time.Now()) {
+		if !rrsigInValidityPeriod(rrsig, time.Now(), v.clockSkew) {
 			lastErr = fmt.Errorf("RRSIG with keytag=%d has expired or is not yet valid", keyTag)
 			v.r.verboseLog(depth, "DNSSEC: RRSIG with keytag=", keyTag, "has expired or is not yet valid")
 			continue
@@ -574,6 +662,14 @@ func (v *dNSSECValidator) validateRRSIG(rrSetType uint16, rrSet []dns.RR, rrsigs
 		// Verify the RRSIG with the matching DNSKEY
 		if err := rrsig.Verify(matchingKey, rrSet); err == nil {
 			v.dNSKEY[*matchingKey] = struct{}{}
+			link := v.chainLink(signer)
+			if rrSetType == dns.TypeDNSKEY {
+				link.KSKKeyTag = keyTag
+			} else {
+				link.ZSKKeyTag = keyTag
+				link.Inception = dns.TimeToString(rrsig.Inception)
+				link.Expiration = dns.TimeToString(rrsig.Expiration)
+			}
 			return rrsig, trace, nil
 		} else {
 			lastErr = fmt.Errorf("RRSIG with keytag=%d failed to verify: %v", keyTag, err)
@@ -584,3 +680,37 @@ func (v *dNSSECValidator) validateRRSIG(rrSetType uint16, rrSet []dns.RR, rrsigs
 
 	return nil, trace, lastErr
 }
+
+// rrsigInValidityPeriod reports whether now is within the validity period of rrsig, widened by skew on both ends
+func rrsigInValidityPeriod(rrsig *dns.RRSIG, now time.Time, skew time.Duration) bool {
+	return rrsig.ValidityPeriod(now) || rrsig.ValidityPeriod(now.Add(skew)) || rrsig.ValidityPeriod(now.Add(-skew))
+}
+
+// chainLink returns the link of the chain of trust for zone, adding it if it isn't there yet
+func (v *dNSSECValidator) chainLink(zone string) *DNSSECChainLink {
+	zone = dns.CanonicalName(zone)
+	if v.chain == nil {
+		v.chain = make(map[string]*DNSSECChainLink)
+	}
+	link, ok := v.chain[zone]
+	if !ok {
+		link = &DNSSECChainLink{Zone: zone}
+		v.chain[zone] = link
+	}
+	return link
+}
+
+// chainOfTrust returns the links of the chain of trust recorded so far, ordered from the root down
+func (v *dNSSECValidator) chainOfTrust() []DNSSECChainLink {
+	chain := make([]DNSSECChainLink, 0, len(v.chain))
+	for _, link := range v.chain {
+		chain = append(chain, *link)
+	}
+	slices.SortFunc(chain, func(a, b DNSSECChainLink) int {
+		if c := dns.CountLabel(a.Zone) - dns.CountLabel(b.Zone); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Zone, b.Zone)
+	})
+	return chain
+}
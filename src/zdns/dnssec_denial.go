@@ -0,0 +1,324 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nsec3MaxIterations is the highest NSEC3 iteration count a denial of existence is accepted with, answers proven with
+// more iterations are reported insecure since they are costly to verify, RFC 9276 section 3.2
+const nsec3MaxIterations = 150
+
+// deniedName returns the name a negative answer msg denies the existence of, or the existence of data of the queried
+// type at, and whether it's an NXDOMAIN. ok is false if msg isn't a negative answer, ex. a referral or positive answer.
+func deniedName(msg *dns.Msg) (name string, nxdomain, ok bool) {
+	if len(msg.Question) == 0 {
+		return "", false, false
+	}
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		// the denial is about the end of a CNAME/DNAME chain, if any
+		name, _ = followCNAMEChain(msg.Question[0].Name, msg.Answer)
+		return name, true, true
+	case dns.RcodeSuccess:
+		if msg.Authoritative && len(msg.Answer) == 0 {
+			return strings.ToLower(dns.Fqdn(msg.Question[0].Name)), false, true
+		}
+	}
+	return "", false, false
+}
+
+// validateDenial validates the signatures of the NSEC and NSEC3 records in the authority section of a negative answer,
+// unless the authority section already was, and checks that those found secure prove the answer. Returns the status
+// the proof warrants, with the reason if it isn't secure.
+func (v *dNSSECValidator) validateDenial(name string, nxdomain bool, result *DNSSECResult, depth int, trace Trace) (DNSSECStatus, string, Trace) {
+	denialSets := result.Authorities
+	if !slices.Contains(result.ValidatedSections, DNSSECSectionAuthority) {
+		var denialRRs []dns.RR
+		for _, rr := range v.msg.Ns {
+			rrType := rr.Header().Rrtype
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				rrType = sig.TypeCovered
+			}
+			if rrType == dns.TypeNSEC || rrType == dns.TypeNSEC3 {
+				denialRRs = append(denialRRs, rr)
+			}
+		}
+		denialSets, trace = v.validateSection(denialRRs, depth, trace)
+		result.Authorities = append(result.Authorities, denialSets...)
+	}
+
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range v.msg.Ns {
+		setResult := getResultForRRset(RRsetKey{Name: rr.Header().Name, Type: rr.Header().Rrtype, Class: rr.Header().Class}, denialSets)
+		if setResult == nil || setResult.Status != DNSSECSecure {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+
+	qtype := v.msg.Question[0].Qtype
+	mechanism, status, reason := proveDenial(name, qtype, nxdomain, nsecs, nsec3s)
+	v.r.verboseLog(depth, "DNSSEC: denial of existence for", name, dns.TypeToString[qtype], "status:", status, "reason:", reason)
+	if status != DNSSECBogus {
+		result.Denial = mechanism
+	}
+	return status, reason, trace
+}
+
+// applyDenialStatus lowers the overall status of a negative answer to the status of its denial of existence proof
+func (r *DNSSECResult) applyDenialStatus(status DNSSECStatus, reason string) {
+	switch {
+	case status == DNSSECBogus && r.Status != DNSSECBogus:
+		r.Status = DNSSECBogus
+		r.Reason = reason
+	case status == DNSSECInsecure && r.Status == DNSSECSecure:
+		r.Status = DNSSECInsecure
+		r.Reason = reason
+	}
+}
+
+// proveDenial checks whether nsecs or nsec3s, whose signatures are already validated, prove that name doesn't exist if
+// nxdomain, or that it has no qtype records otherwise. Returns the record type used for the proof, and the resulting
+// status: secure if proven, insecure if the answer may lie in an NSEC3 opt-out span or the NSEC3 iteration count is too
+// high to check, bogus if not proven, with the reason for the latter two.
+func proveDenial(name string, qtype uint16, nxdomain bool, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (string, DNSSECStatus, string) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if len(nsecs) > 0 {
+		if err := proveDenialNSEC(name, qtype, nxdomain, nsecs); err != nil {
+			return "NSEC", DNSSECBogus, err.Error()
+		}
+		return "NSEC", DNSSECSecure, ""
+	}
+	usable := make([]*dns.NSEC3, 0, len(nsec3s))
+	for _, nsec3 := range nsec3s {
+		// records with an unknown hash algorithm or flags must be ignored, RFC 5155 section 8.2
+		if nsec3.Hash != dns.SHA1 || nsec3.Flags > NSEC3OptOutFlag {
+			continue
+		}
+		if nsec3.Iterations > nsec3MaxIterations {
+			return "NSEC3", DNSSECInsecure, fmt.Sprintf("NSEC3 iteration count %d is above the limit of %d", nsec3.Iterations, nsec3MaxIterations)
+		}
+		usable = append(usable, nsec3)
+	}
+	if len(usable) > 0 {
+		optOut, err := proveDenialNSEC3(name, qtype, nxdomain, usable)
+		if err != nil {
+			return "NSEC3", DNSSECBogus, err.Error()
+		}
+		if optOut {
+			return "NSEC3", DNSSECInsecure, fmt.Sprintf("%s lies in an NSEC3 opt-out span, an unsigned delegation may cover it", name)
+		}
+		return "NSEC3", DNSSECSecure, ""
+	}
+	return "", DNSSECBogus, fmt.Sprintf("no secure NSEC or NSEC3 records to prove the negative answer for %s", name)
+}
+
+// proveDenialNSEC implements the NSEC checks of RFC 4035 section 5.4, with the empty non-terminal and delegation
+// handling of RFC 6840 section 4
+func proveDenialNSEC(name string, qtype uint16, nxdomain bool, nsecs []*dns.NSEC) error {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if !strings.EqualFold(nsec.Hdr.Name, name) {
+				continue
+			}
+			if err := checkNoDataBitmap(nsec.TypeBitMap, name, qtype); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+	cover := findCoveringNSEC(nsecs, name)
+	if cover == nil {
+		if nxdomain {
+			return fmt.Errorf("no NSEC proves %s doesn't exist", name)
+		}
+		return fmt.Errorf("no NSEC proves %s has no %s records", name, dns.TypeToString[qtype])
+	}
+	if !nxdomain && dns.IsSubDomain(name, cover.NextDomain) {
+		// name is an empty non-terminal, it exists but has no records of any type
+		return nil
+	}
+	// the closest encloser is the longest ancestor of name that's either end of the covering NSEC
+	ceLabels := max(dns.CompareDomainName(name, cover.Hdr.Name), dns.CompareDomainName(name, cover.NextDomain))
+	wildcard := wildcardAt(trimLabels(name, dns.CountLabel(name)-ceLabels))
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, wildcard) {
+			if nxdomain {
+				return fmt.Errorf("NSEC shows wildcard %s exists, so %s should have been synthesized", wildcard, name)
+			}
+			// NODATA for a name synthesized from a wildcard, RFC 4035 section 3.1.3.4
+			return checkNoDataBitmap(nsec.TypeBitMap, wildcard, qtype)
+		}
+	}
+	if findCoveringNSEC(nsecs, wildcard) == nil {
+		return fmt.Errorf("no NSEC proves wildcard %s doesn't exist", wildcard)
+	}
+	if !nxdomain {
+		return fmt.Errorf("NSEC proves %s doesn't exist, but the response isn't an NXDOMAIN", name)
+	}
+	return nil
+}
+
+// proveDenialNSEC3 implements the NSEC3 checks of RFC 5155 sections 8.4 to 8.7. optOut is true if the proof relies on
+// an opt-out NSEC3 covering the next closer name, which only proves name isn't a signed delegation.
+func proveDenialNSEC3(name string, qtype uint16, nxdomain bool, nsec3s []*dns.NSEC3) (optOut bool, err error) {
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				return false, checkNoDataBitmap(nsec3.TypeBitMap, name, qtype)
+			}
+		}
+	}
+	ce, nextCloserCover, err := nsec3ClosestEncloser(name, nsec3s)
+	if err != nil {
+		return false, err
+	}
+	optOut = nextCloserCover.Flags&NSEC3OptOutFlag != 0
+	if !nxdomain && qtype == dns.TypeDS {
+		// no DS at name, proven by an opt-out span covering it, RFC 5155 section 8.6
+		if !optOut {
+			return false, fmt.Errorf("NSEC3 proves %s doesn't exist, but the response isn't an NXDOMAIN", name)
+		}
+		return false, nil
+	}
+	wildcard := wildcardAt(ce)
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(wildcard) {
+			if nxdomain {
+				return false, fmt.Errorf("NSEC3 shows wildcard %s exists, so %s should have been synthesized", wildcard, name)
+			}
+			// NODATA for a name synthesized from a wildcard, RFC 5155 section 8.7
+			return optOut, checkNoDataBitmap(nsec3.TypeBitMap, wildcard, qtype)
+		}
+	}
+	if !slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3Covers(nsec3, wildcard) }) {
+		return false, fmt.Errorf("no NSEC3 proves wildcard %s doesn't exist", wildcard)
+	}
+	if !nxdomain {
+		return false, fmt.Errorf("NSEC3 proves %s doesn't exist, but the response isn't an NXDOMAIN", name)
+	}
+	return optOut, nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser of name, the longest ancestor matched by an NSEC3, and the NSEC3
+// covering the next closer name, one label longer toward name, RFC 5155 section 8.3
+func nsec3ClosestEncloser(name string, nsec3s []*dns.NSEC3) (string, *dns.NSEC3, error) {
+	labels := dns.CountLabel(name)
+	for i := 1; i <= labels; i++ {
+		ce := trimLabels(name, i)
+		idx := slices.IndexFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Match(ce) })
+		if idx < 0 {
+			continue
+		}
+		if bitmap := nsec3s[idx].TypeBitMap; slices.Contains(bitmap, dns.TypeDNAME) || (slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA)) {
+			return "", nil, fmt.Errorf("closest encloser %s of %s is a delegation or DNAME", ce, name)
+		}
+		nextCloser := trimLabels(name, i-1)
+		for _, nsec3 := range nsec3s {
+			if nsec3Covers(nsec3, nextCloser) {
+				return ce, nsec3, nil
+			}
+		}
+		return "", nil, fmt.Errorf("no NSEC3 covers %s, the next closer name to %s", nextCloser, name)
+	}
+	return "", nil, fmt.Errorf("no NSEC3 matches an ancestor of %s", name)
+}
+
+// nsec3Covers reports whether the hash of name sorts strictly between the owner and next hashes of nsec3. The miekg/dns
+// Cover also counts a hash equal to the owner's as covered.
+func nsec3Covers(nsec3 *dns.NSEC3, name string) bool {
+	return nsec3.Cover(name) && !nsec3.Match(name)
+}
+
+// checkNoDataBitmap checks that the type bitmap of an NSEC or NSEC3 matching name shows it has no qtype records
+func checkNoDataBitmap(bitmap []uint16, name string, qtype uint16) error {
+	if slices.Contains(bitmap, qtype) {
+		return fmt.Errorf("NSEC record shows %s has %s records", name, dns.TypeToString[qtype])
+	}
+	if slices.Contains(bitmap, dns.TypeCNAME) {
+		return fmt.Errorf("NSEC record shows %s is a CNAME", name)
+	}
+	if qtype != dns.TypeDS && slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA) {
+		// the parent's record at a delegation says nothing about the data in the child zone
+		return fmt.Errorf("NSEC record for %s is from above a delegation", name)
+	}
+	return nil
+}
+
+// findCoveringNSEC returns the NSEC whose span covers name, which sorts strictly between its owner and next name in
+// canonical order, RFC 4034 section 6.1. NSECs at delegations or DNAMEs above name are ignored, RFC 6840 section 4.1.
+func findCoveringNSEC(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, nsec := range nsecs {
+		owner := nsec.Hdr.Name
+		if !strings.EqualFold(owner, name) && dns.IsSubDomain(owner, name) {
+			if slices.Contains(nsec.TypeBitMap, dns.TypeDNAME) || (slices.Contains(nsec.TypeBitMap, dns.TypeNS) && !slices.Contains(nsec.TypeBitMap, dns.TypeSOA)) {
+				continue
+			}
+		}
+		afterOwner := canonicalNameCompare(owner, name) < 0
+		beforeNext := canonicalNameCompare(name, nsec.NextDomain) < 0
+		if canonicalNameCompare(owner, nsec.NextDomain) < 0 {
+			if afterOwner && beforeNext {
+				return nsec
+			}
+		} else if afterOwner && dns.IsSubDomain(nsec.NextDomain, name) {
+			// the last NSEC of a zone wraps around to the apex
+			return nsec
+		}
+	}
+	return nil
+}
+
+// canonicalNameCompare compares names in the canonical DNS order of RFC 4034 section 6.1: label by label from the
+// root, case-insensitively, with a name sorting before its descendants. Labels are compared in presentation format.
+func canonicalNameCompare(a, b string) int {
+	aLabels := dns.SplitDomainName(strings.ToLower(a))
+	bLabels := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		if c := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+// wildcardAt returns the wildcard name directly below the FQDN name
+func wildcardAt(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// trimLabels removes the n leftmost labels of the FQDN name
+func trimLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[n:], "."))
+}
@@ -0,0 +1,193 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func makeNSEC(owner, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: append(types, dns.TypeRRSIG, dns.TypeNSEC),
+	}
+}
+
+// makeNSEC3Chain builds the NSEC3 chain of zone, given the types present at each of its names
+func makeNSEC3Chain(zone string, names map[string][]uint16, optOut bool, iterations uint16) []*dns.NSEC3 {
+	hashes := make([]string, 0, len(names))
+	types := make(map[string][]uint16, len(names))
+	for name, nameTypes := range names {
+		hash := dns.HashName(name, dns.SHA1, iterations, "ABCD")
+		hashes = append(hashes, hash)
+		types[hash] = nameTypes
+	}
+	sort.Strings(hashes)
+	var flags uint8
+	if optOut {
+		flags = NSEC3OptOutFlag
+	}
+	chain := make([]*dns.NSEC3, 0, len(hashes))
+	for i, hash := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: iterations,
+			SaltLength: 2,
+			Salt:       "ABCD",
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types[hash],
+		})
+	}
+	return chain
+}
+
+func TestDeniedName(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Rcode = dns.RcodeNameError
+	name, nxdomain, ok := deniedName(msg)
+	require.True(t, ok)
+	require.True(t, nxdomain)
+	require.Equal(t, "www.example.com.", name)
+
+	// the denial is about the end of the CNAME chain
+	cname, err := dns.NewRR("www.example.com. 300 IN CNAME missing.example.com.")
+	require.NoError(t, err)
+	msg.Answer = []dns.RR{cname}
+	name, _, ok = deniedName(msg)
+	require.True(t, ok)
+	require.Equal(t, "missing.example.com.", name)
+
+	// NODATA
+	msg.Answer = nil
+	msg.Rcode = dns.RcodeSuccess
+	msg.Authoritative = true
+	name, nxdomain, ok = deniedName(msg)
+	require.True(t, ok)
+	require.False(t, nxdomain)
+	require.Equal(t, "www.example.com.", name)
+
+	// referrals aren't negative answers
+	msg.Authoritative = false
+	_, _, ok = deniedName(msg)
+	require.False(t, ok)
+}
+
+func TestProveDenialNSEC(t *testing.T) {
+	// example.com. -> a -> d -> x.e (making e an empty non-terminal) -> sub (a delegation) -> back to the apex
+	apex := makeNSEC("example.com.", "a.example.com.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY)
+	a := makeNSEC("a.example.com.", "d.example.com.", dns.TypeA)
+	d := makeNSEC("d.example.com.", "x.e.example.com.", dns.TypeA)
+	xe := makeNSEC("x.e.example.com.", "sub.example.com.", dns.TypeA)
+	sub := makeNSEC("sub.example.com.", "example.com.", dns.TypeNS)
+	chain := []*dns.NSEC{apex, a, d, xe, sub}
+
+	// NXDOMAIN needs the name and the wildcard at its closest encloser covered
+	mechanism, status, _ := proveDenial("b.example.com", dns.TypeA, true, nil, nil)
+	require.Equal(t, DNSSECBogus, status)
+	require.Empty(t, mechanism)
+	mechanism, status, _ = proveDenial("b.example.com", dns.TypeA, true, []*dns.NSEC{apex, a}, nil)
+	require.Equal(t, DNSSECSecure, status)
+	require.Equal(t, "NSEC", mechanism)
+	_, status, reason := proveDenial("b.example.com", dns.TypeA, true, []*dns.NSEC{a}, nil)
+	require.Equal(t, DNSSECBogus, status)
+	require.Contains(t, reason, "*.example.com.")
+	// an existing name can't be denied
+	_, status, _ = proveDenial("a.example.com", dns.TypeA, true, chain, nil)
+	require.Equal(t, DNSSECBogus, status)
+
+	// NODATA
+	_, status, _ = proveDenial("a.example.com", dns.TypeAAAA, false, chain, nil)
+	require.Equal(t, DNSSECSecure, status)
+	_, status, _ = proveDenial("a.example.com", dns.TypeA, false, chain, nil)
+	require.Equal(t, DNSSECBogus, status)
+	_, status, _ = proveDenial("e.example.com", dns.TypeA, false, chain, nil)
+	require.Equal(t, DNSSECSecure, status, "empty non-terminal")
+	_, status, _ = proveDenial("sub.example.com", dns.TypeDS, false, chain, nil)
+	require.Equal(t, DNSSECSecure, status, "no DS at an insecure delegation")
+	_, status, _ = proveDenial("sub.example.com", dns.TypeA, false, chain, nil)
+	require.Equal(t, DNSSECBogus, status, "the parent's NSEC says nothing about the child zone")
+
+	// names below a delegation are out of the zone
+	_, status, _ = proveDenial("www.sub.example.com", dns.TypeA, true, chain, nil)
+	require.Equal(t, DNSSECBogus, status)
+}
+
+func TestProveDenialNSEC3(t *testing.T) {
+	names := map[string][]uint16{
+		"example.com.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG},
+		"a.example.com.":   {dns.TypeA, dns.TypeRRSIG},
+		"e.example.com.":   {}, // empty non-terminal
+		"x.e.example.com.": {dns.TypeA, dns.TypeRRSIG},
+	}
+	chain := makeNSEC3Chain("example.com.", names, false, 0)
+
+	mechanism, status, _ := proveDenial("b.example.com", dns.TypeA, true, nil, chain)
+	require.Equal(t, DNSSECSecure, status)
+	require.Equal(t, "NSEC3", mechanism)
+	_, status, _ = proveDenial("a.example.com", dns.TypeA, true, nil, chain)
+	require.Equal(t, DNSSECBogus, status)
+	_, status, _ = proveDenial("a.example.com", dns.TypeAAAA, false, nil, chain)
+	require.Equal(t, DNSSECSecure, status)
+	_, status, _ = proveDenial("a.example.com", dns.TypeA, false, nil, chain)
+	require.Equal(t, DNSSECBogus, status)
+	_, status, _ = proveDenial("e.example.com", dns.TypeA, false, nil, chain)
+	require.Equal(t, DNSSECSecure, status, "empty non-terminal")
+	_, status, _ = proveDenial("b.example.com", dns.TypeA, false, nil, chain)
+	require.Equal(t, DNSSECBogus, status, "proves an NXDOMAIN, not a NODATA")
+
+	// without the closest encloser's record there's no proof
+	var partial []*dns.NSEC3
+	for _, nsec3 := range chain {
+		if !nsec3.Match("example.com.") {
+			partial = append(partial, nsec3)
+		}
+	}
+	_, status, _ = proveDenial("b.example.com", dns.TypeA, true, nil, partial)
+	require.Equal(t, DNSSECBogus, status)
+
+	// opt-out spans only prove there's no signed delegation
+	optOut := makeNSEC3Chain("example.com.", names, true, 0)
+	_, status, _ = proveDenial("unsigned.example.com", dns.TypeDS, false, nil, optOut)
+	require.Equal(t, DNSSECSecure, status)
+	_, status, _ = proveDenial("unsigned.example.com", dns.TypeDS, false, nil, chain)
+	require.Equal(t, DNSSECBogus, status)
+	_, status, reason := proveDenial("b.example.com", dns.TypeA, true, nil, optOut)
+	require.Equal(t, DNSSECInsecure, status)
+	require.Contains(t, reason, "opt-out")
+
+	// costly iteration counts aren't checked
+	_, status, _ = proveDenial("b.example.com", dns.TypeA, true, nil, makeNSEC3Chain("example.com.", names, false, nsec3MaxIterations+1))
+	require.Equal(t, DNSSECInsecure, status)
+}
+
+func TestCanonicalNameCompare(t *testing.T) {
+	// the example ordering of RFC 4034 section 6.1
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 0; i+1 < len(ordered); i++ {
+		require.Negative(t, canonicalNameCompare(ordered[i], ordered[i+1]), "%s < %s", ordered[i], ordered[i+1])
+		require.Positive(t, canonicalNameCompare(ordered[i+1], ordered[i]))
+	}
+	require.Zero(t, canonicalNameCompare("Example.", "example."))
+}
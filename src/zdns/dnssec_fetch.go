@@ -0,0 +1,113 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DNSSECFetchGroup coalesces the DNSKEY and DS lookups DNSSEC validation makes for signer domains. Validations of
+// different names running concurrently on resolvers that share a group need the same root and TLD keys, with a group
+// they wait on a single in-flight lookup instead of each sending their own. It is safe for concurrent use.
+type DNSSECFetchGroup struct {
+	group singleflight.Group
+	sem   chan struct{} // limits in-flight fetches across the scan, nil if unlimited
+}
+
+// NewDNSSECFetchGroup returns a DNSSECFetchGroup allowing at most maxInFlight fetches at once, 0 means no limit
+func NewDNSSECFetchGroup(maxInFlight int) *DNSSECFetchGroup {
+	g := &DNSSECFetchGroup{}
+	if maxInFlight > 0 {
+		g.sem = make(chan struct{}, maxInFlight)
+	}
+	return g
+}
+
+type signerFetchResult struct {
+	res    *SingleQueryResult
+	trace  Trace
+	status Status
+	err    error
+}
+
+func (fr signerFetchResult) failed() bool {
+	return fr.status != StatusNoError || fr.err != nil
+}
+
+// do runs fetch, or waits for an identical fetch already in flight and returns its result. Failures aren't shared, a
+// caller that waited on a fetch that failed runs its own, since it may have time or retries left that the first
+// caller didn't.
+func (g *DNSSECFetchGroup) do(ctx context.Context, key string, fetch func(context.Context) signerFetchResult) signerFetchResult {
+	if g == nil {
+		return fetch(ctx)
+	}
+	ranFetch := false
+	v, _, _ := g.group.Do(key, func() (interface{}, error) {
+		ranFetch = true
+		return g.limit(ctx, fetch), nil
+	})
+	fr := v.(signerFetchResult)
+	if !ranFetch && fr.failed() {
+		return g.limit(ctx, fetch)
+	}
+	return fr
+}
+
+// fetchSlotKey marks the context of a fetch holding a slot of the group's limit
+type fetchSlotKey struct{}
+
+// limit runs fetch once a slot of the group's limit is free. The fetch's context carries the slot, fetches nested in it
+// (the signer lookups made validating the fetch's own responses) run in the same slot rather than waiting for another
+// one that may never free up.
+func (g *DNSSECFetchGroup) limit(ctx context.Context, fetch func(context.Context) signerFetchResult) signerFetchResult {
+	if g.sem == nil || ctx.Value(fetchSlotKey{}) != nil {
+		return fetch(ctx)
+	}
+	select {
+	case g.sem <- struct{}{}:
+		defer func() { <-g.sem }()
+		return fetch(context.WithValue(ctx, fetchSlotKey{}, true))
+	case <-ctx.Done():
+		return signerFetchResult{status: StatusTimeout, err: fmt.Errorf("waiting to fetch DNSSEC records: %w", ctx.Err())}
+	}
+}
+
+// lookupSignerRRset looks up the DNSKEY or DS RRset of a signer domain through the resolver's fetch group. The
+// returned trace only holds the steps of the fetch itself.
+func (v *dNSSECValidator) lookupSignerRRset(q *QuestionWithMetadata) (*SingleQueryResult, Trace, Status, error) {
+	key := fmt.Sprintf("%s/%d/%d/%t", q.Q.Name, q.Q.Type, q.Q.Class, v.isIterative)
+	fr := v.r.dnssecFetches.do(v.ctx, key, func(ctx context.Context) signerFetchResult {
+		// the fetch's responses are validated by v too, its signer lookups must see the fetch's context
+		outer := v.ctx
+		v.ctx = ctx
+		defer func() { v.ctx = outer }()
+		res, trace, status, err := v.r.lookup(ctx, q, v.r.rootNameServers, v.isIterative, nil)
+		return signerFetchResult{res: res, trace: trace, status: status, err: err}
+	})
+	if fr.res == nil {
+		// callers read the sections before checking the status
+		return &SingleQueryResult{}, fr.trace, fr.status, fr.err
+	}
+	// the result may be shared with other validations, give the caller a copy whose sections it can append to
+	res := *fr.res
+	res.Answers = slices.Clip(res.Answers)
+	res.Additionals = slices.Clip(res.Additionals)
+	res.Authorities = slices.Clip(res.Authorities)
+	return &res, slices.Clip(fr.trace), fr.status, fr.err
+}
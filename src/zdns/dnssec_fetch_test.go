@@ -0,0 +1,106 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runConcurrentFetches calls g.do from n goroutines with a fetch that blocks until all of them have called it or have
+// had time to join an in-flight fetch, and returns the results
+func runConcurrentFetches(g *DNSSECFetchGroup, n int, fetch func() signerFetchResult) []signerFetchResult {
+	release := make(chan struct{})
+	results := make([]signerFetchResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = g.do(context.Background(), "com./48/1/true", func(context.Context) signerFetchResult {
+				<-release
+				return fetch()
+			})
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return results
+}
+
+func TestDNSSECFetchGroupCoalesces(t *testing.T) {
+	var fetches atomic.Int32
+	results := runConcurrentFetches(NewDNSSECFetchGroup(0), 10, func() signerFetchResult {
+		fetches.Add(1)
+		return signerFetchResult{res: &SingleQueryResult{}, status: StatusNoError}
+	})
+	require.Equal(t, int32(1), fetches.Load())
+	for _, fr := range results {
+		require.Equal(t, StatusNoError, fr.status)
+	}
+}
+
+func TestDNSSECFetchGroupDoesNotShareFailures(t *testing.T) {
+	var fetches atomic.Int32
+	results := runConcurrentFetches(NewDNSSECFetchGroup(0), 10, func() signerFetchResult {
+		if fetches.Add(1) == 1 {
+			return signerFetchResult{status: StatusTimeout}
+		}
+		return signerFetchResult{res: &SingleQueryResult{}, status: StatusNoError}
+	})
+	// every caller that waited on the failed fetch ran its own
+	require.Equal(t, int32(10), fetches.Load())
+	failed := 0
+	for _, fr := range results {
+		if fr.failed() {
+			failed++
+		}
+	}
+	require.Equal(t, 1, failed)
+}
+
+func TestDNSSECFetchGroupLimit(t *testing.T) {
+	g := NewDNSSECFetchGroup(1)
+	g.sem <- struct{}{} // a fetch is already in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	fr := g.do(ctx, "org./43/1/true", func(context.Context) signerFetchResult {
+		t.Fatal("fetch ran past the in-flight limit")
+		return signerFetchResult{}
+	})
+	require.Equal(t, StatusTimeout, fr.status)
+	require.Error(t, fr.err)
+}
+
+func TestDNSSECFetchGroupLimitNestedFetch(t *testing.T) {
+	g := NewDNSSECFetchGroup(1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// validating the DNSKEY response of the fetch needs the parent's DS, fetched while the outer slot is held
+	fr := g.do(ctx, "example.org./48/1/true", func(ctx context.Context) signerFetchResult {
+		nested := g.do(ctx, "example.org./43/1/true", func(context.Context) signerFetchResult {
+			return signerFetchResult{status: StatusNoError}
+		})
+		return nested
+	})
+	require.Equal(t, StatusNoError, fr.status)
+	require.NoError(t, fr.err)
+}
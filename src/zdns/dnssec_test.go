@@ -0,0 +1,212 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func makeSigningKey(t *testing.T, zone string) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     keySigningKeyFlag,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return key, priv.(crypto.Signer)
+}
+
+func signRRset(t *testing.T, key *dns.DNSKEY, priv crypto.Signer, signer string, rrSet []dns.RR) *dns.RRSIG {
+	return signRRsetValidFor(t, key, priv, signer, rrSet, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func signRRsetValidFor(t *testing.T, key *dns.DNSKEY, priv crypto.Signer, signer string, rrSet []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrSet[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		KeyTag:     key.KeyTag(),
+		SignerName: signer,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	require.NoError(t, sig.Sign(priv, rrSet))
+	return sig
+}
+
+// makeCachedSignerValidator returns a validator whose resolver serves the DNSKEY of example.com., and its DS at the
+// parent, from the cache
+func makeCachedSignerValidator(t *testing.T, clockSkew time.Duration) (*dNSSECValidator, *dns.DNSKEY, crypto.Signer) {
+	config := InitTest(t)
+	config.DNSSECClockSkew = clockSkew
+	r, err := InitResolver(config)
+	require.NoError(t, err)
+
+	key, priv := makeSigningKey(t, "example.com.")
+	authoritative := DNSFlags{Authoritative: true}
+	r.cache.SafeAddCachedAnswer(Question{Name: "example.com", Type: dns.TypeDNSKEY, Class: dns.ClassINET},
+		&SingleQueryResult{Answers: []interface{}{ParseAnswer(key)}, Flags: authoritative}, nil, "example.com", 0, false)
+	r.cache.SafeAddCachedAnswer(Question{Name: "example.com", Type: dns.TypeDS, Class: dns.ClassINET},
+		&SingleQueryResult{Answers: []interface{}{ParseAnswer(key.ToDS(dns.SHA256))}, Flags: authoritative}, nil, "com", 0, false)
+
+	v := makeDNSSECValidator(r, context.Background(), true)
+	v.resetDNSSECValidator(new(dns.Msg), nil)
+	return v, key, priv
+}
+
+func TestValidateRRSIGMultipleSigners(t *testing.T) {
+	v, current, currentPriv := makeCachedSignerValidator(t, 0)
+	stale, stalePriv := makeSigningKey(t, "example.com.")
+
+	a, err := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	require.NoError(t, err)
+	rrSet := []dns.RR{a}
+	other, otherPriv := makeSigningKey(t, "example.net.")
+	rrsigs := []*dns.RRSIG{
+		signRRset(t, other, otherPriv, "example.net.", rrSet),         // a signer outside the RRset's zone
+		signRRset(t, stale, stalePriv, "example.com.", rrSet),         // a key that's no longer published
+		signRRset(t, current, currentPriv, "example.com.", rrSet),     // the current key
+		signRRset(t, current, currentPriv, "sub.example.com.", rrSet), // never reached
+	}
+
+	sig, _, err := v.validateRRSIG(dns.TypeA, rrSet, rrsigs, nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, rrsigs[2], sig)
+
+	// without the current key's signature, the last error is reported
+	sig, _, err = v.validateRRSIG(dns.TypeA, rrSet, rrsigs[:2], nil, 0)
+	require.Nil(t, sig)
+	require.ErrorContains(t, err, "no matching DNSKEY")
+	sig, _, err = v.validateRRSIG(dns.TypeA, rrSet, rrsigs[:1], nil, 0)
+	require.Nil(t, sig)
+	require.ErrorContains(t, err, "not an ancestor")
+}
+
+func TestValidateRRSIGClockSkew(t *testing.T) {
+	a, err := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	require.NoError(t, err)
+	rrSet := []dns.RR{a}
+	now := time.Now()
+
+	v, key, priv := makeCachedSignerValidator(t, 0)
+	expired := signRRsetValidFor(t, key, priv, "example.com.", rrSet, now.Add(-time.Hour), now.Add(-5*time.Second))
+	notYetValid := signRRsetValidFor(t, key, priv, "example.com.", rrSet, now.Add(5*time.Second), now.Add(time.Hour))
+	for _, rrsig := range []*dns.RRSIG{expired, notYetValid} {
+		sig, _, err := v.validateRRSIG(dns.TypeA, rrSet, []*dns.RRSIG{rrsig}, nil, 0)
+		require.Nil(t, sig)
+		require.ErrorContains(t, err, "has expired or is not yet valid")
+	}
+
+	v, key, priv = makeCachedSignerValidator(t, 30*time.Second)
+	expired = signRRsetValidFor(t, key, priv, "example.com.", rrSet, now.Add(-time.Hour), now.Add(-5*time.Second))
+	notYetValid = signRRsetValidFor(t, key, priv, "example.com.", rrSet, now.Add(5*time.Second), now.Add(time.Hour))
+	for _, rrsig := range []*dns.RRSIG{expired, notYetValid} {
+		sig, _, err := v.validateRRSIG(dns.TypeA, rrSet, []*dns.RRSIG{rrsig}, nil, 0)
+		require.NoError(t, err)
+		require.Equal(t, rrsig, sig)
+	}
+	// beyond the tolerance
+	longExpired := signRRsetValidFor(t, key, priv, "example.com.", rrSet, now.Add(-time.Hour), now.Add(-time.Minute))
+	sig, _, err := v.validateRRSIG(dns.TypeA, rrSet, []*dns.RRSIG{longExpired}, nil, 0)
+	require.Nil(t, sig)
+	require.Error(t, err)
+}
+
+func TestValidateRRSIGAllowedAlgorithms(t *testing.T) {
+	a, err := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	require.NoError(t, err)
+	rrSet := []dns.RR{a}
+
+	v, key, priv := makeCachedSignerValidator(t, 0)
+	rrsig := signRRset(t, key, priv, "example.com.", rrSet)
+	v.r.dnssecAlgorithms = map[uint8]struct{}{dns.ECDSAP256SHA256: {}, dns.ED25519: {}}
+	sig, _, err := v.validateRRSIG(dns.TypeA, rrSet, []*dns.RRSIG{rrsig}, nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, rrsig, sig)
+
+	v.r.dnssecAlgorithms = map[uint8]struct{}{dns.ED25519: {}}
+	sig, _, err = v.validateRRSIG(dns.TypeA, rrSet, []*dns.RRSIG{rrsig}, nil, 0)
+	require.Nil(t, sig)
+	require.ErrorContains(t, err, "disallowed algorithm ECDSAP256SHA256")
+}
+
+func TestValidateRRSIGRecordsChainOfTrust(t *testing.T) {
+	v, key, priv := makeCachedSignerValidator(t, 0)
+	a, err := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	require.NoError(t, err)
+	rrSet := []dns.RR{a}
+	inception, expiration := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	rrsig := signRRsetValidFor(t, key, priv, "example.com.", rrSet, inception, expiration)
+
+	_, _, err = v.validateRRSIG(dns.TypeA, rrSet, []*dns.RRSIG{rrsig}, nil, 0)
+	require.NoError(t, err)
+
+	chain := v.chainOfTrust()
+	require.Len(t, chain, 1)
+	link := chain[0]
+	require.Equal(t, "example.com.", link.Zone)
+	require.NotNil(t, link.DS)
+	require.Equal(t, key.KeyTag(), link.DS.KeyTag)
+	require.Equal(t, key.KeyTag(), link.KSKKeyTag)
+	require.Equal(t, key.KeyTag(), link.ZSKKeyTag)
+	require.Equal(t, dns.TimeToString(uint32(inception.Unix())), link.Inception)
+	require.Equal(t, dns.TimeToString(uint32(expiration.Unix())), link.Expiration)
+}
+
+func TestFindSEPsPrefersStrongestDigest(t *testing.T) {
+	config := InitTest(t)
+	r, err := InitResolver(config)
+	require.NoError(t, err)
+	key, _ := makeSigningKey(t, "example.com.")
+	forged := func(ds *dns.DS) *dns.DS {
+		ds.Digest = strings.Repeat("0", len(ds.Digest))
+		return ds
+	}
+	addDS := func(records ...*dns.DS) {
+		answers := make([]interface{}, 0, len(records))
+		for _, ds := range records {
+			answers = append(answers, ParseAnswer(ds))
+		}
+		r.cache.SafeAddCachedAnswer(Question{Name: "example.com", Type: dns.TypeDS, Class: dns.ClassINET},
+			&SingleQueryResult{Answers: answers, Flags: DNSFlags{Authoritative: true}}, nil, "com", 0, false)
+	}
+	dnskeys := map[uint16]*dns.DNSKEY{key.KeyTag(): key}
+
+	// the SHA-1 digest is ignored in favor of the SHA-256 one
+	addDS(forged(key.ToDS(dns.SHA1)), key.ToDS(dns.SHA256))
+	v := makeDNSSECValidator(r, context.Background(), true)
+	v.resetDNSSECValidator(new(dns.Msg), nil)
+	seps, _, err := v.findSEPs("example.com.", dnskeys, nil, 0)
+	require.NoError(t, err)
+	require.Contains(t, seps, key.KeyTag())
+	link := v.chainOfTrust()[0]
+	require.Equal(t, uint8(dns.SHA256), link.DS.DigestType)
+	require.Equal(t, []string{"SHA1"}, link.IgnoredDigestTypes)
+
+	// a matching SHA-1 digest can't stand in for a SHA-256 one that doesn't match
+	addDS(key.ToDS(dns.SHA1), forged(key.ToDS(dns.SHA256)))
+	v = makeDNSSECValidator(r, context.Background(), true)
+	v.resetDNSSECValidator(new(dns.Msg), nil)
+	_, _, err = v.findSEPs("example.com.", dnskeys, nil, 0)
+	require.Error(t, err)
+}
@@ -15,6 +15,7 @@ package zdns
 
 import (
 	"context"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -29,6 +30,22 @@ const (
 	DNSSECIndeterminate DNSSECStatus = "Indeterminate"
 )
 
+// DNSSECSection is a section of a DNS message that DNSSEC validation can be run over
+type DNSSECSection string
+
+const (
+	DNSSECSectionAnswer     DNSSECSection = "answer"
+	DNSSECSectionAuthority  DNSSECSection = "authority"
+	DNSSECSectionAdditional DNSSECSection = "additional"
+)
+
+// AllDNSSECSections are the sections validated by default
+var AllDNSSECSections = []DNSSECSection{DNSSECSectionAnswer, DNSSECSectionAuthority, DNSSECSectionAdditional}
+
+func (s DNSSECSection) isValid() bool {
+	return s == DNSSECSectionAnswer || s == DNSSECSectionAuthority || s == DNSSECSectionAdditional
+}
+
 type RRsetKey Question
 
 func (r *RRsetKey) String() string {
@@ -52,6 +69,27 @@ type DNSSECResult struct {
 	Answers     []DNSSECPerSetResult `json:"answers" groups:"dnssec,long,trace"`
 	Additionals []DNSSECPerSetResult `json:"additionals" groups:"dnssec,long,trace"`
 	Authorities []DNSSECPerSetResult `json:"authorities" groups:"dnssec,long,trace"`
+	// Denial is the record type, NSEC or NSEC3, that proved a negative answer
+	Denial string `json:"denial,omitempty" groups:"dnssec,long,trace"`
+	// Chain is the chain of trust walked during validation, from the root down
+	Chain []DNSSECChainLink `json:"chain" groups:"dnssec,long,trace"`
+
+	ValidatedSections []DNSSECSection `json:"validated_sections" groups:"dnssec,long,trace"`
+}
+
+// DNSSECChainLink records how trust was established for a single zone in the chain of trust. The KSK is the key
+// matching the DS from the parent, the ZSK is the key that signed records in the zone, and Inception/Expiration are
+// from the RRSIG made with the ZSK.
+type DNSSECChainLink struct {
+	Zone       string    `json:"zone"`
+	DS         *DSAnswer `json:"ds,omitempty"`
+	KSKKeyTag  uint16    `json:"ksk_keytag,omitempty"`
+	ZSKKeyTag  uint16    `json:"zsk_keytag,omitempty"`
+	Inception  string    `json:"inception,omitempty"`
+	Expiration string    `json:"expiration,omitempty"`
+	// IgnoredDigestTypes are the digest types of DS records for the same key that weren't checked because DS has a
+	// stronger digest, RFC 6840 section 5.2
+	IgnoredDigestTypes []string `json:"ignored_digest_types,omitempty"`
 }
 
 func getResultForRRset(rrsetKey RRsetKey, results []DNSSECPerSetResult) *DNSSECPerSetResult {
@@ -68,6 +106,7 @@ type dNSSECValidator struct {
 	r           *Resolver
 	ctx         context.Context
 	isIterative bool
+	clockSkew   time.Duration // RRSIGs are accepted up to this long before their inception or after their expiration
 	status      DNSSECStatus
 	reason      string
 
@@ -76,6 +115,8 @@ type dNSSECValidator struct {
 	nameServer *NameServer
 	ds         map[dns.DS]struct{}
 	dNSKEY     map[dns.DNSKEY]struct{}
+	chain      map[string]*DNSSECChainLink // keyed by canonical zone name
+	ignoredDS  map[string][]dns.DS         // DS records ignored for a stronger digest of the same key, keyed by signer domain
 }
 
 // makeDNSSECValidator creates a new DNSSECValidator instance
@@ -84,6 +125,7 @@ func makeDNSSECValidator(r *Resolver, ctx context.Context, isIterative bool) *dN
 		r:           r,
 		ctx:         ctx,
 		isIterative: isIterative,
+		clockSkew:   r.dnssecClockSkew,
 		status:      DNSSECSecure,
 		reason:      "",
 	}
@@ -95,6 +137,8 @@ func (v *dNSSECValidator) resetDNSSECValidator(msg *dns.Msg, nameServer *NameSer
 	v.nameServer = nameServer
 	v.ds = make(map[dns.DS]struct{})
 	v.dNSKEY = make(map[dns.DNSKEY]struct{})
+	v.chain = make(map[string]*DNSSECChainLink)
+	v.ignoredDS = make(map[string][]dns.DS)
 }
 
 // makeDNSSECResult creates and initializes a new DNSSECResult instance
@@ -107,6 +151,9 @@ func makeDNSSECResult() *DNSSECResult {
 		Answers:     make([]DNSSECPerSetResult, 0),
 		Additionals: make([]DNSSECPerSetResult, 0),
 		Authorities: make([]DNSSECPerSetResult, 0),
+		Chain:       make([]DNSSECChainLink, 0),
+
+		ValidatedSections: make([]DNSSECSection, 0),
 	}
 }
 
@@ -64,10 +64,16 @@ type Edns0ClientSubnet struct {
 	Address       string `json:"address" groups:"short,normal,long,trace"`
 }
 
-// Edns0Expire OPT 9
+// edns0ExpireLowThreshold is the remaining EXPIRE time, in seconds, below which a secondary's copy of a zone is flagged as
+// about to expire. RFC 1912 recommends an SOA expire of 2-4 weeks, so under a day means transfers have been failing.
+const edns0ExpireLowThreshold = 24 * 60 * 60
+
+// Edns0Expire OPT 9, RFC 7314
 type Edns0Expire struct {
 	Code   uint16 `json:"code" groups:"short,normal,long,trace"`
-	Expire uint32 `json:"expire" groups:"short,normal,long,trace"`
+	Expire uint32 `json:"expire" groups:"short,normal,long,trace"`          // seconds until the responding server stops serving the zone
+	Empty  bool   `json:"empty,omitempty" groups:"short,normal,long,trace"` // the option was echoed without a value, ex. by a non-authoritative server
+	Low    bool   `json:"low,omitempty" groups:"short,normal,long,trace"`   // Expire is under a day, the zone is close to expiring on this server
 }
 
 // Edns0Cookie OPT 10
@@ -87,6 +93,12 @@ type Edns0Padding struct {
 	Padding string `json:"padding" groups:"short,normal,long,trace"`
 }
 
+// Edns0Local an option zdns doesn't parse, ex. an experimental or vendor one, with its data hex encoded
+type Edns0Local struct {
+	Code uint16 `json:"code" groups:"short,normal,long,trace"`
+	Data string `json:"data" groups:"short,normal,long,trace"`
+}
+
 // Edns0Ede OPT15
 type Edns0Ede struct {
 	InfoCode      uint16 `json:"info_code" groups:"short,normal,long,trace"`
@@ -106,9 +118,10 @@ type EDNSAnswer struct {
 	DHU          *Edns0DHU          `json:"dhu,omitempty" groups:"short,normal,long,trace"` //not implemented
 	N3U          *Edns0N3U          `json:"n3u,omitempty" groups:"short,normal,long,trace"` //not implemented
 	ClientSubnet *Edns0ClientSubnet `json:"csubnet,omitempty" groups:"short,normal,long,trace"`
-	Expire       *Edns0Expire       `json:"expire,omitempty" groups:"short,normal,long,trace"`        //not implemented
+	Expire       *Edns0Expire       `json:"expire,omitempty" groups:"short,normal,long,trace"`
 	Cookie       *Edns0Cookie       `json:"cookie,omitempty" groups:"short,normal,long,trace"`        //not implemented
 	TCPKeepalive *Edns0TCPKeepalive `json:"tcp_keepalive,omitempty" groups:"short,normal,long,trace"` //not implemented
 	Padding      *Edns0Padding      `json:"padding,omitempty" groups:"short,normal,long,trace"`       //not implemented
 	EDE          []*Edns0Ede        `json:"ede,omitempty" groups:"short,normal,long,trace"`
+	Local        []*Edns0Local      `json:"local,omitempty" groups:"short,normal,long,trace"`
 }
@@ -15,13 +15,18 @@ package zdns
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
@@ -36,6 +41,13 @@ import (
 
 var ErrorContextExpired = errors.New("context expired")
 
+const (
+	// minRandomSourcePort is the lowest source port picked with RandomizeSourcePort, lower ones are privileged
+	minRandomSourcePort = 1024
+	// randomSourcePortAttempts is how many random source ports are tried before giving up on finding a free one
+	randomSourcePortAttempts = 16
+)
+
 func GetDNSServers(path string) (ipv4, ipv6 []string, err error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -96,6 +108,64 @@ func getDNSServersFromReader(resolvReader io.Reader) (ipv4, ipv6 []string, err e
 	return ipv4, ipv6, nil
 }
 
+// GetRootHints parses a root hints file in the standard named.root format and returns the IPv4 and IPv6 root name
+// servers it lists
+func GetRootHints(path string) (ipv4, ipv6 []NameServer, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening root hints file (%s): %w", path, err)
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Errorf("error closing root hints file (%s): %s", path, err)
+		}
+	}(file)
+	return getRootHintsFromReader(file, path)
+}
+
+// getRootHintsFromReader returns the root name servers from a named.root formatted io.Reader. Only addresses of names
+// listed in an NS record for the root zone are used, and every such name must have at least one address.
+func getRootHintsFromReader(hintsReader io.Reader, fileName string) (ipv4, ipv6 []NameServer, err error) {
+	rootNSNames := make([]string, 0, 13)
+	addrs := make(map[string][]net.IP)
+	zp := dns.NewZoneParser(hintsReader, ".", fileName)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		switch v := rr.(type) {
+		case *dns.NS:
+			if name != "." {
+				return nil, nil, fmt.Errorf("root hints contain an NS record for %s, only the root zone is allowed", name)
+			}
+			rootNSNames = append(rootNSNames, strings.ToLower(v.Ns))
+		case *dns.A:
+			addrs[name] = append(addrs[name], v.A)
+		case *dns.AAAA:
+			addrs[name] = append(addrs[name], v.AAAA)
+		}
+	}
+	if err = zp.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error parsing root hints: %w", err)
+	}
+	if len(rootNSNames) == 0 {
+		return nil, nil, errors.New("root hints contain no NS records for the root zone")
+	}
+	for _, nsName := range rootNSNames {
+		if len(addrs[nsName]) == 0 {
+			return nil, nil, fmt.Errorf("root hints contain no A/AAAA records for root server %s", nsName)
+		}
+		for _, ip := range addrs[nsName] {
+			ns := NameServer{IP: ip, Port: DefaultDNSPort, DomainName: removeTrailingDotIfNotRoot(nsName)}
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ns)
+			} else {
+				ipv6 = append(ipv6, ns)
+			}
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
 // Lookup client interface for help in mocking
 type Lookuper interface {
 	DoDstServersLookup(ctx context.Context, r *Resolver, q Question, nameServer []NameServer, isIterative bool) (*SingleQueryResult, Trace, Status, error)
@@ -129,7 +199,7 @@ func (r *Resolver) doDstServersLookup(ctx context.Context, q Question, nameServe
 		}
 	}
 	if r.shouldValidateDNSSEC {
-		r.validator = makeDNSSECValidator(r, ctx, isIterative)
+		r.validator = makeDNSSECValidator(r, ctx, isIterative || r.iterativeDNSSECFetches)
 	}
 	r.retriesRemaining = r.retries
 
@@ -162,13 +232,19 @@ func (r *Resolver) lookup(ctx context.Context, qWithMeta *QuestionWithMetadata,
 	}
 	if isIterative {
 		r.verboseLog(1, "MIEKG-IN: following iterative lookup for ", qWithMeta.Q.Name, " (", qWithMeta.Q.Type, ")")
+		traceStart := len(trace)
 		res, trace, status, err = r.iterativeLookup(ctx, qWithMeta, nameServers, 1, ".", trace)
+		if res != nil {
+			res.RootServer, res.TLDServer = iterationServersFromTrace(trace[traceStart:], qWithMeta.Q.Name)
+		}
 		r.verboseLog(1, "MIEKG-OUT: following iterative lookup for ", qWithMeta.Q.Name, " (", qWithMeta.Q.Type, "): status: ", status, " , err: ", err)
 	} else {
-		tries := 0
 		// external lookup
 		r.verboseLog(1, "MIEKG-IN: following external lookup for ", qWithMeta.Q.Name, " (", qWithMeta.Q.Type, ")")
+		stepStart := time.Now()
 		res, isCached, status, trace, err = r.cyclingLookup(ctx, qWithMeta, nameServers, qWithMeta.Q.Name, 1, true, trace)
+		stepDuration := time.Since(stepStart)
+		tries := getTryNumber(r.retries, *qWithMeta.RetriesRemaining)
 		r.verboseLog(1, "MIEKG-OUT: following external lookup for ", qWithMeta.Q.Name, " (", qWithMeta.Q.Type, ") with ", tries, " attempts: status: ", status, " , err: ", err)
 		var t TraceStep
 		// TODO check for null res
@@ -185,11 +261,30 @@ func (r *Resolver) lookup(ctx context.Context, qWithMeta *QuestionWithMetadata,
 		t.Depth = 1
 		t.Cached = isCached
 		t.Try = tries
+		t.Status = status
+		t.DurationMS = DurationMS(stepDuration)
 		trace = append(trace, t)
 	}
 	return res, trace, status, err
 }
 
+// iterationServersFromTrace returns the root and TLD name servers that answered the iterative lookup of name, given
+// the trace steps of that lookup. Steps that resolved glueless name servers along the way are skipped, as are cached
+// steps since no server was contacted for them.
+func iterationServersFromTrace(trace Trace, name string) (rootServer, tldServer string) {
+	for _, step := range trace {
+		if step.Cached || step.Name != name || (step.Status != "" && step.Status != StatusNoError) {
+			continue
+		}
+		if step.Layer == "." && rootServer == "" {
+			rootServer = step.NameServer
+		} else if step.Layer != "." && !strings.Contains(step.Layer, ".") && tldServer == "" {
+			tldServer = step.NameServer
+		}
+	}
+	return rootServer, tldServer
+}
+
 // followingLoopup follows CNAMEs and DNAMEs in a DNS lookup for either an iterative or external lookup
 // A lookup of a name has a certain number of retries where it will re-attempt with another nameserver if one times out.
 // Those retries are per-name, so all subsequent iterative lookups for that name can use the single pool of retries.
@@ -209,10 +304,21 @@ func (r *Resolver) followingLookup(ctx context.Context, qWithMeta *QuestionWithM
 	originalName := qWithMeta.Q.Name // in case this is a CNAME, this keeps track of the original name while we change the question
 	currName := qWithMeta.Q.Name     // this is the current name we are looking up
 	r.verboseLog(0, "MIEKG-IN: starting a C/DNAME following lookup for ", originalName, " (", qWithMeta.Q.Type, ")")
-	for i := 0; i < r.maxDepth; i++ {
+	// every lookup after the first follows at least one more alias, so the chain length check ends the loop first
+	for i := 0; i <= r.maxCNAMEDepth; i++ {
 		qWithMeta.Q.Name = currName // update the question with the current name, this allows following CNAMEs
 		iterRes, newTrace, iterStatus, lookupErr := r.lookup(ctx, qWithMeta, nameServers, isIterative, trace)
 		trace = newTrace
+		if r.reportCNAMETargetNXDomain && i > 0 && iterRes != nil && (iterStatus == StatusNXDomain || iterStatus == StatusCNAMETargetNXDomain) {
+			// we followed a CNAME/DNAME to a name that doesn't exist, report the chain that led there
+			copiedRes := *iterRes
+			copiedRes.Answers = append(allAnswerSet, iterRes.Answers...)
+			if copiedRes.NXDomainTarget == "" {
+				copiedRes.NXDomainTarget = currName
+			}
+			copiedRes.CNAMEChain, _ = aliasChain(originalName, cnameSet, dnameSet, r.maxCNAMEDepth)
+			return &copiedRes, trace, StatusCNAMETargetNXDomain, nil
+		}
 		if iterStatus != StatusNoError || lookupErr != nil {
 			if i == 0 {
 				// only have 1 result to return
@@ -235,9 +341,27 @@ func (r *Resolver) followingLookup(ctx context.Context, qWithMeta *QuestionWithM
 		populateResults(res.Answers, qWithMeta.Q.Type, candidateSet, cnameSet, dnameSet, garbage)
 		allAnswerSet = append(allAnswerSet, res.Answers...)
 
+		// check the aliases followed so far before going any further, a response can hold a whole chain
+		chain, isLoop := aliasChain(originalName, cnameSet, dnameSet, r.maxCNAMEDepth)
+		if isLoop {
+			copiedRes := *res
+			copiedRes.Answers = allAnswerSet
+			copiedRes.CNAMEChain = chain
+			return &copiedRes, trace, StatusCNAMELoop, fmt.Errorf("CNAME/DNAME loop: %s", strings.Join(chain, " -> "))
+		}
+		if len(chain)-1 > r.maxCNAMEDepth {
+			copiedRes := *res
+			copiedRes.Answers = allAnswerSet
+			copiedRes.CNAMEChain = chain
+			return &copiedRes, trace, StatusServFail, fmt.Errorf("CNAME/DNAME chain of %s is longer than %d aliases", originalName, r.maxCNAMEDepth)
+		}
+
 		if isLookupComplete(originalName, candidateSet, cnameSet, dnameSet) {
 			copiedRes := *res
 			copiedRes.Answers = allAnswerSet
+			if len(chain) > 1 {
+				copiedRes.CNAMEChain = chain
+			}
 			return &copiedRes, trace, StatusNoError, nil
 		}
 
@@ -269,6 +393,37 @@ func (r *Resolver) followingLookup(ctx context.Context, qWithMeta *QuestionWithM
 	return nil, trace, StatusServFail, errors.New("max recursion depth reached")
 }
 
+// aliasChain follows the CNAMEs and DNAMEs in cnameSet and dnameSet from name and returns the names along the way,
+// starting with name. If a name comes up twice, the chain is a loop and ends with the repeated name. Following stops
+// once the chain holds more than maxAliases aliases, so DNAMEs that keep growing the name can't go on forever.
+func aliasChain(name string, cnameSet, dnameSet map[string][]Answer, maxAliases int) (chain []string, isLoop bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	visited := make(map[string]struct{})
+	for len(chain) <= maxAliases+1 {
+		chain = append(chain, name)
+		if _, ok := visited[name]; ok {
+			return chain, true
+		}
+		visited[name] = struct{}{}
+		if candidates, ok := cnameSet[name]; ok && len(candidates) > 0 {
+			name = strings.ToLower(strings.TrimSuffix(candidates[0].Answer, "."))
+			continue
+		}
+		foundDNameMatch := false
+		for k, v := range dnameSet {
+			if strings.Contains(name, k) {
+				name = strings.Replace(name, k, strings.TrimSuffix(v[0].Answer, "."), 1)
+				foundDNameMatch = true
+				break
+			}
+		}
+		if !foundDNameMatch {
+			break
+		}
+	}
+	return chain, false
+}
+
 // isLookupComplete checks if there's a valid answer using the originalName and following CNAMES
 // An illustrative example of why this fn is needed, say we're doing an A lookup for foo.com. There exists a CNAME from
 // foo.com -> bar.com. Therefore, the candidate set will contain an A record for bar.com, and we need to ensure there's
@@ -315,24 +470,94 @@ func (r *Resolver) LookupAllNameserversExternal(q *Question, nameServers []NameS
 		nameServers = r.externalNameServers
 	}
 
-	for _, ns := range nameServers {
+	// each nameserver's lookup is kept by index, so results are reported in the order of nameServers
+	type nameServerLookup struct {
+		result  *SingleQueryResult
+		trace   Trace
+		status  Status
+		err     error
+		expired bool
+	}
+	lookups := make([]nameServerLookup, len(nameServers))
+	r.forEachNameServer(len(nameServers), func(res *Resolver, i int) {
 		if util.HasCtxExpired(ctx) {
+			lookups[i].expired = true
+			return
+		}
+		ns := nameServers[i]
+		l := &lookups[i]
+		l.result, l.trace, l.status, l.err = res.ExternalLookup(ctx, q, &ns)
+	})
+	for i, l := range lookups {
+		ns := nameServers[i]
+		if l.expired {
 			return retv, trace, StatusTimeout, ErrorContextExpired
 		}
-		result, currTrace, status, err := r.ExternalLookup(ctx, q, &ns)
-		trace = append(trace, currTrace...)
-		if err != nil {
-			log.Errorf("LookupAllNameserversExternal of name %s errored for %s/%s: %v", q.Name, ns.DomainName, ns.IP.String(), err)
+		trace = append(trace, l.trace...)
+		if l.err != nil {
+			log.Errorf("LookupAllNameserversExternal of name %s errored for %s/%s: %v", q.Name, ns.DomainName, ns.IP.String(), l.err)
 			continue
 		}
-		if status == StatusNoError {
-			retv = append(retv, *result)
+		if l.status == StatusNoError {
+			retv = append(retv, *l.result)
 			log.Debugf("LookupAllNameserversExternal of name %s succeeded for %s/%s", q.Name, ns.DomainName, ns.IP.String())
 		}
 	}
 	return retv, trace, StatusNoError, nil
 }
 
+// forEachNameServer calls f with the index of each of n nameservers and the resolver to query it with. With
+// AllNSConcurrency, up to that many nameservers are queried at once by helper resolvers, so a slow nameserver doesn't
+// hold up the others. Otherwise, they're queried one at a time by r.
+// f must only write state belonging to the index it's called with.
+func (r *Resolver) forEachNameServer(n int, f func(res *Resolver, i int)) {
+	workers := 0
+	if r.allNSConfig != nil {
+		workers = min(r.allNSConfig.AllNSConcurrency, n)
+	}
+	for len(r.allNSHelpers) < workers {
+		// each helper gets a seed of its own, drawn from r's, or they'd all make the same choices
+		helperConfig := *r.allNSConfig
+		helperConfig.Seed = r.rand.Int63()
+		helper, err := InitResolver(&helperConfig)
+		if err != nil {
+			log.Errorf("could not create resolver to query nameservers concurrently, querying them one at a time: %v", err)
+			workers = 0
+			break
+		}
+		r.allNSHelpers = append(r.allNSHelpers, helper)
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(r, i)
+		}
+		return
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for _, helper := range r.allNSHelpers[:workers] {
+		// the helpers validate on r's behalf, so they fetch DNSSEC records the way r would
+		helper.iterativeDNSSECFetches = r.iterativeDNSSECFetches
+		wg.Add(1)
+		go func(helper *Resolver) {
+			defer wg.Done()
+			for i := range indices {
+				f(helper, i)
+			}
+		}(helper)
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	// the helpers' queries are reported as this resolver's
+	for _, helper := range r.allNSHelpers[:workers] {
+		r.queriesSent += helper.queriesSent
+		helper.queriesSent = 0
+	}
+}
+
 // filterNameServersForUniqueNames will filter out duplicate nameservers based on the name.
 // Usually we'll have duplicates if a nameserver has both an IPv4 and IPv6 address. We'll use r.ipVersionMode and r.iterationIPPreference to determine which to keep.
 func (r *Resolver) filterNameServersForUniqueNames(nameServers []NameServer) []NameServer {
@@ -410,6 +635,11 @@ func (r *Resolver) LookupAllNameserversIterative(q *Question, rootNameServers []
 		// no root nameservers provided, use the resolver's root nameservers
 		currentLayerNameServers = r.rootNameServers
 	}
+	if r.shouldValidateDNSSEC {
+		// each nameserver's response is validated on its own, against keys found by iterating from the root
+		r.iterativeDNSSECFetches = true
+		defer func() { r.iterativeDNSSECFetches = false }()
+	}
 	originalQuestionType := q.Type
 	q.Type = dns.TypeNS
 	var layerResults []ExtendedResult
@@ -482,10 +712,28 @@ func (r *Resolver) LookupAllNameserversIterative(q *Question, rootNameServers []
 	} else {
 		retv.LayeredResponses[currentLayer] = append(retv.LayeredResponses[currentLayer], layerResults...)
 	}
+	retv.DNSSECInconsistent = dnssecStatusesDiffer(layerResults)
 
 	return &retv, trace, StatusNoError, nil
 }
 
+// dnssecStatusesDiffer returns true if the responses of the nameservers in results didn't all validate the same way,
+// ex. one secondary serving unsigned data while the others are Secure
+func dnssecStatusesDiffer(results []ExtendedResult) bool {
+	var first DNSSECStatus
+	for _, res := range results {
+		if res.DNSSECStatus == "" {
+			continue
+		}
+		if first == "" {
+			first = res.DNSSECStatus
+		} else if res.DNSSECStatus != first {
+			return true
+		}
+	}
+	return false
+}
+
 // extractNameServersFromLayerResults
 // extracts unique nameservers from Additionals/Authorities. Uniques by nameserver name, not by IP
 func (r *Resolver) extractNameServersFromLayerResults(layerResults []ExtendedResult) ([]NameServer, error) {
@@ -639,50 +887,79 @@ func (r *Resolver) populateNameServerIP(ctx context.Context, nameServer *NameSer
 // queryAllNameServersInLayer queries all nameservers in a given layer
 // Returns a slice of ExtendedResults from each NS, a Trace, whether any answer is authoritative, and an error if one occurs
 func (r *Resolver) queryAllNameServersInLayer(ctx context.Context, perNameServerRetriesLimit int, q *Question, currentNameServers []NameServer) ([]ExtendedResult, Trace, bool, error) {
+	type nameServerQuery struct {
+		extResult       *ExtendedResult
+		trace           Trace
+		isAuthoritative bool
+		expired         bool
+	}
+	queries := make([]nameServerQuery, len(currentNameServers))
+	r.forEachNameServer(len(currentNameServers), func(res *Resolver, i int) {
+		nsQuery := &queries[i]
+		nsQuery.extResult, nsQuery.trace, nsQuery.isAuthoritative, nsQuery.expired = res.queryNameServerInLayer(ctx, perNameServerRetriesLimit, q, currentNameServers[i])
+	})
 	trace := make([]TraceStep, 0)
 	currentLayerResults := make([]ExtendedResult, 0, len(currentNameServers))
 	isAuthoritative := false
-	for _, nameServer := range currentNameServers {
-		var extResult *ExtendedResult
-		for retry := 0; retry < perNameServerRetriesLimit; retry++ {
-			if util.HasCtxExpired(ctx) {
-				return currentLayerResults, trace, false, ErrorContextExpired
-			}
-			if nameServer.IP == nil {
-				nsTrace, err := r.populateNameServerIP(ctx, &nameServer)
-				if err != nil {
-					log.Debugf("LookupAllNameserversIterative of name %s errored for %s: %v", q.Name, nameServer.DomainName, err)
-					continue
-				}
-				trace = append(trace, nsTrace...)
-				// we've populated NS IP, we can proceed
-			}
-			result, currTrace, status, err := r.ExternalLookup(ctx, q, &nameServer)
-			trace = append(trace, currTrace...)
-			extResult = &ExtendedResult{Status: status, Nameserver: nameServer.DomainName, Type: dns.TypeToString[q.Type]}
-			if result != nil {
-				extResult.Res = *result
-			}
-			if err == nil && status == StatusNoError && result != nil {
-				if result.Flags.Authoritative {
-					isAuthoritative = true
-				}
-				// successful result, continue to next nameserver
-				break
-			}
+	expired := false
+	for i, nsQuery := range queries {
+		trace = append(trace, nsQuery.trace...)
+		if nsQuery.expired {
+			expired = true
+			continue
+		}
+		if nsQuery.extResult == nil {
+			log.Debugf("LookupAllNameserversIterative of name %s against nameserver %s ran out of retries, continueing to next nameserver", q.Name, currentNameServers[i].IP.String())
+			continue
+		}
+		currentLayerResults = append(currentLayerResults, *nsQuery.extResult)
+		isAuthoritative = isAuthoritative || nsQuery.isAuthoritative
+	}
+	if expired {
+		return currentLayerResults, trace, false, ErrorContextExpired
+	}
+	return currentLayerResults, trace, isAuthoritative, nil
+}
+
+// queryNameServerInLayer queries a single nameserver of a layer, retrying up to perNameServerRetriesLimit times
+// Returns the last ExtendedResult from the NS (nil if there was none), a Trace, whether the answer is authoritative,
+// and whether the context expired before the NS could be queried successfully
+func (r *Resolver) queryNameServerInLayer(ctx context.Context, perNameServerRetriesLimit int, q *Question, nameServer NameServer) (*ExtendedResult, Trace, bool, bool) {
+	var trace Trace
+	var extResult *ExtendedResult
+	for retry := 0; retry < perNameServerRetriesLimit; retry++ {
+		if util.HasCtxExpired(ctx) {
+			return nil, trace, false, true
+		}
+		if nameServer.IP == nil {
+			nsTrace, err := r.populateNameServerIP(ctx, &nameServer)
 			if err != nil {
-				log.Debugf("LookupAllNameserversIterative of name %s errored for %s: %v", q.Name, nameServer.IP.String(), err)
-			} else {
-				log.Debugf("LookupAllNameserversIterative of name %s failed for %s: %v", q.Name, nameServer.IP.String(), status)
+				log.Debugf("LookupAllNameserversIterative of name %s errored for %s: %v", q.Name, nameServer.DomainName, err)
+				continue
+			}
+			trace = append(trace, nsTrace...)
+			// we've populated NS IP, we can proceed
+		}
+		result, currTrace, status, err := r.ExternalLookup(ctx, q, &nameServer)
+		trace = append(trace, currTrace...)
+		extResult = &ExtendedResult{Status: status, Nameserver: nameServer.DomainName, Type: dns.TypeToString[q.Type]}
+		if result != nil {
+			extResult.Res = *result
+			if result.DNSSECResult != nil {
+				extResult.DNSSECStatus = result.DNSSECResult.Status
 			}
 		}
-		if extResult == nil {
-			log.Debugf("LookupAllNameserversIterative of name %s against nameserver %s ran out of retries, continueing to next nameserver", q.Name, nameServer.IP.String())
+		if err == nil && status == StatusNoError && result != nil {
+			// successful result, continue to next nameserver
+			return extResult, trace, result.Flags.Authoritative, false
+		}
+		if err != nil {
+			log.Debugf("LookupAllNameserversIterative of name %s errored for %s: %v", q.Name, nameServer.IP.String(), err)
 		} else {
-			currentLayerResults = append(currentLayerResults, *extResult)
+			log.Debugf("LookupAllNameserversIterative of name %s failed for %s: %v", q.Name, nameServer.IP.String(), status)
 		}
 	}
-	return currentLayerResults, trace, isAuthoritative, nil
+	return extResult, trace, false, false
 }
 
 func (r *Resolver) iterativeLookup(ctx context.Context, qWithMeta *QuestionWithMetadata, nameServers []NameServer,
@@ -696,11 +973,24 @@ func (r *Resolver) iterativeLookup(ctx context.Context, qWithMeta *QuestionWithM
 		r.verboseLog(depth+1, "-> Context expired")
 		return nil, trace, StatusTimeout, nil
 	}
+	if r.qnameMinimization {
+		if minimizedName, ok := minimizedQueryName(qWithMeta.Q.Name, layer); ok {
+			return r.minimizedIterativeLookup(ctx, qWithMeta, minimizedName, nameServers, depth, layer, trace)
+		}
+	}
+	return r.fullNameIterativeLookup(ctx, qWithMeta, nameServers, depth, layer, trace)
+}
+
+// iterationStep sends q to one of nameServers as a single step of an iterative lookup, and records it in the trace
+func (r *Resolver) iterationStep(ctx context.Context, qWithMeta *QuestionWithMetadata, nameServers []NameServer, depth int, layer string, trace Trace) (*SingleQueryResult, Trace, Status, error) {
 	// create iteration context for this iteration step
 	iterationStepCtx, cancel := context.WithTimeout(ctx, r.iterativeTimeout)
 	defer cancel()
+	stepStart := time.Now()
 	result, isCached, status, trace, err := r.cyclingLookup(iterationStepCtx, qWithMeta, nameServers, layer, depth, false, trace)
-	if status == StatusNoError && result != nil {
+	stepDuration := time.Since(stepStart)
+	isLame := isLameResponse(result, status, layer)
+	if (status == StatusNoError || isLame) && result != nil {
 		var t TraceStep
 		t.Result = *result
 		t.NameServer = result.Resolver
@@ -711,7 +1001,31 @@ func (r *Resolver) iterativeLookup(ctx context.Context, qWithMeta *QuestionWithM
 		t.Depth = depth
 		t.Cached = isCached
 		t.Try = getTryNumber(r.retries, *qWithMeta.RetriesRemaining)
+		t.Lame = isLame
+		t.DurationMS = DurationMS(stepDuration)
 		trace = append(trace, t)
+	} else if status != StatusNoError {
+		// failed steps are traced with their status, delegations that time out are the ones worth timing
+		t := TraceStep{
+			DNSType:    qWithMeta.Q.Type,
+			DNSClass:   qWithMeta.Q.Class,
+			Name:       qWithMeta.Q.Name,
+			Layer:      layer,
+			Depth:      depth,
+			Cached:     isCached,
+			Try:        getTryNumber(r.retries, *qWithMeta.RetriesRemaining),
+			Status:     status,
+			DurationMS: DurationMS(stepDuration),
+		}
+		if result != nil {
+			t.Result = *result
+			t.NameServer = result.Resolver
+		}
+		trace = append(trace, t)
+	}
+	if isLame {
+		r.verboseLog(depth+2, "LAME_DELEGATION ", result.Resolver, " doesn't serve ", layer, ", status: ", status)
+		return result, trace, StatusLameDelegation, nil
 	}
 	if status == StatusTimeout && util.HasCtxExpired(iterationStepCtx) && !util.HasCtxExpired(ctx) {
 		// ctx's have a deadline of the minimum of their deadline and their parent's
@@ -720,6 +1034,44 @@ func (r *Resolver) iterativeLookup(ctx context.Context, qWithMeta *QuestionWithM
 		r.verboseLog(depth+2, "ITERATIVE_TIMEOUT ", qWithMeta, ", Layer: ", layer)
 		status = StatusIterTimeout
 	}
+	return result, trace, status, err
+}
+
+// minimizedIterativeLookup performs a step of an iterative lookup with QNAME minimization, RFC 7816. Instead of the
+// full name, the name servers of layer are only asked for the NS records of minimizedName, the name one label below
+// layer. A referral is followed as usual. An authoritative answer, whether it has NS records or is a NODATA for an
+// empty non-terminal, means the same name servers serve the next label too, so we continue with them. Anything
+// else, ex. a NXDOMAIN or NODATA from a server that doesn't handle minimized queries well, falls back to sending the
+// full name at this layer.
+func (r *Resolver) minimizedIterativeLookup(ctx context.Context, qWithMeta *QuestionWithMetadata, minimizedName string, nameServers []NameServer, depth int, layer string, trace Trace) (*SingleQueryResult, Trace, Status, error) {
+	minimizedQ := QuestionWithMetadata{
+		Q:                Question{Name: minimizedName, Type: dns.TypeNS, Class: qWithMeta.Q.Class},
+		RetriesRemaining: qWithMeta.RetriesRemaining,
+	}
+	r.verboseLog(depth+1, "QNAME minimization: querying ", minimizedName, " instead of ", qWithMeta.Q.Name, ", Layer: ", layer)
+	result, trace, status, err := r.iterationStep(ctx, &minimizedQ, nameServers, depth, layer, trace)
+	switch {
+	case status == StatusTimeout || status == StatusIterTimeout || status == StatusLameDelegation:
+		return result, trace, status, err
+	case status != StatusNoError || err != nil:
+		r.verboseLog(depth+1, "-> minimized query failed with status ", status, ", falling back to the full name")
+	case len(result.Answers) == 0 && !result.Flags.Authoritative && hasNSRecord(result.Authorities):
+		r.verboseLog(depth+1, "-> Authority found for minimized query, iterating")
+		return r.iterateOnAuthorities(ctx, qWithMeta, depth, result, layer, trace)
+	case result.Flags.Authoritative:
+		r.verboseLog(depth+1, "-> ", minimizedName, " is served by the same name servers, continuing with the next label")
+		// the layer grows by a label each time, so this is bounded by the length of the name
+		return r.iterativeLookup(ctx, qWithMeta, nameServers, depth, minimizedName, trace)
+	default:
+		r.verboseLog(depth+1, "-> unexpected response to minimized query, falling back to the full name")
+	}
+	return r.fullNameIterativeLookup(ctx, qWithMeta, nameServers, depth, layer, trace)
+}
+
+// fullNameIterativeLookup performs a step of an iterative lookup by sending the full question to the name servers of
+// layer, following any referral
+func (r *Resolver) fullNameIterativeLookup(ctx context.Context, qWithMeta *QuestionWithMetadata, nameServers []NameServer, depth int, layer string, trace Trace) (*SingleQueryResult, Trace, Status, error) {
+	result, trace, status, err := r.iterationStep(ctx, qWithMeta, nameServers, depth, layer, trace)
 	if status != StatusNoError || err != nil {
 		r.verboseLog((depth + 1), "-> error occurred during lookup")
 		return result, trace, status, err
@@ -775,8 +1127,9 @@ func (r *Resolver) cyclingLookup(ctx context.Context, qWithMeta *QuestionWithMet
 			return &SingleQueryResult{}, false, StatusTimeout, trace, nil
 		}
 		// get random unqueried nameserver
-		nameServer, queriedNameServers = getRandomNonQueriedNameServer(nameServers, queriedNameServers)
+		nameServer, queriedNameServers = getRandomNonQueriedNameServer(nameServers, queriedNameServers, r.rand)
 		// perform the lookup
+		attemptStart := time.Now()
 		result, isCached, status, trace, err = r.cachedLookup(ctx, qWithMeta.Q, nameServer, layer, depth, recursionDesired, cacheBasedOnNameServer, cacheNonAuthoritative, trace)
 		if status == StatusNoError {
 			r.verboseLog(depth+1, "Cycling lookup successful. Name: ", qWithMeta.Q.Name, ", Layer: ", layer, ", Nameserver: ", nameServer)
@@ -784,21 +1137,58 @@ func (r *Resolver) cyclingLookup(ctx context.Context, qWithMeta *QuestionWithMet
 		} else if *qWithMeta.RetriesRemaining == 0 {
 			r.verboseLog(depth+1, "Cycling lookup failed - out of retries. Name: ", qWithMeta.Q.Name, ", Layer: ", layer, ", Nameserver: ", nameServer)
 			return result, isCached, status, trace, errors.New("cycling lookup failed - out of retries")
-		} else if !isStatusRetryable(status) {
+		} else if !isStatusRetryable(status) || (status == StatusServFail && r.noRetryServFail) {
 			r.verboseLog(depth+1, "Cycling lookup failed - unretryable status:", status, "Name: ", qWithMeta.Q.Name, ", Layer: ", layer, ", Nameserver: ", nameServer)
 			return result, isCached, status, trace, err
 		}
+		if recursionDesired {
+			// external lookups only trace the final answer, so record each failed attempt as it's retried
+			trace = append(trace, failedAttemptTraceStep(qWithMeta, nameServer, result, isCached, status, getTryNumber(r.retries, *qWithMeta.RetriesRemaining), time.Since(attemptStart)))
+			if status == StatusServFail && len(r.servFailPool) > 0 {
+				// another resolver may not share the upstream failure, the one that failed is skipped as it's been queried
+				nameServers = r.circuitBreaker.available(r.servFailPool)
+			}
+		}
 
 		r.verboseLog(depth+1, "Cycling lookup failed with status:", status, "err: ", err, ", using a retry. Retries remaining: ", *qWithMeta.RetriesRemaining, " , Name: ", qWithMeta.Q.Name, ", Layer: ", layer, ", Nameserver: ", nameServer)
 		*qWithMeta.RetriesRemaining--
+		r.metrics.recordRetry()
+		if r.retryBackoff > 0 && shouldBackOff(status) {
+			delay := retryBackoffDelay(r.retryBackoff, getTryNumber(r.retries, *qWithMeta.RetriesRemaining)-1, r.rand)
+			r.verboseLog(depth+1, "Backing off for ", delay, " before retrying. Name: ", qWithMeta.Q.Name, ", Layer: ", layer)
+			if !sleepCtx(ctx, delay) {
+				// waiting out the backoff would take us past the lookup's timeout
+				return &SingleQueryResult{}, false, StatusTimeout, trace, errors.New("lookup timed out while backing off before a retry")
+			}
+		}
 	}
 	return &SingleQueryResult{}, false, StatusError, trace, errors.New("cycling lookup function did not exit properly")
 }
 
+// failedAttemptTraceStep returns the trace step of an external lookup attempt that's about to be retried
+func failedAttemptTraceStep(qWithMeta *QuestionWithMetadata, nameServer *NameServer, result *SingleQueryResult, isCached IsCached, status Status, try int, duration time.Duration) TraceStep {
+	t := TraceStep{
+		DNSType:    qWithMeta.Q.Type,
+		DNSClass:   qWithMeta.Q.Class,
+		Name:       qWithMeta.Q.Name,
+		NameServer: nameServer.String(),
+		Layer:      qWithMeta.Q.Name,
+		Depth:      1,
+		Cached:     isCached,
+		Try:        try,
+		Status:     status,
+		DurationMS: DurationMS(duration),
+	}
+	if result != nil {
+		t.Result = *result
+	}
+	return t
+}
+
 // getRandomNonQueriedNameServer returns a random name server from the list of name servers that has not been queried yet
 // If all have been queried, it resets the queriedNameServers map and returns a random name server
-func getRandomNonQueriedNameServer(nameServers []NameServer, queriedNameServers map[string]struct{}) (*NameServer, map[string]struct{}) {
-	for _, i := range rand.Perm(len(nameServers)) {
+func getRandomNonQueriedNameServer(nameServers []NameServer, queriedNameServers map[string]struct{}, rnd *lockedRand) (*NameServer, map[string]struct{}) {
+	for _, i := range rnd.Perm(len(nameServers)) {
 		if _, ok := queriedNameServers[nameServers[i].String()]; !ok {
 			// set the nameserver as queried
 			queriedNameServers[nameServers[i].String()] = struct{}{}
@@ -808,7 +1198,7 @@ func getRandomNonQueriedNameServer(nameServers []NameServer, queriedNameServers
 	// all have been queried, reset queriedNameServers
 	queriedNameServers = make(map[string]struct{}, len(nameServers))
 	// return a random one
-	return getRandomNonQueriedNameServer(nameServers, queriedNameServers)
+	return getRandomNonQueriedNameServer(nameServers, queriedNameServers, rnd)
 }
 
 // cachedLookup performs a DNS lookup with caching
@@ -834,10 +1224,6 @@ func (r *Resolver) cachedLookup(ctx context.Context, q Question, nameServer *Nam
 	if isValid, reason := nameServer.IsValid(); !isValid {
 		return &SingleQueryResult{}, false, StatusIllegalInput, trace, fmt.Errorf("invalid nameserver (%s): %s", nameServer.String(), reason)
 	}
-	// create a context for this network lookup
-	lookupCtx, cancel := context.WithTimeout(ctx, r.networkTimeout)
-	defer cancel()
-
 	// For some lookups, we want them to be nameserver specific, ie. if cacheBasedOnNameServer is true
 	// Else, we don't care which nameserver returned it
 	cacheNameServer := nameServer
@@ -845,7 +1231,12 @@ func (r *Resolver) cachedLookup(ctx context.Context, q Question, nameServer *Nam
 		cacheNameServer = nil
 	}
 	// First, we check the cache
-	cachedResult, ok := r.cache.GetCachedResults(q, cacheNameServer, depth+1)
+	var cachedResult *SingleQueryResult
+	var cachedStatus Status
+	var ok bool
+	if !r.bypassCache {
+		cachedResult, cachedStatus, ok = r.cache.GetCachedResultsWithStatus(q, cacheNameServer, depth+1)
+	}
 	if ok {
 		isCached = true
 		// set protocol on the result
@@ -859,7 +1250,7 @@ func (r *Resolver) cachedLookup(ctx context.Context, q Question, nameServer *Nam
 			// default to UDP
 			cachedResult.Protocol = UDPProtocol
 		}
-		return cachedResult, isCached, StatusNoError, trace, nil
+		return cachedResult, isCached, cachedStatus, trace, nil
 	}
 
 	// Stop if we hit a nameserver we don't want to hit
@@ -915,34 +1306,121 @@ func (r *Resolver) cachedLookup(ctx context.Context, q Question, nameServer *Nam
 	if connInfo == nil {
 		return &SingleQueryResult{}, false, StatusError, trace, fmt.Errorf("no connection info for nameserver: %s", nameServer)
 	}
+	// set again by the transports that keep the response as it was received
+	connInfo.rawResponse = nil
+	connInfo.connectTime = 0
+	// wait on the lookup's context, so time spent rate limited doesn't count against the network timeout
+	if err = r.waitForRateLimits(ctx, nameServer); err != nil {
+		return &SingleQueryResult{}, false, StatusTimeout, trace, err
+	}
+	// create a context for this network lookup, its round trips get their own network timeout within the query timeout
+	queryTimeout := r.networkTimeout
+	if r.queryTimeout > 0 {
+		queryTimeout = r.queryTimeout
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	roundTripCtx, cancelRoundTrip := r.roundTripCtx(lookupCtx)
+	defer cancelRoundTrip()
+	m := r.newQueryMsg(q, requestIteration)
+	if r.cookies != nil {
+		r.cookies.addCookie(m, nameServer)
+	}
+	if r.ednsPadding > 0 && (r.dnsOverTLSEnabled || r.dnsOverHTTPSEnabled || r.padPlaintext) {
+		padQuery(m, r.ednsPadding)
+	}
+	r.queriesSent++
+	wireStart := time.Now()
+	// time between wireStart and the response that isn't the round trip of a query, left out of the RTT sample
+	var notRTT time.Duration
 	var result *SingleQueryResult
 	var rawResp *dns.Msg
 	var status Status
 	if r.dnsOverHTTPSEnabled {
 		r.verboseLog(depth, "****WIRE LOOKUP*** ", DoHProtocol, " ", dns.TypeToString[q.Type], " ", q.Name, " ", nameServer)
-		result, rawResp, status, err = doDoHLookup(lookupCtx, connInfo.httpsClient, q, nameServer, requestIteration, r.ednsOptions, r.dnsSecEnabled, r.checkingDisabledBit)
+		result, rawResp, status, err = doDoHLookup(roundTripCtx, connInfo, m, nameServer)
 	} else if r.dnsOverTLSEnabled {
 		r.verboseLog(depth, "****WIRE LOOKUP*** ", DoTProtocol, " ", dns.TypeToString[q.Type], " ", q.Name, " ", nameServer)
-		result, rawResp, status, err = doDoTLookup(lookupCtx, connInfo, q, nameServer, r.rootCAs, r.verifyServerCert, requestIteration, r.ednsOptions, r.dnsSecEnabled, r.checkingDisabledBit)
+		result, rawResp, status, err = doDoTLookup(roundTripCtx, connInfo, m, nameServer, r.tlsServerName, r.rootCAs, r.verifyServerCert)
 	} else if connInfo.udpClient != nil {
 		r.verboseLog(depth, "****WIRE LOOKUP*** ", UDPProtocol, " ", dns.TypeToString[q.Type], " ", q.Name, " ", nameServer)
-		result, rawResp, status, err = wireLookupUDP(lookupCtx, connInfo, q, nameServer, r.ednsOptions, requestIteration, r.dnsSecEnabled, r.checkingDisabledBit)
-		if status == StatusTruncated && connInfo.tcpClient != nil {
+		// retransmits are queries too as far as the rate limits go
+		waitToRetransmit := func() error {
+			waitStart := time.Now()
+			defer func() { notRTT += time.Since(waitStart) }()
+			return r.waitForRateLimits(ctx, nameServer)
+		}
+		result, rawResp, status, err = wireLookupUDP(roundTripCtx, connInfo, m, nameServer, r.udpRetransmits, r.udpRetransmitInterval, waitToRetransmit)
+		if status == StatusTruncated && connInfo.tcpClient != nil && (r.transportMode != UDPOnly || q.Type == dns.TypeTXT) {
 			// result truncated, try again with TCP
+			waitStart := time.Now()
+			if err = r.waitForRateLimits(ctx, nameServer); err != nil {
+				return &SingleQueryResult{}, false, StatusTimeout, trace, err
+			}
+			notRTT += time.Since(waitStart)
+			r.queriesSent++
 			r.verboseLog(depth, "****WIRE LOOKUP*** ", TCPProtocol, " ", dns.TypeToString[q.Type], " ", q.Name, " ", nameServer)
-			result, rawResp, status, err = wireLookupTCP(lookupCtx, connInfo, q, nameServer, r.ednsOptions, requestIteration, r.dnsSecEnabled, r.checkingDisabledBit)
+			connInfo.rawResponse = nil
+			tcpCtx, cancelTCP := r.roundTripCtx(lookupCtx)
+			result, rawResp, status, err = wireLookupTCP(tcpCtx, connInfo, m, nameServer)
+			cancelTCP()
+			if result != nil {
+				result.TCPFallback = true
+			}
 		}
 	} else if connInfo.tcpClient != nil {
 		r.verboseLog(depth, "****WIRE LOOKUP*** ", TCPProtocol, " ", dns.TypeToString[q.Type], " ", q.Name, " ", nameServer)
-		result, rawResp, status, err = wireLookupTCP(lookupCtx, connInfo, q, nameServer, r.ednsOptions, requestIteration, r.dnsSecEnabled, r.checkingDisabledBit)
+		result, rawResp, status, err = wireLookupTCP(roundTripCtx, connInfo, m, nameServer)
 	} else {
 		return &SingleQueryResult{}, false, StatusError, trace, errors.New("no connection info for nameserver")
 	}
+	r.metrics.recordQuery(status)
+	if r.nameServerSelector != nil && requestIteration {
+		if status == StatusTimeout {
+			r.nameServerSelector.recordRTT(nameServer, r.networkTimeout)
+		} else if err == nil {
+			r.nameServerSelector.recordRTT(nameServer, time.Since(wireStart)-notRTT-connInfo.connectTime)
+		}
+	}
+	if requestIteration {
+		r.circuitBreaker.recordResult(nameServer, status == StatusTimeout || status == StatusError)
+	}
 
 	if err != nil {
 		return &SingleQueryResult{}, isCached, status, trace, errors.Wrap(err, "could not perform lookup")
 	}
+	if rawResp != nil && !responseQuestionMatches(m, rawResp) {
+		// don't trust anything in a response to a different question
+		r.verboseLog(depth+2, "Response question ", rawResp.Question, " does not match query ", m.Question, " from nameserver ", nameServer)
+		return &SingleQueryResult{Resolver: nameServer.String()}, false, StatusQuestionMismatch, trace, fmt.Errorf("response question %v does not match query %v", rawResp.Question, m.Question)
+	}
 	if result != nil {
+		result.QuerySize = newQuerySize(m)
+		if rawResp != nil {
+			result.ResponseSize = responseSize(connInfo.rawResponse, rawResp)
+		}
+		if r.includeRawResponse && rawResp != nil {
+			result.RawResponse = encodeRawResponse(connInfo.rawResponse, rawResp)
+		}
+		if r.separateUnrelatedAnswers && status == StatusNoError && rawResp != nil {
+			separateUnrelatedAnswers(result, m.Question[0], rawResp)
+		}
+		if r.reportCNAMETargetNXDomain && status == StatusNXDomain && rawResp != nil {
+			status = markCNAMETargetNXDomain(result, m.Question[0], rawResp)
+		}
+		if r.detectCNAMEViolations && rawResp != nil {
+			result.CNAMEViolations = findCNAMEViolations(rawResp)
+		}
+		if rawResp != nil {
+			result.Zone = findZoneCut(m.Question[0], rawResp)
+		}
+		// requestIteration is set on queries with the RD bit, to recursive resolvers
+		if !requestIteration && layer != "" {
+			result.OutOfBailiwick = checkBailiwick(result, layer, r.stripOutOfBailiwick)
+		}
+		if r.cookies != nil && rawResp != nil {
+			result.Cookie = r.cookies.recordCookie(rawResp, nameServer)
+		}
 		r.verboseLog(depth+2, "Results from wire for name: ", q, ", Layer: ", layer, ", Nameserver: ", nameServer, " status: ", status, " , err: ", err, " result: ", *result)
 	}
 
@@ -953,68 +1431,137 @@ func (r *Resolver) cachedLookup(ctx context.Context, q Question, nameServer *Nam
 		}
 
 		// only cache answers that don't have errors and pass DNSSEC validation
-		if !r.shouldValidateDNSSEC || result.DNSSECResult.Status != DNSSECBogus {
+		if r.bypassCache {
+			r.verboseLog(depth+2, "skipping cache for domain", q.Name, "and type", dns.TypeToString[q.Type], "since the cache is bypassed for this lookup")
+		} else if !r.shouldValidateDNSSEC || result.DNSSECResult.Status != DNSSECBogus {
 			if !requestIteration && strings.ToLower(q.Name) != layer && authName != layer && !result.Flags.Authoritative { // TODO - how to detect if we've retrieved an authority record or a answer record? maybe add q.Name != authName
 				r.verboseLog(depth+2, "Cache auth upsert for ", authName)
 				r.cache.SafeAddCachedAuthority(result, cacheNameServer, depth+2, layer)
+			} else if len(result.Answers) == 0 && result.Flags.Authoritative {
+				// NODATA, the name exists but has no records of this type
+				r.cache.SafeAddCachedNegativeAnswer(q, result, cacheNameServer, layer, status, depth+2)
 			} else {
 				r.cache.SafeAddCachedAnswer(q, result, cacheNameServer, layer, depth+2, cacheNonAuthoritative)
 			}
 		} else {
 			r.verboseLog(depth+2, "skipping cache for domain", q.Name, "and type", dns.TypeToString[q.Type], "due to DNSSEC bogus status")
 		}
+	} else if r.shouldValidateDNSSEC && (status == StatusNXDomain || status == StatusCNAMETargetNXDomain) && result != nil && rawResp != nil {
+		// NXDOMAIN answers are validated for a proof of non-existence
+		result.DNSSECResult, trace = r.validator.validate(layer, rawResp, nameServer, depth+2, trace)
 	} else if r.shouldValidateDNSSEC {
 		result.DNSSECResult = makeDNSSECResult()
 	}
+	if status == StatusNXDomain && result != nil && !r.bypassCache && (!r.shouldValidateDNSSEC || result.DNSSECResult.Status != DNSSECBogus) {
+		r.cache.SafeAddCachedNegativeAnswer(q, result, cacheNameServer, layer, status, depth+2)
+	}
 
 	return result, isCached, status, trace, err
 }
 
-func doDoTLookup(ctx context.Context, connInfo *ConnectionInfo, q Question, nameServer *NameServer, rootCAs *x509.CertPool, shouldVerifyServerCert, recursive bool, ednsOptions []dns.EDNS0, dnssec bool, checkingDisabled bool) (*SingleQueryResult, *dns.Msg, Status, error) {
+// roundTripCtx returns the context of one network round trip of a query, given the query's context. With a query
+// timeout, each round trip gets its own network timeout within it, otherwise they share the query's network timeout.
+func (r *Resolver) roundTripCtx(lookupCtx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return lookupCtx, func() {}
+	}
+	return context.WithTimeout(lookupCtx, r.networkTimeout)
+}
+
+// waitForRateLimits blocks until both the global and the per-name server rate limits, if any, allow a query to nameServer
+func (r *Resolver) waitForRateLimits(ctx context.Context, nameServer *NameServer) error {
+	if r.rateLimiter != nil {
+		if err := r.rateLimiter.Wait(ctx); err != nil {
+			return fmt.Errorf("waiting to send a query: %w", err)
+		}
+	}
+	if r.nameServerRateLimiter != nil {
+		return r.nameServerRateLimiter.Wait(ctx, nameServer)
+	}
+	return nil
+}
+
+// newQueryMsg builds the outbound query for q using the resolver's EDNS, DNSSEC, RD-bit, CD-bit and compression settings
+func (r *Resolver) newQueryMsg(q Question, recursive bool) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetQuestion(dotName(q.Name), q.Type)
 	m.Question[0].Qclass = q.Class
-	m.RecursionDesired = recursive
-	m.CheckingDisabled = checkingDisabled
-	m.Id = 12345
+	m.RecursionDesired = recursive && !r.recursionDisabled
+	m.CheckingDisabled = r.checkingDisabledBit
+	m.Compress = r.compressQueries
 
-	m.SetEdns0(1232, dnssec)
+	m.SetEdns0(r.udpBufferSize, r.dnsSecEnabled)
 	if ednsOpt := m.IsEdns0(); ednsOpt != nil {
-		ednsOpt.Option = append(ednsOpt.Option, ednsOptions...)
+		ednsOpt.Option = append(ednsOpt.Option, r.ednsOptions...)
 	}
+	return m
+}
 
-	// if tlsConn is nil or if this is a new nameserver, create a new connection
-	var isConnNew bool
-	if connInfo.tlsConn != nil {
-		newRemoteAddr := net.TCPAddr{IP: nameServer.IP, Port: int(nameServer.Port)}
-		prevRemoteAddr := connInfo.tlsConn.Conn.RemoteAddr().String()
-		if prevRemoteAddr != newRemoteAddr.String() {
-			isConnNew = true
-		}
+// padQuery appends an EDNS0 padding option to m, sized so the packed message is a multiple of blockSize bytes, RFC 7830.
+// It must be called after every other option is attached, since they count towards the size.
+func padQuery(m *dns.Msg, blockSize int) {
+	opt := m.IsEdns0()
+	if opt == nil || blockSize <= 0 {
+		return
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	// the size includes the padding option's 4 byte header, so only its data is left to fill
+	if remainder := m.Len() % blockSize; remainder != 0 {
+		padding.Padding = make([]byte, blockSize-remainder)
 	}
-	if connInfo.tlsConn == nil || isConnNew {
+}
+
+// newQuerySize reports the wire size of the query m, both with and without name compression
+func newQuerySize(m *dns.Msg) *QuerySize {
+	compress := m.Compress
+	defer func() { m.Compress = compress }()
+	m.Compress = true
+	compressed := m.Len()
+	m.Compress = false
+	uncompressed := m.Len()
+	sent := uncompressed
+	if compress {
+		sent = compressed
+	}
+	return &QuerySize{Sent: sent, Compressed: compressed, Uncompressed: uncompressed}
+}
+
+func doDoTLookup(ctx context.Context, connInfo *ConnectionInfo, m *dns.Msg, nameServer *NameServer, serverName string, rootCAs *x509.CertPool, shouldVerifyServerCert bool) (*SingleQueryResult, *dns.Msg, Status, error) {
+	m.Id = 12345
+
+	// re-use the connection to this nameserver if there is one, otherwise create a new connection
+	addr := nameServer.String()
+	c, ok := connInfo.tlsConns[addr]
+	if !ok {
+		connectStart := time.Now()
 		// new connection
 		// Custom dialer with local address binding
 		dialer := &net.Dialer{
 			LocalAddr: &net.TCPAddr{
 				IP:   connInfo.localAddr,
 				Port: 0,
+				Zone: connInfo.localZone,
 			},
 		}
-		tcpConn, err := dialer.DialContext(ctx, "tcp", nameServer.String())
+		tcpConn, err := dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
-			return nil, nil, StatusError, errors.Wrap(err, "could not connect to server")
+			return nil, nil, StatusError, errors.Wrapf(err, "could not connect to server, %s may not support DNS over TLS", nameServer)
+		}
+		if serverName == "" {
+			serverName = nameServer.DomainName
 		}
 		// Now wrap the connection with TLS
 		tlsConn := tls.Client(tcpConn, &tls.Config{
 			InsecureSkipVerify: true,
+			ServerName:         serverName,
 		})
 		if shouldVerifyServerCert {
 			// if we're verifying the server cert, we need to pass in the root CAs
 			tlsConn = tls.Client(tcpConn, &tls.Config{
 				RootCAs:            rootCAs,
 				InsecureSkipVerify: false,
-				ServerName:         nameServer.DomainName,
+				ServerName:         serverName,
 			})
 		}
 		err = tlsConn.Handshake()
@@ -1023,19 +1570,38 @@ func doDoTLookup(ctx context.Context, connInfo *ConnectionInfo, q Question, name
 			if closeErr != nil {
 				log.Errorf("error closing TLS connection: %v", err)
 			}
-			return nil, nil, StatusError, errors.Wrap(err, "could not perform TLS handshake")
+			return nil, nil, StatusError, errors.Wrapf(err, "could not perform TLS handshake with %s, it may not support DNS over TLS", nameServer)
+		}
+		if connInfo.tlsConns == nil {
+			connInfo.tlsConns = make(map[string]*tlsConnection)
 		}
-		connInfo.tlsHandshake = tlsConn.GetHandshakeLog()
-		connInfo.tlsConn = &dns.Conn{Conn: tlsConn}
+		if len(connInfo.tlsConns) >= maxTLSConns {
+			for oldAddr := range connInfo.tlsConns {
+				connInfo.closeTLSConn(oldAddr)
+				break
+			}
+		}
+		c = &tlsConnection{conn: &dns.Conn{Conn: tlsConn}, handshake: tlsConn.GetHandshakeLog()}
+		connInfo.tlsConns[addr] = c
+		connInfo.connectTime = time.Since(connectStart)
 	}
+	connInfo.tlsConn, connInfo.tlsHandshake = c.conn, c.handshake
 	err := connInfo.tlsConn.WriteMsg(m)
 	if err != nil {
+		// the connection may have been closed by the server, the next lookup opens a new one
+		connInfo.closeTLSConn(addr)
 		return nil, nil, "", errors.Wrap(err, "could not write query over DoT to server")
 	}
-	responseMsg, err := connInfo.tlsConn.ReadMsg()
+	raw, err := connInfo.tlsConn.ReadMsgHeader(nil)
 	if err != nil {
+		connInfo.closeTLSConn(addr)
+		return nil, nil, StatusError, errors.Wrap(err, "could not read DNS message from DoT server")
+	}
+	responseMsg := new(dns.Msg)
+	if err = responseMsg.Unpack(raw); err != nil {
 		return nil, nil, StatusError, errors.Wrap(err, "could not unpack DNS message from DoT server")
 	}
+	connInfo.rawResponse = raw
 	res := SingleQueryResult{
 		Resolver:    connInfo.tlsConn.Conn.RemoteAddr().String(),
 		Protocol:    DoTProtocol,
@@ -1056,17 +1622,7 @@ func doDoTLookup(ctx context.Context, connInfo *ConnectionInfo, q Question, name
 	return constructSingleQueryResultFromDNSMsg(&res, responseMsg)
 }
 
-func doDoHLookup(ctx context.Context, httpClient *http.Client, q Question, nameServer *NameServer, recursive bool, ednsOptions []dns.EDNS0, dnssec bool, checkingDisabled bool) (*SingleQueryResult, *dns.Msg, Status, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dotName(q.Name), q.Type)
-	m.Question[0].Qclass = q.Class
-	m.RecursionDesired = recursive
-	m.CheckingDisabled = checkingDisabled
-
-	m.SetEdns0(1232, dnssec)
-	if ednsOpt := m.IsEdns0(); ednsOpt != nil {
-		ednsOpt.Option = append(ednsOpt.Option, ednsOptions...)
-	}
+func doDoHLookup(ctx context.Context, connInfo *ConnectionInfo, m *dns.Msg, nameServer *NameServer) (*SingleQueryResult, *dns.Msg, Status, error) {
 	bytes, err := m.Pack()
 	if err != nil {
 		return nil, nil, StatusError, errors.Wrap(err, "could not pack DNS message")
@@ -1088,7 +1644,7 @@ func doDoHLookup(ctx context.Context, httpClient *http.Client, q Question, nameS
 	req.Header.Set("Content-Type", "application/dns-message")
 	req.Header.Set("Accept", "application/dns-message")
 	req = req.WithContext(ctx)
-	resp, err := httpClient.Do(req)
+	resp, err := connInfo.httpsClient.Do(req)
 	if err != nil {
 		return nil, nil, StatusError, errors.Wrap(err, "could not perform HTTP request")
 	}
@@ -1108,6 +1664,7 @@ func doDoHLookup(ctx context.Context, httpClient *http.Client, q Question, nameS
 	if err != nil {
 		return nil, nil, StatusError, errors.Wrap(err, "could not unpack DNS message")
 	}
+	connInfo.rawResponse = bytes
 	res := SingleQueryResult{
 		Resolver:    nameServer.DomainName,
 		Protocol:    DoHProtocol,
@@ -1128,21 +1685,10 @@ func doDoHLookup(ctx context.Context, httpClient *http.Client, q Question, nameS
 }
 
 // wireLookupTCP performs a DNS lookup on-the-wire over TCP with the given parameters
-func wireLookupTCP(ctx context.Context, connInfo *ConnectionInfo, q Question, nameServer *NameServer, ednsOptions []dns.EDNS0, recursive, dnssec, checkingDisabled bool) (*SingleQueryResult, *dns.Msg, Status, error) {
+func wireLookupTCP(ctx context.Context, connInfo *ConnectionInfo, m *dns.Msg, nameServer *NameServer) (*SingleQueryResult, *dns.Msg, Status, error) {
 	res := SingleQueryResult{Answers: []interface{}{}, Authorities: []interface{}{}, Additionals: []interface{}{}}
 	res.Resolver = nameServer.String()
 
-	m := new(dns.Msg)
-	m.SetQuestion(dotName(q.Name), q.Type)
-	m.Question[0].Qclass = q.Class
-	m.RecursionDesired = recursive
-	m.CheckingDisabled = checkingDisabled
-
-	m.SetEdns0(1232, dnssec)
-	if ednsOpt := m.IsEdns0(); ednsOpt != nil {
-		ednsOpt.Option = append(ednsOpt.Option, ednsOptions...)
-	}
-
 	var r *dns.Msg
 	var err error
 	if connInfo.tcpConn != nil && connInfo.tcpConn.RemoteAddr != nil && connInfo.tcpConn.RemoteAddr.String() == nameServer.String() {
@@ -1182,34 +1728,75 @@ func wireLookupTCP(ctx context.Context, connInfo *ConnectionInfo, q Question, na
 }
 
 // wireLookupUDP performs a DNS lookup on-the-wire over UDP with the given parameters
-func wireLookupUDP(ctx context.Context, connInfo *ConnectionInfo, q Question, nameServer *NameServer, ednsOptions []dns.EDNS0, recursive, dnssec, checkingDisabled bool) (*SingleQueryResult, *dns.Msg, Status, error) {
+// Before giving up on a timeout, up to retransmits retransmits are sent on the same socket, retransmitInterval apart.
+// waitToSend, if set, is called before each retransmit and blocks until the rate limits allow another query.
+func wireLookupUDP(ctx context.Context, connInfo *ConnectionInfo, m *dns.Msg, nameServer *NameServer, retransmits int, retransmitInterval time.Duration, waitToSend func() error) (*SingleQueryResult, *dns.Msg, Status, error) {
 	res := SingleQueryResult{Answers: []interface{}{}, Authorities: []interface{}{}, Additionals: []interface{}{}}
 	res.Resolver = nameServer.String()
 	res.Protocol = "udp"
 
-	m := new(dns.Msg)
-	m.SetQuestion(dotName(q.Name), q.Type)
-	m.Question[0].Qclass = q.Class
-	m.RecursionDesired = recursive
-	m.CheckingDisabled = checkingDisabled
-
-	m.SetEdns0(1232, dnssec)
-	if ednsOpt := m.IsEdns0(); ednsOpt != nil {
-		ednsOpt.Option = append(ednsOpt.Option, ednsOptions...)
-	}
-
 	var r *dns.Msg
 	var err error
 
+	// exchange sends the query and waits for its response on a single socket, so that a late response to an
+	// earlier retransmit is still accepted. Responses are matched on ID, so duplicates are ignored by later queries.
+	var exchange func(ctx context.Context) (*dns.Msg, error)
 	if connInfo.udpConn != nil {
 		var dst *net.UDPAddr
 		dst, err = net.ResolveUDPAddr("udp", nameServer.String())
 		if err != nil {
 			return nil, nil, StatusError, errors.Wrapf(err, "could not resolve UDP address %s", nameServer.String())
 		}
-		r, _, err = connInfo.udpClient.ExchangeWithConnToContext(ctx, m, connInfo.udpConn, dst)
+		exchange = func(ctx context.Context) (*dns.Msg, error) {
+			resp, raw, discarded, exchangeErr := exchangeRecycledUDP(ctx, connInfo.udpConn, m, dst)
+			res.StrayResponses += discarded
+			connInfo.rawResponse = raw
+			return resp, exchangeErr
+		}
+		res.SourcePort = localPort(connInfo.udpConn.LocalAddr())
 	} else {
-		r, _, err = connInfo.udpClient.ExchangeContext(ctx, m, nameServer.String())
+		// the socket is dialed here rather than by the client, so the port it's bound to is known
+		var conn *dns.Conn
+		if connInfo.randomizeSourcePort {
+			conn, err = dialUDPFromRandomPort(ctx, connInfo, nameServer)
+		} else {
+			conn, err = connInfo.udpClient.DialContext(ctx, nameServer.String())
+		}
+		if err != nil {
+			return &res, nil, StatusError, errors.Wrapf(err, "could not dial UDP address %s", nameServer.String())
+		}
+		res.SourcePort = localPort(conn.LocalAddr())
+		if udpConn, ok := conn.Conn.(*net.UDPConn); ok && connInfo.pcapWriter != nil {
+			conn.Conn = newPcapUDPConn(udpConn, connInfo.pcapWriter)
+		}
+		defer func() {
+			if closeErr := conn.Close(); closeErr != nil {
+				log.Errorf("error closing UDP connection: %v", closeErr)
+			}
+		}()
+		exchange = func(ctx context.Context) (*dns.Msg, error) {
+			resp, _, exchangeErr := connInfo.udpClient.ExchangeWithConnContext(ctx, m, conn)
+			return resp, exchangeErr
+		}
+	}
+	// send up to retransmits quick retransmits before giving up on this name server. The final attempt gets whatever
+	// is left of the network timeout
+	for attempt := 0; attempt <= retransmits; attempt++ {
+		if attempt > 0 && waitToSend != nil {
+			if waitErr := waitToSend(); waitErr != nil {
+				return &res, nil, StatusTimeout, waitErr
+			}
+		}
+		if attempt == retransmits {
+			r, err = exchange(ctx)
+			break
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, retransmitInterval)
+		r, err = exchange(attemptCtx)
+		cancel()
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() || util.HasCtxExpired(ctx) {
+			break
+		}
 	}
 
 	if r != nil && (r.Truncated || r.Rcode == dns.RcodeBadTrunc) {
@@ -1227,6 +1814,179 @@ func wireLookupUDP(ctx context.Context, connInfo *ConnectionInfo, q Question, na
 	return constructSingleQueryResultFromDNSMsg(&res, r)
 }
 
+// dialUDPFromRandomPort dials nameServer over UDP from a socket bound to a port picked uniformly at random from the
+// unprivileged range, rather than from the OS's ephemeral port range. Ports found in use are skipped.
+func dialUDPFromRandomPort(ctx context.Context, connInfo *ConnectionInfo, nameServer *NameServer) (*dns.Conn, error) {
+	var err error
+	for attempt := 0; attempt < randomSourcePortAttempts; attempt++ {
+		dialer := net.Dialer{
+			Timeout:   connInfo.udpClient.Timeout,
+			LocalAddr: &net.UDPAddr{IP: connInfo.localAddr, Port: minRandomSourcePort + rand.Intn(math.MaxUint16+1-minRandomSourcePort), Zone: connInfo.localZone},
+		}
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "udp", nameServer.String()); err == nil {
+			return &dns.Conn{Conn: conn, UDPSize: connInfo.udpClient.UDPSize}, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, errors.Wrapf(err, "no free source port found in %d attempts", randomSourcePortAttempts)
+}
+
+// localPort returns the port of a socket's local address, 0 if it isn't a UDP or TCP address
+func localPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+// separateUnrelatedAnswers moves answer records that weren't asked for by question q out of res.Answers and into
+// res.ExtraAnswers, so injected or unsolicited records don't get mixed in with the answer
+func separateUnrelatedAnswers(res *SingleQueryResult, q dns.Question, r *dns.Msg) {
+	related, unrelated := splitUnrelatedAnswers(q, r.Answer)
+	if len(unrelated) == 0 {
+		return
+	}
+	res.Answers = make([]interface{}, 0, len(related))
+	for _, ans := range related {
+		if inner := ParseAnswer(ans); inner != nil {
+			res.Answers = append(res.Answers, inner)
+		}
+	}
+	res.ExtraAnswers = make([]interface{}, 0, len(unrelated))
+	for _, ans := range unrelated {
+		if inner := ParseAnswer(ans); inner != nil {
+			res.ExtraAnswers = append(res.ExtraAnswers, inner)
+		}
+	}
+}
+
+// checkBailiwick returns how many records of an iterative response aren't at or beneath layer, the zone the queried
+// name server was asked about, and so can't be trusted from it, ex. records injected to poison a cache. They're
+// removed from res if strip is set. NSEC3 records are exempt, as in the cache's poison check.
+func checkBailiwick(res *SingleQueryResult, layer string, strip bool) int {
+	outOfBailiwick := 0
+	filter := func(records []interface{}) []interface{} {
+		kept := records[:0:0]
+		for _, rec := range records {
+			if ans, ok := rec.(WithBaseAnswer); ok && ans.BaseAns().Type != dns.TypeToString[dns.TypeNSEC3] {
+				if beneath, _ := nameIsBeneath(ans.BaseAns().Name, layer); !beneath {
+					outOfBailiwick++
+					continue
+				}
+			}
+			kept = append(kept, rec)
+		}
+		return kept
+	}
+	answers, authorities, additionals := filter(res.Answers), filter(res.Authorities), filter(res.Additionals)
+	if strip && outOfBailiwick > 0 {
+		res.Answers, res.Authorities, res.Additionals = answers, authorities, additionals
+	}
+	return outOfBailiwick
+}
+
+// encodeRawResponse returns the base64 encoding of a response's wire format. raw is the response as it was received, if
+// the transport kept it, otherwise resp is packed again. Packing keeps every record and option but may compress names
+// differently than the name server did.
+func encodeRawResponse(raw []byte, resp *dns.Msg) string {
+	if raw == nil {
+		var err error
+		if raw, err = resp.Pack(); err != nil {
+			log.Debugf("could not pack response to output it: %v", err)
+			return ""
+		}
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// responseSize returns the wire size of resp, from the bytes received if the transport kept them, or else by packing it
+// again with name compression, as name servers send responses
+func responseSize(raw []byte, resp *dns.Msg) int {
+	if raw != nil {
+		return len(raw)
+	}
+	compress := resp.Compress
+	defer func() { resp.Compress = compress }()
+	resp.Compress = true
+	return resp.Len()
+}
+
+// exchangeRecycledUDP sends m to dst over a UDP socket that is shared by all of a resolver's queries, and waits for
+// the response. Since the socket outlives each query, a late response to an earlier query that timed out can arrive
+// while we wait. Datagrams that aren't a response to m, those from another address, with another ID, or for another
+// question, are discarded. Returns the response, its wire format, and the number of datagrams discarded.
+func exchangeRecycledUDP(ctx context.Context, conn *dns.Conn, m *dns.Msg, dst *net.UDPAddr) (*dns.Msg, []byte, int, error) {
+	pc, ok := conn.Conn.(net.PacketConn)
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("recycled UDP socket of type %T is not a packet connection", conn.Conn)
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, nil, 0, errors.Wrap(err, "could not pack query")
+	}
+	deadline, _ := ctx.Deadline() // the zero time clears any deadline left over from a previous query
+	if err = pc.SetDeadline(deadline); err != nil {
+		return nil, nil, 0, errors.Wrap(err, "could not set deadline on UDP socket")
+	}
+	if _, err = pc.WriteTo(packed, dst); err != nil {
+		return nil, nil, 0, err
+	}
+	bufSize := dns.MinMsgSize
+	if opt := m.IsEdns0(); opt != nil && int(opt.UDPSize()) > bufSize {
+		bufSize = int(opt.UDPSize())
+	}
+	buf := make([]byte, bufSize)
+	discarded := 0
+	for {
+		n, from, readErr := pc.ReadFrom(buf)
+		if readErr != nil {
+			return nil, nil, discarded, readErr
+		}
+		if fromUDP, isUDP := from.(*net.UDPAddr); !isUDP || !fromUDP.IP.Equal(dst.IP) || fromUDP.Port != dst.Port {
+			log.Debugf("discarding stray UDP datagram from %v while waiting for a response from %v", from, dst)
+			discarded++
+			continue
+		}
+		r := new(dns.Msg)
+		if err = r.Unpack(buf[:n]); err != nil {
+			if r.Id == m.Id {
+				// a malformed response to our query, let the caller decide what to do with it
+				return r, buf[:n], discarded, err
+			}
+			discarded++
+			continue
+		}
+		if r.Id != m.Id || !responseQuestionMatches(m, r) {
+			log.Debugf("discarding late or stray response (id %d, question %v) while waiting for a response to id %d from %v", r.Id, r.Question, m.Id, dst)
+			discarded++
+			continue
+		}
+		return r, buf[:n], discarded, nil
+	}
+}
+
+// markCNAMETargetNXDomain checks whether an NXDOMAIN response r is about the target of a CNAME/DNAME chain in its answer
+// section rather than about the queried name. If so, the chain is added to res and StatusCNAMETargetNXDomain returned.
+func markCNAMETargetNXDomain(res *SingleQueryResult, q dns.Question, r *dns.Msg) Status {
+	target, ok := followCNAMEChain(q.Name, r.Answer)
+	if !ok {
+		return StatusNXDomain
+	}
+	for _, ans := range r.Answer {
+		if inner := ParseAnswer(ans); inner != nil {
+			res.Answers = append(res.Answers, inner)
+		}
+	}
+	res.NXDomainTarget = strings.TrimSuffix(target, ".")
+	return StatusCNAMETargetNXDomain
+}
+
 // fills out all the fields in a SingleQueryResult from a dns.Msg directly.
 func constructSingleQueryResultFromDNSMsg(res *SingleQueryResult, r *dns.Msg) (*SingleQueryResult, *dns.Msg, Status, error) {
 	if r.Rcode != dns.RcodeSuccess {
@@ -1280,10 +2040,12 @@ func (r *Resolver) iterateOnAuthorities(ctx context.Context, qWithMeta *Question
 	// Shuffle authorities to try them in random order
 	authorities := make([]interface{}, len(result.Authorities))
 	copy(authorities, result.Authorities)
-	rand.Shuffle(len(authorities), func(i, j int) {
+	r.rand.Shuffle(len(authorities), func(i, j int) {
 		authorities[i], authorities[j] = authorities[j], authorities[i]
 	})
 
+	// if every authority turned out lame, that's reported rather than a generic failure
+	triedAuthorities, lameAuthorities := 0, 0
 	for _, elem := range authorities {
 		// Skip DNSSEC records
 		switch elem.(type) {
@@ -1296,6 +2058,7 @@ func (r *Resolver) iterateOnAuthorities(ctx context.Context, qWithMeta *Question
 		}
 
 		r.verboseLog(depth+1, "Trying Authority: ", elem)
+		triedAuthorities++
 
 		// Extract authority details
 		ns, nsStatus, nextLayer, newTrace := r.extractAuthority(ctx, elem, layer, depth, result, trace)
@@ -1332,11 +2095,19 @@ func (r *Resolver) iterateOnAuthorities(ctx context.Context, qWithMeta *Question
 			return iterateResult, trace, status, err
 		}
 
+		if status == StatusLameDelegation {
+			r.verboseLog(depth+2, "--> Iterative resolution at ", ns, " ran into a lame delegation, trying the next authority")
+			lameAuthorities++
+			continue
+		}
 		r.verboseLog(depth+2, "--> Iterative resolution of ", qWithMeta.Q.Name, " at ", ns, " Failed: ", status)
 	}
 
 	// If we get here, all authorities failed
 	r.verboseLog(depth+2, "--> No more authorities to try for name ", qWithMeta.Q.Name, ", terminating")
+	if lameAuthorities > 0 && lameAuthorities == triedAuthorities {
+		return &SingleQueryResult{}, trace, StatusLameDelegation, errors.New("all delegated nameservers are lame")
+	}
 	return &SingleQueryResult{}, trace, StatusServFail, errors.New("no valid nameservers found or all lookups failed")
 }
 
@@ -15,6 +15,7 @@ package zdns
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"math/rand"
@@ -23,6 +24,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -391,6 +393,67 @@ func TestParseAnswer(t *testing.T) {
 	}
 }
 
+func TestParseDSAnswer(t *testing.T) {
+	rr, err := dns.NewRR("example.com. 3600 IN DS 370 13 2 BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C")
+	require.NoError(t, err)
+	ds, ok := ParseAnswer(rr).(DSAnswer)
+	require.True(t, ok)
+	require.Equal(t, uint16(370), ds.KeyTag)
+	require.Equal(t, uint8(13), ds.Algorithm)
+	require.Equal(t, "ECDSAP256SHA256", ds.AlgorithmName)
+	require.Equal(t, uint8(2), ds.DigestType)
+	require.Equal(t, "SHA256", ds.DigestTypeName)
+	require.Equal(t, "BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C", ds.Digest)
+
+	// unassigned code points fall back to the number
+	rr.(*dns.DS).Algorithm = 200
+	rr.(*dns.DS).DigestType = 200
+	ds = ParseAnswer(rr).(DSAnswer)
+	require.Equal(t, "200", ds.AlgorithmName)
+	require.Equal(t, "200", ds.DigestTypeName)
+}
+
+func TestParseDHCIDAnswer(t *testing.T) {
+	// example from RFC 4701, section 3.6
+	rr, err := dns.NewRR("chi6.example.com. 86400 IN DHCID AAIBY2/AuCccgoJbsaxcQc9TUapptP69lOjxfNuVAA2kjEA=")
+	require.NoError(t, err)
+	dhcid, ok := ParseAnswer(rr).(DHCIDAnswer)
+	require.True(t, ok)
+	require.Equal(t, "AAIBY2/AuCccgoJbsaxcQc9TUapptP69lOjxfNuVAA2kjEA=", dhcid.Answer.Answer)
+	require.Equal(t, uint16(2), dhcid.IdentifierType)
+	require.Equal(t, "DUID", dhcid.IdentifierTypeName)
+	require.Equal(t, uint8(1), dhcid.DigestType)
+	require.Equal(t, "SHA256", dhcid.DigestTypeName)
+	require.Equal(t, "636FC0B8271C82825BB1AC5C41CF5351AA69B4FEBD94E8F17CDB95000DA48C40", dhcid.Digest)
+
+	// too short to hold the type fields
+	rr.(*dns.DHCID).Digest = "AAI="
+	_, ok = ParseAnswer(rr).(Answer)
+	require.True(t, ok)
+}
+
+func TestConcatenateTXTAnswers(t *testing.T) {
+	// a DKIM key longer than 255 bytes is split across character-strings
+	rr, err := dns.NewRR(`sel._domainkey.example.com. 300 IN TXT "v=DKIM1; k=rsa; p=MIIBIjAN" "BgkqhkiG9w0BAQEFAAOCAQ8A"`)
+	require.NoError(t, err)
+	a, err := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	require.NoError(t, err)
+	res := &SingleQueryResult{
+		Answers:     []interface{}{ParseAnswer(rr)},
+		Additionals: []interface{}{ParseAnswer(a)},
+	}
+
+	concatenated := ConcatenateTXTAnswers(res)
+	txt, ok := concatenated.Answers[0].(TXTAnswer)
+	require.True(t, ok)
+	require.Equal(t, "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", txt.Answer.Answer)
+	require.Equal(t, []string{"v=DKIM1; k=rsa; p=MIIBIjAN", "BgkqhkiG9w0BAQEFAAOCAQ8A"}, txt.Segments)
+	require.Equal(t, res.Additionals, concatenated.Additionals)
+	require.Nil(t, concatenated.Authorities)
+	// the original result is left as is
+	require.Equal(t, "v=DKIM1; k=rsa; p=MIIBIjAN\nBgkqhkiG9w0BAQEFAAOCAQ8A", res.Answers[0].(Answer).Answer)
+}
+
 func TestParseEdnsAnswerNsid1(t *testing.T) {
 	rr := &dns.OPT{
 		Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232},
@@ -419,6 +482,37 @@ func TestParseEdnsAnswerNsid2(t *testing.T) {
 	assert.Nil(t, ednsAnswer.NSID, "Unexpected NSID string. Expected %v, got %v", nil, ednsAnswer.NSID)
 }
 
+func TestParseEdnsAnswerExpire(t *testing.T) {
+	rr := &dns.OPT{
+		Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232},
+		Option: []dns.EDNS0{&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 3600}},
+	}
+	ednsAnswer, ok := ParseAnswer(rr).(EDNSAnswer)
+	require.True(t, ok, "Failed to parse OPT record")
+	require.NotNil(t, ednsAnswer.Expire)
+	require.Equal(t, uint32(3600), ednsAnswer.Expire.Expire)
+	require.True(t, ednsAnswer.Expire.Low, "an hour left before expiry should be flagged")
+
+	rr.Option = []dns.EDNS0{&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 1209600}}
+	ednsAnswer = ParseAnswer(rr).(EDNSAnswer)
+	require.False(t, ednsAnswer.Expire.Low)
+
+	rr.Option = []dns.EDNS0{&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true}}
+	ednsAnswer = ParseAnswer(rr).(EDNSAnswer)
+	require.True(t, ednsAnswer.Expire.Empty)
+	require.False(t, ednsAnswer.Expire.Low, "an empty option carries no expire time")
+}
+
+func TestParseEdnsAnswerLocal(t *testing.T) {
+	rr := &dns.OPT{
+		Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232},
+		Option: []dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{0xca, 0xfe}}, &dns.EDNS0_LOCAL{Code: 65002}},
+	}
+	ednsAnswer, ok := ParseAnswer(rr).(EDNSAnswer)
+	require.True(t, ok, "Failed to parse OPT record")
+	require.Equal(t, []*Edns0Local{{Code: 65001, Data: "cafe"}, {Code: 65002, Data: ""}}, ednsAnswer.Local)
+}
+
 func TestParseEdnsAnswerNoEdns(t *testing.T) {
 	rr := &dns.OPT{
 		Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232},
@@ -1948,6 +2042,60 @@ func TestAllNsLookupNXDomain(t *testing.T) {
 	require.Error(t, err) // could not successfully complete lookup, so this should error
 }
 
+func TestAllNsLookupExternalConcurrent(t *testing.T) {
+	config := InitTest(t)
+	config.LookupAllNameServers = true
+	config.AllNSConcurrency = 3
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	nameServers := make([]NameServer, 0, 5)
+	for i := 1; i <= 5; i++ {
+		ns := NameServer{IP: net.ParseIP(fmt.Sprintf("127.0.0.%d", i)), Port: 53}
+		nameServers = append(nameServers, ns)
+		// the third nameserver has no answer, so it's left out of the results
+		if i == 3 {
+			continue
+		}
+		mockResults[nameAndIP{name: "example.com", IP: ns.String()}] = SingleQueryResult{
+			Resolver: ns.String(),
+			Answers:  []interface{}{Answer{Type: "A", Class: "IN", Name: "example.com", Answer: fmt.Sprintf("192.0.2.%d", i)}},
+		}
+	}
+	q := Question{Type: dns.TypeA, Class: dns.ClassINET, Name: "example.com"}
+
+	results, _, status, err := resolver.LookupAllNameserversExternal(&q, nameServers)
+	require.NoError(t, err)
+	require.Equal(t, StatusNoError, status)
+	require.Len(t, resolver.allNSHelpers, 3)
+	// results are reported in the order of the nameservers, whichever answered first
+	resolvers := make([]string, 0, len(results))
+	for _, res := range results {
+		resolvers = append(resolvers, res.Resolver)
+	}
+	require.Equal(t, []string{"127.0.0.1:53", "127.0.0.2:53", "127.0.0.4:53", "127.0.0.5:53"}, resolvers)
+}
+
+func TestForEachNameServerHelpersFetchDNSSECRecordsLikeResolver(t *testing.T) {
+	config := InitTest(t)
+	config.LookupAllNameServers = true
+	config.AllNSConcurrency = 3
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	for _, iterative := range []bool{true, false} {
+		resolver.iterativeDNSSECFetches = iterative
+		fetchesIteratively := make([]bool, 5)
+		resolver.forEachNameServer(len(fetchesIteratively), func(res *Resolver, i int) {
+			require.NotSame(t, resolver, res, "nameservers should be queried by helpers")
+			fetchesIteratively[i] = res.iterativeDNSSECFetches
+		})
+		require.Equal(t, []bool{iterative, iterative, iterative, iterative, iterative}, fetchesIteratively)
+	}
+}
+
 func TestInvalidInputsLookup(t *testing.T) {
 	config := InitTest(t)
 	config.LocalAddrsV4 = []net.IP{net.ParseIP("127.0.0.1")}
@@ -2118,3 +2266,1010 @@ func verifyCombinedResult(t *testing.T, records map[string][]ExtendedResult, exp
 		t.Errorf("Combined result not matching, expected %v, found %v", expectedRecords, records)
 	}
 }
+
+func TestNewQuerySize(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Question = append(m.Question, dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	m.Compress = true
+	size := newQuerySize(m)
+	require.True(t, m.Compress, "compression setting of the query should be preserved")
+	require.Less(t, size.Compressed, size.Uncompressed)
+	require.Equal(t, size.Compressed, size.Sent)
+
+	m.Compress = false
+	size = newQuerySize(m)
+	require.False(t, m.Compress, "compression setting of the query should be preserved")
+	require.Equal(t, size.Uncompressed, size.Sent)
+	packed, err := m.Pack()
+	require.NoError(t, err)
+	require.Equal(t, len(packed), size.Sent)
+}
+
+func TestPadQuery(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		for _, name := range []string{"a.com", "www.example.com", "a-much-longer-label-than-the-others.subdomain.example.org"} {
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+			m.Compress = compress
+			m.SetEdns0(1232, true)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, new(dns.EDNS0_NSID), &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+			padQuery(m, 128)
+			require.Equal(t, 0, m.Len()%128, name)
+			packed, err := m.Pack()
+			require.NoError(t, err)
+			require.Equal(t, 0, len(packed)%128, name)
+			// the options already attached are kept, with the padding last
+			require.Len(t, opt.Option, 3)
+			require.IsType(t, &dns.EDNS0_PADDING{}, opt.Option[2])
+		}
+	}
+
+	// without EDNS0 there's nowhere to put the padding
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	size := m.Len()
+	padQuery(m, 128)
+	require.Equal(t, size, m.Len())
+}
+
+func TestNewQueryMsgRecursionDesired(t *testing.T) {
+	q := Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET}
+	r := &Resolver{udpBufferSize: defaultUDPBufferSize}
+	require.True(t, r.newQueryMsg(q, true).RecursionDesired)
+	require.False(t, r.newQueryMsg(q, false).RecursionDesired)
+
+	r.recursionDisabled = true
+	require.False(t, r.newQueryMsg(q, true).RecursionDesired)
+	require.False(t, r.newQueryMsg(q, false).RecursionDesired)
+}
+
+func TestSplitUnrelatedAnswers(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	answers := []dns.RR{
+		// out of order, the A record for the CNAME target comes before the CNAME
+		mustRR("cdn.example.net. 300 IN A 192.0.2.2"),
+		mustRR("www.example.com. 300 IN CNAME cdn.example.net."),
+		mustRR("injected.example.org. 300 IN A 198.51.100.1"),
+		mustRR("www.example.com. 300 IN MX 10 mail.example.com."),
+	}
+	related, unrelated := splitUnrelatedAnswers(q, answers)
+	require.Equal(t, []dns.RR{answers[0], answers[1]}, related)
+	require.Equal(t, []dns.RR{answers[2], answers[3]}, unrelated)
+
+	// DNAME synthesis
+	answers = []dns.RR{
+		mustRR("example.com. 300 IN DNAME example.net."),
+		mustRR("www.example.com. 300 IN CNAME www.example.net."),
+		mustRR("www.example.net. 300 IN A 192.0.2.3"),
+	}
+	related, unrelated = splitUnrelatedAnswers(q, answers)
+	require.Equal(t, answers, related)
+	require.Empty(t, unrelated)
+}
+
+func TestWireLookupUDPRetransmits(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	received := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		count := 0
+		for {
+			n, addr, readErr := pc.ReadFrom(buf)
+			if readErr != nil {
+				received <- count
+				return
+			}
+			count++
+			if count == 1 {
+				// drop the first query so the client has to retransmit
+				continue
+			}
+			query := new(dns.Msg)
+			require.NoError(t, query.Unpack(buf[:n]))
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+			packed, packErr := resp.Pack()
+			require.NoError(t, packErr)
+			_, _ = pc.WriteTo(packed, addr)
+		}
+	}()
+
+	udpAddr := pc.LocalAddr().(*net.UDPAddr)
+	ns := &NameServer{IP: udpAddr.IP, Port: uint16(udpAddr.Port)}
+	connInfo := &ConnectionInfo{udpClient: &dns.Client{Net: "udp"}}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	waits := 0
+	res, _, status, err := wireLookupUDP(ctx, connInfo, m, ns, 2, 100*time.Millisecond, func() error {
+		waits++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusNoError, status)
+	require.Len(t, res.Answers, 1)
+	pc.Close()
+	require.Equal(t, 2, <-received, "the query should have been sent once and retransmitted once")
+	require.Equal(t, 1, waits, "the retransmit should have waited for the rate limits")
+}
+
+func TestWireLookupUDPSourcePort(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	sourcePorts := make(chan int, 10)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, readErr := pc.ReadFrom(buf)
+			if readErr != nil {
+				return
+			}
+			sourcePorts <- addr.(*net.UDPAddr).Port
+			query := new(dns.Msg)
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			packed, packErr := resp.Pack()
+			if packErr != nil {
+				continue
+			}
+			_, _ = pc.WriteTo(packed, addr)
+		}
+	}()
+
+	udpAddr := pc.LocalAddr().(*net.UDPAddr)
+	ns := &NameServer{IP: udpAddr.IP, Port: uint16(udpAddr.Port)}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	for _, randomize := range []bool{false, true} {
+		connInfo := &ConnectionInfo{udpClient: &dns.Client{Net: "udp"}, localAddr: net.ParseIP("127.0.0.1"), randomizeSourcePort: randomize}
+		for i := 0; i < 3; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			res, _, status, err := wireLookupUDP(ctx, connInfo, m, ns, 0, time.Second, nil)
+			cancel()
+			require.NoError(t, err)
+			require.Equal(t, StatusNoError, status)
+			// the reported source port is the one the query arrived from
+			require.Equal(t, <-sourcePorts, res.SourcePort)
+			if randomize {
+				require.GreaterOrEqual(t, res.SourcePort, minRandomSourcePort)
+			}
+		}
+	}
+}
+
+func TestGetRootHintsFromReader(t *testing.T) {
+	hints := `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+; End of file
+`
+	v4, v6, err := getRootHintsFromReader(strings.NewReader(hints), "named.root")
+	require.NoError(t, err)
+	require.Equal(t, []NameServer{
+		{IP: net.ParseIP("198.41.0.4"), Port: 53, DomainName: "a.root-servers.net"},
+		{IP: net.ParseIP("170.247.170.2"), Port: 53, DomainName: "b.root-servers.net"},
+	}, v4)
+	require.Equal(t, []NameServer{{IP: net.ParseIP("2001:503:ba3e::2:30"), Port: 53, DomainName: "a.root-servers.net"}}, v6)
+
+	// root server without an address
+	_, _, err = getRootHintsFromReader(strings.NewReader(". 3600000 NS C.ROOT-SERVERS.NET.\n"), "named.root")
+	require.Error(t, err)
+	// no root NS records at all
+	_, _, err = getRootHintsFromReader(strings.NewReader("A.ROOT-SERVERS.NET. 3600000 A 198.41.0.4\n"), "named.root")
+	require.Error(t, err)
+	// malformed file
+	_, _, err = getRootHintsFromReader(strings.NewReader(". 3600000 NS\n"), "named.root")
+	require.Error(t, err)
+}
+
+func TestIterationServersFromTrace(t *testing.T) {
+	trace := Trace{
+		{Name: "www.example.com", Layer: ".", NameServer: "198.41.0.4:53", Cached: true},
+		{Name: "www.example.com", Layer: ".", NameServer: "170.247.170.2:53"},
+		// glueless name server resolution shouldn't be attributed to the lookup
+		{Name: "ns1.example.net", Layer: "net", NameServer: "192.5.6.30:53"},
+		{Name: "www.example.com", Layer: "com", NameServer: "192.12.94.30:53"},
+		{Name: "www.example.com", Layer: "example.com", NameServer: "199.43.135.53:53"},
+	}
+	root, tld := iterationServersFromTrace(trace, "www.example.com")
+	require.Equal(t, "170.247.170.2:53", root)
+	require.Equal(t, "192.12.94.30:53", tld)
+
+	root, tld = iterationServersFromTrace(Trace{}, "www.example.com")
+	require.Empty(t, root)
+	require.Empty(t, tld)
+}
+
+func TestFindCNAMEViolations(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+	// well-formed CNAME chain
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		mustRR("www.example.com. 300 IN CNAME example.net."),
+		mustRR("www.example.com. 300 IN RRSIG CNAME 13 3 300 20300101000000 20200101000000 12345 example.com. AAAA"),
+		mustRR("example.net. 300 IN A 192.0.2.1"),
+	}
+	require.Empty(t, findCNAMEViolations(m))
+
+	m.Answer = []dns.RR{
+		mustRR("www.example.com. 300 IN CNAME example.net."),
+		mustRR("www.example.com. 300 IN TXT \"other data\""),
+		mustRR("www.example.com. 300 IN CNAME example.org."),
+		mustRR("example.com. 300 IN CNAME example.net."),
+	}
+	m.Ns = []dns.RR{mustRR("example.com. 300 IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 300")}
+	require.Equal(t, []CNAMEViolation{
+		{Type: MultipleCNAMEs, Name: "www.example.com"},
+		{Type: CNAMEAndOtherData, Name: "www.example.com"},
+		{Type: CNAMEAtApex, Name: "example.com"},
+	}, findCNAMEViolations(m))
+}
+
+// startTestUDPServer serves DNS over UDP on a loopback port until the test ends, answering each query with the
+// response returned by handle. No response is sent if handle returns nil.
+func startTestUDPServer(t *testing.T, handle func(query *dns.Msg) *dns.Msg) *NameServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveTestUDP(t, pc, handle)
+}
+
+// serveTestUDP answers the queries arriving on pc as startTestUDPServer does
+func serveTestUDP(t *testing.T, pc net.PacketConn, handle func(query *dns.Msg) *dns.Msg) *NameServer {
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, readErr := pc.ReadFrom(buf)
+			if readErr != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			resp := handle(query)
+			if resp == nil {
+				continue
+			}
+			packed, packErr := resp.Pack()
+			if packErr != nil {
+				continue
+			}
+			_, _ = pc.WriteTo(packed, addr)
+		}
+	}()
+	udpAddr := pc.LocalAddr().(*net.UDPAddr)
+	return &NameServer{IP: udpAddr.IP, Port: uint16(udpAddr.Port)}
+}
+
+// newTestResolverConfig returns a config for an IPv4-only resolver that only talks to ns
+func newTestResolverConfig(ns *NameServer) *ResolverConfig {
+	config := NewResolverConfig()
+	config.LocalAddrsV4 = []net.IP{net.ParseIP("127.0.0.1")}
+	config.ExternalNameServersV4 = []NameServer{*ns}
+	config.RootNameServersV4 = []NameServer{*ns}
+	config.IPVersionMode = IPv4Only
+	return config
+}
+
+func TestServFailRetry(t *testing.T) {
+	failing := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetRcode(query, dns.RcodeServerFailure)
+		return resp
+	})
+	working := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.RecursionAvailable = true
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		return resp
+	})
+	q := &Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET}
+	lookup := func(configure func(*ResolverConfig)) (Trace, Status) {
+		config := newTestResolverConfig(failing)
+		config.ExternalNameServersV4 = []NameServer{*failing, *working}
+		config.Retries = 1
+		configure(config)
+		resolver, err := InitResolver(config)
+		require.NoError(t, err)
+		defer resolver.Close()
+		// the pool's first pick is random, start from the failing server
+		resolver.lastUsedExternalNameServer = failing
+		_, trace, status, _ := resolver.ExternalLookup(context.Background(), q, nil)
+		return trace, status
+	}
+
+	trace, status := lookup(func(config *ResolverConfig) { config.ServFailOtherServer = true })
+	require.Equal(t, StatusNoError, status)
+	require.Len(t, trace, 2)
+	require.Equal(t, failing.String(), trace[0].NameServer)
+	require.Equal(t, StatusServFail, trace[0].Status)
+	require.Equal(t, 1, trace[0].Try)
+	require.Positive(t, trace[0].DurationMS, "failed attempts are timed too")
+	require.Equal(t, working.String(), trace[1].NameServer)
+	require.Equal(t, 2, trace[1].Try)
+	require.Equal(t, StatusNoError, trace[1].Status)
+	require.Positive(t, trace[1].DurationMS)
+
+	// by default, the retry goes to the same name server
+	trace, status = lookup(func(*ResolverConfig) {})
+	require.Equal(t, StatusServFail, status)
+	require.Len(t, trace, 2)
+
+	trace, status = lookup(func(config *ResolverConfig) { config.NoRetryServFail = true })
+	require.Equal(t, StatusServFail, status)
+	require.Len(t, trace, 1)
+	require.Equal(t, 1, trace[0].Try)
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	var advertised uint16
+	var sentSize int
+	ns := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		if opt := query.IsEdns0(); opt != nil {
+			advertised = opt.UDPSize()
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		packed, err := resp.Pack()
+		require.NoError(t, err)
+		sentSize = len(packed)
+		return resp
+	})
+	config := newTestResolverConfig(ns)
+	config.UDPBufferSize = 4096
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Equal(t, StatusNoError, status)
+	require.Equal(t, uint16(4096), advertised)
+	require.Equal(t, sentSize, res.ResponseSize)
+
+	config.UDPBufferSize = 256
+	require.ErrorContains(t, config.Validate(), "UDP buffer size")
+}
+
+func TestQueryTimeoutRoundTrips(t *testing.T) {
+	r := &Resolver{networkTimeout: time.Second}
+	lookupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// without a query timeout, the round trips share the query's network timeout
+	roundTripCtx, cancelRoundTrip := r.roundTripCtx(lookupCtx)
+	cancelRoundTrip()
+	require.Equal(t, lookupCtx, roundTripCtx)
+
+	r.queryTimeout = 5 * time.Second
+	roundTripCtx, cancelRoundTrip = r.roundTripCtx(lookupCtx)
+	defer cancelRoundTrip()
+	deadline, ok := roundTripCtx.Deadline()
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+
+	config := NewResolverConfig()
+	config.QueryTimeout = time.Second
+	config.NetworkTimeout = 2 * time.Second
+	require.ErrorContains(t, config.Validate(), "query timeout")
+}
+
+func TestIterationStepTracesFailures(t *testing.T) {
+	root := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Rcode = dns.RcodeServerFailure
+		return resp
+	})
+	config := newTestResolverConfig(root)
+	config.Retries = 0
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	_, trace, status, _ := resolver.IterativeLookup(context.Background(), &Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET})
+	require.Equal(t, StatusServFail, status)
+	require.Len(t, trace, 1)
+	require.Equal(t, StatusServFail, trace[0].Status)
+	require.Equal(t, ".", trace[0].Layer)
+	require.Positive(t, trace[0].DurationMS)
+}
+
+func TestCNAMETargetNXDomain(t *testing.T) {
+	cname := func(owner, target string) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target}
+	}
+	ns := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.RecursionAvailable = true
+		switch query.Question[0].Name {
+		case "alias.example.com.":
+			// the target is in another zone, so it has to be followed
+			resp.Answer = []dns.RR{cname("alias.example.com.", "missing.example.net.")}
+		case "inzone.example.com.":
+			// the resolver followed the chain itself, RFC 6604
+			resp.Rcode = dns.RcodeNameError
+			resp.Answer = []dns.RR{cname("inzone.example.com.", "gone.example.com.")}
+		default:
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp
+	})
+	config := newTestResolverConfig(ns)
+	config.ReportCNAMETargetNXDomain = true
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	// CNAME to a name that doesn't exist in another zone
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "alias.example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Equal(t, StatusCNAMETargetNXDomain, status)
+	require.Equal(t, "missing.example.net", res.NXDomainTarget)
+	require.Len(t, res.Answers, 1)
+	require.Equal(t, "missing.example.net.", res.Answers[0].(Answer).Answer)
+
+	// chain followed by the name server, returned alongside NXDOMAIN
+	res, _, status, err = resolver.ExternalLookup(context.Background(), &Question{Name: "inzone.example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Equal(t, StatusCNAMETargetNXDomain, status)
+	require.Equal(t, "gone.example.com", res.NXDomainTarget)
+	require.Len(t, res.Answers, 1)
+
+	// the queried name itself doesn't exist
+	res, _, status, _ = resolver.ExternalLookup(context.Background(), &Question{Name: "nonexistent.example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.Equal(t, StatusNXDomain, status)
+	require.Empty(t, res.NXDomainTarget)
+
+	t.Run("iterative", testCNAMETargetNXDomainIterative)
+}
+
+// testCNAMETargetNXDomainIterative checks that a CNAME_TARGET_NXDOMAIN answer of a delegated name server is the
+// iterative lookup's answer
+func testCNAMETargetNXDomainIterative(t *testing.T) {
+	// glue can't carry a port, so the delegated name server has to listen on port 53
+	pc, err := net.ListenPacket("udp", "127.0.0.2:53")
+	if err != nil {
+		t.Skipf("can't listen on port 53 for the delegated name server: %v", err)
+	}
+	serveTestUDP(t, pc, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Authoritative = true
+		resp.Rcode = dns.RcodeNameError
+		resp.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "inzone.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "gone.example.com."}}
+		return resp
+	})
+	root := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.example.com."}}
+		resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("127.0.0.2")}}
+		return resp
+	})
+	config := newTestResolverConfig(root)
+	config.ReportCNAMETargetNXDomain = true
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	// the delegated name server's answer ends the iteration, rather than sending it on to other authorities
+	res, _, status, err := resolver.IterativeLookup(context.Background(), &Question{Name: "inzone.example.com", Type: dns.TypeA, Class: dns.ClassINET})
+	require.NoError(t, err)
+	require.Equal(t, StatusCNAMETargetNXDomain, status)
+	require.Equal(t, "gone.example.com", res.NXDomainTarget)
+}
+
+func TestResponseQuestionMatches(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("Example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	require.True(t, responseQuestionMatches(query, resp))
+	resp.Question[0].Name = "eXample.COM."
+	require.True(t, responseQuestionMatches(query, resp), "names are compared case-insensitively")
+	resp.Question[0].Name = "example.net."
+	require.False(t, responseQuestionMatches(query, resp))
+	resp.SetReply(query)
+	resp.Question[0].Qtype = dns.TypeAAAA
+	require.False(t, responseQuestionMatches(query, resp))
+	resp.SetReply(query)
+	resp.Question[0].Qclass = dns.ClassCHAOS
+	require.False(t, responseQuestionMatches(query, resp))
+
+	// an empty question is only accepted for errors
+	resp.SetReply(query)
+	resp.Question = nil
+	require.False(t, responseQuestionMatches(query, resp))
+	resp.Rcode = dns.RcodeFormatError
+	require.True(t, responseQuestionMatches(query, resp))
+}
+
+func TestQuestionMismatchStatus(t *testing.T) {
+	ns := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		// answer a different question than the one asked
+		spoofed := new(dns.Msg)
+		spoofed.SetQuestion("attacker.example.", dns.TypeA)
+		resp := new(dns.Msg)
+		resp.SetReply(spoofed)
+		resp.Id = query.Id
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "attacker.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.66")}}
+		return resp
+	})
+	config := newTestResolverConfig(ns)
+	config.Retries = 1
+	// responses for other questions are discarded while waiting on a recycled socket, so use a socket per query
+	config.ShouldRecycleSockets = false
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.Error(t, err)
+	require.Equal(t, StatusQuestionMismatch, status)
+	require.Empty(t, res.Answers, "answers from a mismatched response must not be used")
+}
+
+func TestExchangeRecycledUDPDiscardsStrays(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer server.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer other.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer client.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	reply := func(mutate func(resp *dns.Msg)) []byte {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		mutate(resp)
+		packed, packErr := resp.Pack()
+		require.NoError(t, packErr)
+		return packed
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		_, addr, readErr := server.ReadFrom(buf)
+		if readErr != nil {
+			return
+		}
+		// a response from another address
+		_, _ = other.WriteTo(reply(func(*dns.Msg) {}), addr)
+		// a late response to an earlier query with another ID
+		_, _ = server.WriteTo(reply(func(resp *dns.Msg) { resp.Id = m.Id + 1 }), addr)
+		// a response with the right ID to another question
+		_, _ = server.WriteTo(reply(func(resp *dns.Msg) { resp.Question[0].Name = "example.net." }), addr)
+		// the actual response
+		_, _ = server.WriteTo(reply(func(*dns.Msg) {}), addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, raw, discarded, err := exchangeRecycledUDP(ctx, &dns.Conn{Conn: client}, m, server.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	require.Equal(t, 3, discarded)
+	require.Equal(t, m.Id, r.Id)
+	require.Equal(t, "example.com.", r.Question[0].Name)
+	require.Len(t, r.Answer, 1)
+	require.NotEmpty(t, raw)
+
+	// no response at all times out
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, _, err = exchangeRecycledUDP(ctx, &dns.Conn{Conn: client}, m, other.LocalAddr().(*net.UDPAddr))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+}
+
+func TestQueriesSent(t *testing.T) {
+	ns := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.RecursionAvailable = true
+		switch query.Question[0].Name {
+		case "alias.example.com.":
+			resp.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "alias.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "example.net."}}
+		default:
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		}
+		return resp
+	})
+	resolver, err := InitResolver(newTestResolverConfig(ns))
+	require.NoError(t, err)
+	defer resolver.Close()
+	require.Equal(t, 0, resolver.QueriesSent())
+
+	// following the CNAME takes a second query
+	_, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "alias.example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Equal(t, StatusNoError, status)
+	require.Equal(t, 2, resolver.QueriesSent())
+
+	// answers from the cache aren't queries
+	_, _, _, err = resolver.ExternalLookup(context.Background(), &Question{Name: "example.net", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Equal(t, 2, resolver.QueriesSent())
+}
+
+func TestDNSSECStatusesDiffer(t *testing.T) {
+	secure := ExtendedResult{Nameserver: "ns1.example.com", DNSSECStatus: DNSSECSecure}
+	insecure := ExtendedResult{Nameserver: "ns2.example.com", DNSSECStatus: DNSSECInsecure}
+	unvalidated := ExtendedResult{Nameserver: "ns3.example.com", Status: StatusTimeout}
+	require.False(t, dnssecStatusesDiffer(nil))
+	require.False(t, dnssecStatusesDiffer([]ExtendedResult{secure, secure, unvalidated}))
+	require.True(t, dnssecStatusesDiffer([]ExtendedResult{secure, unvalidated, insecure}))
+}
+
+func TestCheckBailiwick(t *testing.T) {
+	ns := Answer{Name: "example.com", Type: "NS", RrType: dns.TypeNS, Answer: "ns1.example.net."}
+	inGlue := Answer{Name: "ns1.example.com", Type: "A", RrType: dns.TypeA, Answer: "192.0.2.1"}
+	outGlue := Answer{Name: "ns1.example.net", Type: "A", RrType: dns.TypeA, Answer: "192.0.2.2"}
+	nsec3 := Answer{Name: "abc.net", Type: "NSEC3", RrType: dns.TypeNSEC3}
+	opt := EDNSAnswer{Type: "EDNS0"}
+	newResult := func() *SingleQueryResult {
+		return &SingleQueryResult{
+			Authorities: []interface{}{ns, nsec3},
+			Additionals: []interface{}{inGlue, outGlue, opt},
+		}
+	}
+
+	res := newResult()
+	require.Equal(t, 1, checkBailiwick(res, "com", false))
+	require.Equal(t, newResult(), res, "records are only counted unless stripped")
+
+	require.Equal(t, 1, checkBailiwick(res, "com", true))
+	require.Equal(t, []interface{}{ns, nsec3}, res.Authorities)
+	require.Equal(t, []interface{}{inGlue, opt}, res.Additionals)
+
+	require.Equal(t, 0, checkBailiwick(newResult(), ".", true), "everything is beneath the root")
+	require.Equal(t, 3, checkBailiwick(newResult(), "org", false))
+}
+
+func TestFindZoneCut(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+	soa := func(owner string) dns.RR {
+		return mustRR(owner + " 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	}
+	q := dns.Question{Name: "www.sub.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// NXDOMAIN/NODATA, SOA in the authority section
+	m := new(dns.Msg)
+	m.Ns = []dns.RR{soa("Sub.Example.com.")}
+	require.Equal(t, "sub.example.com", findZoneCut(q, m))
+
+	// the SOA at the end of a CNAME chain belongs to the target's zone
+	m = new(dns.Msg)
+	m.Answer = []dns.RR{mustRR("www.sub.example.com. 300 IN CNAME missing.example.net.")}
+	m.Ns = []dns.RR{soa("example.net.")}
+	require.Equal(t, "example.net", findZoneCut(q, m))
+
+	// SOA query answered at the apex
+	m = new(dns.Msg)
+	m.Answer = []dns.RR{soa("example.com.")}
+	require.Equal(t, "example.com", findZoneCut(dns.Question{Name: "example.com.", Qtype: dns.TypeSOA}, m))
+
+	// an SOA that doesn't enclose the name is ignored, as is a response without one
+	m = new(dns.Msg)
+	m.Ns = []dns.RR{soa("example.org.")}
+	require.Empty(t, findZoneCut(q, m))
+	m = new(dns.Msg)
+	m.Answer = []dns.RR{mustRR("www.sub.example.com. 300 IN A 192.0.2.1")}
+	require.Empty(t, findZoneCut(q, m))
+}
+
+func TestTraceNameServersConsulted(t *testing.T) {
+	trace := Trace{
+		{NameServer: "198.41.0.4:53"},
+		{NameServer: "192.5.6.30:53"},
+		{NameServer: "198.41.0.4:53"},
+		{NameServer: "[2001:503:ba3e::2:30]:53"},
+		{NameServer: "192.0.2.1:53", Cached: true},
+		{NameServer: ""},
+	}
+	require.Equal(t, []string{"198.41.0.4", "192.5.6.30", "2001:503:ba3e::2:30"}, trace.NameServersConsulted())
+	require.Empty(t, Trace{}.NameServersConsulted())
+}
+
+func TestTraceLameNameServers(t *testing.T) {
+	trace := Trace{
+		{NameServer: "198.41.0.4:53"},
+		{NameServer: "192.0.2.1:53", Lame: true},
+		{NameServer: "[2001:db8::1]:53", Lame: true},
+		{NameServer: "192.0.2.1:53", Lame: true, Cached: true},
+	}
+	require.Equal(t, []string{"192.0.2.1", "2001:db8::1"}, trace.LameNameServers())
+	require.Empty(t, Trace{{NameServer: "198.41.0.4:53"}}.LameNameServers())
+}
+
+func TestIsLameResponse(t *testing.T) {
+	childNS := Answer{Name: "sub.example.com.", RrType: dns.TypeNS, Answer: "ns1.sub.example.com."}
+	rootNS := Answer{Name: ".", RrType: dns.TypeNS, Answer: "a.root-servers.net."}
+	sameNS := Answer{Name: "Example.com.", RrType: dns.TypeNS, Answer: "ns1.example.com."}
+	a := Answer{Name: "www.example.com.", RrType: dns.TypeA, Answer: "192.0.2.1"}
+	tests := []struct {
+		name     string
+		result   *SingleQueryResult
+		status   Status
+		layer    string
+		expected bool
+	}{
+		{"referral to a child zone", &SingleQueryResult{Authorities: []interface{}{childNS}}, StatusNoError, "example.com", false},
+		{"upward referral", &SingleQueryResult{Authorities: []interface{}{rootNS}}, StatusNoError, "example.com", true},
+		{"referral to the same zone", &SingleQueryResult{Authorities: []interface{}{sameNS}}, StatusNoError, "example.com", true},
+		{"empty non-authoritative response", &SingleQueryResult{}, StatusNoError, "example.com", true},
+		{"authoritative NODATA", &SingleQueryResult{Flags: DNSFlags{Authoritative: true}}, StatusNoError, "example.com", false},
+		{"answer", &SingleQueryResult{Answers: []interface{}{a}}, StatusNoError, "example.com", false},
+		{"refused", &SingleQueryResult{}, StatusRefused, "example.com", true},
+		{"servfail", &SingleQueryResult{}, StatusServFail, "example.com", false},
+		{"root servers aren't delegated to", &SingleQueryResult{}, StatusRefused, ".", false},
+		{"no result", nil, StatusRefused, "example.com", false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, isLameResponse(test.result, test.status, test.layer), test.name)
+	}
+}
+
+func TestMinimizedQueryName(t *testing.T) {
+	tests := []struct {
+		name, layer, expected string
+		ok                    bool
+	}{
+		{"www.google.com", ".", "com", true},
+		{"www.google.com", "com", "google.com", true},
+		{"WWW.Google.com.", "com", "google.com", true},
+		{"a.b.c.example.com", "example.com", "c.example.com", true},
+		// the last step sends the full name
+		{"www.google.com", "google.com", "", false},
+		{"com", ".", "", false},
+		// the name isn't beneath the layer
+		{"www.google.com", "org", "", false},
+	}
+	for _, test := range tests {
+		minimized, ok := minimizedQueryName(test.name, test.layer)
+		require.Equal(t, test.ok, ok, "%s at layer %s", test.name, test.layer)
+		require.Equal(t, test.expected, minimized, "%s at layer %s", test.name, test.layer)
+	}
+}
+
+func TestHasNSRecord(t *testing.T) {
+	soa := SOAAnswer{Answer: Answer{Name: "com", RrType: dns.TypeSOA}}
+	ns := Answer{Name: "google.com", RrType: dns.TypeNS, Answer: "ns1.google.com."}
+	require.False(t, hasNSRecord(nil))
+	require.False(t, hasNSRecord([]interface{}{soa}))
+	require.True(t, hasNSRecord([]interface{}{soa, ns}))
+}
+
+func TestRetryBackoffDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	for retry, expected := range map[int]time.Duration{1: base, 2: 2 * base, 3: 4 * base, 30: maxRetryBackoff} {
+		for i := 0; i < 20; i++ {
+			delay := retryBackoffDelay(base, retry, newLockedRand(0))
+			require.GreaterOrEqual(t, delay, expected/2, "retry %d", retry)
+			require.LessOrEqual(t, delay, expected, "retry %d", retry)
+		}
+	}
+}
+
+func TestSeededNameServerSelection(t *testing.T) {
+	picks := func(seed int64) []string {
+		config := InitTest(t)
+		for i := 2; i <= 9; i++ {
+			config.ExternalNameServersV4 = append(config.ExternalNameServersV4, NameServer{IP: net.ParseIP(fmt.Sprintf("192.0.2.%d", i)), Port: DefaultDNSPort})
+		}
+		config.Seed = seed
+		resolver, err := InitResolver(config)
+		require.NoError(t, err)
+		var picked []string
+		for i := 0; i < 20; i++ {
+			picked = append(picked, resolver.randomExternalNameServer().String())
+		}
+		return picked
+	}
+	require.Equal(t, picks(42), picks(42), "resolvers with the same seed pick the same name servers")
+	require.NotEqual(t, picks(42), picks(43))
+}
+
+func TestShouldBackOff(t *testing.T) {
+	require.True(t, shouldBackOff(StatusTimeout))
+	require.True(t, shouldBackOff(StatusServFail))
+	require.False(t, shouldBackOff(StatusRefused), "other servers may answer, retry them right away")
+	require.False(t, isStatusRetryable(StatusNXDomain), "NXDOMAIN is an answer, not a failure")
+}
+
+func TestSleepCtxRespectsDeadline(t *testing.T) {
+	require.True(t, sleepCtx(context.Background(), time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.False(t, sleepCtx(ctx, time.Second))
+	require.Less(t, time.Since(start), 10*time.Millisecond, "a sleep past the deadline shouldn't wait at all")
+}
+
+func TestTruncatedUDPResponseFallsBackToTCP(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+			resp.Truncated = true
+		} else {
+			resp.Answer = append(resp.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{"long record"}})
+		}
+		_ = w.WriteMsg(resp)
+	})
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := tcpListener.Addr().(*net.TCPAddr).Port
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	require.NoError(t, err)
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: handler}
+	udpServer := &dns.Server{PacketConn: udpConn, Handler: handler}
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	go func() { _ = udpServer.ActivateAndServe() }()
+	defer func() { _ = tcpServer.Shutdown() }()
+	defer func() { _ = udpServer.Shutdown() }()
+
+	config := NewResolverConfig()
+	ns := NameServer{IP: net.ParseIP("127.0.0.1"), Port: uint16(port)}
+	config.ExternalNameServersV4 = []NameServer{ns}
+	config.RootNameServersV4 = []NameServer{ns}
+	config.LocalAddrsV4 = []net.IP{net.ParseIP("127.0.0.1")}
+	config.IPVersionMode = IPv4Only
+	config.Retries = 0
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "example.com", Type: dns.TypeTXT, Class: dns.ClassINET}, &ns)
+	require.NoError(t, err)
+	require.Equal(t, StatusNoError, status)
+	require.Equal(t, TCPProtocol, res.Protocol)
+	require.True(t, res.TCPFallback)
+	require.Len(t, res.Answers, 1)
+}
+
+func TestAliasChain(t *testing.T) {
+	cnameSet := map[string][]Answer{
+		"www.example.com": {{Answer: "cdn.example.net."}},
+		"cdn.example.net": {{Answer: "edge.example.org."}},
+		"a.example.com":   {{Answer: "b.example.com."}},
+		"b.example.com":   {{Answer: "a.example.com."}},
+	}
+	dnameSet := map[string][]Answer{"example.org": {{Answer: "example.edu."}}}
+
+	chain, isLoop := aliasChain("WWW.example.com.", cnameSet, dnameSet, 12)
+	require.False(t, isLoop)
+	require.Equal(t, []string{"www.example.com", "cdn.example.net", "edge.example.org", "edge.example.edu"}, chain)
+
+	chain, isLoop = aliasChain("a.example.com", cnameSet, dnameSet, 12)
+	require.True(t, isLoop)
+	require.Equal(t, []string{"a.example.com", "b.example.com", "a.example.com"}, chain)
+
+	chain, isLoop = aliasChain("www.example.com", cnameSet, dnameSet, 1)
+	require.False(t, isLoop)
+	require.Len(t, chain, 3, "following stops one alias past the limit")
+
+	// a DNAME to a name beneath itself grows the name without ever repeating it
+	chain, isLoop = aliasChain("a.example.org", nil, map[string][]Answer{"example.org": {{Answer: "x.example.org."}}}, 5)
+	require.False(t, isLoop)
+	require.Len(t, chain, 7)
+}
+
+func TestFollowingLookupCNAMELoopAndDepth(t *testing.T) {
+	// each name is a CNAME to the next, alias-5 points back at alias-2
+	targets := map[string]string{"alias-0.test.": "alias-1.test.", "alias-1.test.": "alias-2.test.", "alias-2.test.": "alias-3.test.",
+		"alias-3.test.": "alias-4.test.", "alias-4.test.": "alias-5.test.", "alias-5.test.": "alias-2.test."}
+	ns := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.RecursionAvailable = true
+		if target, ok := targets[query.Question[0].Name]; ok {
+			resp.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target}}
+		}
+		return resp
+	})
+	config := newTestResolverConfig(ns)
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "alias-0.test", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.Error(t, err)
+	require.Equal(t, StatusCNAMELoop, status)
+	require.Equal(t, []string{"alias-0.test", "alias-1.test", "alias-2.test", "alias-3.test", "alias-4.test", "alias-5.test", "alias-2.test"}, res.CNAMEChain)
+
+	config.MaxCNAMEDepth = 3
+	resolver, err = InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+	res, _, status, err = resolver.ExternalLookup(context.Background(), &Question{Name: "alias-0.test", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.Error(t, err)
+	require.Equal(t, StatusServFail, status)
+	require.Equal(t, []string{"alias-0.test", "alias-1.test", "alias-2.test", "alias-3.test", "alias-4.test"}, res.CNAMEChain)
+}
+
+func TestIncludeRawResponse(t *testing.T) {
+	var sent []byte
+	var mu sync.Mutex
+	ns := startTestUDPServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.RecursionAvailable = true
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		packed, err := resp.Pack()
+		require.NoError(t, err)
+		mu.Lock()
+		sent = packed
+		mu.Unlock()
+		return resp
+	})
+	config := newTestResolverConfig(ns)
+	config.IncludeRawResponse = true
+	resolver, err := InitResolver(config)
+	require.NoError(t, err)
+	defer resolver.Close()
+
+	res, _, status, err := resolver.ExternalLookup(context.Background(), &Question{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Equal(t, StatusNoError, status)
+	raw, err := base64.StdEncoding.DecodeString(res.RawResponse)
+	require.NoError(t, err)
+	mu.Lock()
+	require.Equal(t, sent, raw)
+	mu.Unlock()
+
+	// without the option the response isn't kept
+	resolver, err = InitResolver(newTestResolverConfig(ns))
+	require.NoError(t, err)
+	defer resolver.Close()
+	res, _, _, err = resolver.ExternalLookup(context.Background(), &Question{Name: "example.net", Type: dns.TypeA, Class: dns.ClassINET}, ns)
+	require.NoError(t, err)
+	require.Empty(t, res.RawResponse)
+}
+
+func TestEncodeRawResponse(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	packed, err := m.Pack()
+	require.NoError(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte{1, 2, 3}), encodeRawResponse([]byte{1, 2, 3}, m), "the bytes as received are preferred")
+	require.Equal(t, base64.StdEncoding.EncodeToString(packed), encodeRawResponse(nil, m))
+}
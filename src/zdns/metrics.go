@@ -0,0 +1,57 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"github.com/zmap/zdns/src/internal/metrics"
+)
+
+// Metrics counts the queries and retries of the resolvers sharing it, for scraping while a scan runs. A nil *Metrics
+// records nothing.
+type Metrics struct {
+	queries *metrics.Counter
+	retries *metrics.Counter
+}
+
+// NewMetrics registers the resolver metrics in reg. If cache is set, its hits and misses are exposed as well, which
+// turns on its statistics.
+func NewMetrics(reg *metrics.Registry, cache *Cache) *Metrics {
+	m := &Metrics{
+		queries: reg.NewCounter("zdns_queries_total", "Queries sent to name servers, by response status.", "status"),
+		retries: reg.NewCounter("zdns_retries_total", "Queries retried against another name server after a failure."),
+	}
+	if cache != nil {
+		cache.Stats.CaptureStatistics()
+		reg.NewCounterFunc("zdns_cache_hits_total", "Lookups answered from the cache.", func() float64 {
+			return float64(cache.Stats.GetStatistics().Hits)
+		})
+		reg.NewCounterFunc("zdns_cache_misses_total", "Lookups not found in the cache.", func() float64 {
+			return float64(cache.Stats.GetStatistics().Misses)
+		})
+	}
+	return m
+}
+
+func (m *Metrics) recordQuery(status Status) {
+	if m != nil {
+		m.queries.Inc(string(status))
+	}
+}
+
+func (m *Metrics) recordRetry() {
+	if m != nil {
+		m.retries.Inc()
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type NameServerStrategy string
+
+const (
+	// NameServerStrategyRandom has each resolver pick one of the external name servers at random and stick to it
+	NameServerStrategyRandom NameServerStrategy = "random"
+	// NameServerStrategyRoundRobin cycles through the external name servers, lookup by lookup, across all resolvers
+	NameServerStrategyRoundRobin NameServerStrategy = "round-robin"
+	// NameServerStrategyLatencyWeighted picks external name servers at random, weighted by the inverse of their
+	// observed round trip time, so faster name servers get more of the lookups
+	NameServerStrategyLatencyWeighted NameServerStrategy = "latency-weighted"
+)
+
+const (
+	// rttSmoothing is the weight of a new sample in a name server's smoothed RTT
+	rttSmoothing = 0.25
+	// minWeightedRTT keeps a name server with a near-zero RTT, ex. on localhost, from getting every lookup
+	minWeightedRTT = time.Millisecond
+)
+
+// NameServerSelector picks the external name server of each lookup that isn't given one. It's safe for concurrent use
+// and meant to be shared between resolvers, so lookups are spread over the name servers across all threads.
+type NameServerSelector struct {
+	strategy NameServerStrategy
+	next     atomic.Uint64 // index of the next name server with round-robin
+
+	sync.Mutex
+	rtts map[string]time.Duration // smoothed RTT of each name server with latency-weighted, timeouts count as the full network timeout
+}
+
+// NewNameServerSelector returns a selector for strategy. NameServerStrategyRandom needs no selector, it's the default
+// behavior of a resolver.
+func NewNameServerSelector(strategy NameServerStrategy) (*NameServerSelector, error) {
+	switch strategy {
+	case NameServerStrategyRoundRobin, NameServerStrategyLatencyWeighted:
+		return &NameServerSelector{strategy: strategy, rtts: make(map[string]time.Duration)}, nil
+	default:
+		return nil, fmt.Errorf("invalid name server strategy %q, options: %s, %s", strategy, NameServerStrategyRoundRobin, NameServerStrategyLatencyWeighted)
+	}
+}
+
+// selectNameServer returns one of nameServers, which must not be empty
+func (s *NameServerSelector) selectNameServer(nameServers []NameServer, rnd *lockedRand) *NameServer {
+	if s.strategy == NameServerStrategyRoundRobin {
+		return &nameServers[(s.next.Add(1)-1)%uint64(len(nameServers))]
+	}
+	weights := s.weights(nameServers)
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	pick := rnd.Float64() * total
+	for i, w := range weights {
+		if pick < w {
+			return &nameServers[i]
+		}
+		pick -= w
+	}
+	return &nameServers[len(nameServers)-1]
+}
+
+// weights returns the selection weight of each name server, the inverse of its smoothed RTT. Name servers without an
+// RTT yet get the weight of the fastest one, so they're tried early on. A name server that times out isn't dropped, its
+// weight only falls, so it's still tried now and then and can win its share back once it recovers.
+func (s *NameServerSelector) weights(nameServers []NameServer) []float64 {
+	s.Lock()
+	defer s.Unlock()
+	weights := make([]float64, len(nameServers))
+	fastest := 0.0
+	for i := range nameServers {
+		if rtt, ok := s.rtts[nameServers[i].String()]; ok {
+			weights[i] = 1 / max(rtt, minWeightedRTT).Seconds()
+			fastest = max(fastest, weights[i])
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+	for i := range weights {
+		if weights[i] == 0 {
+			weights[i] = fastest
+		}
+	}
+	return weights
+}
+
+// recordRTT adds a round trip time sample for nameServer, a timeout is recorded as the network timeout
+func (s *NameServerSelector) recordRTT(nameServer *NameServer, rtt time.Duration) {
+	if s.strategy != NameServerStrategyLatencyWeighted {
+		return
+	}
+	key := nameServer.String()
+	s.Lock()
+	defer s.Unlock()
+	if smoothed, ok := s.rtts[key]; ok {
+		s.rtts[key] = smoothed + time.Duration(rttSmoothing*float64(rtt-smoothed))
+	} else {
+		s.rtts[key] = rtt
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testNameServers() []NameServer {
+	return []NameServer{
+		{IP: net.ParseIP("192.0.2.1"), Port: 53},
+		{IP: net.ParseIP("192.0.2.2"), Port: 53},
+		{IP: net.ParseIP("192.0.2.3"), Port: 53},
+	}
+}
+
+func TestNewNameServerSelector(t *testing.T) {
+	_, err := NewNameServerSelector(NameServerStrategyRoundRobin)
+	require.NoError(t, err)
+	_, err = NewNameServerSelector(NameServerStrategyLatencyWeighted)
+	require.NoError(t, err)
+	_, err = NewNameServerSelector("fastest")
+	require.Error(t, err)
+}
+
+func TestRoundRobinNameServerSelection(t *testing.T) {
+	s, err := NewNameServerSelector(NameServerStrategyRoundRobin)
+	require.NoError(t, err)
+	nameServers := testNameServers()
+	// shared by concurrent resolvers, every name server gets the same share
+	counts := make(map[string]int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				ns := s.selectNameServer(nameServers, newLockedRand(0))
+				mu.Lock()
+				counts[ns.String()]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, ns := range nameServers {
+		require.Equal(t, 40, counts[ns.String()])
+	}
+}
+
+func TestLatencyWeightedNameServerSelection(t *testing.T) {
+	s, err := NewNameServerSelector(NameServerStrategyLatencyWeighted)
+	require.NoError(t, err)
+	nameServers := testNameServers()
+	s.recordRTT(&nameServers[0], 10*time.Millisecond)
+	s.recordRTT(&nameServers[1], 100*time.Millisecond)
+
+	weights := s.weights(nameServers)
+	require.InDelta(t, 100, weights[0], 0.001)
+	require.InDelta(t, 10, weights[1], 0.001)
+	require.InDelta(t, 100, weights[2], 0.001, "name servers without an RTT are weighted like the fastest one")
+
+	// a name server that starts timing out loses most, but not all, of its share
+	for i := 0; i < 10; i++ {
+		s.recordRTT(&nameServers[0], 2*time.Second)
+	}
+	weights = s.weights(nameServers)
+	require.Less(t, weights[0], weights[1])
+	require.Greater(t, weights[0], 0.0)
+
+	picks := make(map[string]int)
+	rnd := newLockedRand(0)
+	for i := 0; i < 1000; i++ {
+		picks[s.selectNameServer(nameServers, rnd).String()]++
+	}
+	require.Greater(t, picks[nameServers[1].String()], picks[nameServers[0].String()])
+	require.Greater(t, picks[nameServers[2].String()], picks[nameServers[0].String()])
+}
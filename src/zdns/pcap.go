@@ -0,0 +1,211 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapVersionMajor      = 2
+	pcapVersionMinor      = 4
+	pcapSnapLen           = 65535
+	pcapLinkTypeRaw       = 101 // LINKTYPE_RAW, each packet begins with an IPv4 or IPv6 header
+	ipv4HeaderLen         = 20
+	ipv6HeaderLen         = 40
+	udpHeaderLen          = 8
+	ipProtocolUDP         = 17
+	pcapIPTTL             = 64
+)
+
+// PcapWriter writes DNS messages sent and received over UDP to a pcap file, with synthetic IP/UDP headers, so they can
+// be inspected in tools like Wireshark. It is safe for concurrent use by multiple resolvers.
+type PcapWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewPcapWriter writes the pcap global header to w and returns a PcapWriter that appends packets to it
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	// bytes 8-16 are the timezone offset and timestamp accuracy, both zero
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, fmt.Errorf("could not write pcap header: %w", err)
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WriteUDPPacket records a single UDP datagram carrying payload from src to dst
+func (pw *PcapWriter) WriteUDPPacket(src, dst *net.UDPAddr, payload []byte) error {
+	pkt, err := buildUDPPacket(src, dst, payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+
+	pw.Lock()
+	defer pw.Unlock()
+	if _, err = pw.w.Write(rec); err != nil {
+		return fmt.Errorf("could not write pcap record: %w", err)
+	}
+	return nil
+}
+
+// buildUDPPacket constructs an IPv4 or IPv6 packet, depending on the address family of src and dst, wrapping payload
+// in a UDP datagram
+func buildUDPPacket(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	udpLen := udpHeaderLen + len(payload)
+	if udpLen > 0xffff {
+		return nil, fmt.Errorf("payload of %d bytes is too large for a UDP datagram", len(payload))
+	}
+	udp := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, ipv4HeaderLen, ipv4HeaderLen+udpLen)
+		ip[0] = 0x45 // version 4, 5 32-bit words of header
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipv4HeaderLen+udpLen))
+		binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+		ip[8] = pcapIPTTL
+		ip[9] = ipProtocolUDP
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], internetChecksum(0, ip))
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, src4...)
+		pseudo = append(pseudo, dst4...)
+		pseudo = append(pseudo, 0, ipProtocolUDP, byte(udpLen>>8), byte(udpLen))
+		binary.BigEndian.PutUint16(udp[6:8], udpChecksum(pseudo, udp))
+		return append(ip, udp...), nil
+	}
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+	if src16 == nil || dst16 == nil {
+		return nil, fmt.Errorf("invalid addresses for pcap packet, src: %v, dst: %v", src, dst)
+	}
+	ip := make([]byte, ipv6HeaderLen, ipv6HeaderLen+udpLen)
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+	ip[6] = ipProtocolUDP
+	ip[7] = pcapIPTTL
+	copy(ip[8:24], src16)
+	copy(ip[24:40], dst16)
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, src16...)
+	pseudo = append(pseudo, dst16...)
+	pseudo = append(pseudo, 0, 0, byte(udpLen>>8), byte(udpLen), 0, 0, 0, ipProtocolUDP)
+	binary.BigEndian.PutUint16(udp[6:8], udpChecksum(pseudo, udp))
+	return append(ip, udp...), nil
+}
+
+func udpChecksum(pseudoHeader, udp []byte) uint16 {
+	sum := internetChecksum(0, pseudoHeader)
+	sum = internetChecksum(^sum, udp)
+	if sum == 0 {
+		// a zero checksum means "no checksum" for UDP, RFC 768
+		return 0xffff
+	}
+	return sum
+}
+
+// internetChecksum computes the RFC 1071 checksum of b, continuing from the one's complement of a previous checksum
+func internetChecksum(initial uint16, b []byte) uint16 {
+	sum := uint32(initial)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// pcapUDPConn wraps a UDP socket and records every datagram read from or written to it
+type pcapUDPConn struct {
+	*net.UDPConn
+	pcap *PcapWriter
+}
+
+func newPcapUDPConn(conn *net.UDPConn, pcap *PcapWriter) *pcapUDPConn {
+	return &pcapUDPConn{UDPConn: conn, pcap: pcap}
+}
+
+func (c *pcapUDPConn) Read(p []byte) (int, error) {
+	n, addr, err := c.UDPConn.ReadFrom(p)
+	if err == nil {
+		c.record(addr, c.LocalAddr(), p[:n])
+	}
+	return n, err
+}
+
+func (c *pcapUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(p)
+	if err == nil {
+		c.record(addr, c.LocalAddr(), p[:n])
+	}
+	return n, addr, err
+}
+
+func (c *pcapUDPConn) Write(p []byte) (int, error) {
+	n, err := c.UDPConn.Write(p)
+	if err == nil {
+		c.record(c.LocalAddr(), c.RemoteAddr(), p[:n])
+	}
+	return n, err
+}
+
+func (c *pcapUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.UDPConn.WriteTo(p, addr)
+	if err == nil {
+		c.record(c.LocalAddr(), addr, p[:n])
+	}
+	return n, err
+}
+
+func (c *pcapUDPConn) record(src, dst net.Addr, payload []byte) {
+	srcUDP, srcOK := src.(*net.UDPAddr)
+	dstUDP, dstOK := dst.(*net.UDPAddr)
+	if !srcOK || !dstOK {
+		log.Warnf("unable to record packet from %v to %v in pcap, not UDP addresses", src, dst)
+		return
+	}
+	if err := c.pcap.WriteUDPPacket(srcUDP, dstUDP, payload); err != nil {
+		log.Warnf("unable to record packet in pcap: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 24, buf.Len())
+	require.Equal(t, uint32(pcapMagicMicroseconds), binary.LittleEndian.Uint32(buf.Bytes()[0:4]))
+	require.Equal(t, uint32(pcapLinkTypeRaw), binary.LittleEndian.Uint32(buf.Bytes()[20:24]))
+
+	payload := []byte{0x30, 0x39, 0x01, 0x00, 0x00}
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.UDPAddr{IP: net.ParseIP("198.51.100.53"), Port: 53}
+	require.NoError(t, pw.WriteUDPPacket(src, dst, payload))
+
+	rec := buf.Bytes()[24:]
+	pktLen := int(binary.LittleEndian.Uint32(rec[8:12]))
+	require.Equal(t, ipv4HeaderLen+udpHeaderLen+len(payload), pktLen)
+	require.Equal(t, pktLen, int(binary.LittleEndian.Uint32(rec[12:16])))
+	pkt := rec[16:]
+	require.Len(t, pkt, pktLen)
+	require.Equal(t, byte(0x45), pkt[0])
+	require.Equal(t, byte(ipProtocolUDP), pkt[9])
+	require.Equal(t, src.IP.To4(), net.IP(pkt[12:16]))
+	require.Equal(t, dst.IP.To4(), net.IP(pkt[16:20]))
+	// a correct header checksums to zero
+	require.Equal(t, uint16(0), internetChecksum(0, pkt[:ipv4HeaderLen]))
+	udp := pkt[ipv4HeaderLen:]
+	require.Equal(t, uint16(40000), binary.BigEndian.Uint16(udp[0:2]))
+	require.Equal(t, uint16(53), binary.BigEndian.Uint16(udp[2:4]))
+	require.Equal(t, payload, udp[udpHeaderLen:])
+}
+
+func TestPcapWriterIPv6(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	require.NoError(t, err)
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst := &net.UDPAddr{IP: net.ParseIP("2001:db8::53"), Port: 53}
+	require.NoError(t, pw.WriteUDPPacket(src, dst, []byte{1, 2, 3}))
+	pkt := buf.Bytes()[24+16:]
+	require.Len(t, pkt, ipv6HeaderLen+udpHeaderLen+3)
+	require.Equal(t, byte(0x60), pkt[0])
+	require.Equal(t, byte(ipProtocolUDP), pkt[6])
+	require.Equal(t, src.IP, net.IP(pkt[8:24]))
+	require.Equal(t, dst.IP, net.IP(pkt[24:40]))
+	require.NotEqual(t, uint16(0), binary.BigEndian.Uint16(pkt[ipv6HeaderLen+6:ipv6HeaderLen+8]), "UDP checksum is mandatory over IPv6")
+}
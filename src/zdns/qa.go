@@ -50,39 +50,95 @@ type TraceStep struct {
 	Layer      string            `json:"layer" groups:"trace"`
 	Cached     IsCached          `json:"cached" groups:"trace"`
 	Try        int               `json:"try" groups:"trace"`
+	Lame       bool              `json:"lame,omitempty" groups:"trace"` // the name server doesn't serve the zone it was delegated
+	// status of the attempt, set on the steps of external lookups and on failed iteration steps, so failures can be told
+	// apart
+	Status Status `json:"status,omitempty" groups:"trace"`
+	// wall time of the step in milliseconds, retries at the same layer included
+	DurationMS float64 `json:"duration_ms,omitempty" groups:"timing"`
 }
 
 // Result contains all the metadata from a complete lookup(s) for a name. Results is keyed with the ModuleName.
 type Result struct {
 	AlteredName string                        `json:"altered_name,omitempty" groups:"short,normal,long,trace"`
 	Name        string                        `json:"name,omitempty" groups:"short,normal,long,trace"`
+	UnicodeName string                        `json:"unicode_name,omitempty" groups:"short,normal,long,trace"` // the name as given in the input when it was converted to punycode for the lookup
 	Nameserver  string                        `json:"nameserver,omitempty" groups:"normal,long,trace"`
 	Class       string                        `json:"class,omitempty" groups:"long,trace"`
 	AlexaRank   int                           `json:"alexa_rank,omitempty" groups:"short,normal,long,trace"`
 	Metadata    string                        `json:"metadata,omitempty" groups:"short,normal,long,trace"`
+	Transport   string                        `json:"transport,omitempty" groups:"short,normal,long,trace"` // transport selected by the input line's metadata, if any
+	InputFile   string                        `json:"input_file,omitempty" groups:"short,normal,long,trace"`
 	Results     map[string]SingleModuleResult `json:"results,omitempty" groups:"short,normal,long,trace"`
 }
 
 // SingleModuleResult contains all the metadata from a complete lookup for a name, potentially after following many CNAMEs/etc.
 type SingleModuleResult struct {
-	Status    string      `json:"status,omitempty" groups:"short,normal,long,trace"`
-	Error     string      `json:"error,omitempty" groups:"short,normal,long,trace"`
-	Timestamp string      `json:"timestamp,omitempty" groups:"short,normal,long,trace"`
-	Duration  float64     `json:"duration,omitempty" groups:"short,normal,long,trace"` // in seconds
-	Data      interface{} `json:"data,omitempty" groups:"short,normal,long,trace"`
-	Trace     Trace       `json:"trace,omitempty" groups:"trace"`
+	Status     string      `json:"status,omitempty" groups:"short,normal,long,trace"`
+	Error      string      `json:"error,omitempty" groups:"short,normal,long,trace"`
+	Timestamp  string      `json:"timestamp,omitempty" groups:"short,normal,long,trace"`
+	Duration   float64     `json:"duration,omitempty" groups:"short,normal,long,trace"`   // in seconds
+	QueryCount int         `json:"query_count,omitempty" groups:"query_count,long,trace"` // queries sent to name servers for this lookup, including iteration, retries, CNAME following and DNSSEC
+	Data       interface{} `json:"data,omitempty" groups:"short,normal,long,trace"`
+	Trace      Trace       `json:"trace,omitempty" groups:"trace"`
+	// TraceTruncated is the number of trace steps left out of Trace to respect the CLI's --max-trace-entries
+	TraceTruncated int `json:"trace_truncated,omitempty" groups:"trace"`
+	// NameServersConsulted lists the IP of every name server queried for this lookup, see Trace.NameServersConsulted
+	NameServersConsulted []string `json:"nameservers_consulted,omitempty" groups:"nameservers_consulted,trace"`
+	// LameNameServers lists the IP of every name server found to be a lame delegation during iteration, see Trace.LameNameServers
+	LameNameServers []string `json:"lame_nameservers,omitempty" groups:"short,normal,long,trace"`
+	// DurationMS is the wall time of the lookup in milliseconds, finer grained than Duration for latency distributions
+	DurationMS float64 `json:"duration_ms,omitempty" groups:"timing"`
 }
 
 // SingleQueryResult contains the results of a single DNS query
 type SingleQueryResult struct {
-	Answers            []interface{} `json:"answers,omitempty" groups:"short,normal,long,trace"`
-	Additionals        []interface{} `json:"additionals,omitempty" groups:"short,normal,long,trace"`
-	Authorities        []interface{} `json:"authorities,omitempty" groups:"short,normal,long,trace"`
-	Protocol           string        `json:"protocol" groups:"protocol,normal,long,trace"`
-	Resolver           string        `json:"resolver" groups:"resolver,normal,long,trace"` // IP address
-	Flags              DNSFlags      `json:"flags" groups:"flags,long,trace"`
-	DNSSECResult       *DNSSECResult `json:"dnssec,omitempty" groups:"dnssec,normal,long,trace"`
-	TLSServerHandshake interface{}   `json:"tls_handshake,omitempty" groups:"normal,long,trace"` // used for --tls and --https, JSON string of the TLS handshake
+	Answers            []interface{}    `json:"answers,omitempty" groups:"short,normal,long,trace"`
+	AnswersTruncated   bool             `json:"answers_truncated,omitempty" groups:"short,normal,long,trace"` // answers beyond the CLI's --max-answers were left out
+	Additionals        []interface{}    `json:"additionals,omitempty" groups:"short,normal,long,trace"`
+	Authorities        []interface{}    `json:"authorities,omitempty" groups:"short,normal,long,trace"`
+	ExtraAnswers       []interface{}    `json:"extra_answers,omitempty" groups:"short,normal,long,trace"` // answer records unrelated to the query, only with SeparateUnrelatedAnswers
+	Protocol           string           `json:"protocol" groups:"protocol,normal,long,trace"`
+	TCPFallback        bool             `json:"tcp_fallback,omitempty" groups:"protocol,normal,long,trace"`  // the UDP response was truncated, so the query was retried over TCP
+	Resolver           string           `json:"resolver" groups:"resolver,normal,long,trace"`                // IP address
+	RootServer         string           `json:"root_server,omitempty" groups:"iteration_servers,long,trace"` // root server queried during iterative resolution
+	TLDServer          string           `json:"tld_server,omitempty" groups:"iteration_servers,long,trace"`  // TLD server queried during iterative resolution
+	Flags              DNSFlags         `json:"flags" groups:"flags,long,trace"`
+	QuerySize          *QuerySize       `json:"query_size,omitempty" groups:"query_size,long,trace"`
+	ResponseSize       int              `json:"response_size,omitempty" groups:"query_size,long,trace"`      // wire size in bytes of the response received
+	Cookie             *DNSCookie       `json:"cookie,omitempty" groups:"cookie,long,trace"`                 // only with DNSCookies
+	StrayResponses     int              `json:"stray_responses,omitempty" groups:"long,trace"`               // late or stray responses to other queries discarded while waiting on a recycled UDP socket
+	SourcePort         int              `json:"source_port,omitempty" groups:"source_port,long,trace"`       // local port a UDP query was sent from
+	NXDomainTarget     string           `json:"nxdomain_target,omitempty" groups:"short,normal,long,trace"`  // name at the end of the CNAME/DNAME chain that doesn't exist, with StatusCNAMETargetNXDomain
+	CNAMEChain         []string         `json:"cname_chain,omitempty" groups:"short,normal,long,trace"`      // names followed through CNAMEs/DNAMEs from the queried name, if any were
+	CNAMEViolations    []CNAMEViolation `json:"cname_violations,omitempty" groups:"short,normal,long,trace"` // only with DetectCNAMEViolations
+	Zone               string           `json:"zone,omitempty" groups:"normal,long,trace"`                   // apex of the zone the response comes from, from its SOA, if any
+	OutOfBailiwick     int              `json:"out_of_bailiwick,omitempty" groups:"normal,long,trace"`       // records of an iterative response outside the zone of the queried name server
+	DNSSECResult       *DNSSECResult    `json:"dnssec,omitempty" groups:"dnssec,normal,long,trace"`
+	TLSServerHandshake interface{}      `json:"tls_handshake,omitempty" groups:"normal,long,trace"` // used for --tls and --https, JSON string of the TLS handshake
+	RawResponse        string           `json:"raw_response,omitempty" groups:"raw"`                // base64 of the response in wire format, only with IncludeRawResponse
+}
+
+// QuerySize records the wire size in bytes of the query sent to the name server, with and without name compression
+type QuerySize struct {
+	Sent         int `json:"sent" groups:"query_size,long,trace"`
+	Compressed   int `json:"compressed" groups:"query_size,long,trace"`
+	Uncompressed int `json:"uncompressed" groups:"query_size,long,trace"`
+}
+
+// CNAMEViolationType is a way in which a zone breaks the rule that a CNAME is the only data at its owner name, RFC 1034 section 3.6.2
+type CNAMEViolationType string
+
+const (
+	CNAMEAndOtherData CNAMEViolationType = "cname_and_other_data" // a CNAME shares its owner name with records of other types
+	MultipleCNAMEs    CNAMEViolationType = "multiple_cnames"      // more than one CNAME exists at the same owner name
+	CNAMEAtApex       CNAMEViolationType = "cname_at_apex"        // a CNAME exists at a zone apex, alongside the zone's SOA
+)
+
+// CNAMEViolation records a single CNAME protocol violation found in a response
+type CNAMEViolation struct {
+	Type CNAMEViolationType `json:"type" groups:"short,normal,long,trace"`
+	Name string             `json:"name" groups:"short,normal,long,trace"` // owner name of the offending CNAME
 }
 
 type ExtendedResult struct {
@@ -90,10 +146,14 @@ type ExtendedResult struct {
 	Res        SingleQueryResult `json:"result,omitempty" groups:"short,normal,long,trace"`
 	Status     Status            `json:"status" groups:"short,normal,long,trace"`
 	Nameserver string            `json:"nameserver" groups:"short,normal,long,trace"` // NS name queried for this result
+	// DNSSECStatus is the validation status of this nameserver's response alone, set if DNSSEC validation is enabled
+	DNSSECStatus DNSSECStatus `json:"dnssec_status,omitempty" groups:"dnssec,normal,long,trace"`
 }
 
 type AllNameServersResult struct {
 	LayeredResponses map[string][]ExtendedResult `json:"per_layer_responses" groups:"short,normal,long,trace"`
+	// DNSSECInconsistent is true if the authoritative nameservers' responses to the question validated differently
+	DNSSECInconsistent bool `json:"dnssec_inconsistent,omitempty" groups:"dnssec,normal,long,trace"`
 }
 
 type IPResult struct {
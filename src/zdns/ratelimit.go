@@ -0,0 +1,152 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rateLimiterBurst is how far ahead of an even spacing queries may be sent, so short bursts aren't needlessly delayed
+const rateLimiterBurst = 100 * time.Millisecond
+
+// RateLimiter is a token bucket that limits how many queries per second are sent. It's safe for concurrent use and
+// only holds its lock to reserve a send time, callers wait outside of it.
+type RateLimiter struct {
+	sync.Mutex
+	interval time.Duration // time for the bucket to gain one token
+	burst    time.Duration // bucket size, as the time it takes to fill
+	nextSend time.Time     // time at which the bucket would be empty if every reservation so far was made
+}
+
+// NewRateLimiter returns a RateLimiter allowing qps queries per second, qps must be positive
+func NewRateLimiter(qps int) *RateLimiter {
+	interval := time.Second / time.Duration(qps)
+	return &RateLimiter{interval: interval, burst: max(rateLimiterBurst-interval, 0)}
+}
+
+// reserve takes a token and returns when the caller may send with it. If that's past deadline, the token is left in
+// the bucket and ok is false. A zero deadline means the caller has none.
+func (rl *RateLimiter) reserve(now, deadline time.Time) (sendAt time.Time, ok bool) {
+	rl.Lock()
+	defer rl.Unlock()
+	next := rl.nextSend
+	if next.Before(now) {
+		next = now
+	}
+	sendAt = next.Add(-rl.burst)
+	if sendAt.Before(now) {
+		sendAt = now
+	}
+	if !deadline.IsZero() && deadline.Before(sendAt) {
+		return sendAt, false
+	}
+	rl.nextSend = next.Add(rl.interval)
+	return sendAt, true
+}
+
+// cancel puts back the token of a reservation whose caller stopped waiting for it, so it doesn't delay later callers
+func (rl *RateLimiter) cancel() {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.nextSend = rl.nextSend.Add(-rl.interval)
+}
+
+// idle reports whether the bucket is full, in which case the limiter behaves as a new one would
+func (rl *RateLimiter) idle(now time.Time) bool {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.nextSend.Before(now)
+}
+
+// Wait blocks until a token is available, or returns an error if ctx is done first
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	now := time.Now()
+	deadline, _ := ctx.Deadline()
+	sendAt, ok := rl.reserve(now, deadline)
+	return rl.waitUntil(ctx, now, sendAt, ok)
+}
+
+// waitUntil waits for the send time of a reservation made at now, returning its token if ctx is done first
+func (rl *RateLimiter) waitUntil(ctx context.Context, now, sendAt time.Time, ok bool) error {
+	if !ok {
+		return fmt.Errorf("rate limit of one query per %v would delay the query past its deadline", rl.interval)
+	}
+	if !sendAt.After(now) {
+		return nil
+	}
+	timer := time.NewTimer(sendAt.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		rl.cancel()
+		return ctx.Err()
+	}
+}
+
+// nameServerRateLimiterSweepInterval is how often a NameServerRateLimiter drops the limiters of name servers it no
+// longer has queries pending for, so scans touching many name servers don't keep one limiter per IP forever
+const nameServerRateLimiterSweepInterval = time.Minute
+
+// NameServerRateLimiter limits how many queries per second are sent to each name server IP, it's safe for concurrent
+// use and meant to be shared between resolvers
+type NameServerRateLimiter struct {
+	sync.Mutex
+	qps       int
+	limiters  map[string]*RateLimiter
+	lastSweep time.Time // when idle limiters were last dropped
+}
+
+// NewNameServerRateLimiter returns a NameServerRateLimiter allowing qps queries per second to each name server
+func NewNameServerRateLimiter(qps int) *NameServerRateLimiter {
+	return &NameServerRateLimiter{qps: qps, limiters: make(map[string]*RateLimiter), lastSweep: time.Now()}
+}
+
+// Wait blocks until a query may be sent to nameServer, or returns an error if ctx is done first
+func (l *NameServerRateLimiter) Wait(ctx context.Context, nameServer *NameServer) error {
+	key := nameServer.IP.String()
+	now := time.Now()
+	deadline, _ := ctx.Deadline()
+	// reservations are made under the lock, so a limiter found idle by a sweep can't have one in the making
+	l.Lock()
+	if now.Sub(l.lastSweep) >= nameServerRateLimiterSweepInterval {
+		l.sweep(now)
+	}
+	rl, ok := l.limiters[key]
+	if !ok {
+		rl = NewRateLimiter(l.qps)
+		l.limiters[key] = rl
+	}
+	sendAt, ok := rl.reserve(now, deadline)
+	l.Unlock()
+	if err := rl.waitUntil(ctx, now, sendAt, ok); err != nil {
+		return fmt.Errorf("waiting to query nameserver %s: %w", nameServer, err)
+	}
+	return nil
+}
+
+// sweep drops the limiters whose bucket is full, a new limiter is created for their name server when it's queried again
+func (l *NameServerRateLimiter) sweep(now time.Time) {
+	for key, rl := range l.limiters {
+		if rl.idle(now) {
+			delete(l.limiters, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,111 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reserveNoDeadline takes a token for a caller without a deadline and returns its send time
+func reserveNoDeadline(rl *RateLimiter, now time.Time) time.Time {
+	sendAt, _ := rl.reserve(now, time.Time{})
+	return sendAt
+}
+
+func TestRateLimiterSpacesReservations(t *testing.T) {
+	rl := NewRateLimiter(100) // one token every 10ms, with 90ms of burst
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		require.Equal(t, now, reserveNoDeadline(rl, now), "reservation %d should fit in the burst", i)
+	}
+	require.Equal(t, now.Add(10*time.Millisecond), reserveNoDeadline(rl, now))
+	require.Equal(t, now.Add(20*time.Millisecond), reserveNoDeadline(rl, now))
+	// once idle long enough, the bucket refills
+	later := now.Add(time.Second)
+	require.Equal(t, later, reserveNoDeadline(rl, later))
+}
+
+func TestRateLimiterWaitRespectsDeadline(t *testing.T) {
+	rl := NewRateLimiter(1)
+	require.NoError(t, rl.Wait(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, rl.Wait(ctx), "the next token is a second away, past the deadline")
+}
+
+func TestRateLimiterAbandonedWaitsKeepTheirToken(t *testing.T) {
+	rl := NewRateLimiter(10) // one token every 100ms, no burst
+	now := time.Now()
+	require.Equal(t, now, reserveNoDeadline(rl, now))
+	_, ok := rl.reserve(now, now.Add(10*time.Millisecond))
+	require.False(t, ok, "the next token is 100ms away, past the deadline")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, rl.Wait(ctx))
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	require.ErrorIs(t, rl.Wait(ctx), context.Canceled)
+	// neither the wait that couldn't meet its deadline nor the ones given up on took a token from the next caller
+	require.Equal(t, now.Add(100*time.Millisecond), reserveNoDeadline(rl, now))
+}
+
+func TestNameServerRateLimiterIsPerNameServer(t *testing.T) {
+	l := NewNameServerRateLimiter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	a := &NameServer{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	b := &NameServer{IP: net.ParseIP("192.0.2.2"), Port: 53}
+	require.NoError(t, l.Wait(ctx, a))
+	require.NoError(t, l.Wait(ctx, b), "a different name server has its own bucket")
+	require.Error(t, l.Wait(ctx, &NameServer{IP: net.ParseIP("192.0.2.1"), Port: 853}), "the bucket is keyed by IP, not port")
+}
+
+func TestRateLimiterConcurrentReservations(t *testing.T) {
+	rl := NewRateLimiter(1000)
+	now := time.Now()
+	const threads = 100
+	sendTimes := make(chan time.Time, threads)
+	for i := 0; i < threads; i++ {
+		go func() {
+			sendTimes <- reserveNoDeadline(rl, now)
+		}()
+	}
+	latest := now
+	for i := 0; i < threads; i++ {
+		if sendAt := <-sendTimes; sendAt.After(latest) {
+			latest = sendAt
+		}
+	}
+	// 100 reservations at 1000 QPS, with the first 100ms of tokens in the bucket, all fit without waiting
+	require.Equal(t, now, latest)
+	require.Equal(t, now.Add(time.Millisecond), reserveNoDeadline(rl, now))
+}
+
+func TestNameServerRateLimiterDropsIdleLimiters(t *testing.T) {
+	l := NewNameServerRateLimiter(1000)
+	a := &NameServer{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	b := &NameServer{IP: net.ParseIP("192.0.2.2"), Port: 53}
+	require.NoError(t, l.Wait(context.Background(), a))
+	time.Sleep(5 * time.Millisecond) // a's bucket refills
+	l.lastSweep = time.Time{}
+	require.NoError(t, l.Wait(context.Background(), b))
+	require.NotContains(t, l.limiters, a.IP.String())
+	require.Contains(t, l.limiters, b.IP.String())
+}
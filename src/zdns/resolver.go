@@ -17,7 +17,6 @@ package zdns
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"net"
 	"strings"
 	"time"
@@ -36,15 +35,19 @@ import (
 )
 
 const (
-	defaultTimeout               = 15 * time.Second // timeout for resolving a single name
-	defaultIterativeTimeout      = 4 * time.Second  // timeout for single iteration in an iterative query
-	defaultNetworkTimeout        = 2 * time.Second  // timeout for a single on-the-wire network call
+	defaultTimeout               = 15 * time.Second       // timeout for resolving a single name
+	defaultIterativeTimeout      = 4 * time.Second        // timeout for single iteration in an iterative query
+	defaultNetworkTimeout        = 2 * time.Second        // timeout for a single on-the-wire network call
+	defaultUDPRetransmitInterval = 500 * time.Millisecond // time to wait before retransmitting a UDP query
 	defaultTransportMode         = UDPOrTCP
 	defaultShouldRecycleSockets  = true
 	defaultLogVerbosity          = 3 // 1 = lowest, 5 = highest
 	defaultRetries               = 1
 	defaultMaxDepth              = 10
+	defaultMaxCNAMEDepth         = 12
 	defaultCheckingDisabledBit   = false // Sends DNS packets with the CD bit set
+	defaultCompressQueries       = true  // Pack outbound queries with DNS name compression
+	defaultUDPBufferSize         = 1232  // EDNS0 UDP payload size advertised in queries, per DNS flag day 2020
 	defaultNameServerModeEnabled = false // Treats input as nameservers to query with a static query rather than queries to send to a static name server
 	defaultFollowCNAMEs          = true  // Follow CNAMEs/DNAMEs in iterative queries
 	defaultCacheSize             = 10000
@@ -77,29 +80,90 @@ type ResolverConfig struct {
 	IPVersionMode         IPVersionMode
 	IterationIPPreference IterationIPPreference // preference for IPv4 or IPv6 lookups in iterative queries
 	ShouldRecycleSockets  bool
+	TXTTCPFallback        bool // with UDPOnly, still retry truncated TXT responses over TCP
+	RandomizeSourcePort   bool // send each UDP query from a fresh socket bound to a random port, instead of a recycled socket or an OS-picked port
 
 	IterativeTimeout      time.Duration // applicable to iterative queries only, timeout for a single iteration step
 	NetworkTimeout        time.Duration // timeout for a single on-the-wire network call
+	QueryTimeout          time.Duration // if set, deadline for a query to one name server across all its network calls, ex. a TCP fallback
+	UDPRetransmits        int           // number of quick retransmits of a UDP query on the same socket before it times out
+	UDPRetransmitInterval time.Duration // time to wait for a response before retransmitting a UDP query
 	Timeout               time.Duration // timeout for the resolution of a single name
+	RetryBackoff          time.Duration // delay before retrying a timeout or SERVFAIL, doubled for each retry after with jitter. 0 retries immediately
+	NoRetryServFail       bool          // SERVFAIL answers are returned as-is instead of being retried
+	ServFailOtherServer   bool          // an external lookup that got SERVFAIL from a name server picked from the pool is retried against another
 	MaxDepth              int
 	ExternalNameServersV4 []NameServer // v4 name servers used for external lookups
 	ExternalNameServersV6 []NameServer // v6 name servers used for external lookups
 	RootNameServersV4     []NameServer // v4 root servers used for iterative lookups
 	RootNameServersV6     []NameServer // v6 root servers used for iterative lookups
 	LookupAllNameServers  bool         // perform the lookup via all the nameservers for the name
+	AllNSConcurrency      int          // how many nameservers are queried at once with LookupAllNameServers. 0 or 1 queries them one at a time
 	FollowCNAMEs          bool         // whether iterative lookups should follow CNAMEs/DNAMEs
+	MaxCNAMEDepth         int          // most CNAMEs/DNAMEs followed from a queried name with FollowCNAMEs
+	QNAMEMinimization     bool         // whether iterative lookups only send each name server the labels it needs, RFC 7816
 	DNSConfigFilePath     string       // path to the DNS config file, ex: /etc/resolv.conf
 
 	DNSSecEnabled        bool
-	ShouldValidateDNSSEC bool           // whether to validate DNSSEC
-	DNSOverHTTPS         bool           // whether to use DNS over HTTPS for External Lookups, n/a to Iterative Lookups
-	DNSOverTLS           bool           // whether to use DNS over TLS for External Lookups, n/a to Iterative Lookups
-	RootCAs              *x509.CertPool // Root CAs for DoT/DoH Server Verification
-	VerifyServerCert     bool           // Verify server certificates for DoT/DoH
-	HTTPSClientIPv4      *http.Client   // for DoH, per docs should be shared amongst requests
-	HTTPSClientIPv6      *http.Client   // for DoH, per docs should be shared amongst requests
-	EdnsOptions          []dns.EDNS0
-	CheckingDisabledBit  bool
+	ShouldValidateDNSSEC bool // whether to validate DNSSEC
+	// DNSSECFetchGroup, if set, coalesces DNSSEC validation's DNSKEY/DS lookups across the resolvers sharing it
+	DNSSECFetchGroup *DNSSECFetchGroup
+	// DNSSECClockSkew is how far outside of their validity period RRSIGs are still accepted, to tolerate clock drift
+	DNSSECClockSkew time.Duration
+	// TrustAnchors, if set, are the DS records DNSSEC validation trusts for each zone instead of fetching them from
+	// its parent. Anchors for the root augment the built-in root anchors, unless ReplaceRootAnchors is set.
+	TrustAnchors TrustAnchors
+	// ReplaceRootAnchors makes the root anchors in TrustAnchors replace the built-in root anchors
+	ReplaceRootAnchors bool
+	// DNSSECAllowedAlgorithms, if set, are the only algorithms DNSSEC validation accepts RRSIGs made with, RRSIGs made
+	// with others fail to verify so records only signed with them are Bogus
+	DNSSECAllowedAlgorithms []uint8
+	// DNSSECValidateSections are the message sections DNSSEC validation runs over. If empty, all sections are validated
+	DNSSECValidateSections []DNSSECSection
+	DNSOverHTTPS           bool           // whether to use DNS over HTTPS for External Lookups, n/a to Iterative Lookups
+	DNSOverTLS             bool           // whether to use DNS over TLS for External Lookups, n/a to Iterative Lookups
+	TLSServerName          string         // if set, used for DoT SNI and certificate verification instead of the name server's domain name
+	RootCAs                *x509.CertPool // Root CAs for DoT/DoH Server Verification
+	VerifyServerCert       bool           // Verify server certificates for DoT/DoH
+	HTTPSClientIPv4        *http.Client   // for DoH, per docs should be shared amongst requests
+	HTTPSClientIPv6        *http.Client   // for DoH, per docs should be shared amongst requests
+	EdnsOptions            []dns.EDNS0
+	DNSCookies             bool // whether to send DNS cookies, RFC 7873, and report the ones name servers return
+	CheckingDisabledBit    bool
+	CompressQueries        bool // whether outbound queries are packed with DNS name compression
+	// RecursionDisabled clears the RD bit on queries to external name servers too, ex. to probe authoritative servers
+	// directly. Iterative queries never set it
+	RecursionDisabled bool
+	// EDNSPadding, if set, pads queries over DoT/DoH to a multiple of this many bytes with the EDNS0 padding option, RFC 7830
+	EDNSPadding int
+	// EDNSPaddingPlaintext pads queries over plain UDP/TCP too, when EDNSPadding is set
+	EDNSPaddingPlaintext bool
+	// UDPBufferSize is the EDNS0 UDP payload size advertised in queries, the largest UDP response name servers may send
+	// before truncating. At least 512, 0 for the default of 1232
+	UDPBufferSize uint16
+	// Seed seeds the random choices of the resolver, ex. the name server an external lookup is sent to or the order
+	// authorities are tried in, so lookups can be reproduced. 0 picks a random seed
+	Seed int64
+
+	SeparateUnrelatedAnswers  bool // report answer records unrelated to the query under ExtraAnswers instead of Answers
+	ReportCNAMETargetNXDomain bool // report StatusCNAMETargetNXDomain instead of NXDOMAIN/NOERROR when a CNAME/DNAME chain leads to a non-existent name
+	DetectCNAMEViolations     bool // report CNAMEs that coexist with other data or sit at a zone apex under CNAMEViolations
+	IncludeRawResponse        bool // report each response's wire format, base64 encoded, under RawResponse
+	StripOutOfBailiwick       bool // leave the records of iterative responses outside the zone of the queried name server out of results, they're counted under OutOfBailiwick either way
+
+	PcapWriter *PcapWriter // if set, UDP queries and responses are recorded here. May be shared between resolvers
+	// Metrics, if set, counts the queries and retries of the resolvers sharing it
+	Metrics *Metrics
+	// RateLimiter, if set, limits the queries per second sent by all the resolvers sharing it, retries included
+	RateLimiter *RateLimiter
+	// NameServerRateLimiter, if set, limits the queries per second sent to each name server by the resolvers sharing it
+	NameServerRateLimiter *NameServerRateLimiter
+	// NameServerSelector, if set, picks the external name server of lookups that aren't given one, instead of each
+	// resolver sticking to one picked at random
+	NameServerSelector *NameServerSelector
+	// NameServerCircuitBreaker, if set, leaves external name servers that keep failing out of the selection of lookups
+	// that aren't given a name server, until they've cooled down
+	NameServerCircuitBreaker *NameServerCircuitBreaker
 }
 
 // Validate checks if the ResolverConfig is valid, returns an error describing the issue if it is not.
@@ -119,6 +183,50 @@ func (rc *ResolverConfig) Validate() error {
 		return errors.New("cannot use DNS over HTTPS with UDP only transport mode")
 	}
 
+	if rc.NoRetryServFail && rc.ServFailOtherServer {
+		return errors.New("cannot retry SERVFAIL against another name server when SERVFAIL isn't retried")
+	}
+	if rc.UDPBufferSize != 0 && rc.UDPBufferSize < dns.MinMsgSize {
+		return fmt.Errorf("UDP buffer size must be at least %d bytes", dns.MinMsgSize)
+	}
+	if rc.QueryTimeout < 0 {
+		return errors.New("query timeout cannot be negative")
+	}
+	if rc.QueryTimeout > 0 && rc.QueryTimeout < rc.NetworkTimeout {
+		return errors.New("query timeout cannot be less than the network timeout it bounds")
+	}
+	if rc.RetryBackoff < 0 {
+		return errors.New("retry backoff cannot be negative")
+	}
+	if rc.MaxCNAMEDepth < 0 {
+		return errors.New("max CNAME depth cannot be negative")
+	}
+	if rc.AllNSConcurrency < 0 {
+		return errors.New("all nameservers concurrency cannot be negative")
+	}
+	if rc.EDNSPadding < 0 || rc.EDNSPadding > dns.MaxMsgSize {
+		return fmt.Errorf("EDNS padding block size must be between 0 and %d", dns.MaxMsgSize)
+	}
+
+	if rc.UDPRetransmits < 0 {
+		return errors.New("UDP retransmits cannot be negative")
+	}
+	if rc.UDPRetransmits > 0 && rc.UDPRetransmitInterval <= 0 {
+		return errors.New("UDP retransmit interval must be positive when using UDP retransmits")
+	}
+
+	if rc.DNSSECClockSkew < 0 {
+		return errors.New("DNSSEC clock skew cannot be negative")
+	}
+	for _, section := range rc.DNSSECValidateSections {
+		if !section.isValid() {
+			return fmt.Errorf("invalid DNSSEC validation section: %s", section)
+		}
+	}
+	if rc.ReplaceRootAnchors && len(rc.TrustAnchors[rootZone]) == 0 {
+		return errors.New("replacing the built-in root trust anchors requires a trust anchor for the root zone")
+	}
+
 	if rc.DNSOverTLS && rc.DNSOverHTTPS {
 		return errors.New("cannot use both DNS over TLS and DNS over HTTPS")
 	}
@@ -191,10 +299,10 @@ func (rc *ResolverConfig) Validate() error {
 		}
 	}
 
-	// Ensure no IPv6 link-local/multicast external/root nameservers are used
+	// Link-local IPv6 external/root nameservers are only reachable through the interface named by their zone
 	for _, ns := range util.Concat(rc.ExternalNameServersV6, rc.RootNameServersV6) {
-		if ns.IP.IsLinkLocalUnicast() || ns.IP.IsLinkLocalMulticast() {
-			return fmt.Errorf("link-local IPv6 external/root nameservers are not supported: %v", ns.IP)
+		if (ns.IP.IsLinkLocalUnicast() || ns.IP.IsLinkLocalMulticast()) && ns.Zone == "" {
+			return fmt.Errorf("link-local IPv6 external/root nameservers must specify a zone, ex. fe80::1%%eth0: %v", ns.IP)
 		}
 	}
 	return nil
@@ -234,6 +342,7 @@ func NewResolverConfig() *ResolverConfig {
 		ShouldRecycleSockets:  defaultShouldRecycleSockets,
 		LookupAllNameServers:  false,
 		FollowCNAMEs:          defaultFollowCNAMEs,
+		MaxCNAMEDepth:         defaultMaxCNAMEDepth,
 
 		Retries:  defaultRetries,
 		LogLevel: defaultLogVerbosity,
@@ -241,11 +350,16 @@ func NewResolverConfig() *ResolverConfig {
 		Timeout:          defaultTimeout,
 		IterativeTimeout: defaultIterativeTimeout,
 		NetworkTimeout:   defaultNetworkTimeout,
-		MaxDepth:         defaultMaxDepth,
+
+		UDPRetransmitInterval: defaultUDPRetransmitInterval,
+		MaxDepth:              defaultMaxDepth,
 
 		DNSSecEnabled:        defaultDNSSECEnabled,
 		ShouldValidateDNSSEC: defaultShouldValidateDNSSEC,
+		DNSSECFetchGroup:     NewDNSSECFetchGroup(0),
 		CheckingDisabledBit:  defaultCheckingDisabledBit,
+		CompressQueries:      defaultCompressQueries,
+		UDPBufferSize:        defaultUDPBufferSize,
 	}
 }
 
@@ -255,9 +369,62 @@ type ConnectionInfo struct {
 	udpConn      *dns.Conn            // for socket re-use with UDP
 	tcpConn      *dns.Conn            // for socket re-use with TCP
 	httpsClient  *http.Client         // for DoH
-	tlsConn      *dns.Conn            // for DoT
+	tlsConn      *dns.Conn            // for DoT, the connection of the last lookup, one of tlsConns
 	tlsHandshake *tls.ServerHandshake // for DoT, used to print TLS handshake to user
 	localAddr    net.IP
+	localZone    string      // zone of localAddr, set when it's a link-local address
+	pcapWriter   *PcapWriter // if set, UDP sockets are wrapped so their traffic is recorded
+	rawResponse  []byte      // the last response as it was received, if the transport kept it
+	// randomizeSourcePort binds each UDP query's socket to a random port rather than letting the OS pick one
+	randomizeSourcePort bool
+	// tlsConns holds a DoT connection per name server, so lookups moving between name servers don't redo handshakes
+	tlsConns map[string]*tlsConnection
+	// connectTime is how long the last lookup spent setting up its connection, it isn't part of the lookup's RTT
+	connectTime time.Duration
+}
+
+// tlsConnection is an established DoT connection to a name server
+type tlsConnection struct {
+	conn      *dns.Conn
+	handshake *tls.ServerHandshake
+}
+
+// maxTLSConns is how many DoT connections a ConnectionInfo keeps open, one of them is closed to open another
+const maxTLSConns = 16
+
+// closeTLSConn closes and forgets the DoT connection to the name server with the given address
+func (ci *ConnectionInfo) closeTLSConn(addr string) {
+	c, ok := ci.tlsConns[addr]
+	if !ok {
+		return
+	}
+	if err := c.conn.Close(); err != nil {
+		log.Errorf("error closing TLS connection to %s: %v", addr, err)
+	}
+	delete(ci.tlsConns, addr)
+	if ci.tlsConn == c.conn {
+		ci.tlsConn, ci.tlsHandshake = nil, nil
+	}
+}
+
+// close closes the connections kept open for re-use, kind describes ci in errors
+func (ci *ConnectionInfo) close(kind string) {
+	if ci == nil {
+		return
+	}
+	if ci.udpConn != nil {
+		if err := ci.udpConn.Close(); err != nil {
+			log.Errorf("error closing %s UDP connection: %v", kind, err)
+		}
+	}
+	if ci.tcpConn != nil {
+		if err := ci.tcpConn.Close(); err != nil {
+			log.Errorf("error closing %s TCP connection: %v", kind, err)
+		}
+	}
+	for addr := range ci.tlsConns {
+		ci.closeTLSConn(addr)
+	}
 }
 
 // Resolver is a struct that holds the state of a DNS resolver. It is used to perform DNS lookups.
@@ -273,8 +440,15 @@ type Resolver struct {
 	connInfoIPv4Loopback        *ConnectionInfo // used for IPv4 lookups to loopback nameservers
 	connInfoIPv6Loopback        *ConnectionInfo // used for IPv6 lookups to loopback nameservers
 
+	// used for IPv6 lookups to link-local nameservers, keyed by the zone (interface) they're reached through
+	connInfoIPv6Scoped map[string]*ConnectionInfo
+
 	retries          int               // constant, configured max number of retries
 	retriesRemaining int               // number of retries left in the current lookup
+	retryBackoff     time.Duration     // base delay before retrying a timeout or SERVFAIL
+	noRetryServFail  bool              // SERVFAIL answers aren't retried
+	retryElsewhere   bool              // SERVFAIL answers of external lookups are retried against another name server of the pool
+	servFailPool     []NameServer      // name servers a SERVFAIL in the current external lookup may be retried against, if any
 	pendingQueries   map[Question]bool // map of pending queries, to prevent cyclic queries
 	logLevel         log.Level
 
@@ -282,8 +456,13 @@ type Resolver struct {
 	ipVersionMode         IPVersionMode
 	iterationIPPreference IterationIPPreference
 	shouldRecycleSockets  bool
+	txtTCPFallback        bool // with UDPOnly, truncated TXT responses are retried over TCP
+	randomizeSourcePort   bool // each UDP query is sent from a fresh socket bound to a random port
 
 	networkTimeout             time.Duration // timeout for a single on-the-wire network call
+	queryTimeout               time.Duration // deadline for all the network calls of a query to one name server, 0 if they share networkTimeout
+	udpRetransmits             int           // quick retransmits of a UDP query on the same socket, before consuming a retry
+	udpRetransmitInterval      time.Duration // time to wait for a response before retransmitting a UDP query
 	iterativeTimeout           time.Duration // timeout for a layer of the iterative lookup
 	timeout                    time.Duration // timeout for the entire name lookup
 	maxDepth                   int
@@ -292,18 +471,56 @@ type Resolver struct {
 	lastUsedExternalNameServer *NameServer  // the last external name server used for an external lookup
 	lookupAllNameServers       bool
 	followCNAMEs               bool // whether iterative lookups should follow CNAMEs/DNAMEs
+	maxCNAMEDepth              int
+	qnameMinimization          bool // whether iterative lookups send each layer only the next label of the name
 
 	dnsSecEnabled        bool
-	shouldValidateDNSSEC bool             // whether to validate DNSSEC
-	validator            *dNSSECValidator // DNSSEC validator for the current lookup
+	shouldValidateDNSSEC bool                       // whether to validate DNSSEC
+	dnssecFetches        *DNSSECFetchGroup          // nil if DNSKEY and DS lookups aren't coalesced with other resolvers
+	dnssecSections       map[DNSSECSection]struct{} // sections DNSSEC validation runs over
+	dnssecAlgorithms     map[uint8]struct{}         // if set, the only algorithms RRSIGs may be made with
+	trustAnchors         TrustAnchors               // nil if only the built-in root anchors are trusted
+	dnssecClockSkew      time.Duration              // tolerance for RRSIG validity periods
+	validator            *dNSSECValidator           // DNSSEC validator for the current lookup
+	// iterativeDNSSECFetches makes the validator of a non-iterative lookup fetch DNSKEY/DS records iteratively, used to
+	// validate each nameserver's response during iterative all-nameservers lookups
+	iterativeDNSSECFetches bool
 
 	dnsOverHTTPSEnabled bool           // whether to use DNS over HTTPS for External Lookups, n/a to Iterative Lookups
 	dnsOverTLSEnabled   bool           // whether to use DNS over TLS for External Lookups, n/a to Iterative Lookups
+	tlsServerName       string         // overrides the name server's domain name for DoT
 	rootCAs             *x509.CertPool // Root CAs for DoT/DoH Server Verification
 	verifyServerCert    bool           // Verify server certificates for DoT/DoH
 	ednsOptions         []dns.EDNS0
+	cookies             *cookieJar // nil unless DNS cookies are sent
 	checkingDisabledBit bool
-	isClosed            bool // true if the resolver has been closed, lookup will panic if called after Close
+	recursionDisabled   bool // clear the RD bit on all queries
+	compressQueries     bool
+	udpBufferSize       uint16
+	ednsPadding         int  // block size queries are padded to, 0 for no padding
+	padPlaintext        bool // whether queries over plain UDP/TCP are padded too
+
+	separateUnrelatedAnswers  bool // move answer records unrelated to the query into ExtraAnswers
+	detectCNAMEViolations     bool
+	reportCNAMETargetNXDomain bool
+	includeRawResponse        bool
+	stripOutOfBailiwick       bool // remove records outside the zone of the queried name server from iterative responses
+	bypassCache               bool // don't read answers from or write answers to the cache, used by diagnostic lookups whose answers differ from normal ones
+	pcapWriter                *PcapWriter
+	metrics                   *Metrics
+	rateLimiter               *RateLimiter
+	nameServerRateLimiter     *NameServerRateLimiter
+	nameServerSelector        *NameServerSelector
+	circuitBreaker            *NameServerCircuitBreaker
+	queriesSent               int  // number of queries sent on the wire, for run statistics
+	isClosed                  bool // true if the resolver has been closed, lookup will panic if called after Close
+	// rand is the source of the resolver's random choices, seeded with Seed
+	rand *lockedRand
+
+	// allNSConfig is the config of the helper resolvers that query nameservers concurrently with LookupAllNameServers,
+	// nil if they're queried one at a time. The helpers are created on first use
+	allNSConfig  *ResolverConfig
+	allNSHelpers []*Resolver
 }
 
 // InitResolver creates a new Resolver struct using the ResolverConfig. The Resolver is used to perform DNS lookups.
@@ -331,6 +548,9 @@ func InitResolver(config *ResolverConfig) (*Resolver, error) {
 		blacklist: config.Blacklist,
 
 		retries:              config.Retries,
+		retryBackoff:         config.RetryBackoff,
+		noRetryServFail:      config.NoRetryServFail,
+		retryElsewhere:       config.ServFailOtherServer,
 		logLevel:             config.LogLevel,
 		pendingQueries:       make(map[Question]bool),
 		lookupAllNameServers: config.LookupAllNameServers,
@@ -339,20 +559,67 @@ func InitResolver(config *ResolverConfig) (*Resolver, error) {
 		ipVersionMode:         config.IPVersionMode,
 		iterationIPPreference: config.IterationIPPreference,
 		shouldRecycleSockets:  config.ShouldRecycleSockets,
+		txtTCPFallback:        config.TXTTCPFallback,
+		randomizeSourcePort:   config.RandomizeSourcePort,
 		followCNAMEs:          config.FollowCNAMEs,
+		maxCNAMEDepth:         config.MaxCNAMEDepth,
+		qnameMinimization:     config.QNAMEMinimization,
 
 		timeout: config.Timeout,
 
 		dnsOverHTTPSEnabled:  config.DNSOverHTTPS,
 		dnsOverTLSEnabled:    config.DNSOverTLS,
+		tlsServerName:        config.TLSServerName,
 		rootCAs:              config.RootCAs,
 		verifyServerCert:     config.VerifyServerCert,
 		dnsSecEnabled:        config.DNSSecEnabled,
 		shouldValidateDNSSEC: config.ShouldValidateDNSSEC,
+		dnssecFetches:        config.DNSSECFetchGroup,
+		dnssecClockSkew:      config.DNSSECClockSkew,
 		ednsOptions:          config.EdnsOptions,
 		checkingDisabledBit:  config.CheckingDisabledBit,
+		recursionDisabled:    config.RecursionDisabled,
+		compressQueries:      config.CompressQueries,
+		udpBufferSize:        config.UDPBufferSize,
+		ednsPadding:          config.EDNSPadding,
+		padPlaintext:         config.EDNSPaddingPlaintext,
+
+		separateUnrelatedAnswers:  config.SeparateUnrelatedAnswers,
+		stripOutOfBailiwick:       config.StripOutOfBailiwick,
+		detectCNAMEViolations:     config.DetectCNAMEViolations,
+		reportCNAMETargetNXDomain: config.ReportCNAMETargetNXDomain,
+		includeRawResponse:        config.IncludeRawResponse,
+		pcapWriter:                config.PcapWriter,
+		metrics:                   config.Metrics,
+		rateLimiter:               config.RateLimiter,
+		nameServerRateLimiter:     config.NameServerRateLimiter,
+		nameServerSelector:        config.NameServerSelector,
+		circuitBreaker:            config.NameServerCircuitBreaker,
+		rand:                      newLockedRand(config.Seed),
 	}
 	log.SetLevel(r.logLevel)
+	dnssecSections := config.DNSSECValidateSections
+	if len(dnssecSections) == 0 {
+		dnssecSections = AllDNSSECSections
+	}
+	r.dnssecSections = make(map[DNSSECSection]struct{}, len(dnssecSections))
+	for _, section := range dnssecSections {
+		r.dnssecSections[section] = struct{}{}
+	}
+	if r.udpBufferSize == 0 {
+		r.udpBufferSize = defaultUDPBufferSize
+	}
+	if len(config.DNSSECAllowedAlgorithms) > 0 {
+		r.dnssecAlgorithms = make(map[uint8]struct{}, len(config.DNSSECAllowedAlgorithms))
+		for _, alg := range config.DNSSECAllowedAlgorithms {
+			r.dnssecAlgorithms[alg] = struct{}{}
+		}
+	}
+	if config.ReplaceRootAnchors {
+		r.trustAnchors = config.TrustAnchors
+	} else if len(config.TrustAnchors) > 0 {
+		r.trustAnchors = config.TrustAnchors.withRootAnchors()
+	}
 	// Deep copy local address so Resolver is independent of the config
 	r.userPreferredIPv4LocalAddrs = DeepCopyIPs(config.LocalAddrsV4)
 	r.userPreferredIPv6LocalAddrs = DeepCopyIPs(config.LocalAddrsV6)
@@ -370,7 +637,16 @@ func InitResolver(config *ResolverConfig) (*Resolver, error) {
 			r.externalNameServers = append(r.externalNameServers, *ns.DeepCopy())
 		}
 	}
+	if config.DNSCookies {
+		var err error
+		if r.cookies, err = newCookieJar(); err != nil {
+			return nil, err
+		}
+	}
 	r.networkTimeout = config.NetworkTimeout
+	r.queryTimeout = config.QueryTimeout
+	r.udpRetransmits = config.UDPRetransmits
+	r.udpRetransmitInterval = config.UDPRetransmitInterval
 	r.iterativeTimeout = config.IterativeTimeout
 	r.maxDepth = config.MaxDepth
 	r.rootNameServers = make([]NameServer, 0, len(config.RootNameServersV4)+len(config.RootNameServersV6))
@@ -394,6 +670,14 @@ func InitResolver(config *ResolverConfig) (*Resolver, error) {
 			r.rootNameServers = append(r.rootNameServers, *ns.DeepCopy())
 		}
 	}
+	if config.LookupAllNameServers && config.AllNSConcurrency > 1 {
+		// helpers share this resolver's cache, and only query a single nameserver at a time
+		helperConfig := *config
+		helperConfig.Cache = r.cache
+		helperConfig.CacheSize = 0
+		helperConfig.LookupAllNameServers = false
+		r.allNSConfig = &helperConfig
+	}
 	return r, nil
 }
 
@@ -404,9 +688,12 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 	// what local addresses should we use?
 	isNSIPv6 := util.IsIPv6(&nameServer.IP)
 	isLoopback := nameServer.IP.IsLoopback()
+	isScoped := nameServer.Zone != ""
 	// check if we have a pre-existing udpConn info
 	var existingConnInfo *ConnectionInfo
-	if isNSIPv6 && isLoopback && r.connInfoIPv6Loopback != nil {
+	if isScoped {
+		existingConnInfo = r.connInfoIPv6Scoped[nameServer.Zone]
+	} else if isNSIPv6 && isLoopback && r.connInfoIPv6Loopback != nil {
 		existingConnInfo = r.connInfoIPv6Loopback
 	} else if isNSIPv6 && !isLoopback && r.connInfoIPv6Internet != nil {
 		existingConnInfo = r.connInfoIPv6Internet
@@ -425,6 +712,9 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 			return existingConnInfo, nil
 		} else if r.transportMode == TCPOnly && r.shouldRecycleSockets && existingConnInfo.tcpConn != nil {
 			return existingConnInfo, nil
+		} else if (r.transportMode == UDPOnly || r.transportMode == UDPOrTCP) && r.randomizeSourcePort && existingConnInfo.udpClient != nil {
+			// each query opens its own socket, the connection info only holds the local address
+			return existingConnInfo, nil
 		}
 	}
 
@@ -438,12 +728,14 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 		userIPs = r.userPreferredIPv4LocalAddrs
 	}
 	// Shuffle the slice in random order so that we don't always use the same local address
-	rand.Shuffle(len(userIPs), func(i, j int) {
+	r.rand.Shuffle(len(userIPs), func(i, j int) {
 		userIPs[i], userIPs[j] = userIPs[j], userIPs[i]
 	})
 	var localAddr *net.IP
+	var localZone string
 	for _, ip := range userIPs {
-		if isLoopback == ip.IsLoopback() {
+		// a link-local nameserver is reached from the link-local address of its interface, found below
+		if isLoopback == ip.IsLoopback() && !isScoped {
 			localAddr = &ip
 			break
 		}
@@ -469,13 +761,14 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 				return nil, errors.New("unable to get local address from connection")
 			}
 			localAddr = &localUDPAddr.IP
+			localZone = localUDPAddr.Zone
 
 			// cleanup socket
 			if err = conn.Close(); err != nil {
 				log.Error("unable to close test connection to Google public DNS: ", err)
 			}
 		}
-		if localAddr != nil {
+		if localAddr != nil && !isScoped {
 			if (len(r.userPreferredIPv4LocalAddrs) > 0 && localAddr.To4() != nil) || (len(r.userPreferredIPv6LocalAddrs) > 0 && util.IsIPv6(localAddr)) {
 				// the user provided a local addr. explicitly that won't work, error
 				log.Fatalf("none of the user-supplied local addresses (%v) could connect to name server %s", userIPs, nameServer.String())
@@ -489,16 +782,23 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 		return nil, errors.New("unable to find local address for connection")
 	}
 	connInfo := &ConnectionInfo{
-		localAddr: *localAddr,
+		localAddr:           *localAddr,
+		localZone:           localZone,
+		pcapWriter:          r.pcapWriter,
+		randomizeSourcePort: r.randomizeSourcePort,
 	}
-	if r.shouldRecycleSockets {
+	if r.shouldRecycleSockets && !r.randomizeSourcePort {
 		// create persistent connection
-		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: connInfo.localAddr})
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: connInfo.localAddr, Zone: connInfo.localZone})
 		if err != nil {
 			return nil, fmt.Errorf("unable to create UDP connection: %w", err)
 		}
 		connInfo.udpConn = new(dns.Conn)
-		connInfo.udpConn.Conn = conn
+		if connInfo.pcapWriter != nil {
+			connInfo.udpConn.Conn = newPcapUDPConn(conn, connInfo.pcapWriter)
+		} else {
+			connInfo.udpConn.Conn = conn
+		}
 	}
 
 	usingUDP := r.transportMode == UDPOrTCP || r.transportMode == UDPOnly
@@ -507,17 +807,18 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 		connInfo.udpClient.Timeout = r.timeout
 		connInfo.udpClient.Dialer = &net.Dialer{
 			Timeout:   r.timeout,
-			LocalAddr: &net.UDPAddr{IP: connInfo.localAddr},
+			LocalAddr: &net.UDPAddr{IP: connInfo.localAddr, Zone: connInfo.localZone},
 		}
 	}
-	usingTCP := r.transportMode == UDPOrTCP || r.transportMode == TCPOnly
+	// with UDPOnly, a TCP client is still needed to retry truncated TXT responses
+	usingTCP := r.transportMode == UDPOrTCP || r.transportMode == TCPOnly || r.txtTCPFallback
 	if usingTCP {
 		connInfo.tcpClient = new(dns.Client)
 		connInfo.tcpClient.Net = "tcp"
 		connInfo.tcpClient.Timeout = r.timeout
 		connInfo.tcpClient.Dialer = &net.Dialer{
 			Timeout:   r.timeout,
-			LocalAddr: &net.TCPAddr{IP: connInfo.localAddr},
+			LocalAddr: &net.TCPAddr{IP: connInfo.localAddr, Zone: connInfo.localZone},
 		}
 	}
 	if r.transportMode == TCPOnly && r.shouldRecycleSockets {
@@ -538,6 +839,7 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 					localTCPAddr := &net.TCPAddr{
 						IP:   net.ParseIP(connInfo.localAddr.String()),
 						Port: 0,
+						Zone: connInfo.localZone,
 					}
 
 					// Custom dialer with local address binding
@@ -576,7 +878,12 @@ func (r *Resolver) getConnectionInfo(nameServer *NameServer) (*ConnectionInfo, e
 		}
 	}
 	// save the connection info for future use
-	if isNSIPv6 && isLoopback {
+	if isScoped {
+		if r.connInfoIPv6Scoped == nil {
+			r.connInfoIPv6Scoped = make(map[string]*ConnectionInfo)
+		}
+		r.connInfoIPv6Scoped[nameServer.Zone] = connInfo
+	} else if isNSIPv6 && isLoopback {
 		r.connInfoIPv6Loopback = connInfo
 	} else if isNSIPv6 {
 		r.connInfoIPv6Internet = connInfo
@@ -596,13 +903,13 @@ func getNewTCPConn(nameServer *NameServer, connInfo *ConnectionInfo) error {
 		}
 	}
 	// create persistent TCP connection to nameserver
-	conn, err := net.DialTCP("tcp", &net.TCPAddr{IP: connInfo.localAddr}, &net.TCPAddr{IP: nameServer.IP, Port: int(nameServer.Port)})
+	conn, err := net.DialTCP("tcp", &net.TCPAddr{IP: connInfo.localAddr, Zone: connInfo.localZone}, &net.TCPAddr{IP: nameServer.IP, Port: int(nameServer.Port), Zone: nameServer.Zone})
 	if err != nil {
 		return fmt.Errorf("unable to create TCP connection for nameserver %s: %w", nameServer.String(), err)
 	}
 	connInfo.tcpConn = new(dns.Conn)
 	connInfo.tcpConn.Conn = conn
-	connInfo.tcpConn.RemoteAddr = &net.TCPAddr{IP: nameServer.IP, Port: int(nameServer.Port)}
+	connInfo.tcpConn.RemoteAddr = &net.TCPAddr{IP: nameServer.IP, Port: int(nameServer.Port), Zone: nameServer.Zone}
 	return nil
 }
 
@@ -617,8 +924,15 @@ func (r *Resolver) ExternalLookup(ctx context.Context, q *Question, dstServer *N
 	if r.isClosed {
 		log.Fatal("resolver has been closed, cannot perform lookup")
 	}
+	// a SERVFAIL may only be retried elsewhere if the name server was ours to pick
+	if dstServer == nil && r.retryElsewhere {
+		r.servFailPool = r.externalNameServers
+		defer func() { r.servFailPool = nil }()
+	}
 	// If dstServer is not provided, AND we're in HTTPS/TLS/TCP mode, AND we have a pre-existing external name server, use it
-	if dstServer == nil && r.lastUsedExternalNameServer == nil {
+	if dstServer == nil && r.nameServerSelector != nil && len(r.externalNameServers) > 0 {
+		dstServer = r.nameServerSelector.selectNameServer(r.circuitBreaker.available(r.externalNameServers), r.rand)
+	} else if dstServer == nil && (r.lastUsedExternalNameServer == nil || r.circuitBreaker.isTripped(r.lastUsedExternalNameServer)) {
 		dstServer = r.randomExternalNameServer()
 		log.Info("no name server provided for external lookup, using  random external name server: ", dstServer)
 	} else if dstServer == nil {
@@ -648,56 +962,24 @@ func (r *Resolver) IterativeLookup(ctx context.Context, q *Question) (*SingleQue
 	return r.lookupClient.DoDstServersLookup(ctx, r, *q, r.rootNameServers, true)
 }
 
+// QueriesSent returns the number of queries this resolver has sent to name servers. Answers served from the cache and
+// UDP retransmits of the same query aren't counted.
+func (r *Resolver) QueriesSent() int {
+	return r.queriesSent
+}
+
 // Close cleans up any resources used by the resolver. This should be called when the resolver is no longer needed.
 // Lookup will panic if called after Close.
 func (r *Resolver) Close() {
-	if r.connInfoIPv4Internet != nil {
-		if r.connInfoIPv4Internet.udpConn != nil {
-			if err := r.connInfoIPv4Internet.udpConn.Close(); err != nil {
-				log.Errorf("error closing UDP IPv4 connection: %v", err)
-			}
-		}
-		if r.connInfoIPv4Internet.tcpConn != nil {
-			if err := r.connInfoIPv4Internet.tcpConn.Close(); err != nil {
-				log.Errorf("error closing TCP IPv4 connection: %v", err)
-			}
-		}
+	r.connInfoIPv4Internet.close("IPv4")
+	r.connInfoIPv6Internet.close("IPv6")
+	r.connInfoIPv4Loopback.close("IPv4 loopback")
+	r.connInfoIPv6Loopback.close("IPv6 loopback")
+	for zone, connInfo := range r.connInfoIPv6Scoped {
+		connInfo.close("IPv6 zone " + zone)
 	}
-	if r.connInfoIPv6Internet != nil {
-		if r.connInfoIPv6Internet.udpConn != nil {
-			if err := r.connInfoIPv6Internet.udpConn.Close(); err != nil {
-				log.Errorf("error closing UDP IPv6 connection: %v", err)
-			}
-		}
-		if r.connInfoIPv6Internet.tcpConn != nil {
-			if err := r.connInfoIPv6Internet.tcpConn.Close(); err != nil {
-				log.Errorf("error closing TCP IPv6 connection: %v", err)
-			}
-		}
-	}
-	if r.connInfoIPv4Loopback != nil {
-		if r.connInfoIPv4Loopback.udpConn != nil {
-			if err := r.connInfoIPv4Loopback.udpConn.Close(); err != nil {
-				log.Errorf("error closing IPv4 UDP loopback connection: %v", err)
-			}
-		}
-		if r.connInfoIPv4Loopback.tcpConn != nil {
-			if err := r.connInfoIPv4Loopback.tcpConn.Close(); err != nil {
-				log.Errorf("error closing IPv4 TCP loopback connection: %v", err)
-			}
-		}
-	}
-	if r.connInfoIPv6Loopback != nil {
-		if r.connInfoIPv6Loopback.udpConn != nil {
-			if err := r.connInfoIPv6Loopback.udpConn.Close(); err != nil {
-				log.Errorf("error closing IPv6 UDP loopback connection: %v", err)
-			}
-		}
-		if r.connInfoIPv6Loopback.tcpConn != nil {
-			if err := r.connInfoIPv6Loopback.tcpConn.Close(); err != nil {
-				log.Errorf("error closing IPv6 TCP loopback connection: %v", err)
-			}
-		}
+	for _, helper := range r.allNSHelpers {
+		helper.Close()
 	}
 }
 
@@ -706,7 +988,23 @@ func (r *Resolver) randomExternalNameServer() *NameServer {
 	if r.externalNameServers == nil || l == 0 {
 		log.Fatal("no external name servers specified")
 	}
-	return &r.externalNameServers[rand.Intn(l)]
+	nameServers := r.circuitBreaker.available(r.externalNameServers)
+	return &nameServers[r.rand.Intn(len(nameServers))]
+}
+
+// shouldValidateDNSSECSection returns whether DNSSEC validation should run over the given message section
+func (r *Resolver) shouldValidateDNSSECSection(section DNSSECSection) bool {
+	_, ok := r.dnssecSections[section]
+	return ok
+}
+
+// isDNSSECAlgorithmAllowed returns whether DNSSEC validation accepts RRSIGs made with algorithm alg
+func (r *Resolver) isDNSSECAlgorithmAllowed(alg uint8) bool {
+	if r.dnssecAlgorithms == nil {
+		return true
+	}
+	_, ok := r.dnssecAlgorithms[alg]
+	return ok
 }
 
 func (r *Resolver) verboseLog(depth int, args ...interface{}) {
@@ -18,6 +18,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -65,4 +66,46 @@ func TestResolverConfig_Validate(t *testing.T) {
 		err := rc.Validate()
 		require.NotNil(t, err)
 	})
+	t.Run("Invalid DNSSEC validation section", func(t *testing.T) {
+		rc := &ResolverConfig{
+			ExternalNameServersV4:  []NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+			RootNameServersV4:      []NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+			LocalAddrsV4:           []net.IP{net.ParseIP("127.0.0.1")},
+			DNSSECValidateSections: []DNSSECSection{DNSSECSectionAnswer, "question"},
+		}
+		err := rc.Validate()
+		require.NotNil(t, err)
+	})
+	t.Run("Replacing root anchors without a root trust anchor", func(t *testing.T) {
+		rc := &ResolverConfig{
+			ExternalNameServersV4: []NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+			RootNameServersV4:     []NameServer{{IP: net.ParseIP("127.0.0.53"), Port: 53}},
+			LocalAddrsV4:          []net.IP{net.ParseIP("127.0.0.1")},
+			TrustAnchors:          TrustAnchors{"corp.example.": {12345: dns.DS{KeyTag: 12345}}},
+			ReplaceRootAnchors:    true,
+		}
+		err := rc.Validate()
+		require.NotNil(t, err)
+	})
+	t.Run("Link-local external nameserver without a zone", func(t *testing.T) {
+		rc := &ResolverConfig{
+			IPVersionMode:         IPv6Only,
+			ExternalNameServersV6: []NameServer{{IP: net.ParseIP("fe80::1"), Port: 53}},
+			RootNameServersV6:     []NameServer{{IP: net.ParseIP("2001:db8::1"), Port: 53}},
+			LocalAddrsV6:          []net.IP{net.ParseIP("2001:db8::2")},
+		}
+		err := rc.Validate()
+		require.NotNil(t, err)
+	})
+	t.Run("Link-local external nameserver with a zone", func(t *testing.T) {
+		rc := &ResolverConfig{
+			IPVersionMode:         IPv6Only,
+			ExternalNameServersV6: []NameServer{{IP: net.ParseIP("fe80::1"), Port: 53, Zone: "eth0"}},
+			RootNameServersV6:     []NameServer{{IP: net.ParseIP("2001:db8::1"), Port: 53}},
+			LocalAddrsV6:          []net.IP{net.ParseIP("2001:db8::2")},
+		}
+		err := rc.Validate()
+		require.Nil(t, err, "Expected no error but got %v", err)
+		require.Equal(t, "[fe80::1%eth0]:53", rc.ExternalNameServersV6[0].String())
+	})
 }
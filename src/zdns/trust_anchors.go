@@ -0,0 +1,100 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	rootanchors "github.com/zmap/go-dns-root-anchors"
+)
+
+// TrustAnchors are the DS records DNSSEC validation trusts as the base of the chain of trust for a zone, instead of
+// fetching them from its parent. Keyed by canonical zone name, then by key tag.
+type TrustAnchors map[string]map[uint16]dns.DS
+
+// ParseTrustAnchors reads trust anchors in zone file format from r, as DS records or as DNSKEY records, which are
+// converted to SHA-256 DS records. Records that can't anchor a chain of trust, ex. with an unsupported digest type or
+// a revoked key, are skipped. file is only used in error messages.
+// Returns an error if r doesn't parse, has records of other types, or has no usable anchors.
+func ParseTrustAnchors(r io.Reader, file string) (TrustAnchors, error) {
+	anchors := make(TrustAnchors)
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			if !isUsableDS(rr) {
+				log.Warnf("skipping trust anchor with unsupported algorithm %d or digest type %d: %s", rr.Algorithm, rr.DigestType, rr)
+				continue
+			}
+			ds = rr
+		case *dns.DNSKEY:
+			if rr.Flags&dns.ZONE == 0 || rr.Flags&dns.REVOKE != 0 {
+				log.Warnf("skipping trust anchor that isn't a zone key, or is revoked: %s", rr)
+				continue
+			}
+			if ds = rr.ToDS(dns.SHA256); ds == nil {
+				log.Warnf("skipping trust anchor with unsupported algorithm %d: %s", rr.Algorithm, rr)
+				continue
+			}
+		default:
+			return nil, fmt.Errorf("trust anchor %s is not a DS or DNSKEY record", rr)
+		}
+		zone := dns.CanonicalName(rr.Header().Name)
+		if anchors[zone] == nil {
+			anchors[zone] = make(map[uint16]dns.DS)
+		}
+		if current, ok := anchors[zone][ds.KeyTag]; !ok || dsDigestStrength(ds.DigestType) > dsDigestStrength(current.DigestType) {
+			anchors[zone][ds.KeyTag] = *ds
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("could not parse trust anchors: %w", err)
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no usable trust anchors found")
+	}
+	return anchors, nil
+}
+
+// isUsableDS returns whether the digest of ds can be checked against a DNSKEY with a known algorithm
+func isUsableDS(ds *dns.DS) bool {
+	if _, ok := dns.AlgorithmToString[ds.Algorithm]; !ok {
+		return false
+	}
+	return ds.DigestType == dns.SHA1 || ds.DigestType == dns.SHA256 || ds.DigestType == dns.SHA384
+}
+
+// withRootAnchors returns a copy of the trust anchors, with the built-in root anchors added to any for the root zone
+func (ta TrustAnchors) withRootAnchors() TrustAnchors {
+	merged := make(TrustAnchors, len(ta)+1)
+	for zone, anchors := range ta {
+		merged[zone] = maps.Clone(anchors)
+	}
+	if merged[rootZone] == nil {
+		merged[rootZone] = make(map[uint16]dns.DS)
+	}
+	for keyTag, ds := range rootanchors.GetValidDSRecords() {
+		if _, ok := merged[rootZone][keyTag]; !ok {
+			merged[rootZone][keyTag] = ds
+		}
+	}
+	return merged
+}
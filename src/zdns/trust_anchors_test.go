@@ -0,0 +1,92 @@
+/*
+ * ZDNS Copyright 2024 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	rootanchors "github.com/zmap/go-dns-root-anchors"
+)
+
+const testRootKSK = ". 172800 IN DNSKEY 257 3 8 AwEAAaz/tAm8yTn4Mfeh5eyI96WSVexTBAvkMgJzkKTOiW1vkIbzxeF3+/4RgWOq7HrxRixHlFlExOLAJr5emLvN7SWXgnLh4+B5xQlNVz8Og8kvArMtNROxVQuCaSnIDdD5LKyWbRd2n9WGe2R8PzgCmr3EgVLrjyBxWezF0jLHwVN8efS3rCj/EWgvIWgb9tarpVUDK/b58Da+sqqls3eNbuv7pr+eoZG+SrDK6nWeL3c6H5Apxz7LjVc1uTIdsIXxuOLYA4/ilBmSVIzuDWfdRUfhHdY6+cn8HFRm+2hM8AnXGXws9555KrUB5qihylGa8subX2Nn6UwNR1AkUTV74bU="
+
+func TestParseTrustAnchors(t *testing.T) {
+	file := strings.Join([]string{
+		"; a private zone anchored by DS, and the root by its key signing key",
+		"Corp.Example. 3600 IN DS 12345 13 2 BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C",
+		// the same key with a weaker digest doesn't replace it
+		"corp.example. 3600 IN DS 12345 13 1 2BB183AF5F22588179A53B0A98631FAD1A292118",
+		testRootKSK,
+		// unusable anchors are skipped: an unknown digest type and a revoked key
+		"corp.example. 3600 IN DS 23456 13 9 BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C",
+		strings.Replace(testRootKSK, "DNSKEY 257", "DNSKEY 385", 1),
+	}, "\n")
+	anchors, err := ParseTrustAnchors(strings.NewReader(file), "anchors.zone")
+	require.NoError(t, err)
+	require.Len(t, anchors, 2)
+	require.Len(t, anchors["corp.example."], 1)
+	require.Equal(t, uint8(dns.SHA256), anchors["corp.example."][12345].DigestType)
+
+	key, err := dns.NewRR(testRootKSK)
+	require.NoError(t, err)
+	rootKSK := key.(*dns.DNSKEY)
+	require.Len(t, anchors[rootZone], 1)
+	require.Equal(t, *rootKSK.ToDS(dns.SHA256), anchors[rootZone][rootKSK.KeyTag()])
+}
+
+func TestParseTrustAnchorsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"empty", ""},
+		{"syntax error", "corp.example. 3600 IN DS not-a-key-tag"},
+		{"other record type", "corp.example. 3600 IN A 192.0.2.1"},
+		{"no usable anchors", "corp.example. 3600 IN DS 23456 13 9 BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseTrustAnchors(strings.NewReader(tc.file), "anchors.zone")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestFetchDSRecordsUsesTrustAnchors(t *testing.T) {
+	anchors, err := ParseTrustAnchors(strings.NewReader(testRootKSK+"\ncorp.example. 3600 IN DS 12345 13 2 BE74359954660069D5C63D200C39F5603827D7DD02B56F120EE9F3A86764247C"), "anchors.zone")
+	require.NoError(t, err)
+	builtIn := rootanchors.GetValidDSRecords()
+
+	// by default, root anchors augment the built-in ones
+	v := &dNSSECValidator{r: &Resolver{trustAnchors: anchors.withRootAnchors()}}
+	root, hasNSECProof, _, err := v.fetchDSRecords(rootZone, Trace{}, 0)
+	require.NoError(t, err)
+	require.False(t, hasNSECProof)
+	for keyTag := range builtIn {
+		require.Contains(t, root, keyTag)
+	}
+	corp, _, _, err := v.fetchDSRecords("corp.example.", Trace{}, 0)
+	require.NoError(t, err)
+	require.Equal(t, anchors["corp.example."], corp)
+
+	// replacing them leaves only the configured root anchors
+	v = &dNSSECValidator{r: &Resolver{trustAnchors: anchors}}
+	root, _, _, err = v.fetchDSRecords(rootZone, Trace{}, 0)
+	require.NoError(t, err)
+	require.Equal(t, anchors[rootZone], root)
+}
@@ -115,6 +115,7 @@ type NameServer struct {
 	IP         net.IP // ip address, required
 	Port       uint16 // udp/tcp port
 	DomainName string // used for SNI with TLS, required if you want to validate server certs
+	Zone       string // IPv6 zone (interface) used to reach a link-local name server, ex. eth0 in fe80::1%eth0
 }
 
 func (ns *NameServer) String() string {
@@ -123,6 +124,8 @@ func (ns *NameServer) String() string {
 	}
 	if ns.IP.To4() != nil {
 		return fmt.Sprintf("%s:%d", ns.IP.String(), ns.Port)
+	} else if util.IsIPv6(&ns.IP) && ns.Zone != "" {
+		return fmt.Sprintf("[%s%%%s]:%d", ns.IP.String(), ns.Zone, ns.Port)
 	} else if util.IsIPv6(&ns.IP) {
 		return fmt.Sprintf("[%s]:%d", ns.IP.String(), ns.Port)
 	}
@@ -151,6 +154,9 @@ func (ns *NameServer) IsValid() (bool, string) {
 	if ns.Port == 0 {
 		return false, "missing port"
 	}
+	if ns.Zone != "" && !util.IsIPv6(&ns.IP) {
+		return false, "zone is only valid for IPv6 addresses"
+	}
 	return true, ""
 }
 
@@ -164,5 +170,6 @@ func (ns *NameServer) DeepCopy() *NameServer {
 		IP:         ip,
 		Port:       ns.Port,
 		DomainName: ns.DomainName,
+		Zone:       ns.Zone,
 	}
 }
@@ -15,9 +15,13 @@
 package zdns
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -52,7 +56,7 @@ func TranslateMiekgErrorCode(err int) Status {
 }
 
 func isStatusAnswer(s Status) bool {
-	if s == StatusNoError || s == StatusNXDomain {
+	if s == StatusNoError || s == StatusNXDomain || s == StatusCNAMETargetNXDomain {
 		return true
 	}
 	return false
@@ -63,6 +67,97 @@ func getTryNumber(totalRetries, retriesRemaining int) int {
 	return totalRetries - retriesRemaining + 1
 }
 
+// DurationMS returns d in fractional milliseconds, as timings are output
+func DurationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// shouldBackOff returns whether a failed query should be retried only after a delay, to avoid piling retries on a
+// struggling server. Other retryable statuses are retried against another name server right away.
+func shouldBackOff(status Status) bool {
+	return status == StatusTimeout || status == StatusIterTimeout || status == StatusServFail
+}
+
+// maxRetryBackoff caps the delay before a single retry, however many retries came before it
+const maxRetryBackoff = 10 * time.Second
+
+// lockedRand is a *rand.Rand that's safe for concurrent use, the source of a resolver's random choices. Seeding it
+// makes those choices reproducible, unlike the global source.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// newLockedRand returns a lockedRand seeded with seed, or with a random seed if seed is 0
+func newLockedRand(seed int64) *lockedRand {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Intn(n)
+}
+
+func (l *lockedRand) Int63() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Int63()
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Int63n(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Float64()
+}
+
+func (l *lockedRand) Perm(n int) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Perm(n)
+}
+
+func (l *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rnd.Shuffle(n, swap)
+}
+
+// retryBackoffDelay returns the delay before the given retry, 1 for the first. It's base doubled for each retry after
+// the first, randomized over the upper half of that so retries from many names don't line up.
+func retryBackoffDelay(base time.Duration, retry int, rnd *lockedRand) time.Duration {
+	delay := base
+	for i := 1; i < retry && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryBackoff)
+	return delay/2 + time.Duration(rnd.Int63n(int64(delay/2)+1))
+}
+
+// sleepCtx waits for d, returning false without waiting if ctx would be done before then, or once it's done
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func nameIsBeneath(name, layer string) (bool, string) {
 	name = strings.ToLower(name)
 	layer = strings.ToLower(layer)
@@ -77,6 +172,184 @@ func nameIsBeneath(name, layer string) (bool, string) {
 	return false, ""
 }
 
+// splitUnrelatedAnswers separates the answer records that belong to the question q from those that don't.
+// A record is related if its owner is the query name or a name reached from it through the CNAME/DNAME chain in the
+// answer section, and it is of the queried type, a CNAME/DNAME, or an RRSIG. Everything else was not asked for.
+func splitUnrelatedAnswers(q dns.Question, answers []dns.RR) (related, unrelated []dns.RR) {
+	chain := map[string]struct{}{strings.ToLower(dns.Fqdn(q.Name)): {}}
+	// follow the CNAME/DNAME chain until no new names are added, records may be out of order
+	for added := true; added; {
+		added = false
+		for _, rr := range answers {
+			owner := strings.ToLower(rr.Header().Name)
+			var target string
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				if _, ok := chain[owner]; ok {
+					target = strings.ToLower(v.Target)
+				}
+			case *dns.DNAME:
+				for name := range chain {
+					if name != owner && dns.IsSubDomain(owner, name) {
+						target = strings.TrimSuffix(name, owner) + strings.ToLower(v.Target)
+						break
+					}
+				}
+			}
+			if _, ok := chain[target]; target != "" && !ok {
+				chain[target] = struct{}{}
+				added = true
+			}
+		}
+	}
+	for _, rr := range answers {
+		owner := strings.ToLower(rr.Header().Name)
+		_, inChain := chain[owner]
+		switch rr.Header().Rrtype {
+		case dns.TypeDNAME:
+			isAncestor := false
+			for name := range chain {
+				if name != owner && dns.IsSubDomain(owner, name) {
+					isAncestor = true
+					break
+				}
+			}
+			inChain = inChain || isAncestor
+		case q.Qtype, dns.TypeCNAME, dns.TypeRRSIG:
+		default:
+			inChain = inChain && q.Qtype == dns.TypeANY
+		}
+		if inChain {
+			related = append(related, rr)
+		} else {
+			unrelated = append(unrelated, rr)
+		}
+	}
+	return related, unrelated
+}
+
+// responseQuestionMatches checks that the question section of resp echoes the question of query, RFC 5452 section 9.1.
+// Servers may omit the question from error responses, so an empty question section is accepted unless the response
+// claims success. Names are compared case-insensitively.
+func responseQuestionMatches(query, resp *dns.Msg) bool {
+	if len(resp.Question) == 0 {
+		return resp.Rcode != dns.RcodeSuccess
+	}
+	if len(resp.Question) != len(query.Question) {
+		return false
+	}
+	for i, q := range query.Question {
+		rq := resp.Question[i]
+		if rq.Qtype != q.Qtype || rq.Qclass != q.Qclass || !strings.EqualFold(rq.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// followCNAMEChain follows the CNAME/DNAME records in answers starting from name, and returns the lowercase FQDN at the
+// end of the chain. ok is false if name isn't redirected by any record.
+func followCNAMEChain(name string, answers []dns.RR) (target string, ok bool) {
+	target = strings.ToLower(dns.Fqdn(name))
+	// every record can redirect at most once on a loop-free chain
+	for i := 0; i < len(answers); i++ {
+		next := ""
+		for _, rr := range answers {
+			owner := strings.ToLower(rr.Header().Name)
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				if owner == target {
+					next = strings.ToLower(v.Target)
+				}
+			case *dns.DNAME:
+				if owner != target && dns.IsSubDomain(owner, target) {
+					next = strings.TrimSuffix(target, owner) + strings.ToLower(v.Target)
+				}
+			}
+			if next != "" {
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+		ok = true
+	}
+	return target, ok
+}
+
+// findZoneCut returns the apex of the zone the answer to q comes from, the owner of an SOA in the answer or authority
+// section of r that encloses the queried name or the end of its CNAME/DNAME chain. Negative responses carry the SOA in
+// the authority section, RFC 2308 section 3. Returns "" if r has no such SOA.
+func findZoneCut(q dns.Question, r *dns.Msg) string {
+	qname := strings.ToLower(dns.Fqdn(q.Name))
+	target, _ := followCNAMEChain(qname, r.Answer)
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				continue
+			}
+			owner := strings.ToLower(dns.Fqdn(rr.Header().Name))
+			if dns.IsSubDomain(owner, target) || dns.IsSubDomain(owner, qname) {
+				return removeTrailingDotIfNotRoot(owner)
+			}
+		}
+	}
+	return ""
+}
+
+// findCNAMEViolations reports owner names in r that have a CNAME alongside other data, RFC 1034 section 3.6.2. Other
+// data is looked for in the answer section, except for SOAs which also appear in the authority section of negative
+// responses and mark the CNAME as being at a zone apex. RRSIG and NSEC records may accompany a CNAME, RFC 4035 section 2.5.
+func findCNAMEViolations(r *dns.Msg) []CNAMEViolation {
+	cnameCounts := make(map[string]int)
+	var owners []string // CNAME owners in order of appearance, for deterministic output
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype != dns.TypeCNAME {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		if cnameCounts[owner] == 0 {
+			owners = append(owners, owner)
+		}
+		cnameCounts[owner]++
+	}
+	if len(owners) == 0 {
+		return nil
+	}
+	hasOtherData := make(map[string]bool)
+	for _, rr := range r.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeCNAME, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeSOA:
+		default:
+			hasOtherData[strings.ToLower(rr.Header().Name)] = true
+		}
+	}
+	hasSOA := make(map[string]bool)
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				hasSOA[strings.ToLower(rr.Header().Name)] = true
+			}
+		}
+	}
+	var violations []CNAMEViolation
+	for _, owner := range owners {
+		name := strings.TrimSuffix(owner, ".")
+		if cnameCounts[owner] > 1 {
+			violations = append(violations, CNAMEViolation{Type: MultipleCNAMEs, Name: name})
+		}
+		if hasSOA[owner] {
+			violations = append(violations, CNAMEViolation{Type: CNAMEAtApex, Name: name})
+		}
+		if hasOtherData[owner] {
+			violations = append(violations, CNAMEViolation{Type: CNAMEAndOtherData, Name: name})
+		}
+	}
+	return violations
+}
+
 func checkGlue(server string, result *SingleQueryResult, ipMode IPVersionMode, ipPreference IterationIPPreference) (*SingleQueryResult, Status) {
 	var ansType string
 	if ipMode == IPv4Only {
@@ -126,6 +399,62 @@ func checkGlueHelper(server, ansType string, result *SingleQueryResult) (*Single
 	return nil, StatusError
 }
 
+// minimizedQueryName returns the name to query the name servers of layer for, with QNAME minimization, in a lookup of
+// name. This is name truncated to one label below layer. ok is false if that's name itself, and the full name should
+// be sent.
+// Example: minimizedQueryName("www.google.com", ".") -> "com", true
+func minimizedQueryName(name, layer string) (minimized string, ok bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	layer = strings.ToLower(layer)
+	if layer != "." {
+		layer = strings.TrimSuffix(layer, ".")
+	}
+	minimized, err := nextAuthority(name, layer)
+	if err != nil || minimized == "" || minimized == name || minimized == layer {
+		return "", false
+	}
+	return minimized, true
+}
+
+// isLameResponse returns true if the response shows the name server it came from, which was delegated layer, doesn't
+// actually serve it, a lame delegation. That's a REFUSED, or a non-authoritative response without answers that
+// doesn't refer us further down the tree, ex. an upward referral to the root.
+func isLameResponse(result *SingleQueryResult, status Status, layer string) bool {
+	if layer == "." || result == nil {
+		// the root servers aren't delegated to
+		return false
+	}
+	if status == StatusRefused {
+		return true
+	}
+	if status != StatusNoError || len(result.Answers) != 0 || result.Flags.Authoritative {
+		return false
+	}
+	layer = strings.ToLower(strings.TrimSuffix(layer, "."))
+	for _, rec := range result.Authorities {
+		ans, ok := rec.(Answer)
+		if !ok || ans.RrType != dns.TypeNS {
+			continue
+		}
+		owner := strings.ToLower(strings.TrimSuffix(ans.Name, "."))
+		if isBeneath, _ := nameIsBeneath(owner, layer); isBeneath && owner != layer {
+			// a referral to a child zone
+			return false
+		}
+	}
+	return true
+}
+
+// hasNSRecord reports whether records, an authority section, has an NS record, ie. is a referral
+func hasNSRecord(records []interface{}) bool {
+	for _, rec := range records {
+		if ans, ok := rec.(Answer); ok && ans.RrType == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
 // nextAuthority returns the next authority to query based on the current name and layer
 // Example: nextAuthority("www.google.com", ".") -> "com"
 func nextAuthority(name, layer string) (string, error) {
@@ -216,8 +545,12 @@ func handleStatus(status Status, err error) (Status, error) {
 		return status, err
 	case StatusNoNeededGlue:
 		return status, err
+	case StatusLameDelegation:
+		return status, nil
 	case StatusNXDomain:
 		return status, nil
+	case StatusCNAMETargetNXDomain:
+		return status, nil
 	case StatusServFail:
 		return status, nil
 	case StatusRefused:
@@ -253,3 +586,45 @@ func DeepCopyIPs(ips []net.IP) []net.IP {
 	}
 	return copied
 }
+
+// LameNameServers returns the IPs of the name servers marked lame during the traced resolution, without duplicates
+// and in the order they were first found lame
+func (t Trace) LameNameServers() []string {
+	var ips []string
+	seen := make(map[string]struct{})
+	for _, step := range t {
+		if !step.Lame || step.NameServer == "" {
+			continue
+		}
+		ip := step.NameServer
+		if host, _, err := net.SplitHostPort(step.NameServer); err == nil {
+			ip = host
+		}
+		if _, ok := seen[ip]; !ok {
+			seen[ip] = struct{}{}
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// NameServersConsulted returns the IPs of the name servers that answered a query during the traced resolution, without
+// duplicates and in the order they were first queried. Steps answered from the cache aren't counted.
+func (t Trace) NameServersConsulted() []string {
+	var ips []string
+	seen := make(map[string]struct{})
+	for _, step := range t {
+		if step.Cached || step.NameServer == "" {
+			continue
+		}
+		ip := step.NameServer
+		if host, _, err := net.SplitHostPort(step.NameServer); err == nil {
+			ip = host
+		}
+		if _, ok := seen[ip]; !ok {
+			seen[ip] = struct{}{}
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
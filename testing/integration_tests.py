@@ -1172,7 +1172,7 @@ class Tests(unittest.TestCase):
         # in the AXFR fetch for zonetransfer.me because the
         # records can change over time and we want to minimise
         # having to update ./axfr.json
-        c = "axfr"
+        c = "axfr --allow-zone-transfer"
         name = "zonetransfer.me"
         cmd, res = self.run_zdns(c, name)
         self.assertSuccess(res, cmd, "AXFR")
@@ -1366,6 +1366,7 @@ class Tests(unittest.TestCase):
             self.assertEqual(dnssec["status"], "Secure")
             self.assertTrue(len(dnssec["dses"]) > 0)
             self.assertTrue(len(dnssec["dnskeys"]) > 0)
+            self.assertTrue(len(dnssec["chain"]) > 0)
 
     def test_dnssec_validation_secure_circular(self):
         # checks if dnssec validation can handle circular NS dependencies